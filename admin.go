@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+)
+
+// DefaultAdminAddr is default listen address of the admin API, local only
+const DefaultAdminAddr = "127.0.0.1:9080"
+
+// AdminServer serves master state over HTTP
+//
+//	GET /v1/apps                     state of every app
+//	GET /v1/apps/<app>               state of an app
+//	GET /v1/apps/<app>/validation    latest validation report of an app
+//	GET /v1/apps/<app>/approval      commit awaiting approval with its diff
+//	GET /v1/apps/<app>/drift         keys edited outside of the master since its last push
+//	GET /v1/apps/<app>/history       deploy history of an app, newest first(?limit=n)
+//	GET /v1/apps/<app>/fleet         nodes per commit applied, stragglers & failures reported by slaves
+//	POST /v1/restore                 restores a backup archive on the leader(?app=a&dry_run=1)
+//
+// mutating endpoints require "Authorization: Bearer <token>", the actor is the identity of the token
+type AdminServer struct {
+	addr     string
+	mux      *http.ServeMux
+	states   *appStates
+	history  *DeployHistory
+	restores *RestoreManager
+	fleet    *FleetView
+	// identity per token, mutating endpoints are disabled when empty
+	tokens map[string]string
+	log    *logrus.Entry
+}
+
+// LoadAdminTokens reads a JSON object of tokens by identity, returns identities by token
+func LoadAdminTokens(p string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var byIdentity map[string]string
+	if err := json.Unmarshal(data, &byIdentity); err != nil {
+		return nil, fmt.Errorf("admin tokens(%s): %v", p, err)
+	}
+	tokens := make(map[string]string)
+	for identity, token := range byIdentity {
+		if token == "" {
+			return nil, fmt.Errorf("admin tokens(%s): empty token of %s", p, identity)
+		}
+		if _, ok := tokens[token]; ok {
+			return nil, fmt.Errorf("admin tokens(%s): token of %s shared with another identity", p, identity)
+		}
+		tokens[token] = identity
+	}
+	return tokens, nil
+}
+
+// NewAdminServer creates a new admin API server
+func NewAdminServer(addr string, tokens map[string]string, states *appStates, history *DeployHistory, restores *RestoreManager, fleet *FleetView) *AdminServer {
+	if addr == "" {
+		addr = DefaultAdminAddr
+	}
+
+	s := &AdminServer{
+		addr:     addr,
+		mux:      http.NewServeMux(),
+		states:   states,
+		history:  history,
+		restores: restores,
+		fleet:    fleet,
+		tokens:   tokens,
+		log:      configureLogger("admin"),
+	}
+	s.mux.HandleFunc("/v1/apps", s.handleApps)
+	s.mux.HandleFunc("/v1/apps/", s.handleApp)
+	s.mux.HandleFunc("/v1/restore", s.handleRestore)
+	return s
+}
+
+// Run starts admin API server
+func (s *AdminServer) Run() error {
+	go func() {
+		if err := http.ListenAndServe(s.addr, s.mux); err != nil {
+			s.log.Errorf("Failed to start admin API addr(%s): %v", s.addr, err)
+		}
+	}()
+	s.log.Infof("Admin API started addr(%s)", s.addr)
+	return nil
+}
+
+// writeJSON writes v as a JSON response
+func (s *AdminServer) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		s.log.Errorf("Failed to write response: %v", err)
+	}
+}
+
+// authenticate returns the identity of the bearer token of a request
+// every token is compared so the time taken doesn't tell which one matched
+func (s *AdminServer) authenticate(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	presented := []byte(strings.TrimPrefix(header, "Bearer "))
+
+	identity := ""
+	for token, id := range s.tokens {
+		if subtle.ConstantTimeCompare(presented, []byte(token)) == 1 {
+			identity = id
+		}
+	}
+	return identity, identity != ""
+}
+
+// writeError writes an error message as a JSON response
+func (s *AdminServer) writeError(w http.ResponseWriter, code int, msg string) {
+	s.writeJSON(w, code, map[string]string{"error": msg})
+}
+
+func (s *AdminServer) handleApps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	s.writeJSON(w, http.StatusOK, s.states.list())
+}
+
+// handleApp dispatches /v1/apps/<app>[/<resource>]
+func (s *AdminServer) handleApp(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1/apps/"), "/", 2)
+	appID := parts[0]
+	resource := ""
+	if len(parts) == 2 {
+		resource = parts[1]
+	}
+
+	if r.Method != http.MethodGet {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// history & fleet are read from KV, so standby masters serve them too
+	switch resource {
+	case "history":
+		s.handleHistory(w, r, appID)
+		return
+	case "fleet":
+		s.handleFleet(w, appID)
+		return
+	}
+
+	st, ok := s.states.get(appID)
+	if !ok {
+		s.writeError(w, http.StatusNotFound, "unknown app: "+appID)
+		return
+	}
+
+	switch resource {
+	case "":
+		s.writeJSON(w, http.StatusOK, st)
+	case "validation":
+		if st.Validation == nil {
+			s.writeError(w, http.StatusNotFound, "no validation report: "+appID)
+			return
+		}
+		s.writeJSON(w, http.StatusOK, st.Validation)
+	case "approval":
+		if st.Approval == nil {
+			s.writeError(w, http.StatusNotFound, "no commit awaiting approval: "+appID)
+			return
+		}
+		s.writeJSON(w, http.StatusOK, st.Approval)
+	case "drift":
+		if st.Drift == nil {
+			s.writeError(w, http.StatusNotFound, "no drift: "+appID)
+			return
+		}
+		s.writeJSON(w, http.StatusOK, st.Drift)
+	default:
+		s.writeError(w, http.StatusNotFound, "unknown resource: "+resource)
+	}
+}
+
+// handleHistory serves deploy history of an app
+func (s *AdminServer) handleHistory(w http.ResponseWriter, r *http.Request, appID string) {
+	if s.history == nil {
+		s.writeError(w, http.StatusNotFound, "deploy history disabled")
+		return
+	}
+
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s.writeError(w, http.StatusBadRequest, "invalid limit: "+v)
+			return
+		}
+		limit = n
+	}
+
+	entries, err := s.history.list(appID, limit)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.writeJSON(w, http.StatusOK, entries)
+}
+
+// handleFleet serves applied state of an app over the nodes
+func (s *AdminServer) handleFleet(w http.ResponseWriter, appID string) {
+	if s.fleet == nil {
+		s.writeError(w, http.StatusNotFound, "fleet status disabled")
+		return
+	}
+	status, err := s.fleet.status(appID)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.writeJSON(w, http.StatusOK, status)
+}
+
+// handleRestore restores a backup archive posted as body by an authenticated actor, answering 409 when not leading
+func (s *AdminServer) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.restores == nil {
+		s.writeError(w, http.StatusNotFound, "restore disabled")
+		return
+	}
+	if len(s.tokens) == 0 {
+		s.writeError(w, http.StatusForbidden, "restore disabled, no admin tokens configured")
+		return
+	}
+	actor, ok := s.authenticate(r)
+	if !ok {
+		s.writeError(w, http.StatusUnauthorized, "invalid or missing token")
+		return
+	}
+
+	backup, err := client.ReadBackup(r.Body)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalid backup: "+err.Error())
+		return
+	}
+	q := r.URL.Query()
+	result, err := s.restores.Restore(backup, q["app"], actor, q.Get("dry_run") != "")
+	switch {
+	case err == ErrNotLeader:
+		s.writeError(w, http.StatusConflict, err.Error())
+	case err != nil && result != nil:
+		s.writeJSON(w, http.StatusInternalServerError, result)
+	case err != nil:
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		s.writeJSON(w, http.StatusOK, result)
+	}
+}
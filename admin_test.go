@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+func TestAdminRestoreAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := kvstore.NewFileStore(&kvstore.FileConfig{Root: path.Join(dir, "kv"), Node: "master1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokensPath := path.Join(dir, "tokens.json")
+	ioutil.WriteFile(tokensPath, []byte(`{"alice": "s3cret", "bob": "other"}`), 0600)
+	tokens, err := LoadAdminTokens(tokensPath)
+	if err != nil || tokens["s3cret"] != "alice" {
+		t.Fatalf("unexpected tokens %v: %v", tokens, err)
+	}
+
+	changes := make(chan *ConfChange)
+	go func() {
+		for change := range changes {
+			change.restore.run()
+		}
+	}()
+	defer close(changes)
+	restores := NewRestoreManager(&RestoreManagerConfig{
+		store:    store,
+		nodeName: "master1",
+		isLeader: func() (bool, error) { return true, nil },
+		changes:  changes,
+	})
+
+	var archive bytes.Buffer
+	backup := &client.Backup{Namespaces: client.DefaultBackupNamespaces, Pairs: []*client.BackupPair{
+		{Key: "config/app/web/a.conf", Value: []byte("x=1")},
+	}}
+	if err := client.WriteBackup(&archive, backup); err != nil {
+		t.Fatal(err)
+	}
+	restore := func(s *AdminServer, token string) int {
+		r := httptest.NewRequest(http.MethodPost, "/v1/restore?actor=mallory", bytes.NewReader(archive.Bytes()))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := restore(NewAdminServer("", nil, newAppStates(), nil, restores, nil), "s3cret"); code != http.StatusForbidden {
+		t.Fatalf("expected restore disabled without tokens, got %d", code)
+	}
+	s := NewAdminServer("", tokens, newAppStates(), nil, restores, nil)
+	if code := restore(s, ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected missing token refused, got %d", code)
+	}
+	if code := restore(s, "guess"); code != http.StatusUnauthorized {
+		t.Fatalf("expected invalid token refused, got %d", code)
+	}
+	if code := restore(s, "s3cret"); code != http.StatusOK {
+		t.Fatalf("expected restore, got %d", code)
+	}
+
+	pair, _ := store.Get(DefaultRestoreKey)
+	status := &RestoreStatus{}
+	if pair == nil || json.Unmarshal(pair.Value, status) != nil || status.Actor != "alice" {
+		t.Fatalf("expected restore by the token identity, got %v", pair)
+	}
+}
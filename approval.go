@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+const (
+	// ApprovalOff deploys commits without approval (default)
+	ApprovalOff = "off"
+	// ApprovalRequired parks commits until enough distinct approvers approve them
+	ApprovalRequired = "required"
+
+	// DefaultApprovers is number of distinct approvers required
+	DefaultApprovers = 2
+
+	// maxDiffLines bounds line diffs of a key, larger files only report line counts
+	maxDiffLines = 2000
+)
+
+// ApprovalRequest is a commit parked until approved, served by the admin API
+type ApprovalRequest struct {
+	Commit    string      `json:"commit"`
+	Trigger   string      `json:"trigger"`
+	Reason    string      `json:"reason,omitempty"`
+	Required  int         `json:"required"`
+	Approvers []string    `json:"approvers"`
+	Changes   *KeyChanges `json:"changes"`
+	// line diffs per added or changed key, "-" removed & "+" added lines
+	Diff map[string]string `json:"diff,omitempty"`
+	Time time.Time         `json:"time"`
+}
+
+// requiredApprovers parses number of approvers required by an app
+func requiredApprovers(conf *AppConf) (int, error) {
+	if conf.Approvers == "" {
+		return DefaultApprovers, nil
+	}
+	n, err := strconv.Atoi(conf.Approvers)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid approvers(%s)", conf.Approvers)
+	}
+	return n, nil
+}
+
+// lineDiff returns removed & added lines between a and b in order
+func lineDiff(a, b []byte) string {
+	var al, bl []string
+	if len(a) > 0 {
+		al = strings.Split(string(a), "\n")
+	}
+	if len(b) > 0 {
+		bl = strings.Split(string(b), "\n")
+	}
+	if len(al) > maxDiffLines || len(bl) > maxDiffLines {
+		return fmt.Sprintf("(%d lines -> %d lines, too large to diff)", len(al), len(bl))
+	}
+
+	// longest common subsequence from the end
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	i, j := 0, 0
+	for i < len(al) || j < len(bl) {
+		switch {
+		case i < len(al) && j < len(bl) && al[i] == bl[j]:
+			i++
+			j++
+		case j < len(bl) && (i == len(al) || lcs[i][j+1] > lcs[i+1][j]):
+			fmt.Fprintf(&buf, "+%s\n", bl[j])
+			j++
+		default:
+			fmt.Fprintf(&buf, "-%s\n", al[i])
+			i++
+		}
+	}
+	return buf.String()
+}
+
+// approvalDiff diffs added & changed keys, repo holds values before decryption
+// and keys whose value was decrypted are not shown
+func approvalDiff(prev, next, repo map[string][]byte, changes *KeyChanges) map[string]string {
+	diff := make(map[string]string)
+	for _, keys := range [][]string{changes.Added, changes.Changed} {
+		for _, k := range keys {
+			if isMetaKey(k) {
+				continue
+			}
+			if !bytes.Equal(repo[k], next[k]) {
+				diff[k] = "(encrypted, not shown)"
+				continue
+			}
+			diff[k] = lineDiff(prev[k], next[k])
+		}
+	}
+	return diff
+}
+
+// ApprovalGateConfig is configuration for ApprovalGate
+type ApprovalGateConfig struct {
+	store        kvstore.Store
+	keyPrefix    string
+	appKeyPrefix string
+}
+
+// ApprovalGate tracks approvals recorded by confctl approve
+type ApprovalGate struct {
+	shutdown     bool
+	shutdownLock sync.Mutex
+	shutdownCh   chan struct{}
+
+	config       *ApprovalGateConfig
+	watcher      *Watcher
+	store        kvstore.Store
+	log          *logrus.Entry
+	keyPrefix    string
+	appKeyPrefix string
+
+	lock sync.RWMutex
+	// users approving per app & commit
+	approvals map[string]map[string][]string
+}
+
+// NewApprovalGate creates a new ApprovalGate
+func NewApprovalGate(config *ApprovalGateConfig) (*ApprovalGate, error) {
+	keyPrefix := config.keyPrefix
+	if keyPrefix == "" {
+		keyPrefix = client.DefaultApprovalKeyPrefix
+	}
+
+	appKeyPrefix := config.appKeyPrefix
+	if appKeyPrefix == "" {
+		appKeyPrefix = DefaultAppConfigKeyPrefix
+	}
+
+	watcher, err := NewWatcher(&WatcherConfig{watchType: "prefix", key: keyPrefix, store: config.store})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ApprovalGate{
+		shutdownCh:   make(chan struct{}),
+		config:       config,
+		watcher:      watcher,
+		store:        config.store,
+		log:          configureLogger("approval"),
+		keyPrefix:    keyPrefix,
+		appKeyPrefix: appKeyPrefix,
+
+		approvals: make(map[string]map[string][]string),
+	}, nil
+}
+
+// Run starts ApprovalGate
+func (g *ApprovalGate) Run() {
+	go g.Loop()
+}
+
+// Loop is internal loop for ApprovalGate
+func (g *ApprovalGate) Loop() {
+	for {
+		select {
+		case <-g.shutdownCh:
+			return
+		case v, ok := <-g.watcher.eventCh:
+			if !ok {
+				return
+			}
+			pairs, ok := v.(kvstore.Pairs)
+			if !ok {
+				panic("invalid value from watcher")
+			}
+			g.update(pairs)
+		}
+	}
+}
+
+// approvalUser returns the user of an approver(user@host), approvals from several hosts count once
+func approvalUser(approver string) string {
+	return strings.SplitN(approver, "@", 2)[0]
+}
+
+// update replaces approvals as a whole, users are counted once per commit
+// an approval counts only under the key of its approver and while held by the session it names,
+// which confctl approve acquires it with
+func (g *ApprovalGate) update(pairs kvstore.Pairs) {
+	approvals := make(map[string]map[string][]string)
+	seen := make(map[string]bool)
+	for _, pair := range pairs {
+		parts := strings.Split(strings.TrimPrefix(pair.Key, g.keyPrefix+"/"), "/")
+		if len(parts) != 3 {
+			continue
+		}
+		appID, commit := parts[0], parts[1]
+		a, err := client.ParseApproval(pair.Value)
+		if err != nil || a.Approver == "" {
+			g.log.Errorf("Invalid approval(%s): %v", pair.Key, err)
+			continue
+		}
+		if a.Approver != parts[2] {
+			g.log.Errorf("Invalid approval(%s): approver(%s) of another key", pair.Key, a.Approver)
+			continue
+		}
+		if a.Session == "" || pair.Session != a.Session {
+			g.log.Errorf("Invalid approval(%s): not held by session(%s)", pair.Key, a.Session)
+			continue
+		}
+		user := approvalUser(a.Approver)
+		id := appID + "/" + commit + "/" + user
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		if approvals[appID] == nil {
+			approvals[appID] = make(map[string][]string)
+		}
+		approvals[appID][commit] = append(approvals[appID][commit], user)
+	}
+	for _, commits := range approvals {
+		for _, approvers := range commits {
+			sort.Strings(approvers)
+		}
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.approvals = approvals
+}
+
+// approvers returns distinct users approving a commit
+func (g *ApprovalGate) approvers(appID, commit string) []string {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	return append([]string{}, g.approvals[appID][commit]...)
+}
+
+// expire removes approvals of an app except for commit, approvals expire once the branch moves on
+func (g *ApprovalGate) expire(appID, commit string) {
+	g.lock.Lock()
+	for c := range g.approvals[appID] {
+		if c != commit {
+			delete(g.approvals[appID], c)
+		}
+	}
+	g.lock.Unlock()
+
+	pairs, err := g.store.List(client.ApprovalKey(g.keyPrefix, appID, "", ""))
+	if err != nil {
+		g.log.Errorf("Failed to list approvals of app(%s): %v", appID, err)
+		return
+	}
+	for _, pair := range pairs {
+		if commit != "" && strings.HasPrefix(pair.Key, client.ApprovalKey(g.keyPrefix, appID, commit, "")) {
+			continue
+		}
+		if err := g.store.Delete(pair.Key); err != nil {
+			g.log.Errorf("Failed to expire approval(%s): %v", pair.Key, err)
+		}
+	}
+}
+
+// currentSnapshot reads the snapshot currently deployed for an app
+func (g *ApprovalGate) currentSnapshot(appID string) (map[string][]byte, error) {
+	prefix := g.appKeyPrefix + "/" + appID + "/"
+	pairs, err := g.store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	kvs := make(map[string][]byte)
+	for _, pair := range pairs {
+		kvs[strings.TrimPrefix(pair.Key, prefix)] = pair.Value
+	}
+	return kvs, nil
+}
+
+// Shutdown shutdowns ApprovalGate
+func (g *ApprovalGate) Shutdown() {
+	g.shutdownLock.Lock()
+	defer g.shutdownLock.Unlock()
+
+	if g.shutdown {
+		return
+	}
+	g.shutdown = true
+
+	g.watcher.Shutdown()
+	close(g.shutdownCh)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+func TestLineDiff(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected string
+	}{
+		{"a\nb\nc", "a\nx\nc", "-b\n+x\n"},
+		{"", "a\nb", "+a\n+b\n"},
+		{"a\nb", "a\nb\nc", "+c\n"},
+		{"a\nb", "b", "-a\n"},
+		{"a", "a", ""},
+	}
+	for _, c := range cases {
+		if diff := lineDiff([]byte(c.a), []byte(c.b)); diff != c.expected {
+			t.Fatalf("lineDiff(%q, %q) = %q expected %q", c.a, c.b, diff, c.expected)
+		}
+	}
+}
+
+func TestApprovalDiff(t *testing.T) {
+	prev := map[string][]byte{"a.conf": []byte("x=1"), "secret.conf": []byte("old")}
+	next := map[string][]byte{"a.conf": []byte("x=2"), "secret.conf": []byte("new"), metaCommit: []byte("abc")}
+	repo := map[string][]byte{"a.conf": []byte("x=2"), "secret.conf": []byte("ENC[age:...]")}
+
+	diff := approvalDiff(prev, next, repo, diffSnapshot(prev, next))
+	expected := map[string]string{
+		"a.conf":      "-x=1\n+x=2\n",
+		"secret.conf": "(encrypted, not shown)",
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("unexpected diff(%v)", diff)
+	}
+}
+
+func TestApprovalGate(t *testing.T) {
+	g := &ApprovalGate{keyPrefix: client.DefaultApprovalKeyPrefix, log: configureLogger("approval")}
+	g.update(kvstore.Pairs{
+		{Key: client.ApprovalKey(g.keyPrefix, "web", "abc", "bob@h1"), Value: []byte(`{"approver": "bob@h1", "session": "s1"}`), Session: "s1"},
+		{Key: client.ApprovalKey(g.keyPrefix, "web", "abc", "alice@h2"), Value: []byte(`{"approver": "alice@h2", "session": "s2"}`), Session: "s2"},
+		// same user from another host, still one approver
+		{Key: client.ApprovalKey(g.keyPrefix, "web", "abc", "bob@h4"), Value: []byte(`{"approver": "bob@h4", "session": "s4"}`), Session: "s4"},
+		// copied under another key
+		{Key: client.ApprovalKey(g.keyPrefix, "web", "def", "carol@h5"), Value: []byte(`{"approver": "bob@h1", "session": "s1"}`), Session: "s1"},
+		{Key: client.ApprovalKey(g.keyPrefix, "web", "def", "bob@h1"), Value: []byte(`{"approver": "bob@h1", "session": "s1"}`), Session: "s1"},
+		{Key: client.ApprovalKey(g.keyPrefix, "web", "def", "eve@h3"), Value: []byte(`invalid`)},
+		// written without the session, or held by another one
+		{Key: client.ApprovalKey(g.keyPrefix, "web", "def", "dave@h6"), Value: []byte(`{"approver": "dave@h6", "session": "s6"}`)},
+		{Key: client.ApprovalKey(g.keyPrefix, "web", "def", "frank@h7"), Value: []byte(`{"approver": "frank@h7", "session": "s7"}`), Session: "s8"},
+	})
+
+	if approvers := g.approvers("web", "abc"); !reflect.DeepEqual(approvers, []string{"alice", "bob"}) {
+		t.Fatalf("unexpected approvers(%v)", approvers)
+	}
+	if approvers := g.approvers("web", "def"); !reflect.DeepEqual(approvers, []string{"bob"}) {
+		t.Fatalf("unexpected approvers(%v)", approvers)
+	}
+	if approvers := g.approvers("api", "abc"); len(approvers) != 0 {
+		t.Fatalf("unexpected approvers(%v)", approvers)
+	}
+
+	if _, err := requiredApprovers(&AppConf{Approvers: "0"}); err == nil {
+		t.Fatalf("expected error for zero approvers")
+	}
+	if n, err := requiredApprovers(&AppConf{}); err != nil || n != DefaultApprovers {
+		t.Fatalf("unexpected default approvers(%d): %v", n, err)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// DefaultCacheKeyPrefix prefixes keys written to caches
+	DefaultCacheKeyPrefix = "conf"
+
+	// cache retry backoff bounds
+	cacheRetryMin = time.Second
+	cacheRetryMax = time.Minute
+
+	// memcached key & item size limits
+	memcacheMaxKey  = 250
+	memcacheMaxItem = 1024 * 1024
+)
+
+// SnapshotSink mirrors snapshots pushed to KV storage elsewhere, publishing must not block the pusher
+type SnapshotSink interface {
+	Publish(appID string, kvs map[string][]byte)
+	Run()
+	Shutdown()
+}
+
+// cachePublisher writes a whole snapshot to a cache, commit is the consistency marker(_meta/commit)
+type cachePublisher interface {
+	publish(appID, commit string, kvs map[string][]byte) error
+	close()
+}
+
+// permanentCacheError fails a snapshot whatever the retries, e.g. an item over the cache size limit
+type permanentCacheError struct {
+	error
+}
+
+// CacheSinkConfig is configuration for CacheSink
+type CacheSinkConfig struct {
+	// redis://host:port[/db] or memcache://host:port[,host:port]
+	url       string
+	keyPrefix string
+}
+
+// CacheSink mirrors snapshots into Redis or memcached for consumers reading config at request time
+// the latest snapshot of an app is retried with backoff until published or superseded,
+// dropped when the cache refuses it for good
+type CacheSink struct {
+	shutdown     bool
+	shutdownLock sync.Mutex
+	shutdownCh   chan struct{}
+
+	config    *CacheSinkConfig
+	publisher cachePublisher
+	log       *logrus.Entry
+
+	lock    sync.Mutex
+	pending map[string]map[string][]byte
+	wakeCh  chan struct{}
+}
+
+// NewCacheSink creates a new CacheSink
+func NewCacheSink(config *CacheSinkConfig) (*CacheSink, error) {
+	keyPrefix := config.keyPrefix
+	if keyPrefix == "" {
+		keyPrefix = DefaultCacheKeyPrefix
+	}
+
+	u, err := url.Parse(config.url)
+	if err != nil {
+		return nil, err
+	}
+
+	var publisher cachePublisher
+	switch u.Scheme {
+	case "redis":
+		publisher = newRedisPublisher(u, keyPrefix)
+	case "memcache":
+		publisher = newMemcachePublisher(strings.Split(u.Host, ","), keyPrefix)
+	default:
+		return nil, fmt.Errorf("unknown cache(%s)", config.url)
+	}
+
+	return &CacheSink{
+		shutdownCh: make(chan struct{}),
+		config:     config,
+		publisher:  publisher,
+		log:        configureLogger("cache"),
+
+		pending: make(map[string]map[string][]byte),
+		wakeCh:  make(chan struct{}, 1),
+	}, nil
+}
+
+// Publish queues a snapshot, replacing one of the app not published yet
+func (s *CacheSink) Publish(appID string, kvs map[string][]byte) {
+	s.lock.Lock()
+	s.pending[appID] = *copySnapshot(kvs)
+	s.lock.Unlock()
+
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts CacheSink
+func (s *CacheSink) Run() {
+	go s.Loop()
+}
+
+// Loop is internal loop for CacheSink
+func (s *CacheSink) Loop() {
+	backoff := cacheRetryMin
+	var retryC <-chan time.Time
+	for {
+		select {
+		case <-s.shutdownCh:
+			s.publisher.close()
+			return
+		case <-s.wakeCh:
+		case <-retryC:
+		}
+
+		if s.flush() {
+			backoff = cacheRetryMin
+			retryC = nil
+			continue
+		}
+		s.log.Warnf("Retrying in %v", backoff)
+		retryC = time.After(backoff)
+		if backoff *= 2; backoff > cacheRetryMax {
+			backoff = cacheRetryMax
+		}
+	}
+}
+
+// flush publishes pending snapshots, returns false when some failed & are left pending
+func (s *CacheSink) flush() bool {
+	s.lock.Lock()
+	var apps []string
+	for appID := range s.pending {
+		apps = append(apps, appID)
+	}
+	s.lock.Unlock()
+	sort.Strings(apps)
+
+	ok := true
+	for _, appID := range apps {
+		s.lock.Lock()
+		kvs, found := s.pending[appID]
+		s.lock.Unlock()
+		if !found {
+			continue
+		}
+
+		commit := string(kvs[metaCommit])
+		err := s.publisher.publish(appID, commit, kvs)
+		if _, permanent := err.(permanentCacheError); permanent {
+			s.log.Errorf("Dropping app(%s) commit(%s), the cache refuses it: %v", appID, commit, err)
+		} else if err != nil {
+			s.log.Errorf("Failed to publish app(%s) commit(%s): %v", appID, commit, err)
+			ok = false
+			continue
+		} else {
+			s.log.Infof("Published app(%s) commit(%s)", appID, commit)
+		}
+
+		// a snapshot queued while publishing stays pending, the same commit may be rendered anew
+		s.lock.Lock()
+		if reflect.DeepEqual(s.pending[appID], kvs) {
+			delete(s.pending, appID)
+		}
+		s.lock.Unlock()
+	}
+	return ok
+}
+
+// Shutdown shutdowns CacheSink
+func (s *CacheSink) Shutdown() {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+
+	if s.shutdown {
+		return
+	}
+	s.shutdown = true
+
+	close(s.shutdownCh)
+}
+
+// redisPublisher keeps a hash per app(<prefix>:<app>) with a commit marker(<prefix>:<app>:commit)
+// and notifies the commit on channel <prefix>:<app>
+type redisPublisher struct {
+	pool      *redis.Pool
+	keyPrefix string
+}
+
+func newRedisPublisher(u *url.URL, keyPrefix string) *redisPublisher {
+	return &redisPublisher{
+		pool: &redis.Pool{
+			MaxIdle:     2,
+			IdleTimeout: time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.DialURL(u.String(), redis.DialConnectTimeout(5*time.Second))
+			},
+		},
+		keyPrefix: keyPrefix,
+	}
+}
+
+// publish builds the hash aside & renames it over the live one in a transaction,
+// so readers see either snapshot as a whole
+func (p *redisPublisher) publish(appID, commit string, kvs map[string][]byte) error {
+	conn := p.pool.Get()
+	defer conn.Close()
+
+	key := p.keyPrefix + ":" + appID
+	tmp := key + ":" + commit + ":tmp"
+
+	conn.Send("MULTI")
+	conn.Send("DEL", tmp)
+	args := redis.Args{}.Add(tmp)
+	for k, v := range kvs {
+		args = args.Add(k, v)
+	}
+	conn.Send("HSET", args...)
+	conn.Send("RENAME", tmp, key)
+	conn.Send("SET", key+":commit", commit)
+	conn.Send("PUBLISH", key, commit)
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *redisPublisher) close() {
+	p.pool.Close()
+}
+
+// memcachePublisher writes versioned keys(<prefix>:<app>:<commit>:<key>), a key list
+// (<prefix>:<app>:<commit>:_keys) and last the commit marker(<prefix>:<app>:commit)
+// consumers read the marker first, versioned keys never change
+type memcachePublisher struct {
+	client    *memcache.Client
+	keyPrefix string
+}
+
+func newMemcachePublisher(servers []string, keyPrefix string) *memcachePublisher {
+	return &memcachePublisher{client: memcache.New(servers...), keyPrefix: keyPrefix}
+}
+
+// memcacheError classifies errors of memcached, items it can't store are never retried
+func memcacheError(err error) error {
+	if err == memcache.ErrMalformedKey || strings.Contains(err.Error(), "SERVER_ERROR object too large") {
+		return permanentCacheError{err}
+	}
+	return err
+}
+
+// memcacheKey makes a valid memcached key, long keys are hashed
+func memcacheKey(key string) string {
+	key = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, key)
+	if len(key) > memcacheMaxKey {
+		sum := sha1.Sum([]byte(key))
+		key = key[:memcacheMaxKey-len(sum)*2-1] + "#" + hex.EncodeToString(sum[:])
+	}
+	return key
+}
+
+func (p *memcachePublisher) publish(appID, commit string, kvs map[string][]byte) error {
+	version := p.keyPrefix + ":" + appID + ":" + commit + ":"
+
+	var keys []string
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if len(kvs[k]) > memcacheMaxItem {
+			return permanentCacheError{fmt.Errorf("key(%s) exceeds memcached item size", k)}
+		}
+		if err := p.client.Set(&memcache.Item{Key: memcacheKey(version + k), Value: kvs[k]}); err != nil {
+			return memcacheError(err)
+		}
+	}
+	if err := p.client.Set(&memcache.Item{Key: memcacheKey(version + "_keys"), Value: []byte(strings.Join(keys, "\n"))}); err != nil {
+		return memcacheError(err)
+	}
+	if err := p.client.Set(&memcache.Item{Key: memcacheKey(p.keyPrefix + ":" + appID + ":commit"), Value: []byte(commit)}); err != nil {
+		return memcacheError(err)
+	}
+	return nil
+}
+
+func (p *memcachePublisher) close() {}
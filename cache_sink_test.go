@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestCacheSinkRedis(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	s, err := NewCacheSink(&CacheSinkConfig{url: "redis://" + mr.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.publisher.close()
+
+	conn, err := redis.Dial("tcp", mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	psc := redis.PubSubConn{Conn: conn}
+	psc.Subscribe("conf:web")
+	psc.Receive()
+
+	s.Publish("web", map[string][]byte{metaCommit: []byte("c1"), "etc/a.conf": []byte("a1"), "b.yml": []byte("b1")})
+	if !s.flush() {
+		t.Fatal("expected flush to succeed")
+	}
+	s.Publish("web", map[string][]byte{metaCommit: []byte("c2"), "etc/a.conf": []byte("a2")})
+	if !s.flush() {
+		t.Fatal("expected flush to succeed")
+	}
+
+	if fields, _ := mr.HKeys("conf:web"); len(fields) != 2 {
+		t.Fatalf("expected the hash to be replaced, got %v", fields)
+	}
+	if v := mr.HGet("conf:web", "etc/a.conf"); v != "a2" {
+		t.Fatalf("unexpected value %s", v)
+	}
+	if v, _ := mr.Get("conf:web:commit"); v != "c2" {
+		t.Fatalf("unexpected commit marker %s", v)
+	}
+	for _, commit := range []string{"c1", "c2"} {
+		msg, ok := psc.Receive().(redis.Message)
+		if !ok || string(msg.Data) != commit {
+			t.Fatalf("expected notification of %s, got %v", commit, msg)
+		}
+	}
+}
+
+type failingPublisher struct {
+	fail      bool
+	permanent bool
+	// called while publishing
+	during    func()
+	published []string
+}
+
+func (p *failingPublisher) publish(appID, commit string, kvs map[string][]byte) error {
+	if p.during != nil {
+		p.during()
+	}
+	if p.permanent {
+		return permanentCacheError{errors.New("too large")}
+	}
+	if p.fail {
+		return errors.New("unavailable")
+	}
+	p.published = append(p.published, appID+"@"+commit)
+	return nil
+}
+
+func (p *failingPublisher) close() {}
+
+func TestCacheSinkRetry(t *testing.T) {
+	p := &failingPublisher{fail: true}
+	s := &CacheSink{publisher: p, log: configureLogger("cache"), pending: make(map[string]map[string][]byte), wakeCh: make(chan struct{}, 1)}
+
+	s.Publish("web", map[string][]byte{metaCommit: []byte("c1")})
+	s.Publish("api", map[string][]byte{metaCommit: []byte("c1")})
+	if s.flush() {
+		t.Fatal("expected flush to fail")
+	}
+	// only the latest snapshot of an app is retried
+	s.Publish("web", map[string][]byte{metaCommit: []byte("c2")})
+
+	p.fail = false
+	if !s.flush() {
+		t.Fatal("expected flush to succeed")
+	}
+	if strings.Join(p.published, ",") != "api@c1,web@c2" {
+		t.Fatalf("unexpected publishes %v", p.published)
+	}
+	if len(s.pending) != 0 {
+		t.Fatalf("expected nothing pending, got %v", s.pending)
+	}
+}
+
+func TestCacheSinkPending(t *testing.T) {
+	p := &failingPublisher{permanent: true}
+	s := &CacheSink{publisher: p, log: configureLogger("cache"), pending: make(map[string]map[string][]byte), wakeCh: make(chan struct{}, 1)}
+
+	s.Publish("web", map[string][]byte{metaCommit: []byte("c1")})
+	if !s.flush() || len(s.pending) != 0 {
+		t.Fatalf("expected snapshot refused for good to be dropped, pending %v", s.pending)
+	}
+
+	// the same commit rendered anew while publishing stays pending
+	p.permanent = false
+	s.Publish("web", map[string][]byte{metaCommit: []byte("c1")})
+	p.during = func() {
+		p.during = nil
+		s.Publish("web", map[string][]byte{metaCommit: []byte("c1"), "a.conf": []byte("a")})
+	}
+	if !s.flush() || len(s.pending["web"]) != 2 {
+		t.Fatalf("expected snapshot queued meanwhile pending, got %v", s.pending)
+	}
+	if !s.flush() || len(s.pending) != 0 || strings.Join(p.published, ",") != "web@c1,web@c1" {
+		t.Fatalf("unexpected publishes %v, pending %v", p.published, s.pending)
+	}
+}
+
+func TestMemcacheKey(t *testing.T) {
+	if key := memcacheKey("conf:web:c1:etc/my app.conf"); key != "conf:web:c1:etc/my_app.conf" {
+		t.Fatalf("unexpected key %s", key)
+	}
+	long := memcacheKey("conf:web:c1:" + strings.Repeat("a", 300))
+	if len(long) != memcacheMaxKey || long == memcacheKey("conf:web:c1:"+strings.Repeat("a", 301)) {
+		t.Fatalf("unexpected long key %s", long)
+	}
+}
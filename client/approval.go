@@ -0,0 +1,37 @@
+package client
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// DefaultApprovalKeyPrefix is key prefix for approvals(<prefix>/<appID>/<commit>/<approver>)
+const DefaultApprovalKeyPrefix = "config/approval"
+
+// Approval is a commit approved by an approver, written under a Consul session identifying
+// the node approval was made from
+type Approval struct {
+	Approver string    `json:"approver"`
+	Session  string    `json:"session"`
+	Node     string    `json:"node"`
+	Time     time.Time `json:"time"`
+}
+
+// ApprovalKey returns the key of an approval, approvals of an app when commit & approver are empty
+func ApprovalKey(prefix, appID, commit, approver string) string {
+	key := strings.TrimSuffix(prefix, "/") + "/" + appID + "/"
+	if commit != "" {
+		key += commit + "/" + approver
+	}
+	return key
+}
+
+// ParseApproval decodes an approval
+func ParseApproval(data []byte) (*Approval, error) {
+	a := &Approval{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
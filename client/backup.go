@@ -0,0 +1,215 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// BackupVersion is the archive format written by WriteBackup
+	BackupVersion = 1
+
+	// entries of a backup archive(tar.gz)
+	backupManifestName = "manifest.json"
+	backupDataName     = "data.json"
+)
+
+// BackupNamespaces are key prefixes saved by a backup, only history keys are saved of the deploy namespace
+type BackupNamespaces struct {
+	Global   string `json:"global"`
+	App      string `json:"app"`
+	Override string `json:"override"`
+	Deploy   string `json:"deploy"`
+}
+
+// DefaultBackupNamespaces are the namespaces of a master with default key prefixes
+var DefaultBackupNamespaces = &BackupNamespaces{
+	Global:   "config/global",
+	App:      DefaultKeyPrefix,
+	Override: DefaultOverrideKeyPrefix,
+	Deploy:   "config/deploy",
+}
+
+// Prefixes lists prefixes to read for a backup
+func (n *BackupNamespaces) Prefixes() []string {
+	return []string{n.Global + "/", n.App + "/", n.Override + "/", n.Deploy + "/"}
+}
+
+// AppOf returns the app a key belongs to, false when the key isn't backed up
+// config/global/<app>/*, config/app/<app>/*, config/override/<target>/<app> & config/deploy/<app>/history
+func (n *BackupNamespaces) AppOf(key string) (string, bool) {
+	for _, prefix := range []string{n.Global, n.App} {
+		if strings.HasPrefix(key, prefix+"/") {
+			parts := strings.SplitN(strings.TrimPrefix(key, prefix+"/"), "/", 2)
+			return parts[0], len(parts) == 2
+		}
+	}
+	if strings.HasPrefix(key, n.Override+"/") {
+		parts := strings.Split(strings.TrimPrefix(key, n.Override+"/"), "/")
+		return parts[len(parts)-1], len(parts) == 2
+	}
+	if strings.HasPrefix(key, n.Deploy+"/") && strings.HasSuffix(key, "/history") {
+		parts := strings.Split(strings.TrimPrefix(key, n.Deploy+"/"), "/")
+		return parts[0], len(parts) == 2
+	}
+	return "", false
+}
+
+// BackupPair is a key & value of a backup
+type BackupPair struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Backup is a copy of the config KV namespaces
+type Backup struct {
+	Version    int               `json:"version"`
+	Created    time.Time         `json:"created"`
+	Actor      string            `json:"actor"`
+	Datacenter string            `json:"datacenter,omitempty"`
+	Namespaces *BackupNamespaces `json:"namespaces"`
+	// sha256 of the data entry & number of keys, set by WriteBackup
+	Checksum string `json:"checksum"`
+	Keys     int    `json:"keys"`
+
+	Pairs []*BackupPair `json:"-"`
+}
+
+// WriteBackup writes a backup as a tar.gz of a manifest & the pairs sorted by key
+func WriteBackup(w io.Writer, b *Backup) error {
+	sort.Slice(b.Pairs, func(i, j int) bool { return b.Pairs[i].Key < b.Pairs[j].Key })
+	data, err := json.Marshal(b.Pairs)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	b.Version = BackupVersion
+	b.Checksum = hex.EncodeToString(sum[:])
+	b.Keys = len(b.Pairs)
+	manifest, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{{backupManifestName, manifest}, {backupDataName, data}} {
+		hdr := &tar.Header{Name: entry.name, Mode: 0600, Size: int64(len(entry.data)), ModTime: b.Created}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// ReadBackup reads a backup, verifying its version & checksum
+func ReadBackup(r io.Reader) (*Backup, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entries[hdr.Name], err = ioutil.ReadAll(tr); err != nil {
+			return nil, err
+		}
+	}
+
+	manifest, data := entries[backupManifestName], entries[backupDataName]
+	if manifest == nil || data == nil {
+		return nil, fmt.Errorf("not a backup, missing %s or %s", backupManifestName, backupDataName)
+	}
+	b := &Backup{}
+	if err := json.Unmarshal(manifest, b); err != nil {
+		return nil, err
+	}
+	if b.Version < 1 || b.Version > BackupVersion {
+		return nil, fmt.Errorf("unsupported backup version(%d)", b.Version)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != b.Checksum {
+		return nil, fmt.Errorf("backup checksum mismatch")
+	}
+	if err := json.Unmarshal(data, &b.Pairs); err != nil {
+		return nil, err
+	}
+	if len(b.Pairs) != b.Keys {
+		return nil, fmt.Errorf("backup has %d keys, manifest says %d", len(b.Pairs), b.Keys)
+	}
+	if b.Namespaces == nil {
+		b.Namespaces = DefaultBackupNamespaces
+	}
+	return b, nil
+}
+
+// RestorePlan lists keys a restore sets & deletes
+type RestorePlan struct {
+	Set    []*BackupPair
+	Delete []string
+}
+
+// PlanRestore compares a backup with current pairs of its namespaces, restricted to apps when set
+// keys equal in both are left alone, keys missing from the backup are deleted
+func PlanRestore(b *Backup, current map[string][]byte, apps []string) *RestorePlan {
+	selected := func(key string) bool {
+		app, ok := b.Namespaces.AppOf(key)
+		if !ok {
+			return false
+		}
+		if len(apps) == 0 {
+			return true
+		}
+		for _, a := range apps {
+			if a == app {
+				return true
+			}
+		}
+		return false
+	}
+
+	plan := &RestorePlan{}
+	backedUp := make(map[string]bool)
+	for _, pair := range b.Pairs {
+		if !selected(pair.Key) {
+			continue
+		}
+		backedUp[pair.Key] = true
+		if v, ok := current[pair.Key]; !ok || !bytes.Equal(v, pair.Value) {
+			plan.Set = append(plan.Set, pair)
+		}
+	}
+	for key := range current {
+		if selected(key) && !backedUp[key] {
+			plan.Delete = append(plan.Delete, key)
+		}
+	}
+	sort.Strings(plan.Delete)
+	return plan
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"testing"
+	"time"
+)
+
+func TestBackupArchive(t *testing.T) {
+	b := &Backup{
+		Created:    time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC),
+		Actor:      "ops@box",
+		Namespaces: DefaultBackupNamespaces,
+		Pairs: []*BackupPair{
+			{Key: "config/global/web/rev", Value: []byte("latest")},
+			{Key: "config/app/web/a.conf", Value: []byte{0x00, 0xff}},
+		},
+	}
+	var buf bytes.Buffer
+	if err := WriteBackup(&buf, b); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	read, err := ReadBackup(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Version != BackupVersion || read.Keys != 2 || read.Actor != "ops@box" || !read.Created.Equal(b.Created) {
+		t.Fatalf("unexpected manifest %+v", read)
+	}
+	if read.Pairs[0].Key != "config/app/web/a.conf" || !bytes.Equal(read.Pairs[0].Value, []byte{0x00, 0xff}) {
+		t.Fatalf("unexpected pairs %v", read.Pairs)
+	}
+
+	// data not matching the manifest checksum
+	var tampered bytes.Buffer
+	gz := gzip.NewWriter(&tampered)
+	tw := tar.NewWriter(gz)
+	manifest := []byte(`{"version": 1, "checksum": "00", "keys": 0}`)
+	tw.WriteHeader(&tar.Header{Name: backupManifestName, Mode: 0600, Size: int64(len(manifest))})
+	tw.Write(manifest)
+	tw.WriteHeader(&tar.Header{Name: backupDataName, Mode: 0600, Size: 2})
+	tw.Write([]byte("[]"))
+	tw.Close()
+	gz.Close()
+	if _, err := ReadBackup(&tampered); err == nil || err.Error() != "backup checksum mismatch" {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if _, err := ReadBackup(bytes.NewReader(data[:len(data)/2])); err == nil {
+		t.Fatal("expected truncated backup to fail")
+	}
+}
+
+func TestBackupNamespaces(t *testing.T) {
+	ns := DefaultBackupNamespaces
+	cases := []struct {
+		key string
+		app string
+		ok  bool
+	}{
+		{"config/global/web/repo", "web", true},
+		{"config/app/web/etc/a.conf", "web", true},
+		{"config/override/node1/web", "web", true},
+		{"config/override/node1/web/extra", "", false},
+		{"config/deploy/web/history", "web", true},
+		{"config/deploy/web/status", "", false},
+		{"config/freeze/global", "", false},
+	}
+	for _, c := range cases {
+		app, ok := ns.AppOf(c.key)
+		if ok != c.ok || (ok && app != c.app) {
+			t.Fatalf("AppOf(%s) = %s, %v", c.key, app, ok)
+		}
+	}
+}
+
+func TestPlanRestore(t *testing.T) {
+	b := &Backup{
+		Namespaces: DefaultBackupNamespaces,
+		Pairs: []*BackupPair{
+			{Key: "config/global/web/rev", Value: []byte("v1")},
+			{Key: "config/global/web/repo", Value: []byte("git/web")},
+			{Key: "config/global/api/rev", Value: []byte("v2")},
+		},
+	}
+	current := map[string][]byte{
+		"config/global/web/rev":    []byte("v2"),
+		"config/global/web/repo":   []byte("git/web"),
+		"config/global/web/branch": []byte("master"),
+		"config/deploy/web/status": []byte("{}"),
+		"config/global/new/rev":    []byte("v1"),
+	}
+
+	plan := PlanRestore(b, current, []string{"web"})
+	if len(plan.Set) != 1 || plan.Set[0].Key != "config/global/web/rev" {
+		t.Fatalf("unexpected keys set %v", plan.Set)
+	}
+	if len(plan.Delete) != 1 || plan.Delete[0] != "config/global/web/branch" {
+		t.Fatalf("unexpected keys deleted %v", plan.Delete)
+	}
+
+	plan = PlanRestore(b, current, nil)
+	if len(plan.Set) != 2 || len(plan.Delete) != 2 || plan.Delete[1] != "config/global/web/branch" {
+		t.Fatalf("unexpected full plan %v %v", plan.Set, plan.Delete)
+	}
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const (
+	// DefaultKeyPrefix is key prefix for app snapshots
+	DefaultKeyPrefix = "config/app"
+	// DefaultRetries is number of reads retried on hash mismatch
+	DefaultRetries = 3
+	// DefaultRetryWait is wait between retries in millisecond
+	DefaultRetryWait = 500
+)
+
+// Config contains configuration for Client
+type Config struct {
+	Client    *consulapi.Client
+	KeyPrefix string
+	Retries   int
+	RetryWait int // in millisecond
+	// snapshots not signed by a key in KeyRing are refused when set
+	KeyRing *KeyRing
+	// node name & node groups overrides are resolved for, in order of precedence
+	Node              string
+	Groups            []string
+	OverrideKeyPrefix string
+}
+
+// Client reads verified app snapshots from Consul KV
+type Client struct {
+	kv        *consulapi.KV
+	keyPrefix string
+	retries   int
+	retryWait time.Duration
+	keyRing   *KeyRing
+
+	node              string
+	groups            []string
+	overrideKeyPrefix string
+}
+
+// Snapshot is a verified app snapshot
+type Snapshot struct {
+	AppID  string
+	Commit string
+	Hash   string
+	Index  uint64
+	KVs    map[string][]byte
+	// app the snapshot was read from, differs from AppID when redirected
+	Source   string
+	Override *Override
+}
+
+// New creates a new Client
+func New(config *Config) *Client {
+	keyPrefix := config.KeyPrefix
+	if keyPrefix == "" {
+		keyPrefix = DefaultKeyPrefix
+	}
+
+	retries := config.Retries
+	if retries == 0 {
+		retries = DefaultRetries
+	}
+
+	retryWait := config.RetryWait
+	if retryWait == 0 {
+		retryWait = DefaultRetryWait
+	}
+
+	overrideKeyPrefix := config.OverrideKeyPrefix
+	if overrideKeyPrefix == "" {
+		overrideKeyPrefix = DefaultOverrideKeyPrefix
+	}
+
+	return &Client{
+		kv:        config.Client.KV(),
+		keyPrefix: strings.TrimSuffix(keyPrefix, "/"),
+		retries:   retries,
+		retryWait: time.Duration(retryWait) * time.Millisecond,
+		keyRing:   config.KeyRing,
+
+		node:              config.Node,
+		groups:            config.Groups,
+		overrideKeyPrefix: overrideKeyPrefix,
+	}
+}
+
+// Read reads an app snapshot without verification
+func (c *Client) Read(appID string) (*Snapshot, error) {
+	prefix := c.keyPrefix + "/" + appID + "/"
+	pairs, meta, err := c.kv.List(prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	kvs := make(map[string][]byte)
+	for _, pair := range pairs {
+		kvs[strings.TrimPrefix(pair.Key, prefix)] = pair.Value
+	}
+
+	return &Snapshot{
+		AppID:  appID,
+		Commit: string(kvs[MetaCommitKey]),
+		Hash:   string(kvs[MetaHashKey]),
+		Index:  meta.LastIndex,
+		KVs:    kvs,
+		Source: appID,
+	}, nil
+}
+
+// Verify checks snapshot hash and signature(when a key ring is configured)
+func (c *Client) Verify(s *Snapshot) error {
+	if err := Verify(s.KVs); err != nil {
+		return err
+	}
+	if c.keyRing != nil {
+		return c.keyRing.Verify(s.Source, s.KVs)
+	}
+	return nil
+}
+
+// Get resolves overrides, reads an app snapshot and verifies it against _meta/hash & signature
+func (c *Client) Get(appID string) (*Snapshot, error) {
+	o, err := c.ResolveOverride(appID)
+	if err != nil {
+		return nil, err
+	}
+
+	source := appID
+	if o != nil {
+		if err := c.checkOverride(o); err != nil {
+			return nil, fmt.Errorf("app(%s): %v", appID, err)
+		}
+		if o.App != "" {
+			source = o.App
+		}
+	}
+
+	s, err := c.get(source)
+	if err != nil {
+		return nil, err
+	}
+	s.AppID = appID
+	if o != nil {
+		o.apply(s)
+	}
+	return s, nil
+}
+
+// get reads a verified snapshot without resolving overrides
+// reads are retried on mismatch since a push may be in progress
+func (c *Client) get(appID string) (*Snapshot, error) {
+	var err error
+	for i := 0; i <= c.retries; i++ {
+		if i > 0 {
+			time.Sleep(c.retryWait)
+		}
+
+		var s *Snapshot
+		s, err = c.Read(appID)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = c.Verify(s); err == nil {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("app(%s): %v", appID, err)
+}
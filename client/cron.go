@@ -0,0 +1,108 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronBounds are value bounds of fields, in order minute hour day-of-month month day-of-week
+var cronBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// CronSchedule is a parsed cron expression(minute hour day-of-month month day-of-week)
+// fields support *, lists(1,2), ranges(1-5) and steps(*/15, 0-30/10), sunday is 0 or 7
+type CronSchedule struct {
+	fields [5]map[int]bool
+	// when both day-of-month & day-of-week are restricted, either one matching is enough
+	domAny, dowAny bool
+}
+
+// ParseCron parses a cron expression
+func ParseCron(expr string) (*CronSchedule, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("invalid cron(%s): expected 5 fields", expr)
+	}
+
+	s := &CronSchedule{
+		domAny: parts[2] == "*",
+		dowAny: parts[4] == "*",
+	}
+	for i, part := range parts {
+		values, err := parseCronField(part, cronBounds[i][0], cronBounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron(%s): %v", expr, err)
+		}
+		s.fields[i] = values
+	}
+	// sunday as 7
+	if s.fields[4][7] {
+		s.fields[4][0] = true
+	}
+	return s, nil
+}
+
+// parseCronField parses one comma separated field
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	// day-of-week accepts 7 for sunday
+	if max == 6 {
+		max = 7
+	}
+
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step(%s)", item)
+			}
+			item = item[:i]
+		}
+
+		lo, hi := min, max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value(%s)", item)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value(%s)", item)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("value(%s) out of range %d-%d", item, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// Matches checks whether the minute of t matches the schedule
+func (s *CronSchedule) Matches(t time.Time) bool {
+	if !s.fields[0][t.Minute()] || !s.fields[1][t.Hour()] || !s.fields[3][int(t.Month())] {
+		return false
+	}
+
+	dom := s.fields[2][t.Day()]
+	dow := s.fields[4][int(t.Weekday())]
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	}
+	return dom || dow
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+const (
+	// EncryptedFileSuffix marks files encrypted as a whole (age, armored or binary)
+	EncryptedFileSuffix = ".age"
+
+	// MetaEncryptedKey is set when a snapshot holds ciphertext for slaves to decrypt
+	MetaEncryptedKey = MetaKeyPrefix + "encrypted"
+)
+
+// encryptedValue matches values encrypted in place, sops-like:
+// password: ENC[age:<base64 of binary age file>]
+var encryptedValue = regexp.MustCompile(`ENC\[age:([A-Za-z0-9+/=]+)\]`)
+
+// IsEncryptedKey checks whether a file is encrypted as a whole
+func IsEncryptedKey(key string) bool {
+	return strings.HasSuffix(key, EncryptedFileSuffix)
+}
+
+// HasEncrypted checks whether a snapshot has any encrypted file or value
+func HasEncrypted(kvs map[string][]byte) bool {
+	for k, v := range kvs {
+		if IsMetaKey(k) {
+			continue
+		}
+		if IsEncryptedKey(k) || encryptedValue.Match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// StripEncryptedValues removes in-place encrypted values from s
+func StripEncryptedValues(s string) string {
+	return encryptedValue.ReplaceAllString(s, "ENC[]")
+}
+
+// LoadIdentities loads age X25519 identities from a file
+func LoadIdentities(path string) ([]age.Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ids, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("identities(%s): %v", path, err)
+	}
+	return ids, nil
+}
+
+// decryptFile decrypts an armored or binary age file
+func decryptFile(data []byte, ids []age.Identity) ([]byte, error) {
+	var src io.Reader = bytes.NewReader(data)
+	br := bufio.NewReader(src)
+	if head, _ := br.Peek(len(armor.Header)); string(head) == armor.Header {
+		src = armor.NewReader(br)
+	} else {
+		src = br
+	}
+
+	r, err := age.Decrypt(src, ids...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// EncryptValue encrypts a value to be embedded in a file as ENC[age:...]
+func EncryptValue(plaintext []byte, recipients []age.Recipient) (string, error) {
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return "ENC[age:" + base64.StdEncoding.EncodeToString(buf.Bytes()) + "]", nil
+}
+
+// DecryptSnapshot returns a copy of snapshot with encrypted files & values decrypted
+// files lose EncryptedFileSuffix (secrets/db.yml.age => secrets/db.yml)
+func DecryptSnapshot(kvs map[string][]byte, ids []age.Identity) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	for k, v := range kvs {
+		if k == MetaEncryptedKey {
+			continue
+		}
+		if IsMetaKey(k) {
+			out[k] = v
+			continue
+		}
+
+		if IsEncryptedKey(k) {
+			plain, err := decryptFile(v, ids)
+			if err != nil {
+				return nil, fmt.Errorf("decrypting(%s): %v", k, err)
+			}
+			out[strings.TrimSuffix(k, EncryptedFileSuffix)] = plain
+			continue
+		}
+
+		if !encryptedValue.Match(v) {
+			out[k] = v
+			continue
+		}
+
+		var decErr error
+		out[k] = encryptedValue.ReplaceAllFunc(v, func(m []byte) []byte {
+			sub := encryptedValue.FindSubmatch(m)
+			raw, err := base64.StdEncoding.DecodeString(string(sub[1]))
+			if err != nil {
+				decErr = err
+				return m
+			}
+			plain, err := decryptFile(raw, ids)
+			if err != nil {
+				decErr = err
+				return m
+			}
+			return plain
+		})
+		if decErr != nil {
+			return nil, fmt.Errorf("decrypting value in(%s): %v", k, decErr)
+		}
+	}
+	return out, nil
+}
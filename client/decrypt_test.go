@@ -0,0 +1,74 @@
+package client
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+func encryptArmored(t *testing.T, plaintext []byte, recipient age.Recipient) []byte {
+	var buf bytes.Buffer
+	aw := armor.NewWriter(&buf)
+	w, err := age.Encrypt(aw, recipient)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	w.Write(plaintext)
+	w.Close()
+	aw.Close()
+	return buf.Bytes()
+}
+
+func TestDecryptSnapshot(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	other, _ := age.GenerateX25519Identity()
+
+	enc, err := EncryptValue([]byte("s3cr3t"), []age.Recipient{id.Recipient()})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	kvs := map[string][]byte{
+		"db.yml":         []byte("user: app\npassword: " + enc + "\n"),
+		"tls/key.age":    encryptArmored(t, []byte("PRIVATE"), id.Recipient()),
+		"plain.conf":     []byte("a=1"),
+		MetaCommitKey:    []byte("e491da1"),
+		MetaEncryptedKey: []byte("true"),
+	}
+	if !HasEncrypted(kvs) {
+		t.Fatalf("snapshot should have encrypted contents")
+	}
+	if strings.Contains(StripEncryptedValues(string(kvs["db.yml"])), "age:") {
+		t.Fatalf("encrypted value not stripped")
+	}
+
+	out, err := DecryptSnapshot(kvs, []age.Identity{id})
+	if err != nil {
+		t.Fatalf("decrypt failed: %v", err)
+	}
+	if string(out["db.yml"]) != "user: app\npassword: s3cr3t\n" {
+		t.Fatalf("unexpected db.yml(%s)", out["db.yml"])
+	}
+	if string(out["tls/key"]) != "PRIVATE" {
+		t.Fatalf("unexpected tls/key(%s)", out["tls/key"])
+	}
+	if _, ok := out["tls/key.age"]; ok {
+		t.Fatalf("ciphertext key should be renamed")
+	}
+	if _, ok := out[MetaEncryptedKey]; ok {
+		t.Fatalf("encrypted marker should be dropped")
+	}
+	if string(out[MetaCommitKey]) != "e491da1" || string(out["plain.conf"]) != "a=1" {
+		t.Fatalf("plain keys should be kept")
+	}
+
+	if _, err := DecryptSnapshot(kvs, []age.Identity{other}); err == nil {
+		t.Fatalf("decrypt with wrong identity should fail")
+	}
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultFreezeKeyPrefix is key prefix for freezes(<prefix>/global, <prefix>/app/<appID>)
+	// and emergency deploys(<prefix>/emergency/<appID>)
+	DefaultFreezeKeyPrefix = "config/freeze"
+
+	// maxFreezeWindow bounds recurring freeze windows
+	maxFreezeWindow = 7 * 24 * time.Hour
+)
+
+// Freeze holds pushes of every app(global) or one app while active
+type Freeze struct {
+	Reason string    `json:"reason,omitempty"`
+	Actor  string    `json:"actor,omitempty"`
+	Time   time.Time `json:"time"`
+	// a one-off freeze ends at Until when set, lasts until removed otherwise
+	Until *time.Time `json:"until,omitempty"`
+	// recurring windows starting on a cron schedule(UTC) and lasting Duration, e.g. "0 18 * * 5" & "62h"
+	Schedule string `json:"schedule,omitempty"`
+	Duration string `json:"duration,omitempty"`
+
+	schedule *CronSchedule
+	duration time.Duration
+}
+
+// EmergencyDeploy lets one deploy through an active freeze, any commit when Commit is empty
+type EmergencyDeploy struct {
+	Commit string    `json:"commit,omitempty"`
+	Reason string    `json:"reason"`
+	Actor  string    `json:"actor"`
+	Time   time.Time `json:"time"`
+}
+
+// FreezeKey returns the key of the freeze of an app, of the global freeze when appID is empty
+func FreezeKey(prefix, appID string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if appID == "" {
+		return prefix + "/global"
+	}
+	return prefix + "/app/" + appID
+}
+
+// EmergencyKey returns the key of the emergency deploy of an app
+func EmergencyKey(prefix, appID string) string {
+	return strings.TrimSuffix(prefix, "/") + "/emergency/" + appID
+}
+
+// ParseFreeze decodes & validates a freeze
+func ParseFreeze(data []byte) (*Freeze, error) {
+	f := &Freeze{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, err
+	}
+
+	if f.Schedule == "" {
+		if f.Duration != "" {
+			return nil, fmt.Errorf("duration without schedule")
+		}
+		return f, nil
+	}
+
+	var err error
+	if f.schedule, err = ParseCron(f.Schedule); err != nil {
+		return nil, err
+	}
+	if f.duration, err = time.ParseDuration(f.Duration); err != nil {
+		return nil, fmt.Errorf("invalid duration(%s)", f.Duration)
+	}
+	if f.duration < time.Minute || f.duration > maxFreezeWindow {
+		return nil, fmt.Errorf("duration(%s) out of range 1m-%s", f.Duration, maxFreezeWindow)
+	}
+	return f, nil
+}
+
+// Active checks whether the freeze holds pushes at now
+func (f *Freeze) Active(now time.Time) bool {
+	if f.schedule == nil {
+		return f.Until == nil || now.Before(*f.Until)
+	}
+
+	// a window is open when the schedule fired within duration
+	now = now.UTC().Truncate(time.Minute)
+	for t := now; now.Sub(t) < f.duration; t = t.Add(-time.Minute) {
+		if f.schedule.Matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseEmergencyDeploy decodes an emergency deploy
+func ParseEmergencyDeploy(data []byte) (*EmergencyDeploy, error) {
+	e := &EmergencyDeploy{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	// 2026-10-16 is a friday
+	friday := time.Date(2026, 10, 16, 18, 30, 0, 0, time.UTC)
+
+	cases := []struct {
+		expr    string
+		t       time.Time
+		matches bool
+	}{
+		{"* * * * *", friday, true},
+		{"30 18 * * 5", friday, true},
+		{"*/15 18 * * 1-5", friday, true},
+		{"*/20 18 * * *", friday, false},
+		{"30 18 * * 0,6", friday, false},
+		{"30 18 1 * 7", friday, false},
+		// either day field matches when both are restricted
+		{"30 18 16 * 1", friday, true},
+		{"30 18 * 12 *", friday, false},
+	}
+	for _, c := range cases {
+		s, err := ParseCron(c.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%s) err: %v", c.expr, err)
+		}
+		if s.Matches(c.t) != c.matches {
+			t.Fatalf("cron(%s) matches(%v) expected %v", c.expr, !c.matches, c.matches)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Fatalf("expected error for(%s)", expr)
+		}
+	}
+}
+
+func TestFreezeActive(t *testing.T) {
+	// weekend freeze from friday 18:00 for 62 hours
+	f, err := ParseFreeze([]byte(`{"schedule": "0 18 * * 5", "duration": "62h"}`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cases := map[time.Time]bool{
+		time.Date(2026, 10, 16, 17, 59, 0, 0, time.UTC): false,
+		time.Date(2026, 10, 16, 18, 0, 0, 0, time.UTC):  true,
+		time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC):  true,
+		time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC):   false,
+	}
+	for now, active := range cases {
+		if f.Active(now) != active {
+			t.Fatalf("freeze active(%v) at %v", !active, now)
+		}
+	}
+
+	until := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	f = &Freeze{Until: &until}
+	if !f.Active(until.Add(-time.Second)) || f.Active(until) {
+		t.Fatalf("one-off freeze should end at until")
+	}
+	if !(&Freeze{}).Active(until) {
+		t.Fatalf("freeze without until should be active")
+	}
+
+	for _, data := range []string{`{"duration": "1h"}`, `{"schedule": "0 18 * * 5"}`, `{"schedule": "0 18 * * 5", "duration": "30d"}`} {
+		if _, err := ParseFreeze([]byte(data)); err == nil {
+			t.Fatalf("expected error for(%s)", data)
+		}
+	}
+}
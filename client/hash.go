@@ -0,0 +1,98 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+)
+
+const (
+	// MetaKeyPrefix is a key prefix for deploy metadata in app snapshots
+	MetaKeyPrefix = "_meta/"
+	// MetaHashKey holds merkle root of snapshot contents
+	MetaHashKey = MetaKeyPrefix + "hash"
+	// MetaCommitKey holds commit the snapshot is made of
+	MetaCommitKey = MetaKeyPrefix + "commit"
+)
+
+var (
+	// ErrHashMissing is returned when a snapshot has no _meta/hash
+	ErrHashMissing = errors.New("snapshot hash missing")
+	// ErrHashMismatch is returned when snapshot contents don't match _meta/hash
+	ErrHashMismatch = errors.New("snapshot hash mismatch")
+)
+
+// domain separation prefixes for merkle tree nodes
+var (
+	leafPrefix = []byte{0x00}
+	nodePrefix = []byte{0x01}
+)
+
+// IsMetaKey checks whether key(relative to app prefix) is a metadata key
+func IsMetaKey(key string) bool {
+	return strings.HasPrefix(key, MetaKeyPrefix)
+}
+
+// leafHash hashes one key/value pair
+func leafHash(key string, value []byte) []byte {
+	h := sha256.New()
+	h.Write(leafPrefix)
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write(value)
+	return h.Sum(nil)
+}
+
+// SnapshotHash computes merkle root over key/value pairs sorted by key
+// metadata keys are excluded; an odd node is promoted to the next level
+func SnapshotHash(kvs map[string][]byte) string {
+	var keys []string
+	for k := range kvs {
+		if !IsMetaKey(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	if len(keys) == 0 {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:])
+	}
+
+	level := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		level = append(level, leafHash(k, kvs[k]))
+	}
+
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write(nodePrefix)
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return hex.EncodeToString(level[0])
+}
+
+// Verify checks snapshot contents against its _meta/hash
+func Verify(kvs map[string][]byte) error {
+	expected, ok := kvs[MetaHashKey]
+	if !ok || len(expected) == 0 {
+		return ErrHashMissing
+	}
+	if !bytes.Equal(bytes.TrimSpace(expected), []byte(SnapshotHash(kvs))) {
+		return ErrHashMismatch
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestSnapshotHash(t *testing.T) {
+	a := map[string][]byte{
+		"etc/a.conf": []byte("a=1"),
+		"b.yml":      []byte("b: 2"),
+		"c.json":     []byte("{}"),
+	}
+	b := map[string][]byte{
+		"c.json":      []byte("{}"),
+		"b.yml":       []byte("b: 2"),
+		"etc/a.conf":  []byte("a=1"),
+		MetaCommitKey: []byte("e491da11fa3ffc9eb80a58374cb99365c1f1aef8"),
+	}
+	if SnapshotHash(a) != SnapshotHash(b) {
+		t.Fatalf("hash should ignore metadata & key order")
+	}
+
+	b["b.yml"] = []byte("b: 3")
+	if SnapshotHash(a) == SnapshotHash(b) {
+		t.Fatalf("hash should change with values")
+	}
+
+	// moving a byte between key & value must change hash
+	c := map[string][]byte{"ab": []byte("c")}
+	d := map[string][]byte{"a": []byte("bc")}
+	if SnapshotHash(c) == SnapshotHash(d) {
+		t.Fatalf("hash should separate keys from values")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	kvs := map[string][]byte{
+		"etc/a.conf": []byte("a=1"),
+		"b.yml":      []byte("b: 2"),
+	}
+	if err := Verify(kvs); err != ErrHashMissing {
+		t.Fatalf("expected ErrHashMissing got(%v)", err)
+	}
+
+	kvs[MetaHashKey] = []byte(SnapshotHash(kvs))
+	if err := Verify(kvs); err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+
+	// partially read snapshot
+	delete(kvs, "b.yml")
+	if err := Verify(kvs); err != ErrHashMismatch {
+		t.Fatalf("expected ErrHashMismatch got(%v)", err)
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const (
+	// DefaultHistoryLimit is number of deploy history entries kept per app
+	DefaultHistoryLimit = 100
+
+	// HistoryRetries is number of appends retried on concurrent update
+	HistoryRetries = 5
+)
+
+// HistoryEntry records a deploy attempt or a manual action on an app
+type HistoryEntry struct {
+	App      string    `json:"app"`
+	Commit   string    `json:"commit,omitempty"`
+	Previous string    `json:"previous,omitempty"`
+	State    string    `json:"state"`
+	Reason   string    `json:"reason,omitempty"`
+	Trigger  string    `json:"trigger"`
+	Node     string    `json:"node"`
+	Time     time.Time `json:"time"`
+}
+
+// ChangeNote explains a rev change made by confctl(rollback, promote), stored next to rev
+// as the "change" field of the app configuration so deploys of Rev are recorded with its trigger
+type ChangeNote struct {
+	Rev     string    `json:"rev"`
+	Trigger string    `json:"trigger"`
+	Reason  string    `json:"reason,omitempty"`
+	Actor   string    `json:"actor"`
+	Time    time.Time `json:"time"`
+}
+
+// ParseChangeNote decodes a change note
+func ParseChangeNote(data []byte) (*ChangeNote, error) {
+	n := &ChangeNote{}
+	if err := json.Unmarshal(data, n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// HistoryKey returns the key holding deploy history of an app, oldest entry first
+func HistoryKey(deployPrefix, appID string) string {
+	return strings.TrimSuffix(deployPrefix, "/") + "/" + appID + "/history"
+}
+
+// ParseHistory decodes a deploy history list
+func ParseHistory(data []byte) ([]*HistoryEntry, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var entries []*HistoryEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// appendEntry appends an entry dropping the oldest ones beyond limit
+func appendEntry(entries []*HistoryEntry, entry *HistoryEntry, limit int) []*HistoryEntry {
+	entries = append(entries, entry)
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries
+}
+
+// AppendEncoded appends an entry to an encoded deploy history list
+func AppendEncoded(data []byte, entry *HistoryEntry, limit int) ([]byte, error) {
+	entries, err := ParseHistory(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(appendEntry(entries, entry, limit))
+}
+
+// AppendHistory appends an entry to a deploy history list, check-and-set guards concurrent writers
+// entries beyond limit are dropped, none when limit is 0
+func AppendHistory(kv *consulapi.KV, key string, entry *HistoryEntry, limit int) error {
+	for i := 0; i < HistoryRetries; i++ {
+		pair, _, err := kv.Get(key, nil)
+		if err != nil {
+			return err
+		}
+
+		var value []byte
+		var index uint64
+		if pair != nil {
+			value, index = pair.Value, pair.ModifyIndex
+		}
+
+		data, err := AppendEncoded(value, entry, limit)
+		if err != nil {
+			return fmt.Errorf("invalid history(%s): %v", key, err)
+		}
+		ok, _, err := kv.CAS(&consulapi.KVPair{Key: key, Value: data, ModifyIndex: index}, nil)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("history(%s) updated concurrently", key)
+}
@@ -0,0 +1,33 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	var entries []*HistoryEntry
+	for _, commit := range []string{"a", "b", "c"} {
+		entries = appendEntry(entries, &HistoryEntry{App: "web", Commit: commit}, 2)
+	}
+	if len(entries) != 2 || entries[0].Commit != "b" || entries[1].Commit != "c" {
+		t.Fatalf("unexpected history(%v)", entries)
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	parsed, err := ParseHistory(data)
+	if err != nil || len(parsed) != 2 || parsed[1].Commit != "c" {
+		t.Fatalf("unexpected parsed history(%v): %v", parsed, err)
+	}
+
+	if parsed, err := ParseHistory(nil); err != nil || parsed != nil {
+		t.Fatalf("empty history should parse to nil")
+	}
+
+	if key := HistoryKey("config/deploy/", "web"); key != "config/deploy/web/history" {
+		t.Fatalf("unexpected key(%s)", key)
+	}
+}
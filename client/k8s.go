@@ -0,0 +1,255 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// MetaSecretPathsKey holds newline separated key globs exported as Kubernetes Secrets
+	MetaSecretPathsKey = MetaKeyPrefix + "secret_paths"
+
+	// annotations set on exported objects
+	K8sCommitAnnotation = "eos-conf/commit"
+	K8sHashAnnotation   = "eos-conf/hash"
+	K8sPathsAnnotation  = "eos-conf/paths"
+
+	// ConfigMap & Secret key and object name length limit
+	k8sMaxName = 253
+)
+
+// K8sOptions tunes ExportK8s
+type K8sOptions struct {
+	// namespace of the objects, left unset when empty
+	Namespace string
+	// key globs exported as Secrets in addition to _meta/secret_paths
+	SecretPaths []string
+}
+
+type k8sMetadata struct {
+	Name        string            `yaml:"name"`
+	Namespace   string            `yaml:"namespace,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+type k8sObject struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   k8sMetadata       `yaml:"metadata"`
+	Type       string            `yaml:"type,omitempty"`
+	Data       map[string]string `yaml:"data,omitempty"`
+	BinaryData map[string]string `yaml:"binaryData,omitempty"`
+}
+
+// K8sName makes a valid object name(DNS subdomain) of an app ID
+func K8sName(appID string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, appID)
+	name = strings.Trim(name, "-.")
+	if len(name) > k8sMaxName {
+		name = strings.TrimRight(name[:k8sMaxName], "-.")
+	}
+	if name == "" {
+		name = "app"
+	}
+	return name
+}
+
+// K8sKey makes a valid ConfigMap & Secret key of a snapshot key, etc/app.conf => etc_app.conf
+func K8sKey(key string) string {
+	k := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.', r == '_':
+			return r
+		}
+		return '_'
+	}, key)
+	if k == "." || k == ".." {
+		k = strings.Repeat("_", len(k))
+	}
+	if len(k) > k8sMaxName {
+		k = hashedK8sKey(k[:k8sMaxName-9], key)
+	}
+	return k
+}
+
+// hashedK8sKey suffixes k with a short hash of the original key
+func hashedK8sKey(k, key string) string {
+	sum := sha1.Sum([]byte(key))
+	return k + "-" + hex.EncodeToString(sum[:4])
+}
+
+// QuoteGlob escapes glob metacharacters so key only matches itself
+func QuoteGlob(key string) string {
+	var b bytes.Buffer
+	for _, r := range key {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// EncryptedKeys lists keys holding encrypted files or values, named as after decryption
+func EncryptedKeys(kvs map[string][]byte) []string {
+	var keys []string
+	for k, v := range kvs {
+		if IsMetaKey(k) {
+			continue
+		}
+		if IsEncryptedKey(k) {
+			keys = append(keys, strings.TrimSuffix(k, EncryptedFileSuffix))
+		} else if encryptedValue.Match(v) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// isBinary checks whether a value can't be carried as ConfigMap data
+func isBinary(v []byte) bool {
+	return !utf8.Valid(v) || bytes.IndexByte(v, 0) >= 0
+}
+
+// ExportK8s renders a snapshot as a ConfigMap, and a Secret of keys matching secret globs
+// or still encrypted, in one multi-document YAML, both named after the app
+// keys are sanitised with K8sKey, renamed ones are listed in the eos-conf/paths annotation
+func ExportK8s(appID string, kvs map[string][]byte, opts *K8sOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &K8sOptions{}
+	}
+	secretPaths := append([]string{}, opts.SecretPaths...)
+	for _, p := range strings.Split(string(kvs[MetaSecretPathsKey]), "\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			secretPaths = append(secretPaths, p)
+		}
+	}
+	isSecret := func(k string, v []byte) bool {
+		if IsEncryptedKey(k) || encryptedValue.Match(v) {
+			return true
+		}
+		for _, pattern := range secretPaths {
+			if matched, _ := path.Match(pattern, k); matched {
+				return true
+			}
+		}
+		return false
+	}
+
+	var keys []string
+	for k := range kvs {
+		if !IsMetaKey(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	name := K8sName(appID)
+	annotations := make(map[string]string)
+	if commit := string(kvs[MetaCommitKey]); commit != "" {
+		annotations[K8sCommitAnnotation] = commit
+	}
+	if hash := string(kvs[MetaHashKey]); hash != "" {
+		annotations[K8sHashAnnotation] = hash
+	}
+	newObject := func(kind string) *k8sObject {
+		return &k8sObject{
+			APIVersion: "v1",
+			Kind:       kind,
+			Metadata: k8sMetadata{
+				Name:      name,
+				Namespace: opts.Namespace,
+				Labels:    map[string]string{"app.kubernetes.io/name": name, "app.kubernetes.io/managed-by": "eos-conf"},
+			},
+		}
+	}
+	configMap := newObject("ConfigMap")
+	secret := newObject("Secret")
+	secret.Type = "Opaque"
+
+	// ConfigMap & Secret keys share one namespace so volumes of both can be merged
+	used := make(map[string]bool)
+	renamed := map[string]map[string]string{"ConfigMap": {}, "Secret": {}}
+	for _, k := range keys {
+		v := kvs[k]
+		ck := K8sKey(k)
+		if used[ck] {
+			if len(ck) > k8sMaxName-9 {
+				ck = ck[:k8sMaxName-9]
+			}
+			ck = hashedK8sKey(ck, k)
+		}
+		used[ck] = true
+
+		obj := configMap
+		switch {
+		case isSecret(k, v):
+			obj = secret
+			if obj.Data == nil {
+				obj.Data = make(map[string]string)
+			}
+			obj.Data[ck] = base64.StdEncoding.EncodeToString(v)
+		case isBinary(v):
+			if obj.BinaryData == nil {
+				obj.BinaryData = make(map[string]string)
+			}
+			obj.BinaryData[ck] = base64.StdEncoding.EncodeToString(v)
+		default:
+			if obj.Data == nil {
+				obj.Data = make(map[string]string)
+			}
+			obj.Data[ck] = string(v)
+		}
+		if ck != k {
+			renamed[obj.Kind][ck] = k
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, obj := range []*k8sObject{configMap, secret} {
+		if obj == secret && len(secret.Data) == 0 {
+			continue
+		}
+		obj.Metadata.Annotations = make(map[string]string)
+		for k, v := range annotations {
+			obj.Metadata.Annotations[k] = v
+		}
+		if len(renamed[obj.Kind]) > 0 {
+			paths, err := json.Marshal(renamed[obj.Kind])
+			if err != nil {
+				return nil, err
+			}
+			obj.Metadata.Annotations[K8sPathsAnnotation] = string(paths)
+		}
+		if len(obj.Metadata.Annotations) == 0 {
+			obj.Metadata.Annotations = nil
+		}
+
+		out, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString("---\n")
+		buf.Write(out)
+	}
+	return buf.Bytes(), nil
+}
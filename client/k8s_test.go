@@ -0,0 +1,87 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestK8sNames(t *testing.T) {
+	if name := K8sName("Web_4096@eu"); name != "web-4096-eu" {
+		t.Fatalf("unexpected name %s", name)
+	}
+	if key := K8sKey("etc/nginx/site a.conf"); key != "etc_nginx_site_a.conf" {
+		t.Fatalf("unexpected key %s", key)
+	}
+	if key := K8sKey(strings.Repeat("a/", 200)); len(key) != k8sMaxName {
+		t.Fatalf("expected long key to be hashed, got %s", key)
+	}
+	if QuoteGlob("a[1]/*.conf") != `a\[1]/\*.conf` {
+		t.Fatalf("unexpected quoted glob %s", QuoteGlob("a[1]/*.conf"))
+	}
+}
+
+func TestExportK8s(t *testing.T) {
+	kvs := map[string][]byte{
+		MetaCommitKey:      []byte("abc123"),
+		MetaSecretPathsKey: []byte("secrets/*\ndb\\[1].yml"),
+		"etc/app.conf":     []byte("port: 80\nhost: a\n"),
+		"etc_app.conf":     []byte("clash"),
+		"logo.png":         {0x89, 'P', 'N', 'G', 0x00},
+		"secrets/api.key":  []byte("s3cr3t"),
+		"db[1].yml":        []byte("password: x"),
+		"tls.pem.age":      []byte("ciphertext"),
+	}
+	out, err := ExportK8s("web", kvs, &K8sOptions{Namespace: "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var objs []k8sObject
+	for _, doc := range bytes.Split(out, []byte("---\n")) {
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		var obj k8sObject
+		if err := yaml.Unmarshal(doc, &obj); err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, obj)
+	}
+	if len(objs) != 2 || objs[0].Kind != "ConfigMap" || objs[1].Kind != "Secret" {
+		t.Fatalf("expected a ConfigMap and a Secret, got %s", out)
+	}
+
+	cm, secret := objs[0], objs[1]
+	if cm.Metadata.Name != "web" || cm.Metadata.Namespace != "prod" || cm.Metadata.Annotations[K8sCommitAnnotation] != "abc123" {
+		t.Fatalf("unexpected metadata %v", cm.Metadata)
+	}
+	if cm.Data["etc_app.conf"] != "port: 80\nhost: a\n" || len(cm.Data) != 2 {
+		t.Fatalf("unexpected data %v", cm.Data)
+	}
+	if v, _ := base64.StdEncoding.DecodeString(cm.BinaryData["logo.png"]); !bytes.Equal(v, kvs["logo.png"]) {
+		t.Fatalf("unexpected binary data %v", cm.BinaryData)
+	}
+	if !strings.Contains(cm.Metadata.Annotations[K8sPathsAnnotation], `"etc_app.conf":"etc/app.conf"`) {
+		t.Fatalf("expected renamed key in annotation, got %v", cm.Metadata.Annotations)
+	}
+
+	if len(secret.Data) != 3 || secret.Type != "Opaque" {
+		t.Fatalf("unexpected secret data %v", secret.Data)
+	}
+	if v, _ := base64.StdEncoding.DecodeString(secret.Data["secrets_api.key"]); string(v) != "s3cr3t" {
+		t.Fatalf("unexpected secret value %s", v)
+	}
+	if _, ok := secret.Data["tls.pem.age"]; !ok {
+		t.Fatal("expected encrypted file in secret")
+	}
+
+	// no Secret without secret keys
+	out, _ = ExportK8s("web", map[string][]byte{"a.conf": []byte("a")}, nil)
+	if bytes.Contains(out, []byte("kind: Secret")) {
+		t.Fatalf("unexpected secret %s", out)
+	}
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// DefaultOverrideKeyPrefix is key prefix for per node overrides(<prefix>/<node or group>/<appID>)
+	DefaultOverrideKeyPrefix = "config/override"
+
+	// derivedAppSeparator separates app & target in ids of apps derived for overrides
+	derivedAppSeparator = "@"
+)
+
+// ErrUnsignedOverride is returned for an override of keys when snapshots are required to be signed
+var ErrUnsignedOverride = errors.New("override keys are not signed, refused when a key ring is configured")
+
+// Override redirects a node or node group to another app snapshot and/or overrides keys
+// override keys are applied after verification and are not covered by snapshot signatures,
+// so they are refused by clients with a key ring; redirects are verified as the snapshot of App
+type Override struct {
+	App  string            `json:"app,omitempty"`
+	Keys map[string]string `json:"keys,omitempty"`
+}
+
+// OverrideKey returns the key holding override of an app for a node or node group
+func OverrideKey(prefix, target, appID string) string {
+	return strings.TrimSuffix(prefix, "/") + "/" + target + "/" + appID
+}
+
+// DerivedAppID returns id of the app deployed for an override pinning a branch or rev
+func DerivedAppID(appID, target string) string {
+	return appID + derivedAppSeparator + target
+}
+
+// IsDerivedApp checks whether an app only exists as an override target
+func IsDerivedApp(appID string) bool {
+	return strings.Contains(appID, derivedAppSeparator)
+}
+
+// ParseOverride decodes an override entry
+func ParseOverride(data []byte) (*Override, error) {
+	o := &Override{}
+	if err := json.Unmarshal(data, o); err != nil {
+		return nil, err
+	}
+	for k := range o.Keys {
+		if IsMetaKey(k) {
+			return nil, fmt.Errorf("override of meta key(%s)", k)
+		}
+	}
+	return o, nil
+}
+
+// check refuses override keys a key ring can't verify
+func (c *Client) checkOverride(o *Override) error {
+	if c.keyRing != nil && len(o.Keys) > 0 {
+		return ErrUnsignedOverride
+	}
+	return nil
+}
+
+// apply sets override keys on a verified snapshot
+func (o *Override) apply(s *Snapshot) {
+	for k, v := range o.Keys {
+		s.KVs[k] = []byte(v)
+	}
+	s.Override = o
+}
+
+// ResolveOverride returns override of the node, or else of the first node group having one
+// returns nil when no override applies
+func (c *Client) ResolveOverride(appID string) (*Override, error) {
+	var targets []string
+	if c.node != "" {
+		targets = append(targets, c.node)
+	}
+	targets = append(targets, c.groups...)
+
+	for _, target := range targets {
+		pair, _, err := c.kv.Get(OverrideKey(c.overrideKeyPrefix, target, appID), nil)
+		if err != nil {
+			return nil, err
+		}
+		if pair == nil {
+			continue
+		}
+		o, err := ParseOverride(pair.Value)
+		if err != nil {
+			return nil, fmt.Errorf("override(%s): %v", pair.Key, err)
+		}
+		return o, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestOverride(t *testing.T) {
+	o, err := ParseOverride([]byte(`{"app": "web@edge", "keys": {"conf/a.conf": "pinned"}}`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	s := &Snapshot{
+		AppID:  "web",
+		Source: o.App,
+		KVs: map[string][]byte{
+			"conf/a.conf": []byte("a"),
+			"conf/b.conf": []byte("b"),
+		},
+	}
+	o.apply(s)
+	if string(s.KVs["conf/a.conf"]) != "pinned" || string(s.KVs["conf/b.conf"]) != "b" || s.Override != o {
+		t.Fatalf("override not applied(%v)", s.KVs)
+	}
+
+	pub, _, _ := ed25519.GenerateKey(nil)
+	c := &Client{keyRing: NewKeyRing(pub)}
+	if err := c.checkOverride(o); err != ErrUnsignedOverride {
+		t.Fatalf("expected unsigned keys refused with a key ring, got %v", err)
+	}
+	if err := c.checkOverride(&Override{App: "web@edge"}); err != nil {
+		t.Fatalf("redirect should be allowed: %v", err)
+	}
+	if err := (&Client{}).checkOverride(o); err != nil {
+		t.Fatalf("keys should be allowed without a key ring: %v", err)
+	}
+
+	if _, err := ParseOverride([]byte(`{"keys": {"` + MetaCommitKey + `": "x"}}`)); err == nil {
+		t.Fatalf("overriding meta keys should fail")
+	}
+
+	if id := DerivedAppID("web", "edge"); id != "web@edge" || !IsDerivedApp(id) || IsDerivedApp("web") {
+		t.Fatalf("unexpected derived app id(%s)", id)
+	}
+}
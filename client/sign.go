@@ -0,0 +1,181 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	// MetaSignatureKey holds base64 ed25519 signature of snapshot metadata
+	MetaSignatureKey = MetaKeyPrefix + "signature"
+	// MetaKeyIDKey holds id of the key used for signing
+	MetaKeyIDKey = MetaKeyPrefix + "key_id"
+
+	// signature context, bumped when signed payload format changes
+	signContext = "eos-conf-snapshot-v1"
+)
+
+var (
+	// ErrSignatureMissing is returned when a snapshot is not signed
+	ErrSignatureMissing = errors.New("snapshot signature missing")
+	// ErrUnknownKey is returned when a snapshot is signed by an untrusted key
+	ErrUnknownKey = errors.New("snapshot signed by untrusted key")
+	// ErrBadSignature is returned when a snapshot signature doesn't verify
+	ErrBadSignature = errors.New("snapshot signature invalid")
+)
+
+// KeyID derives key id from a public key
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// signedPayload serializes app id & metadata(signature excluded) deterministically
+// snapshot contents are covered through _meta/hash
+func signedPayload(appID string, kvs map[string][]byte) []byte {
+	var keys []string
+	for k := range kvs {
+		if IsMetaKey(k) && k != MetaSignatureKey {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteString(signContext)
+	buf.WriteByte(0)
+	buf.WriteString(appID)
+	buf.WriteByte(0)
+	for _, k := range keys {
+		buf.WriteString(k)
+		buf.WriteByte(0)
+		buf.Write(kvs[k])
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// Signer signs snapshots on master
+type Signer struct {
+	keyID string
+	key   ed25519.PrivateKey
+}
+
+// NewSigner creates a new Signer
+func NewSigner(key ed25519.PrivateKey) *Signer {
+	return &Signer{
+		keyID: KeyID(key.Public().(ed25519.PublicKey)),
+		key:   key,
+	}
+}
+
+// LoadSigner loads a base64 encoded ed25519 seed or private key from file
+func LoadSigner(path string) (*Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("signing key(%s): %v", path, err)
+	}
+
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return NewSigner(ed25519.NewKeyFromSeed(raw)), nil
+	case ed25519.PrivateKeySize:
+		return NewSigner(ed25519.PrivateKey(raw)), nil
+	default:
+		return nil, fmt.Errorf("signing key(%s): invalid key size(%d)", path, len(raw))
+	}
+}
+
+// KeyID returns id of the signing key
+func (s *Signer) KeyID() string {
+	return s.keyID
+}
+
+// Sign writes _meta/key_id & _meta/signature into snapshot
+// must be called after every other metadata key is set
+func (s *Signer) Sign(appID string, kvs map[string][]byte) {
+	kvs[MetaKeyIDKey] = []byte(s.keyID)
+	sig := ed25519.Sign(s.key, signedPayload(appID, kvs))
+	kvs[MetaSignatureKey] = []byte(base64.StdEncoding.EncodeToString(sig))
+}
+
+// KeyRing is a set of trusted public keys
+// several keys may be trusted at once while rotating
+type KeyRing struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// NewKeyRing creates a KeyRing with given public keys
+func NewKeyRing(pubs ...ed25519.PublicKey) *KeyRing {
+	k := &KeyRing{keys: make(map[string]ed25519.PublicKey)}
+	for _, pub := range pubs {
+		k.keys[KeyID(pub)] = pub
+	}
+	return k
+}
+
+// LoadKeyRing loads base64 encoded public keys, one per line
+func LoadKeyRing(path string) (*KeyRing, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pubs []ed25519.PublicKey
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("trusted keys(%s): invalid key(%s)", path, line)
+		}
+		pubs = append(pubs, ed25519.PublicKey(raw))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(pubs) == 0 {
+		return nil, fmt.Errorf("trusted keys(%s): no key found", path)
+	}
+	return NewKeyRing(pubs...), nil
+}
+
+// Verify checks snapshot signature against trusted keys
+func (k *KeyRing) Verify(appID string, kvs map[string][]byte) error {
+	sig64, ok := kvs[MetaSignatureKey]
+	if !ok || len(sig64) == 0 {
+		return ErrSignatureMissing
+	}
+
+	pub, ok := k.keys[string(kvs[MetaKeyIDKey])]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(string(sig64))
+	if err != nil {
+		return ErrBadSignature
+	}
+	if !ed25519.Verify(pub, signedPayload(appID, kvs), sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
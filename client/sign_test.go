@@ -0,0 +1,66 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+func makeSignedSnapshot(t *testing.T, signer *Signer) map[string][]byte {
+	kvs := map[string][]byte{
+		"etc/a.conf":  []byte("a=1"),
+		MetaCommitKey: []byte("e491da11fa3ffc9eb80a58374cb99365c1f1aef8"),
+	}
+	kvs[MetaHashKey] = []byte(SnapshotHash(kvs))
+	signer.Sign("web2048", kvs)
+	return kvs
+}
+
+func TestSignVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	signer := NewSigner(priv)
+	ring := NewKeyRing(pub)
+
+	kvs := makeSignedSnapshot(t, signer)
+	if err := ring.Verify("web2048", kvs); err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+
+	// replaying snapshot of another app
+	if err := ring.Verify("web4096", kvs); err != ErrBadSignature {
+		t.Fatalf("expected ErrBadSignature got(%v)", err)
+	}
+
+	// tampered metadata
+	kvs[MetaCommitKey] = []byte("0000000000000000000000000000000000000000")
+	if err := ring.Verify("web2048", kvs); err != ErrBadSignature {
+		t.Fatalf("expected ErrBadSignature got(%v)", err)
+	}
+
+	delete(kvs, MetaSignatureKey)
+	if err := ring.Verify("web2048", kvs); err != ErrSignatureMissing {
+		t.Fatalf("expected ErrSignatureMissing got(%v)", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldPub, oldPriv, _ := ed25519.GenerateKey(nil)
+	newPub, newPriv, _ := ed25519.GenerateKey(nil)
+	_, rogue, _ := ed25519.GenerateKey(nil)
+
+	ring := NewKeyRing(oldPub, newPub)
+
+	for _, priv := range []ed25519.PrivateKey{oldPriv, newPriv} {
+		kvs := makeSignedSnapshot(t, NewSigner(priv))
+		if err := ring.Verify("web2048", kvs); err != nil {
+			t.Fatalf("verify failed: %v", err)
+		}
+	}
+
+	kvs := makeSignedSnapshot(t, NewSigner(rogue))
+	if err := ring.Verify("web2048", kvs); err != ErrUnknownKey {
+		t.Fatalf("expected ErrUnknownKey got(%v)", err)
+	}
+}
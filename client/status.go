@@ -0,0 +1,87 @@
+package client
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultStatusKeyPrefix is key prefix slaves report applied state on(<prefix>/<appID>/<node>)
+// entries are held by a session of the agent, so they vanish when the node dies
+const DefaultStatusKeyPrefix = "config/status"
+
+// AppliedStatus is the state of an app on a node as reported by its slave agent
+// Commit is the last commit applied, Error & FailedCommit the last failure, cleared once a commit applies
+type AppliedStatus struct {
+	Node         string    `json:"node"`
+	Commit       string    `json:"commit,omitempty"`
+	AppliedAt    time.Time `json:"applied_at"`
+	Error        string    `json:"error,omitempty"`
+	FailedCommit string    `json:"failed_commit,omitempty"`
+	Version      string    `json:"version"`
+	Time         time.Time `json:"time"`
+}
+
+// StatusKey returns the key a node reports state of an app on
+func StatusKey(prefix, appID, node string) string {
+	return strings.TrimSuffix(prefix, "/") + "/" + appID + "/" + node
+}
+
+// ParseAppliedStatus decodes a status entry
+func ParseAppliedStatus(data []byte) (*AppliedStatus, error) {
+	s := &AppliedStatus{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// FleetStatus aggregates applied state of an app over the nodes running slave agents
+type FleetStatus struct {
+	App string `json:"app"`
+	// commit deployed by the master
+	Commit string `json:"commit"`
+	Nodes  int    `json:"nodes"`
+	// number of nodes per commit applied
+	Commits map[string]int `json:"commits"`
+	// nodes on another commit than deployed, failing nodes
+	Stragglers []*AppliedStatus `json:"stragglers"`
+	Failures   []*AppliedStatus `json:"failures"`
+	// nodes running slave agents without status of the app
+	Missing []string `json:"missing"`
+}
+
+// SummarizeFleet aggregates statuses reported for an app deployed at commit
+// nodes lists nodes running slave agents, nodes reporting are counted whether listed or not
+func SummarizeFleet(appID, commit string, statuses []*AppliedStatus, nodes []string) *FleetStatus {
+	f := &FleetStatus{
+		App:        appID,
+		Commit:     commit,
+		Commits:    make(map[string]int),
+		Stragglers: []*AppliedStatus{},
+		Failures:   []*AppliedStatus{},
+		Missing:    []string{},
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Node < statuses[j].Node })
+	reported := make(map[string]bool)
+	for _, s := range statuses {
+		reported[s.Node] = true
+		f.Commits[s.Commit]++
+		if s.Error != "" {
+			f.Failures = append(f.Failures, s)
+		}
+		if s.Commit != commit {
+			f.Stragglers = append(f.Stragglers, s)
+		}
+	}
+	for _, node := range nodes {
+		if !reported[node] {
+			f.Missing = append(f.Missing, node)
+		}
+	}
+	sort.Strings(f.Missing)
+	f.Nodes = len(statuses) + len(f.Missing)
+	return f
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSummarizeFleet(t *testing.T) {
+	statuses := []*AppliedStatus{
+		{Node: "n3", Commit: "def", Error: "health check failed", FailedCommit: "def"},
+		{Node: "n1", Commit: "abc"},
+		{Node: "n2", Commit: "abc"},
+		{Node: "n4", Error: "bad signature", FailedCommit: "abc"},
+	}
+	f := SummarizeFleet("web", "abc", statuses, []string{"n1", "n2", "n3", "n4", "n5"})
+
+	if f.Nodes != 5 || !reflect.DeepEqual(f.Commits, map[string]int{"abc": 2, "def": 1, "": 1}) {
+		t.Fatalf("unexpected fleet %+v", f)
+	}
+	if len(f.Stragglers) != 2 || f.Stragglers[0].Node != "n3" || f.Stragglers[1].Node != "n4" {
+		t.Fatalf("unexpected stragglers %v", f.Stragglers)
+	}
+	if len(f.Failures) != 2 || f.Failures[0].Node != "n3" || f.Failures[1].FailedCommit != "abc" {
+		t.Fatalf("unexpected failures %v", f.Failures)
+	}
+	if !reflect.DeepEqual(f.Missing, []string{"n5"}) {
+		t.Fatalf("unexpected missing %v", f.Missing)
+	}
+
+	// a node reporting without being registered is still counted
+	f = SummarizeFleet("web", "abc", []*AppliedStatus{{Node: "n9", Commit: "abc"}}, nil)
+	if f.Nodes != 1 || len(f.Stragglers) != 0 || len(f.Missing) != 0 {
+		t.Fatalf("unexpected fleet %+v", f)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	git "github.com/libgit2/git2go"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// SignaturesOff deploys commits regardless of signatures (default)
+	SignaturesOff = "off"
+	// SignaturesRequired refuses commits not signed by a trusted key
+	SignaturesRequired = "required"
+
+	// allowedSignersFile lists trusted ssh keys in authorized_keys format
+	allowedSignersFile = "allowed_signers"
+
+	pgpSignatureBegin = "-----BEGIN PGP SIGNATURE-----"
+	sshSignatureBegin = "-----BEGIN SSH SIGNATURE-----"
+	sshSignatureEnd   = "-----END SSH SIGNATURE-----"
+	sshSigMagic       = "SSHSIG"
+	sshSigNamespace   = "git"
+)
+
+var (
+	// ErrNotSigned is returned for unsigned commits or tags
+	ErrNotSigned = errors.New("object is not signed")
+	// ErrUntrustedSignature is returned when no trusted key verifies a signature
+	ErrUntrustedSignature = errors.New("signature is not made by a trusted key")
+)
+
+// CommitVerifier verifies OpenPGP & SSH signatures of commits and tags
+type CommitVerifier struct {
+	pgpKeys openpgp.EntityList
+	sshKeys []ssh.PublicKey
+}
+
+// LoadCommitVerifier loads trusted keys from a directory
+// *.asc files hold armored OpenPGP public keys, allowed_signers holds ssh keys
+func LoadCommitVerifier(dir string) (*CommitVerifier, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &CommitVerifier{}
+	for _, fi := range files {
+		p := path.Join(dir, fi.Name())
+		switch {
+		case strings.HasSuffix(fi.Name(), ".asc"):
+			f, err := os.Open(p)
+			if err != nil {
+				return nil, err
+			}
+			keys, err := openpgp.ReadArmoredKeyRing(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("pgp keyring(%s): %v", p, err)
+			}
+			v.pgpKeys = append(v.pgpKeys, keys...)
+		case fi.Name() == allowedSignersFile:
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return nil, err
+			}
+			for len(bytes.TrimSpace(data)) > 0 {
+				var pub ssh.PublicKey
+				pub, _, _, data, err = ssh.ParseAuthorizedKey(data)
+				if err != nil {
+					return nil, fmt.Errorf("allowed signers(%s): %v", p, err)
+				}
+				v.sshKeys = append(v.sshKeys, pub)
+			}
+		}
+	}
+
+	if len(v.pgpKeys) == 0 && len(v.sshKeys) == 0 {
+		return nil, fmt.Errorf("no trusted signer found in(%s)", dir)
+	}
+	return v, nil
+}
+
+// splitCommitSignature extracts gpgsig header from a raw commit object
+// returns the signed payload (commit without the header) and the signature
+func splitCommitSignature(raw []byte) ([]byte, []byte) {
+	var payload, sig bytes.Buffer
+	inSig := false
+	inHeader := true
+
+	lines := bytes.SplitAfter(raw, []byte("\n"))
+	for _, line := range lines {
+		if inHeader {
+			if inSig && bytes.HasPrefix(line, []byte(" ")) {
+				sig.Write(line[1:])
+				continue
+			}
+			inSig = false
+			if bytes.HasPrefix(line, []byte("gpgsig ")) {
+				inSig = true
+				sig.Write(line[len("gpgsig "):])
+				continue
+			}
+			if len(bytes.TrimRight(line, "\n")) == 0 {
+				inHeader = false
+			}
+		}
+		payload.Write(line)
+	}
+	return payload.Bytes(), sig.Bytes()
+}
+
+// splitTagSignature extracts the signature appended to a raw tag object
+func splitTagSignature(raw []byte) ([]byte, []byte) {
+	for _, begin := range []string{pgpSignatureBegin, sshSignatureBegin} {
+		if ix := bytes.LastIndex(raw, []byte(begin)); ix >= 0 {
+			return raw[:ix], raw[ix:]
+		}
+	}
+	return raw, nil
+}
+
+// Verify checks signature over payload against trusted keys
+func (v *CommitVerifier) Verify(payload []byte, sig []byte) error {
+	sig = bytes.TrimSpace(sig)
+	switch {
+	case len(sig) == 0:
+		return ErrNotSigned
+	case bytes.HasPrefix(sig, []byte(pgpSignatureBegin)):
+		if len(v.pgpKeys) == 0 {
+			return ErrUntrustedSignature
+		}
+		_, err := openpgp.CheckArmoredDetachedSignature(v.pgpKeys, bytes.NewReader(payload), bytes.NewReader(sig), nil)
+		if err != nil {
+			return ErrUntrustedSignature
+		}
+		return nil
+	case bytes.HasPrefix(sig, []byte(sshSignatureBegin)):
+		return v.verifySSH(payload, sig)
+	default:
+		return fmt.Errorf("unsupported signature format")
+	}
+}
+
+// sshSigBlob is the wire format of an armored ssh signature (PROTOCOL.sshsig)
+type sshSigBlob struct {
+	Magic         [6]byte
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      []byte
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// sshSigSigned is the data actually signed by ssh-keygen -Y sign
+type sshSigSigned struct {
+	Magic         [6]byte
+	Namespace     string
+	Reserved      []byte
+	HashAlgorithm string
+	Hash          []byte
+}
+
+// verifySSH verifies an armored ssh signature made with namespace "git"
+func (v *CommitVerifier) verifySSH(payload []byte, armored []byte) error {
+	body := bytes.TrimPrefix(armored, []byte(sshSignatureBegin))
+	if ix := bytes.Index(body, []byte(sshSignatureEnd)); ix >= 0 {
+		body = body[:ix]
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	if err != nil {
+		return fmt.Errorf("invalid ssh signature: %v", err)
+	}
+
+	var blob sshSigBlob
+	if err := ssh.Unmarshal(raw, &blob); err != nil {
+		return fmt.Errorf("invalid ssh signature: %v", err)
+	}
+	if string(blob.Magic[:]) != sshSigMagic || blob.Namespace != sshSigNamespace {
+		return fmt.Errorf("invalid ssh signature namespace(%s)", blob.Namespace)
+	}
+
+	pub, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return err
+	}
+	if !v.trustsSSHKey(pub) {
+		return ErrUntrustedSignature
+	}
+
+	var h hash.Hash
+	switch blob.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported ssh signature hash(%s)", blob.HashAlgorithm)
+	}
+	h.Write(payload)
+
+	signed := sshSigSigned{
+		Namespace:     blob.Namespace,
+		Reserved:      blob.Reserved,
+		HashAlgorithm: blob.HashAlgorithm,
+		Hash:          h.Sum(nil),
+	}
+	copy(signed.Magic[:], sshSigMagic)
+
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(blob.Signature, &sig); err != nil {
+		return fmt.Errorf("invalid ssh signature: %v", err)
+	}
+	if err := pub.Verify(ssh.Marshal(signed), &sig); err != nil {
+		return ErrUntrustedSignature
+	}
+	return nil
+}
+
+func (v *CommitVerifier) trustsSSHKey(pub ssh.PublicKey) bool {
+	for _, k := range v.sshKeys {
+		if bytes.Equal(k.Marshal(), pub.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// readRawObject reads raw contents of a git object
+func (r *Repo) readRawObject(oid *git.Oid) ([]byte, git.ObjectType, error) {
+	odb, err := r.repo.Odb()
+	if err != nil {
+		return nil, git.ObjectAny, err
+	}
+	defer odb.Free()
+
+	obj, err := odb.Read(oid)
+	if err != nil {
+		return nil, git.ObjectAny, err
+	}
+	defer obj.Free()
+
+	data := make([]byte, len(obj.Data()))
+	copy(data, obj.Data())
+	return data, obj.Type(), nil
+}
+
+// VerifyCommitSignature checks signature of a commit
+func (r *Repo) VerifyCommitSignature(commit string, v *CommitVerifier) error {
+	oid, err := git.NewOid(commit)
+	if err != nil {
+		return err
+	}
+
+	raw, t, err := r.readRawObject(oid)
+	if err != nil {
+		return err
+	}
+	if t != git.ObjectCommit {
+		return fmt.Errorf("object(%s) is not a commit", commit)
+	}
+
+	payload, sig := splitCommitSignature(raw)
+	return v.Verify(payload, sig)
+}
+
+// VerifyTagSignature checks signature of an annotated tag
+func (r *Repo) VerifyTagSignature(tagName string, v *CommitVerifier) error {
+	ref, err := r.repo.References.Lookup(fmt.Sprintf("refs/tags/%s", tagName))
+	if err != nil {
+		return err
+	}
+	defer ref.Free()
+
+	raw, t, err := r.readRawObject(ref.Target())
+	if err != nil {
+		return err
+	}
+	if t != git.ObjectTag {
+		// lightweight tags can't carry a signature
+		return ErrNotSigned
+	}
+
+	payload, sig := splitTagSignature(raw)
+	return v.Verify(payload, sig)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshSign makes an armored ssh signature the way `ssh-keygen -Y sign -n git` does
+func sshSign(t *testing.T, signer ssh.Signer, payload []byte) []byte {
+	h := sha512.Sum512(payload)
+	signed := sshSigSigned{
+		Namespace:     sshSigNamespace,
+		HashAlgorithm: "sha512",
+		Hash:          h[:],
+	}
+	copy(signed.Magic[:], sshSigMagic)
+
+	sig, err := signer.Sign(nil, ssh.Marshal(signed))
+	checkFatal(t, err)
+
+	blob := sshSigBlob{
+		Version:       1,
+		PublicKey:     signer.PublicKey().Marshal(),
+		Namespace:     sshSigNamespace,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(sig),
+	}
+	copy(blob.Magic[:], sshSigMagic)
+
+	var buf bytes.Buffer
+	buf.WriteString(sshSignatureBegin + "\n")
+	buf.WriteString(base64.StdEncoding.EncodeToString(ssh.Marshal(blob)) + "\n")
+	buf.WriteString(sshSignatureEnd + "\n")
+	return buf.Bytes()
+}
+
+// makeSignedCommit composes a raw commit object with a gpgsig header
+func makeSignedCommit(payloadHeader, message string, sig []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(payloadHeader)
+	lines := bytes.Split(bytes.TrimRight(sig, "\n"), []byte("\n"))
+	buf.WriteString("gpgsig " + string(lines[0]) + "\n")
+	for _, l := range lines[1:] {
+		buf.WriteString(" " + string(l) + "\n")
+	}
+	buf.WriteString("\n" + message)
+	return buf.Bytes()
+}
+
+func TestCommitSignatureSSH(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	checkFatal(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	checkFatal(t, err)
+
+	_, rogue, err := ed25519.GenerateKey(nil)
+	checkFatal(t, err)
+	rogueSigner, err := ssh.NewSignerFromKey(rogue)
+	checkFatal(t, err)
+
+	v := &CommitVerifier{sshKeys: []ssh.PublicKey{signer.PublicKey()}}
+
+	header := "tree 3683f870be446c7cc05ffaef9fa06415276e1828\n" +
+		"author T <t@example.com> 1792383501 +0000\n" +
+		"committer T <t@example.com> 1792383501 +0000\n"
+	message := "update config\n"
+	unsigned := []byte(header + "\n" + message)
+
+	raw := makeSignedCommit(header, message, sshSign(t, signer, unsigned))
+	payload, sig := splitCommitSignature(raw)
+	if !bytes.Equal(payload, unsigned) {
+		t.Fatalf("unexpected payload(%s)", payload)
+	}
+	if err := v.Verify(payload, sig); err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+
+	// tampered message
+	raw = makeSignedCommit(header, "evil\n", sshSign(t, signer, unsigned))
+	payload, sig = splitCommitSignature(raw)
+	if err := v.Verify(payload, sig); err != ErrUntrustedSignature {
+		t.Fatalf("expected ErrUntrustedSignature got(%v)", err)
+	}
+
+	// untrusted key
+	raw = makeSignedCommit(header, message, sshSign(t, rogueSigner, unsigned))
+	payload, sig = splitCommitSignature(raw)
+	if err := v.Verify(payload, sig); err != ErrUntrustedSignature {
+		t.Fatalf("expected ErrUntrustedSignature got(%v)", err)
+	}
+
+	// unsigned
+	payload, sig = splitCommitSignature(unsigned)
+	if err := v.Verify(payload, sig); err != ErrNotSigned {
+		t.Fatalf("expected ErrNotSigned got(%v)", err)
+	}
+}
+
+func TestTagSignatureSSH(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	checkFatal(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	checkFatal(t, err)
+	v := &CommitVerifier{sshKeys: []ssh.PublicKey{signer.PublicKey()}}
+
+	payload := []byte("object 5a9dfb5c16aa3d4c96ae77b9bcebd7085885ffb1\ntype commit\ntag v1.2\n" +
+		"tagger T <t@example.com> 1792383501 +0000\n\nrelease v1.2\n")
+	raw := append(append([]byte{}, payload...), sshSign(t, signer, payload)...)
+
+	p, sig := splitTagSignature(raw)
+	if err := v.Verify(p, sig); err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/Sirupsen/logrus"
@@ -67,6 +68,10 @@ const (
 	DefaultGlobalConfigKeyPrefix = "config/global"
 	// DefaultAppConfigKeyPrefix is key prefix for app configuration
 	DefaultAppConfigKeyPrefix = "config/app"
+	// DefaultDeployKeyPrefix is key prefix for deploy status of apps
+	DefaultDeployKeyPrefix = "config/deploy"
+	// DefaultAckKeyPrefix is key prefix slaves ack applied commits on
+	DefaultAckKeyPrefix = "config/ack"
 	// DefaultConsulAddr specifies default consul host to contact
 	DefaultConsulAddr = "localhost:8500"
 	// DefaultCommitMonitorPeriod specifies montitor period in millisecond
@@ -80,6 +85,20 @@ const (
 	*/
 )
 
+// Version is the agent version reported by slaves, set at build time(-ldflags "-X main.Version=1.2.0")
+var Version = "dev"
+
+// splitList splits a comma separated list
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 // makeTempDir creates a temporary directory
 func makeTempDir(t *testing.T) string {
 	path, err := ioutil.TempDir("", "git2go")
@@ -1,18 +1,28 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"path"
 	"strings"
 	"time"
 
+	"bitbucket.org/cdnetworks/eos-conf/client"
 	lh "bitbucket.org/cdnetworks/eos-conf/leaderhandler"
+	"filippo.io/age"
 	"github.com/Sirupsen/logrus"
 )
 
 // LatestCommit macro
 const LatestCommit string = "latest"
 
+const (
+	// DecryptMaster pushes decrypted snapshots (default)
+	DecryptMaster = "master"
+	// DecryptSlave pushes ciphertext, slaves decrypt with a local identity
+	DecryptSlave = "slave"
+)
+
 // ConfFetcherConfig is
 type ConfFetcherConfig struct {
 	pathRoot      string
@@ -22,6 +32,30 @@ type ConfFetcherConfig struct {
 	monitorPeriod int
 	leaderC       chan lh.LeaderEvent
 	gitHTTPURL    string
+	nodeName      string
+	// datacenter of the master, selects overlays
+	datacenter string
+	// trusted signers for apps requiring signed commits
+	commitVerifier *CommitVerifier
+	// external validators by name
+	validatorCommands map[string]*ValidatorCommand
+	states            *appStates
+	// dump keys & sizes of snapshots only, detected secrets are masked otherwise
+	redactLogs bool
+	// identities for apps decrypted on master
+	ageIdentities []age.Identity
+	// staged rollouts, every commit is pushed at once when nil
+	rollouts *RolloutManager
+	// automatic rollback on slave health failures, disabled when nil
+	monitor *HealthMonitor
+	// freezes holding pushes, disabled when nil
+	freezes *FreezeManager
+	// approvals of apps requiring them, disabled when nil
+	approvals *ApprovalGate
+	// drift policies are set on it, disabled when nil
+	drift *DriftDetector
+	// rollbacks noted by confctl are checked against it, gated as config changes when nil
+	history *DeployHistory
 }
 
 // ConfFetcher get config from git
@@ -35,6 +69,20 @@ type ConfFetcher struct {
 	monitorPeriod time.Duration
 	leaderC       chan lh.LeaderEvent
 	gitHTTPURL    string
+	nodeName      string
+	datacenter    string
+
+	commitVerifier    *CommitVerifier
+	validatorCommands map[string]*ValidatorCommand
+	states            *appStates
+	redactLogs        bool
+	ageIdentities     []age.Identity
+	rollouts          *RolloutManager
+	monitor           *HealthMonitor
+	freezes           *FreezeManager
+	approvals         *ApprovalGate
+	drift             *DriftDetector
+	history           *DeployHistory
 }
 
 // ConfEvent is used to deliver configuration changes event
@@ -42,6 +90,8 @@ type ConfEvent struct {
 	evt        AppConfEvent
 	isMaster   bool
 	leaderNode string
+	// set to redeploy a good commit of the current configuration
+	rollback *rollbackRequest
 }
 
 // NewConfFetcher creates a new ConfFetcher
@@ -54,6 +104,11 @@ func NewConfFetcher(conf *ConfFetcherConfig) *ConfFetcher {
 
 	logEntry := configureLogger("fetcher")
 
+	states := conf.states
+	if states == nil {
+		states = newAppStates()
+	}
+
 	f := &ConfFetcher{
 		config:        conf,
 		repos:         make(map[string]*Repo),
@@ -64,6 +119,20 @@ func NewConfFetcher(conf *ConfFetcherConfig) *ConfFetcher {
 		monitorPeriod: time.Duration(monitorPeriod) * time.Millisecond,
 		leaderC:       conf.leaderC,
 		gitHTTPURL:    conf.gitHTTPURL,
+		nodeName:      conf.nodeName,
+		datacenter:    conf.datacenter,
+
+		commitVerifier:    conf.commitVerifier,
+		validatorCommands: conf.validatorCommands,
+		states:            states,
+		redactLogs:        conf.redactLogs,
+		ageIdentities:     conf.ageIdentities,
+		rollouts:          conf.rollouts,
+		monitor:           conf.monitor,
+		freezes:           conf.freezes,
+		approvals:         conf.approvals,
+		drift:             conf.drift,
+		history:           conf.history,
 	}
 	return f
 }
@@ -106,7 +175,7 @@ func (f *ConfFetcher) RemoveLocalRepo(repoID string) {
 	os.RemoveAll(path)
 }
 
-func (f *ConfFetcher) processEvent(id string, confEvt ConfEvent, commitCached string) (string, error) {
+func (f *ConfFetcher) processEvent(id string, confEvt ConfEvent, commitCached string, trigger string) (string, error) {
 	repo := f.repos[id]
 
 	var commit string
@@ -126,6 +195,11 @@ func (f *ConfFetcher) processEvent(id string, confEvt ConfEvent, commitCached st
 		}
 	}
 
+	repo.SetSnapshotOptions(evt.snapshotOptions())
+	if f.drift != nil {
+		f.drift.setPolicy(evt.ID, evt.Drift)
+	}
+
 	// fetching repo
 	err = repo.Fetch()
 	if err != nil {
@@ -156,35 +230,387 @@ func (f *ConfFetcher) processEvent(id string, confEvt ConfEvent, commitCached st
 		}
 	}
 
+	// rev changed by confctl(rollback, promote) is deployed with the trigger noted along
+	var reason string
+	if trigger == TriggerConfig && evt.Change != "" {
+		note, err := client.ParseChangeNote([]byte(evt.Change))
+		if err != nil {
+			f.log.Errorf("Invalid change note of app(%s): %v", evt.ID, err)
+		} else if note.Rev == evt.Rev {
+			trigger = note.Trigger
+			reason = strings.TrimSpace(note.Reason + " by " + note.Actor)
+		}
+	}
+	// anyone writing config/global may note a rollback, which skips approval & freezes,
+	// so only a commit deployed before is rolled back to
+	if trigger == TriggerRollback && !f.deployedBefore(evt.ID, commit) {
+		f.log.Errorf("Rollback of app(%s) to commit(%s) not deployed before, gated as a config change", evt.ID, commit)
+		trigger = TriggerConfig
+	}
+
+	// blocked commits are not redeployed until an operator unblocks them
+	if f.monitor != nil {
+		if why, blocked := f.monitor.blocked(evt.ID, commit); blocked {
+			f.log.Errorf("Skipped app(%s) blocked commit(%s): %s", evt.ID, commit, why)
+			status := newDeployStatus(evt.ID, commit, DeploySkipped, "commit blocked: "+why, f.nodeName)
+			status.Trigger = trigger
+			f.setStatus(status, nil)
+			return commit, nil
+		}
+	}
+
+	if err := f.deployCommit(repo, evt, commit, trigger, reason); err != nil {
+		return "", err
+	}
+	return commit, nil
+}
+
+// deployedBefore checks whether a commit is in deploy history of an app as deployed
+func (f *ConfFetcher) deployedBefore(appID, commit string) bool {
+	if f.history == nil {
+		return false
+	}
+	ok, err := f.history.deployed(appID, commit)
+	if err != nil {
+		f.log.Errorf("Failed to read history of app(%s): %v", appID, err)
+	}
+	return ok
+}
+
+// deployCommit verifies, renders & pushes a commit, reason is recorded in deploy status once pushed
+// refusing a commit is not an error, the last good snapshot is kept
+func (f *ConfFetcher) deployCommit(repo *Repo, evt AppConfEvent, commit string, trigger string, reason string) error {
+	// signature policy
+	if evt.Signatures == SignaturesRequired {
+		if err := f.verifySignature(repo, evt.AppConf, commit); err != nil {
+			f.refuse(evt.ID, commit, trigger, fmt.Sprintf("signature verification failed: %v", err))
+			return nil
+		}
+	}
+
 	f.log.Infof("Snapshotting repo(%s)", evt.ID)
 
 	snapshot, err := repo.GetSnapshot(commit)
 	if err != nil {
 		f.log.Errorf("Failed to get snapshot for commit(%s): %v", commit, err)
-		return "", err
+		return err
 	}
 
 	f.log.Infof("snapshot repo(%s) branch(%s) commit(%s)", evt.ID, repo.BranchName(), commit)
 
-	// dump snapshot
+	// overlays & variables
+	builtins := map[string]string{
+		"dc":     f.datacenter,
+		"app":    evt.ID,
+		"commit": commit,
+	}
+	rendered, err := renderSnapshot(evt.AppConf, *snapshot, evt.vars, builtins)
+	if err != nil {
+		f.refuse(evt.ID, commit, trigger, fmt.Sprintf("rendering failed: %v", err))
+		return nil
+	}
+	*snapshot = rendered
+
+	// decryption, ciphertext is pushed as is for apps decrypted on slaves
+	deployed := *snapshot
+	encrypted := client.HasEncrypted(*snapshot)
+	if encrypted && evt.Decrypt != DecryptSlave {
+		if len(f.ageIdentities) == 0 {
+			f.refuse(evt.ID, commit, trigger, "encrypted snapshot but no age identity configured")
+			return nil
+		}
+		deployed, err = client.DecryptSnapshot(*snapshot, f.ageIdentities)
+		if err != nil {
+			f.refuse(evt.ID, commit, trigger, err.Error())
+			return nil
+		}
+	}
+
+	// validation pipeline
+	var report *ValidationReport
+	if evt.Validate != ValidateOff {
+		pipeline, err := newValidationPipeline(evt.AppConf, commit, deployed, f.validatorCommands)
+		if err != nil {
+			f.refuse(evt.ID, commit, trigger, fmt.Sprintf("validation setup failed: %v", err))
+			return nil
+		}
+		report = pipeline.Run(commit, deployed)
+		f.states.update(evt.ID, func(st *AppState) {
+			st.Validation = report
+		})
+		if !report.Passed {
+			f.refuseWithReport(evt.ID, commit, trigger, "validation "+report.Summary(), report)
+			return nil
+		}
+	}
+
+	// secret scanning & dump see repo contents, never decrypted values
+	var findings []*SecretFinding
+	if evt.Secrets != SecretsOff {
+		findings = scanSecrets(*snapshot, parseSecretsAllow(evt.SecretsAllow))
+	}
+
+	if len(findings) > 0 {
+		if evt.Secrets == SecretsWarn {
+			f.log.Warnf("app(%s) commit(%s) contains secrets: %s", evt.ID, commit, secretsSummary(findings))
+		} else {
+			f.refuse(evt.ID, commit, trigger, "secrets detected: "+secretsSummary(findings))
+			return nil
+		}
+	}
+
+	// dump snapshot once accepted, secrets found are always masked
 	for k, v := range *snapshot {
-		f.log.Infof("k(%s) v(%s)", k, strings.TrimSpace(string(v)))
+		if f.redactLogs {
+			f.log.Infof("k(%s) size(%d)", k, len(v))
+		} else {
+			f.log.Infof("k(%s) v(%s)", k, strings.TrimSpace(redactSecrets(k, v, findings)))
+		}
+	}
+
+	info, err := repo.GetCommitInfo(commit)
+	if err != nil {
+		f.log.Errorf("Failed to get commit info for commit(%s): %v", commit, err)
+		return err
 	}
 
+	if encrypted && evt.Decrypt == DecryptSlave {
+		deployed[metaEncrypted] = []byte("true")
+	}
+	// keys decrypted here stay secret for exporters(Kubernetes Secrets)
+	secretPaths := splitList(evt.SecretPaths)
+	if encrypted && evt.Decrypt != DecryptSlave {
+		for _, k := range client.EncryptedKeys(*snapshot) {
+			secretPaths = append(secretPaths, client.QuoteGlob(k))
+		}
+	}
+	if len(secretPaths) > 0 {
+		deployed[metaSecretPaths] = []byte(strings.Join(secretPaths, "\n"))
+	}
+	snapshot = &deployed
+
 	// adding meta info
-	metaKey := "_meta/"
-	(*snapshot)[metaKey+"branch"] = []byte(evt.Branch)
-	(*snapshot)[metaKey+"rev"] = []byte(evt.Rev)
-	(*snapshot)[metaKey+"commit"] = []byte(commit)
-	(*snapshot)[metaKey+"repo"] = []byte(f.gitHTTPURL + "/" + evt.ID)
+	(*snapshot)[metaHash] = []byte(client.SnapshotHash(*snapshot))
+	(*snapshot)[metaBranch] = []byte(evt.Branch)
+	(*snapshot)[metaRev] = []byte(evt.Rev)
+	(*snapshot)[metaCommit] = []byte(commit)
+	(*snapshot)[metaRepo] = []byte(f.gitHTTPURL + "/" + evt.ID)
+	addCommitMeta(*snapshot, info, f.nodeName)
+	if report != nil {
+		(*snapshot)[metaValidation] = report.encode()
+	}
+	if evt.HealthCheck != "" {
+		(*snapshot)[metaHealthCheck] = []byte(evt.HealthCheck)
+		(*snapshot)[metaHealthTimeout] = []byte(evt.HealthTimeout)
+	}
+
+	// commits are parked until enough distinct approvers approve them, rollbacks go through
+	if f.approvals != nil && evt.Approval == ApprovalRequired && trigger != TriggerRollback {
+		required, err := requiredApprovers(evt.AppConf)
+		if err != nil {
+			f.refuse(evt.ID, commit, trigger, err.Error())
+			return nil
+		}
+		approvers := f.approvals.approvers(evt.ID, commit)
+		if len(approvers) < required {
+			f.park(evt.ID, commit, trigger, reason, required, approvers, rendered, *snapshot)
+			return nil
+		}
+		if reason != "" {
+			reason += "; "
+		}
+		reason += "approved by " + strings.Join(approvers, ",")
+	}
+
+	// freezes hold pushes, rollbacks & emergency deploys go through
+	if f.freezes != nil && trigger != TriggerRollback {
+		if why, frozen := f.freezes.frozen(evt.ID, time.Now()); frozen {
+			e := f.freezes.emergency(evt.ID, commit)
+			if e == nil {
+				f.hold(evt.ID, commit, trigger, reason, why)
+				return nil
+			}
+			f.freezes.consume(evt.ID)
+			f.log.Infof("Emergency deploy app(%s) commit(%s) by %s: %s", evt.ID, commit, e.Actor, e.Reason)
+			trigger = TriggerEmergency
+			reason = fmt.Sprintf("emergency deploy during %s, by %s: %s", why, e.Actor, e.Reason)
+		}
+	}
+	f.states.update(evt.ID, func(st *AppState) {
+		st.Pending = nil
+		st.Approval = nil
+	})
+	if f.approvals != nil && evt.Approval == ApprovalRequired {
+		f.approvals.expire(evt.ID, "")
+	}
+
+	// staged rollouts push through the rollout manager, rollbacks go to every node at once
+	if f.rollouts != nil && isStagedRollout(evt.Rollout) && trigger != TriggerRollback {
+		plan, err := newRolloutPlan(evt.AppConf)
+		if err != nil {
+			f.refuse(evt.ID, commit, trigger, fmt.Sprintf("rollout: %v", err))
+			return nil
+		}
+		f.rollouts.Start(evt.ID, commit, *snapshot, plan)
+		return nil
+	}
+	if f.rollouts != nil {
+		f.rollouts.Cancel(evt.ID)
+	}
 
 	// push snapshot to Consul KV
-	f.changes <- &ConfChange{
-		appID: evt.ID,
-		kvs:   snapshot,
+	status := newDeployStatus(evt.ID, commit, DeployDeployed, reason, f.nodeName)
+	status.Trigger = trigger
+	f.setStatus(status, snapshot)
+	if f.monitor != nil {
+		f.monitor.track(evt.ID, commit, evt.RollbackThreshold)
 	}
 
-	return commit, nil
+	return nil
+}
+
+// verifySignature checks signature of the commit, or of the annotated tag for tag revs
+func (f *ConfFetcher) verifySignature(repo *Repo, conf *AppConf, commit string) error {
+	if f.commitVerifier == nil {
+		return fmt.Errorf("no trusted signers configured")
+	}
+	if conf.Rev != LatestCommit && conf.Rev[0] == 'v' {
+		return repo.VerifyTagSignature(conf.Rev, f.commitVerifier)
+	}
+	return repo.VerifyCommitSignature(commit, f.commitVerifier)
+}
+
+// refuse keeps the last good snapshot and records why commit was not deployed
+func (f *ConfFetcher) refuse(appID string, commit string, trigger string, reason string) {
+	f.refuseWithReport(appID, commit, trigger, reason, nil)
+}
+
+// refuseWithReport refuses a commit attaching the failed validation report
+// the snapshot(and its _meta) is left as is, so the report goes to deploy status
+func (f *ConfFetcher) refuseWithReport(appID string, commit string, trigger string, reason string, report *ValidationReport) {
+	f.log.Errorf("Refused app(%s) commit(%s): %s", appID, commit, reason)
+
+	status := newDeployStatus(appID, commit, DeployRefused, reason, f.nodeName)
+	status.Trigger = trigger
+	status.Validation = report
+	f.setStatus(status, nil)
+}
+
+// hold queues a commit until the freeze lifts, keeping trigger & reason it would be deployed with
+func (f *ConfFetcher) hold(appID, commit, trigger, reason, why string) {
+	f.log.Infof("Held app(%s) commit(%s): %s", appID, commit, why)
+
+	var pending []string
+	f.states.update(appID, func(st *AppState) {
+		queued := st.Pending[:0:0]
+		for _, p := range st.Pending {
+			if p.Commit != commit {
+				queued = append(queued, p)
+			}
+		}
+		st.Pending = append(queued, &PendingDeploy{
+			Commit:  commit,
+			Trigger: trigger,
+			Reason:  reason,
+			Time:    time.Now().UTC(),
+		})
+		for _, p := range st.Pending {
+			pending = append(pending, p.Commit)
+		}
+	})
+
+	status := newDeployStatus(appID, commit, DeployHeld, fmt.Sprintf("%s, pending(%s)", why, strings.Join(pending, ",")), f.nodeName)
+	status.Trigger = trigger
+	f.setStatus(status, nil)
+}
+
+// deployPending deploys the newest held commit once the freeze lifts or an emergency deploy allows it
+func (f *ConfFetcher) deployPending(id string, evt AppConfEvent) error {
+	st, ok := f.states.get(id)
+	if !ok || len(st.Pending) == 0 {
+		return nil
+	}
+	p := st.Pending[len(st.Pending)-1]
+	if _, frozen := f.freezes.frozen(id, time.Now()); frozen && f.freezes.emergency(id, p.Commit) == nil {
+		return nil
+	}
+
+	// dequeued first, a held commit refused on redeploy is not retried every tick
+	f.states.update(id, func(st *AppState) {
+		st.Pending = nil
+	})
+	f.log.Infof("Deploying held app(%s) commit(%s)", id, p.Commit)
+	return f.deployCommit(f.repos[id], evt, p.Commit, p.Trigger, p.Reason)
+}
+
+// park holds a commit until approved, approvals of other commits expire
+// repo holds snapshot values before decryption, decrypted keys are left out of the diff
+func (f *ConfFetcher) park(appID, commit, trigger, reason string, required int, approvers []string, repo, snapshot map[string][]byte) {
+	if st, ok := f.states.get(appID); ok && st.Approval != nil && st.Approval.Commit == commit {
+		return
+	}
+	f.approvals.expire(appID, commit)
+
+	prev, err := f.approvals.currentSnapshot(appID)
+	if err != nil {
+		f.log.Errorf("Failed to read current snapshot of app(%s): %v", appID, err)
+	}
+	changes := diffSnapshot(prev, snapshot)
+
+	f.log.Infof("Parked app(%s) commit(%s) awaiting approval(%d/%d)", appID, commit, len(approvers), required)
+	f.states.update(appID, func(st *AppState) {
+		st.Approval = &ApprovalRequest{
+			Commit:    commit,
+			Trigger:   trigger,
+			Reason:    reason,
+			Required:  required,
+			Approvers: approvers,
+			Changes:   changes,
+			Diff:      approvalDiff(prev, snapshot, repo, changes),
+			Time:      time.Now().UTC(),
+		}
+	})
+
+	status := newDeployStatus(appID, commit, DeployAwaitingApproval, fmt.Sprintf("approvals(%d/%d)", len(approvers), required), f.nodeName)
+	status.Trigger = trigger
+	f.setStatus(status, nil)
+}
+
+// deployApproved deploys the parked commit once enough distinct approvers approved it
+func (f *ConfFetcher) deployApproved(id string, evt AppConfEvent) error {
+	st, ok := f.states.get(id)
+	if !ok || st.Approval == nil {
+		return nil
+	}
+	req := st.Approval
+
+	approvers := f.approvals.approvers(id, req.Commit)
+	if len(approvers) < req.Required {
+		f.states.update(id, func(st *AppState) {
+			if st.Approval != nil {
+				st.Approval.Approvers = approvers
+			}
+		})
+		return nil
+	}
+
+	f.states.update(id, func(st *AppState) {
+		st.Approval = nil
+	})
+	f.log.Infof("Deploying approved app(%s) commit(%s)", id, req.Commit)
+	return f.deployCommit(f.repos[id], evt, req.Commit, req.Trigger, req.Reason)
+}
+
+// setStatus records deploy status and pushes it with snapshot, status only when snapshot is nil
+func (f *ConfFetcher) setStatus(status *DeployStatus, snapshot *map[string][]byte) {
+	f.states.update(status.AppID, func(st *AppState) {
+		st.Status = status
+	})
+	f.changes <- &ConfChange{
+		appID:  status.AppID,
+		kvs:    snapshot,
+		status: status,
+	}
 }
 
 // Fetcher processes configuration changes
@@ -204,16 +630,41 @@ Loop:
 				break Loop
 			}
 
-			cachedCommit, err = f.processEvent(id, evt, "")
+			// cached commit is kept so polling doesn't redeploy the bad commit either
+			if evt.rollback != nil {
+				if cachedEvent == nil || !evt.isMaster {
+					continue
+				}
+				req := evt.rollback
+				f.log.Infof("Rolling back app(%s) to commit(%s)", id, req.commit)
+				reason := fmt.Sprintf("rolled back from commit(%s): %s", req.from, req.reason)
+				// a failed rollback is left to operators, the app keeps being watched
+				if err := f.deployCommit(f.repos[id], cachedEvent.evt, req.commit, TriggerRollback, reason); err != nil {
+					f.refuse(id, req.commit, TriggerRollback, fmt.Sprintf("rollback from commit(%s) failed: %v", req.from, err))
+				}
+				continue
+			}
+
+			cachedCommit, err = f.processEvent(id, evt, "", TriggerConfig)
 			if err != nil {
 				//TODO: fatal what to do?
-				break Loo
+				break Loop
 			}
 			cachedEvent = &evt
 		case <-ticker.C:
+			if cachedEvent != nil && f.approvals != nil {
+				if err = f.deployApproved(id, cachedEvent.evt); err != nil {
+					break Loop
+				}
+			}
+			if cachedEvent != nil && f.freezes != nil {
+				if err = f.deployPending(id, cachedEvent.evt); err != nil {
+					break Loop
+				}
+			}
 			// replay event to force fetching latest for other operation should be no effect
 			if cachedEvent != nil && cachedEvent.evt.Rev == "latest" {
-				cachedCommit, err = f.processEvent(id, *cachedEvent, cachedCommit)
+				cachedCommit, err = f.processEvent(id, *cachedEvent, cachedCommit, TriggerPoll)
 				if err != nil {
 					//TODO: fatal what to do?
 					break Loop
@@ -232,6 +683,11 @@ func (f *ConfFetcher) Loop() {
 	var isLeader bool
 	var leaderNode string
 
+	var rollbacks chan *rollbackRequest
+	if f.monitor != nil {
+		rollbacks = f.monitor.rollbacks
+	}
+
 Loop:
 	for {
 		select {
@@ -243,6 +699,11 @@ Loop:
 			isLeader = le.IsMaster
 			leaderNode = le.LeaderNode
 
+		case req := <-rollbacks:
+			if events, ok := mapa[req.appID]; ok {
+				events <- ConfEvent{isMaster: isLeader, leaderNode: leaderNode, rollback: req}
+			}
+
 		case evt, ok := <-f.events:
 			if !ok { // f.events closed
 				f.events = nil
@@ -260,10 +721,10 @@ Loop:
 
 				go f.Fetcher(evt.ID, events)
 
-				events <- ConfEvent{evt, isLeader, leaderNode}
+				events <- ConfEvent{evt: evt, isMaster: isLeader, leaderNode: leaderNode}
 
 			case appConfChanged:
-				mapa[evt.ID] <- ConfEvent{evt, isLeader, leaderNode}
+				mapa[evt.ID] <- ConfEvent{evt: evt, isMaster: isLeader, leaderNode: leaderNode}
 
 			case appConfRemoved:
 				f.log.Info("Removing channel for ID(%s)", evt.ID)
@@ -10,6 +10,8 @@ import (
 
 	_ "github.com/hashicorp/consul/watch"
 	git "github.com/libgit2/git2go"
+
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
 )
 
 func refToBranch(branchName string) string {
@@ -83,8 +85,10 @@ func TestConfFetcherIntegrated(t *testing.T) {
 	tempDir, err := ioutil.TempDir("", "confFetch")
 	checkFatal(t, err)
 
+	store, err := kvstore.NewConsulStore(server.HTTPAddr)
+	checkFatal(t, err)
 	pusher := NewConfPusher(&ConfPusherConfig{
-		kv: client.KV(),
+		store: store,
 	})
 
 	fetcher := NewConfFetcher(&ConfFetcherConfig{
@@ -11,8 +11,11 @@ import (
 	"syscall"
 	"time"
 
+	"filippo.io/age"
 	log "github.com/Sirupsen/logrus"
 
+	confclient "bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
 	lh "bitbucket.org/cdnetworks/eos-conf/leaderhandler"
 	consulapi "github.com/hashicorp/consul/api"
 )
@@ -25,17 +28,51 @@ type MasterConfig struct {
 	globalConfigKeyPrefix string
 	appConfigKeyPrefix    string
 	consulAddr            string
+	// KV backend(consul, etcd or file), etcd endpoints & the datacenter etcd masters report
+	backend       string
+	etcdEndpoints []string
+	datacenter    string
+	// directory & app manifest of the file backend
+	fileRoot     string
+	manifestPath string
+	// ed25519 key file for signing snapshots, unsigned when empty
+	signingKeyPath string
+	// directory of trusted commit signers(*.asc, allowed_signers)
+	commitSignersPath string
+	// external validator commands file
+	validatorsPath string
+	// admin API listen address & JSON file of tokens by identity allowed to mutate through it
+	adminAddr       string
+	adminTokensPath string
+	// mask detected secrets in snapshot dumps
+	redactLogs bool
+	// age identities for apps decrypted on master
+	ageIdentityPath string
+	// deploy history entries kept per app & optional local JSONL sink
+	historyLimit   int
+	historyLogPath string
+	// cache snapshots are mirrored to(redis://, memcache://), disabled when empty
+	cacheURL       string
+	cacheKeyPrefix string
+	// directory Kubernetes manifests are written to on each push, disabled when empty
+	k8sDir       string
+	k8sNamespace string
 }
 
 // ConfMaster is top-level module for configuration delivery for local cluster
 type ConfMaster struct {
 	config *MasterConfig
 
-	pusher  *ConfPusher
-	fetcher *ConfFetcher
-	handler *lh.LeaderHandler
+	pusher    *ConfPusher
+	fetcher   *ConfFetcher
+	handler   *lh.LeaderHandler
+	admin     *AdminServer
+	monitor   *HealthMonitor
+	freezes   *FreezeManager
+	approvals *ApprovalGate
+	drift     *DriftDetector
 
-	consulClient *consulapi.Client
+	store kvstore.Store
 
 	logger     *log.Entry
 	shutdownCh chan interface{}
@@ -87,7 +124,16 @@ func NewConfMaster(config *MasterConfig) (*ConfMaster, error) {
 		appConfigKeyPrefix = DefaultAppConfigKeyPrefix
 	}
 
-	client, err := makeConsulClient(config.consulAddr)
+	store, err := kvstore.New(&kvstore.Config{
+		Backend:       config.backend,
+		ConsulAddr:    consulAddr,
+		EtcdEndpoints: config.etcdEndpoints,
+		Datacenter:    config.datacenter,
+
+		FileRoot:       config.fileRoot,
+		Manifest:       config.manifestPath,
+		ManifestPrefix: globalConfigKeyPrefix,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -95,28 +141,107 @@ func NewConfMaster(config *MasterConfig) (*ConfMaster, error) {
 	tracker, err := NewConfTracker(&ConfTrackerConfig{
 		keyPrefix:  globalConfigKeyPrefix,
 		consulAddr: consulAddr,
+		store:      store,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	pusher := NewConfPusher(&ConfPusherConfig{
-		kv:        client.KV(),
-		keyPrefix: appConfigKeyPrefix,
+	var signer *confclient.Signer
+	if config.signingKeyPath != "" {
+		signer, err = confclient.LoadSigner(config.signingKeyPath)
+		if err != nil {
+			logEntry.Errorf("Failed to load signing key(%s)", config.signingKeyPath)
+			return nil, err
+		}
+		logEntry.Infof("Signing snapshots with key id(%s)", signer.KeyID())
+	}
+
+	var commitVerifier *CommitVerifier
+	if config.commitSignersPath != "" {
+		commitVerifier, err = LoadCommitVerifier(config.commitSignersPath)
+		if err != nil {
+			logEntry.Errorf("Failed to load commit signers(%s)", config.commitSignersPath)
+			return nil, err
+		}
+	}
+
+	var validatorCommands map[string]*ValidatorCommand
+	if config.validatorsPath != "" {
+		validatorCommands, err = LoadValidatorCommands(config.validatorsPath)
+		if err != nil {
+			logEntry.Errorf("Failed to load validators(%s)", config.validatorsPath)
+			return nil, err
+		}
+	}
+
+	var adminTokens map[string]string
+	if config.adminTokensPath != "" {
+		adminTokens, err = LoadAdminTokens(config.adminTokensPath)
+		if err != nil {
+			logEntry.Errorf("Failed to load admin tokens(%s)", config.adminTokensPath)
+			return nil, err
+		}
+	}
+
+	var ageIdentities []age.Identity
+	if config.ageIdentityPath != "" {
+		ageIdentities, err = confclient.LoadIdentities(config.ageIdentityPath)
+		if err != nil {
+			logEntry.Errorf("Failed to load age identities(%s)", config.ageIdentityPath)
+			return nil, err
+		}
+	}
+
+	history, err := NewDeployHistory(&DeployHistoryConfig{
+		store:   store,
+		limit:   config.historyLimit,
+		logPath: config.historyLogPath,
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	var sinks []SnapshotSink
+	if config.cacheURL != "" {
+		cache, err := NewCacheSink(&CacheSinkConfig{url: config.cacheURL, keyPrefix: config.cacheKeyPrefix})
+		if err != nil {
+			logEntry.Errorf("Failed to create cache sink(%s)", config.cacheURL)
+			return nil, err
+		}
+		sinks = append(sinks, cache)
+	}
+	if config.k8sDir != "" {
+		k8s, err := NewK8sSink(&K8sSinkConfig{dir: config.k8sDir, namespace: config.k8sNamespace})
+		if err != nil {
+			logEntry.Errorf("Failed to create k8s sink(%s)", config.k8sDir)
+			return nil, err
+		}
+		sinks = append(sinks, k8s)
+	}
 
 	handler, err := lh.NewLeaderHandler(&lh.Config{
 		Logger:      logger,
 		LeaderKey:   lh.DefaultLeaderKey,
 		WatchPeriod: 1000,
 		IsMaster:    true,
-		Client:      client,
+		Store:       store,
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
+	pusher := NewConfPusher(&ConfPusherConfig{
+		store:       store,
+		keyPrefix:   appConfigKeyPrefix,
+		signer:      signer,
+		history:     history,
+		sinks:       sinks,
+		isLeader:    handler.IsLeader,
+		leaderCheck: handler.LeaderCheck,
+	})
+
 	githttp := NewGitHTTPServer(tempPathRoot, nextGitHTTPPort())
 	err = githttp.Run()
 	if err != nil {
@@ -125,6 +250,69 @@ func NewConfMaster(config *MasterConfig) (*ConfMaster, error) {
 	}
 	logEntry.Infof("Git HTTP server started(%+v)", githttp)
 
+	states := newAppStates()
+	restores := NewRestoreManager(&RestoreManagerConfig{
+		store:       store,
+		nodeName:    handler.NodeName,
+		isLeader:    handler.IsLeader,
+		leaderCheck: handler.LeaderCheck,
+		changes:     pusher.changes,
+	})
+	fleet := NewFleetView(&FleetViewConfig{
+		store:        store,
+		appKeyPrefix: appConfigKeyPrefix,
+	})
+	admin := NewAdminServer(config.adminAddr, adminTokens, states, history, restores, fleet)
+
+	monitor, err := NewHealthMonitor(&HealthMonitorConfig{
+		store:    store,
+		nodeName: handler.NodeName,
+		isLeader: handler.IsLeader,
+		history:  history,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	freezes, err := NewFreezeManager(&FreezeManagerConfig{
+		store: store,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	approvals, err := NewApprovalGate(&ApprovalGateConfig{
+		store:        store,
+		appKeyPrefix: appConfigKeyPrefix,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	drift, err := NewDriftDetector(&DriftDetectorConfig{
+		store:        store,
+		appKeyPrefix: appConfigKeyPrefix,
+		states:       states,
+		isLeader:     handler.IsLeader,
+		changes:      pusher.changes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the pusher is created before the detector, which queues reverts on it
+	pusher.drift = drift
+
+	rollouts := NewRolloutManager(&RolloutManagerConfig{
+		store:        store,
+		appKeyPrefix: appConfigKeyPrefix,
+		changes:      pusher.changes,
+		states:       states,
+		nodeName:     handler.NodeName,
+		monitor:      monitor,
+		isLeader:     handler.IsLeader,
+		leaderCheck:  handler.LeaderCheck,
+	})
+
 	fetcher := NewConfFetcher(&ConfFetcherConfig{
 		pathRoot:   tempPathRoot,
 		done:       make(chan interface{}),
@@ -132,16 +320,35 @@ func NewConfMaster(config *MasterConfig) (*ConfMaster, error) {
 		leaderC:    handler.LeaderCh(),
 		changes:    pusher.changes,
 		gitHTTPURL: githttp.url,
+		nodeName:   handler.NodeName,
+		datacenter: handler.Datacenter,
+
+		commitVerifier:    commitVerifier,
+		validatorCommands: validatorCommands,
+		states:            states,
+		redactLogs:        config.redactLogs,
+		ageIdentities:     ageIdentities,
+		rollouts:          rollouts,
+		monitor:           monitor,
+		freezes:           freezes,
+		approvals:         approvals,
+		drift:             drift,
+		history:           history,
 	})
 
 	return &ConfMaster{
-		config:       config,
-		pusher:       pusher,
-		fetcher:      fetcher,
-		handler:      handler,
-		consulClient: client,
-		logger:       logEntry,
-		shutdownCh:   make(chan interface{}),
+		config:     config,
+		pusher:     pusher,
+		fetcher:    fetcher,
+		handler:    handler,
+		admin:      admin,
+		monitor:    monitor,
+		freezes:    freezes,
+		approvals:  approvals,
+		drift:      drift,
+		store:      store,
+		logger:     logEntry,
+		shutdownCh: make(chan interface{}),
 	}, nil
 }
 
@@ -152,8 +359,16 @@ func (m *ConfMaster) Run() {
 	signal.Notify(sigC, os.Interrupt, syscall.SIGTERM)
 
 	m.pusher.Run()
+	for _, sink := range m.pusher.sinks {
+		sink.Run()
+	}
 	m.fetcher.Run()
 	m.handler.Run()
+	m.admin.Run()
+	m.monitor.Run()
+	m.freezes.Run()
+	m.approvals.Run()
+	m.drift.Run()
 
 	for {
 		select {
@@ -163,7 +378,15 @@ func (m *ConfMaster) Run() {
 		case <-m.shutdownCh:
 			//TODO: cleanup sub components proper
 			m.logger.Printf("Shutting down ConfMaster...\n")
+			m.monitor.Shutdown()
+			m.freezes.Shutdown()
+			m.approvals.Shutdown()
+			m.drift.Shutdown()
 			m.pusher.Shutdown()
+			for _, sink := range m.pusher.sinks {
+				sink.Shutdown()
+			}
+			m.store.Close()
 			return
 		}
 	}
@@ -1,27 +1,46 @@
 package main
 
 import (
+	"fmt"
 	"strings"
 	"sync"
 
 	log "github.com/Sirupsen/logrus"
 
-	consulapi "github.com/hashicorp/consul/api"
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
 )
 
 // ConfChange contains KV changes
+// kvs is nil when only deploy status is updated (e.g. refused commit)
+// restore is set for backups restored in between pushes
 type ConfChange struct {
-	appID string
-	kvs   *map[string][]byte
+	appID   string
+	kvs     *map[string][]byte
+	status  *DeployStatus
+	restore *restoreRequest
 }
 
 // ConfPusherConfig contains Puser configuration
 type ConfPusherConfig struct {
-	kv        *consulapi.KV
+	store     kvstore.Store
 	keyPrefix string
+	// key prefix for deploy status
+	deployKeyPrefix string
+	// snapshots are signed when set
+	signer *client.Signer
+	// deploy statuses are recorded to history when set
+	history *DeployHistory
+	// snapshots are mirrored to sinks once pushed
+	sinks []SnapshotSink
+	// snapshots pushed are checked for drift when set
+	drift *DriftDetector
+	// only the leader pushes, pushes fail once it no longer holds the leader lock
+	isLeader    func() (bool, error)
+	leaderCheck func() *kvstore.Op
 }
 
-// ConfPusher pushes configuration changes to Consul KV storage
+// ConfPusher pushes configuration changes to KV storage
 type ConfPusher struct {
 	shutdown     bool
 	shutdownLock sync.Mutex
@@ -30,8 +49,16 @@ type ConfPusher struct {
 	config    *ConfPusherConfig
 	changes   chan *ConfChange
 	logger    *log.Entry
-	kv        *consulapi.KV
+	store     kvstore.Store
 	keyPrefix string
+	signer    *client.Signer
+	history   *DeployHistory
+	sinks     []SnapshotSink
+	drift     *DriftDetector
+
+	deployKeyPrefix string
+	isLeader        func() (bool, error)
+	leaderCheck     func() *kvstore.Op
 }
 
 // NewConfPusher creates a new conf pusher
@@ -44,6 +71,11 @@ func NewConfPusher(conf *ConfPusherConfig) *ConfPusher {
 	}
 	conf.keyPrefix = prefix
 
+	deployKeyPrefix := conf.deployKeyPrefix
+	if deployKeyPrefix == "" {
+		deployKeyPrefix = DefaultDeployKeyPrefix
+	}
+
 	f := &ConfPusher{
 		shutdownCh: make(chan struct{}),
 		config:     conf,
@@ -51,53 +83,166 @@ func NewConfPusher(conf *ConfPusherConfig) *ConfPusher {
 		// for now, use one thread with buffered channel
 		changes:   make(chan *ConfChange, 5),
 		logger:    logger,
-		kv:        conf.kv,
+		store:     conf.store,
 		keyPrefix: conf.keyPrefix,
+		signer:    conf.signer,
+		history:   conf.history,
+		sinks:     conf.sinks,
+		drift:     conf.drift,
+
+		deployKeyPrefix: deployKeyPrefix,
+		isLeader:        conf.isLeader,
+		leaderCheck:     conf.leaderCheck,
 	}
 	return f
 }
 
+// currentSnapshot reads the snapshot currently deployed for an app
+func (p *ConfPusher) currentSnapshot(appID string) (map[string][]byte, error) {
+	prefix := p.keyPrefix + "/" + appID + "/"
+	pairs, err := p.store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	kvs := make(map[string][]byte)
+	for _, pair := range pairs {
+		kvs[strings.TrimPrefix(pair.Key, prefix)] = pair.Value
+	}
+	return kvs, nil
+}
+
+// leading checks whether this master pushes, followers would diff against the leader's push
+// and overwrite its metadata
+func (p *ConfPusher) leading() bool {
+	if p.isLeader == nil {
+		return true
+	}
+	leader, err := p.isLeader()
+	if err != nil {
+		p.logger.Errorf("Failed to check leadership: %v", err)
+	}
+	return leader
+}
+
 // KVUpdate update kv storage
 // use tranaction feature(https://www.consul.io/docs/agent/http/kv.html#txn)
 func (p *ConfPusher) KVUpdate(change *ConfChange) error {
-	ops := consulapi.KVTxnOps{}
+	if !p.leading() {
+		p.logger.Infof("Push of app(%s) left to the leader", change.appID)
+		return nil
+	}
+
+	ops := []*kvstore.Op{}
 	prefix := p.keyPrefix + "/" + change.appID
 
+	// list keys changed relative to the previous deploy
+	prev, err := p.currentSnapshot(change.appID)
+	if err != nil {
+		p.logger.Errorf("Failed to read current snapshot of app(%s): %v", change.appID, err)
+		return err
+	}
+	(*change.kvs)[metaChanges] = encodeChanges(diffSnapshot(prev, *change.kvs))
+
+	// signing covers every metadata key so it comes last
+	if p.signer != nil {
+		p.signer.Sign(change.appID, *change.kvs)
+	}
+
 	// Remove whole prefix tree
 	// TODO: Perf using cache or diff?
-	ops = append(ops, &consulapi.KVTxnOp{
-		Verb: string(consulapi.KVDeleteTree),
+	ops = append(ops, &kvstore.Op{
+		Verb: kvstore.OpDeleteTree,
 		Key:  prefix,
 	})
 
 	// append updates
 	for k, v := range *change.kvs {
 		key := prefix + "/" + k
-		p.logger.Infof("[INFO] pushing k(%s) v(%s)\n", key, strings.TrimSpace(string(v)))
-		op := &consulapi.KVTxnOp{
-			Verb:  string(consulapi.KVSet),
+		p.logger.Infof("[INFO] pushing k(%s) size(%d)\n", key, len(v))
+		op := &kvstore.Op{
+			Verb:  kvstore.OpSet,
 			Key:   key,
 			Value: []byte(v),
 		}
 		ops = append(ops, op)
 	}
 
+	if change.status != nil {
+		ops = append(ops, p.statusOp(change.status))
+	}
+	if p.leaderCheck != nil {
+		ops = append(ops, p.leaderCheck())
+	}
+
+	// expected before the transaction, so the drift detector never sees the snapshot unexpected
+	if p.drift != nil {
+		p.drift.expect(change.appID, *change.kvs)
+	}
+
 	p.logger.Infof("Txn len(%d) ops", len(ops))
-	ok, response, _, err := p.kv.Txn(ops, nil)
+	err = p.store.Txn(ops)
+	if err == kvstore.ErrTxnFailed {
+		err = fmt.Errorf("push of app(%s) fenced off, leader lock lost", change.appID)
+	}
 	if err != nil {
-		p.logger.Printf("ok(%v) response(%v)\n", ok, response)
 		p.logger.Printf("Failed to update KV stroage: %v\n", err)
+		if p.drift != nil {
+			p.drift.forget(change.appID)
+		}
 		return err
 	}
 
-	/*
-		for _, kp := range response.Results {
-			p.logger.Printf("Updated k(%s) value(%s)\n", kp.Key, string(kp.Value))
-		}
-	*/
+	if change.status != nil && p.history != nil {
+		p.history.record(change.status, string(prev[metaCommit]))
+	}
+	for _, sink := range p.sinks {
+		sink.Publish(change.appID, *change.kvs)
+	}
+	return nil
+}
 
-	if !ok {
-		panic("Failed to update KV Storage")
+// statusKey returns deploy status key for an app
+func (p *ConfPusher) statusKey(appID string) string {
+	return p.deployKeyPrefix + "/" + appID + "/status"
+}
+
+// statusOp makes a txn op setting deploy status
+func (p *ConfPusher) statusOp(status *DeployStatus) *kvstore.Op {
+	return &kvstore.Op{
+		Verb:  kvstore.OpSet,
+		Key:   p.statusKey(status.AppID),
+		Value: status.encode(),
+	}
+}
+
+// StatusUpdate updates deploy status only, leaving the snapshot untouched
+// statuses are written & recorded to history by the leader only, once per deploy
+func (p *ConfPusher) StatusUpdate(status *DeployStatus) error {
+	p.logger.Infof("app(%s) commit(%s) state(%s) reason(%s)", status.AppID, status.Commit, status.State, status.Reason)
+	if !p.leading() {
+		return nil
+	}
+
+	ops := []*kvstore.Op{p.statusOp(status)}
+	if p.leaderCheck != nil {
+		ops = append(ops, p.leaderCheck())
+	}
+	err := p.store.Txn(ops)
+	if err == kvstore.ErrTxnFailed {
+		err = fmt.Errorf("status of app(%s) fenced off, leader lock lost", status.AppID)
+	}
+	if err != nil {
+		p.logger.Errorf("Failed to update deploy status of app(%s): %v", status.AppID, err)
+		return err
+	}
+
+	if p.history != nil {
+		var previous string
+		if pair, err := p.store.Get(p.keyPrefix + "/" + status.AppID + "/" + metaCommit); err == nil && pair != nil {
+			previous = string(pair.Value)
+		}
+		p.history.record(status, previous)
 	}
 	return nil
 }
@@ -118,7 +263,13 @@ Loop:
 				continue
 			}
 			//TODO: error handling
-			p.KVUpdate(evt)
+			if evt.restore != nil {
+				evt.restore.run()
+			} else if evt.kvs == nil {
+				p.StatusUpdate(evt.status)
+			} else {
+				p.KVUpdate(evt)
+			}
 		case _, ok := <-p.shutdownCh:
 			if !ok {
 				p.shutdownCh = nil // f.done closed
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+func TestConfPusherLeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pusher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := kvstore.NewFileStore(&kvstore.FileConfig{Root: dir, Node: "master1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const leaderKey = "service/confmaster/leader"
+	lock, _ := store.NewLock(leaderKey, []byte("master1"))
+	leader := false
+	p := NewConfPusher(&ConfPusherConfig{
+		store:     store,
+		keyPrefix: DefaultAppConfigKeyPrefix,
+		isLeader:  func() (bool, error) { return leader, nil },
+		leaderCheck: func() *kvstore.Op {
+			return &kvstore.Op{Verb: kvstore.OpCheckSession, Key: leaderKey, Session: lock.Session()}
+		},
+	})
+	push := func() error {
+		return p.KVUpdate(&ConfChange{appID: "web", kvs: &map[string][]byte{"a.conf": []byte("a"), metaCommit: []byte("abc")}})
+	}
+	pushed := func() bool {
+		pair, _ := store.Get(DefaultAppConfigKeyPrefix + "/web/" + metaCommit)
+		return pair != nil
+	}
+
+	if err := push(); err != nil || pushed() {
+		t.Fatalf("follower should leave pushes to the leader, %v", err)
+	}
+
+	// believing to lead without the lock is fenced off
+	leader = true
+	if err := push(); err == nil || pushed() {
+		t.Fatalf("expected push without the leader lock fenced off, %v", err)
+	}
+
+	if ok, err := lock.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expected leader lock, %v %v", ok, err)
+	}
+	defer lock.Release()
+	if err := push(); err != nil || !pushed() {
+		t.Fatalf("expected push by the leader, %v", err)
+	}
+}
+
+func TestConfPusherStatusLeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pusher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := kvstore.NewFileStore(&kvstore.FileConfig{Root: dir, Node: "master1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := NewDeployHistory(&DeployHistoryConfig{store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const leaderKey = "service/confmaster/leader"
+	lock, _ := store.NewLock(leaderKey, []byte("master1"))
+	leader := true
+	p := NewConfPusher(&ConfPusherConfig{
+		store:     store,
+		keyPrefix: DefaultAppConfigKeyPrefix,
+		history:   history,
+		isLeader:  func() (bool, error) { return leader, nil },
+		leaderCheck: func() *kvstore.Op {
+			return &kvstore.Op{Verb: kvstore.OpCheckSession, Key: leaderKey, Session: lock.Session()}
+		},
+	})
+	recorded := func() int {
+		entries, err := history.list("web", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	status := newDeployStatus("web", "abc", DeployRefused, "validation failed", "master1")
+	if err := p.StatusUpdate(status); err == nil || recorded() != 0 {
+		t.Fatalf("expected status without the leader lock fenced off & not recorded, %v", err)
+	}
+	leader = false
+	if err := p.StatusUpdate(status); err != nil || recorded() != 0 {
+		t.Fatalf("follower should not record status, %v", err)
+	}
+
+	leader = true
+	if ok, err := lock.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expected leader lock, %v %v", ok, err)
+	}
+	defer lock.Release()
+	if err := p.StatusUpdate(status); err != nil || recorded() != 1 {
+		t.Fatalf("expected status recorded once by the leader, %v", err)
+	}
+}
@@ -1,45 +1,463 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"filippo.io/age"
+	"github.com/Sirupsen/logrus"
 	consulapi "github.com/hashicorp/consul/api"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+	lh "bitbucket.org/cdnetworks/eos-conf/leaderhandler"
 )
 
+// slaveStatusSession names the session holding status keys of a slave agent
+const slaveStatusSession = "confslave-status"
+
 // SlaveConfig is configration for ConfSlave
 type SlaveConfig struct {
-	configKey       string
-	monitorInterval int64
-	gitRoot         string
+	// key prefix of app snapshots pushed by master
+	keyPrefix  string
+	consulAddr string
+	// local directory where snapshots are applied
+	applyRoot string
+	// trusted public keys, snapshots are not required to be signed when empty
+	trustedKeysPath string
+	// age identities for apps decrypted on slaves
+	ageIdentityPath string
+	// node groups overrides are resolved for after the node itself
+	nodeGroups []string
+	// key prefix applied state is reported on
+	statusKeyPrefix string
 }
 
-// SlaveContext will be deprecated
-type SlaveContext struct {
-	config       *SlaveConfig
-	consulClient *consulapi.Client
-	kv           *consulapi.KV
-	nodeName     string
-	nodeType     string
-}
+// ConfSlave applies verified app snapshots on an edge node
+type ConfSlave struct {
+	shutdown     bool
+	shutdownLock sync.Mutex
+	shutdownCh   chan struct{}
 
-func monitorCommit(context *SlaveContext) error {
-	return nil
+	config          *SlaveConfig
+	watcher         *Watcher
+	overrideWatcher *Watcher
+	client          *client.Client
+	kv              *consulapi.KV
+	agent           *consulapi.Agent
+	sessions        *consulapi.Session
+	log             *logrus.Entry
+	keyPrefix       string
+	applyRoot       string
+	nodeName        string
+
+	ageIdentities []age.Identity
+
+	// source app, commit & override applied per app
+	applied map[string]string
+	// last snapshot pairs, replayed when overrides change
+	pairs kvstore.Pairs
+
+	// applied state per app, reported under statusKeyPrefix while session lives
+	statusKeyPrefix string
+	session         string
+	statuses        map[string]*client.AppliedStatus
 }
 
-func slaveLoop(done chan struct{}, context *SlaveContext) {
-	config := context.config
-	monitorTicker := time.NewTicker(time.Millisecond * time.Duration(config.monitorInterval))
+// NewConfSlave creates a new ConfSlave
+func NewConfSlave(config *SlaveConfig) (*ConfSlave, error) {
+	logEntry := configureLogger("slave")
+
+	keyPrefix := config.keyPrefix
+	if keyPrefix == "" {
+		keyPrefix = DefaultAppConfigKeyPrefix
+	}
+
+	statusKeyPrefix := config.statusKeyPrefix
+	if statusKeyPrefix == "" {
+		statusKeyPrefix = client.DefaultStatusKeyPrefix
+	}
+
+	consulAddr := config.consulAddr
+	if consulAddr == "" {
+		consulAddr = DefaultConsulAddr
+	}
+
+	consulClient, err := makeConsulClient(consulAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyRing *client.KeyRing
+	if config.trustedKeysPath != "" {
+		keyRing, err = client.LoadKeyRing(config.trustedKeysPath)
+		if err != nil {
+			logEntry.Errorf("Failed to load trusted keys(%s)", config.trustedKeysPath)
+			return nil, err
+		}
+	}
+
+	var ageIdentities []age.Identity
+	if config.ageIdentityPath != "" {
+		ageIdentities, err = client.LoadIdentities(config.ageIdentityPath)
+		if err != nil {
+			logEntry.Errorf("Failed to load age identities(%s)", config.ageIdentityPath)
+			return nil, err
+		}
+	}
+
+	nodeName, err := lh.GetNodeName(consulClient)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := NewWatcher(&WatcherConfig{watchType: "prefix", key: keyPrefix, host: consulAddr})
+	if err != nil {
+		return nil, err
+	}
+
+	overrideWatcher, err := NewWatcher(&WatcherConfig{watchType: "prefix", key: client.DefaultOverrideKeyPrefix, host: consulAddr})
+	if err != nil {
+		watcher.Shutdown()
+		return nil, err
+	}
+
+	return &ConfSlave{
+		shutdownCh:      make(chan struct{}),
+		config:          config,
+		watcher:         watcher,
+		overrideWatcher: overrideWatcher,
+		kv:              consulClient.KV(),
+		agent:           consulClient.Agent(),
+		sessions:        consulClient.Session(),
+		client: client.New(&client.Config{
+			Client:    consulClient,
+			KeyPrefix: keyPrefix,
+			KeyRing:   keyRing,
+			Node:      nodeName,
+			Groups:    config.nodeGroups,
+		}),
+		log:       logEntry,
+		keyPrefix: keyPrefix,
+		applyRoot: config.applyRoot,
+		nodeName:  nodeName,
+		applied:   make(map[string]string),
+
+		ageIdentities: ageIdentities,
+
+		statusKeyPrefix: statusKeyPrefix,
+		statuses:        make(map[string]*client.AppliedStatus),
+	}, nil
+}
 
-	context.consulClient.KV()
+// Run starts ConfSlave
+func (s *ConfSlave) Run() {
+	// master finds nodes for staged rollouts by the service
+	err := s.agent.ServiceRegister(&consulapi.AgentServiceRegistration{
+		ID:   SlaveServiceName,
+		Name: SlaveServiceName,
+	})
+	if err != nil {
+		s.log.Errorf("Failed to register service(%s): %v", SlaveServiceName, err)
+	}
+	go s.Loop()
+}
 
-	go func() {
-		for {
-			select {
-			case <-monitorTicker.C:
-				monitorCommit(context)
-			case <-done:
+// Loop is internal loop for ConfSlave
+func (s *ConfSlave) Loop() {
+	for {
+		select {
+		case <-s.shutdownCh:
+			return
+		case v, ok := <-s.watcher.eventCh:
+			if !ok {
+				return
+			}
+			pairs, ok := v.(kvstore.Pairs)
+			if !ok {
+				panic("invalid value from watcher")
+			}
+			s.pairs = pairs
+			s.processPairs(pairs)
+		case _, ok := <-s.overrideWatcher.eventCh:
+			if !ok {
 				return
 			}
+			s.processPairs(s.pairs)
 		}
-	}()
+	}
+}
+
+// processPairs applies apps whose resolved snapshot(_meta/commit of source app) or override changed
+func (s *ConfSlave) processPairs(pairs kvstore.Pairs) {
+	commits := make(map[string]string)
+	for _, pair := range pairs {
+		rel := strings.TrimPrefix(pair.Key, s.keyPrefix+"/")
+		parts := strings.SplitN(rel, "/", 2)
+		if len(parts) == 2 && parts[1] == client.MetaCommitKey {
+			commits[parts[0]] = string(pair.Value)
+		}
+	}
+
+	for appID := range commits {
+		// apps derived for overrides are applied under the app they override
+		if client.IsDerivedApp(appID) {
+			continue
+		}
+
+		o, err := s.client.ResolveOverride(appID)
+		if err != nil {
+			s.log.Errorf("Failed to resolve override app(%s): %v", appID, err)
+			continue
+		}
+		source := appID
+		var encoded []byte
+		if o != nil {
+			if o.App != "" {
+				source = o.App
+			}
+			encoded, _ = json.Marshal(o)
+		}
+
+		state := fmt.Sprintf("%s %s %s", source, commits[source], encoded)
+		if s.applied[appID] == state {
+			continue
+		}
+		snapshot, err := s.apply(appID)
+		if err != nil {
+			s.log.Errorf("Refused snapshot app(%s) source(%s) commit(%s): %v", appID, source, commits[source], err)
+			s.ack(appID, &Ack{Commit: commits[source], State: AckFailed, Message: err.Error()})
+			s.report(appID, "", commits[source], err)
+			continue
+		}
+		// an unhealthy snapshot stays applied until master rolls it back
+		s.applied[appID] = state
+		if err := s.checkHealth(appID, snapshot); err != nil {
+			s.log.Errorf("Unhealthy app(%s) commit(%s): %v", appID, snapshot.Commit, err)
+			s.ack(appID, &Ack{Commit: snapshot.Commit, State: AckFailed, Message: err.Error()})
+			s.report(appID, snapshot.Commit, snapshot.Commit, err)
+			continue
+		}
+		s.ack(appID, &Ack{Commit: snapshot.Commit, State: AckApplied})
+		s.report(appID, snapshot.Commit, "", nil)
+	}
+}
+
+// report updates applied state of an app, commit is set when applied & failed when it failed
+func (s *ConfSlave) report(appID, applied, failed string, err error) {
+	now := time.Now().UTC()
+	st, ok := s.statuses[appID]
+	if !ok {
+		st = &client.AppliedStatus{Node: s.nodeName}
+		s.statuses[appID] = st
+	}
+	if applied != "" {
+		st.Commit = applied
+		st.AppliedAt = now
+	}
+	st.Error, st.FailedCommit = "", ""
+	if err != nil {
+		st.Error, st.FailedCommit = err.Error(), failed
+	}
+	st.Version = Version
+	st.Time = now
+
+	if err := s.publishStatus(appID); err != nil {
+		s.log.Errorf("Failed to report status of app(%s): %v", appID, err)
+	}
+}
+
+// publishStatus writes applied state of an app held by the status session
+// a session invalidated meanwhile(e.g. the node flapped) is recreated and every status published again
+func (s *ConfSlave) publishStatus(appID string) error {
+	if s.session != "" {
+		ok, err := s.acquireStatus(appID)
+		if err != nil || ok {
+			return err
+		}
+		s.session = ""
+	}
+
+	if err := s.createStatusSession(); err != nil {
+		return err
+	}
+	for id := range s.statuses {
+		ok, err := s.acquireStatus(id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("status key of app(%s) held by another session", id)
+		}
+	}
+	return nil
+}
+
+func (s *ConfSlave) acquireStatus(appID string) (bool, error) {
+	data, err := json.Marshal(s.statuses[appID])
+	if err != nil {
+		return false, err
+	}
+	ok, _, err := s.kv.Acquire(&consulapi.KVPair{
+		Key:     client.StatusKey(s.statusKeyPrefix, appID, s.nodeName),
+		Value:   data,
+		Session: s.session,
+	}, nil)
+	return ok, err
+}
+
+// createStatusSession creates the session status keys are held by, deleted with it or when the node dies
+// sessions left by a previous agent on this node are destroyed first, releasing their keys
+func (s *ConfSlave) createStatusSession() error {
+	sessions, _, err := s.sessions.Node(s.nodeName, nil)
+	if err != nil {
+		return err
+	}
+	for _, entry := range sessions {
+		if entry.Name == slaveStatusSession {
+			if _, err := s.sessions.Destroy(entry.ID, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	id, _, err := s.sessions.Create(&consulapi.SessionEntry{
+		Name:     slaveStatusSession,
+		Node:     s.nodeName,
+		Behavior: consulapi.SessionBehaviorDelete,
+		// keys are acquired again right after a previous session is destroyed
+		LockDelay: time.Millisecond,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	s.session = id
+	return nil
+}
+
+// checkHealth runs the health check deployed with a snapshot, if any
+func (s *ConfSlave) checkHealth(appID string, snapshot *client.Snapshot) error {
+	spec := string(snapshot.KVs[metaHealthCheck])
+	if spec == "" {
+		return nil
+	}
+
+	timeout := DefaultHealthTimeout
+	if v := string(snapshot.KVs[metaHealthTimeout]); v != "" {
+		if t, err := strconv.Atoi(v); err == nil && t > 0 {
+			timeout = t
+		}
+	}
+
+	return runHealthCheck(spec, time.Duration(timeout)*time.Second, []string{
+		"CONF_APP_ID=" + appID,
+		"CONF_COMMIT=" + snapshot.Commit,
+		"CONF_DIR=" + path.Join(s.applyRoot, appID),
+	})
+}
+
+// ack reports the outcome of applying a commit to master
+func (s *ConfSlave) ack(appID string, ack *Ack) {
+	ack.Time = time.Now().UTC()
+	_, err := s.kv.Put(&consulapi.KVPair{
+		Key:   ackKey(DefaultAckKeyPrefix, appID, s.nodeName),
+		Value: ack.encode(),
+	}, nil)
+	if err != nil {
+		s.log.Errorf("Failed to ack app(%s) commit(%s): %v", appID, ack.Commit, err)
+	}
+}
+
+// apply reads a verified snapshot and writes it under applyRoot, returns the snapshot applied
+func (s *ConfSlave) apply(appID string) (*client.Snapshot, error) {
+	snapshot, err := s.client.Get(appID)
+	if err != nil {
+		return nil, err
+	}
+
+	// verified over ciphertext, decrypted only on disk
+	kvs := snapshot.KVs
+	_, encrypted := kvs[client.MetaEncryptedKey]
+	if encrypted {
+		if len(s.ageIdentities) == 0 {
+			return nil, fmt.Errorf("encrypted snapshot but no age identity configured")
+		}
+		kvs, err = client.DecryptSnapshot(kvs, s.ageIdentities)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// keys decrypted on the master are listed as secret paths
+	_, secretPaths := kvs[client.MetaSecretPathsKey]
+	dir := path.Join(s.applyRoot, appID)
+	if err := writeSnapshotDir(dir, kvs, encrypted || secretPaths); err != nil {
+		return nil, err
+	}
+
+	s.log.Infof("Applied app(%s) source(%s) commit(%s) hash(%s)", appID, snapshot.Source, snapshot.Commit, snapshot.Hash)
+	return snapshot, nil
+}
+
+// writeSnapshotDir writes snapshot files to a staging directory then swaps it with dir,
+// readable by the owner only when they hold decrypted secrets
+func writeSnapshotDir(dir string, kvs map[string][]byte, secret bool) error {
+	dirMode, fileMode := os.FileMode(0755), os.FileMode(0644)
+	if secret {
+		dirMode, fileMode = 0700, 0600
+	}
+
+	staging := dir + ".new"
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+
+	for k, v := range kvs {
+		// rooting key before cleaning keeps files inside staging
+		p := path.Join(staging, path.Clean("/"+k))
+		if err := os.MkdirAll(path.Dir(p), dirMode); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, v, fileMode); err != nil {
+			return err
+		}
+	}
+
+	old := dir + ".old"
+	os.RemoveAll(old)
+	if _, err := os.Stat(dir); err == nil {
+		if err := os.Rename(dir, old); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(staging, dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// Shutdown shutdowns ConfSlave
+func (s *ConfSlave) Shutdown() {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+
+	if s.shutdown {
+		return
+	}
+	s.shutdown = true
+
+	s.agent.ServiceDeregister(SlaveServiceName)
+	if s.session != "" {
+		s.sessions.Destroy(s.session, nil)
+	}
+	s.watcher.Shutdown()
+	s.overrideWatcher.Shutdown()
+	close(s.shutdownCh)
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+// fakeConsul serves the KV & session endpoints a slave uses from a map
+type fakeConsul struct {
+	lock sync.Mutex
+	kvs  map[string][]byte
+	puts chan string
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	w.Header().Set("X-Consul-Index", "1")
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/session/node/"):
+		w.Write([]byte("[]"))
+	case r.URL.Path == "/v1/session/create":
+		w.Write([]byte(`{"ID":"session"}`))
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		if r.Method == "PUT" {
+			data, _ := ioutil.ReadAll(r.Body)
+			c.kvs[key] = data
+			w.Write([]byte("true"))
+			select {
+			case c.puts <- key:
+			default:
+			}
+			return
+		}
+		_, recurse := r.URL.Query()["recurse"]
+		var pairs consulapi.KVPairs
+		for k, v := range c.kvs {
+			if k == key || (recurse && strings.HasPrefix(k, key)) {
+				pairs = append(pairs, &consulapi.KVPair{Key: k, Value: v})
+			}
+		}
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(pairs)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestConfSlaveLoop(t *testing.T) {
+	kvs := map[string][]byte{"a.conf": []byte("x=1"), client.MetaCommitKey: []byte("abc")}
+	kvs[client.MetaHashKey] = []byte(client.SnapshotHash(kvs))
+	consul := &fakeConsul{kvs: make(map[string][]byte), puts: make(chan string, 10)}
+	for k, v := range kvs {
+		consul.kvs[DefaultAppConfigKeyPrefix+"/web/"+k] = v
+	}
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	config := consulapi.DefaultConfig()
+	config.Address = strings.TrimPrefix(server.URL, "http://")
+	consulClient, err := consulapi.NewClient(config)
+	checkFatal(t, err)
+
+	// snapshot pushed by master as the watcher of a store sees it
+	root, err := ioutil.TempDir("", "slave")
+	checkFatal(t, err)
+	defer os.RemoveAll(root)
+	store, err := kvstore.NewFileStore(&kvstore.FileConfig{Root: path.Join(root, "kv"), PollInterval: 10 * time.Millisecond})
+	checkFatal(t, err)
+	checkFatal(t, store.Put(DefaultAppConfigKeyPrefix+"/web/"+client.MetaCommitKey, []byte("abc")))
+	watcher, err := NewWatcher(&WatcherConfig{watchType: "prefix", key: DefaultAppConfigKeyPrefix, store: store})
+	checkFatal(t, err)
+	defer watcher.Shutdown()
+
+	s := &ConfSlave{
+		shutdownCh:      make(chan struct{}),
+		watcher:         watcher,
+		overrideWatcher: &Watcher{eventCh: make(chan interface{})},
+		kv:              consulClient.KV(),
+		sessions:        consulClient.Session(),
+		client:          client.New(&client.Config{Client: consulClient, KeyPrefix: DefaultAppConfigKeyPrefix, Node: "n1"}),
+		log:             configureLogger("slave"),
+		keyPrefix:       DefaultAppConfigKeyPrefix,
+		applyRoot:       path.Join(root, "apply"),
+		nodeName:        "n1",
+		applied:         make(map[string]string),
+		statusKeyPrefix: client.DefaultStatusKeyPrefix,
+		statuses:        make(map[string]*client.AppliedStatus),
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Loop()
+		close(done)
+	}()
+
+	statusKey := client.StatusKey(client.DefaultStatusKeyPrefix, "web", "n1")
+	timeout := time.After(5 * time.Second)
+	for reported := false; !reported; {
+		select {
+		case key := <-consul.puts:
+			reported = key == statusKey
+		case <-timeout:
+			t.Fatal("status of web never reported")
+		}
+	}
+	close(s.shutdownCh)
+	<-done
+
+	data, err := ioutil.ReadFile(path.Join(root, "apply", "web", "a.conf"))
+	if err != nil || string(data) != "x=1" {
+		t.Fatalf("expected snapshot applied, got %q: %v", data, err)
+	}
+	st, err := client.ParseAppliedStatus(consul.kvs[statusKey])
+	if err != nil || st.Commit != "abc" || st.Error != "" {
+		t.Fatalf("unexpected status %+v: %v", st, err)
+	}
+}
+
+func TestWriteSnapshotDirSecret(t *testing.T) {
+	root, err := ioutil.TempDir("", "slave")
+	checkFatal(t, err)
+	defer os.RemoveAll(root)
+
+	kvs := map[string][]byte{"db/password": []byte("s3cret")}
+	for secret, mode := range map[bool]os.FileMode{false: 0644, true: 0600} {
+		dir := path.Join(root, fmt.Sprint(secret))
+		checkFatal(t, writeSnapshotDir(dir, kvs, secret))
+		info, err := os.Stat(path.Join(dir, "db", "password"))
+		checkFatal(t, err)
+		if info.Mode().Perm() != mode {
+			t.Fatalf("expected mode %v for secret(%v), got %v", mode, secret, info.Mode().Perm())
+		}
+	}
+}
@@ -6,13 +6,16 @@ import (
 	"strings"
 	"sync"
 
-	consulapi "github.com/hashicorp/consul/api"
+	"github.com/Sirupsen/logrus"
+
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
 )
 
 // ConfTrackerConfig contains configuration for ConfTracker
 type ConfTrackerConfig struct {
 	keyPrefix  string
 	consulAddr string
+	store      kvstore.Store
 }
 
 /* TODO: based on struct type? */
@@ -21,6 +24,8 @@ type ConfTrackerConfig struct {
 type AppConfEvent struct {
 	t int
 	*AppConf
+	// global variables when the event was emitted
+	vars map[string]string
 }
 
 func (e AppConfEvent) String() string {
@@ -39,11 +44,53 @@ func (e AppConfEvent) String() string {
 }
 
 // AppConf helper structure for json parsing
+// fields tagged optional are per-app policies and may be left unset
 type AppConf struct {
 	ID     string
 	Branch string
 	Repo   string
 	Rev    string
+
+	// snapshot handling of submodules(ignore/expand) and symlinks(raw/resolve/skip)
+	Submodules string `conf:"optional"`
+	Symlinks   string `conf:"optional"`
+	// comma separated hosts submodules may be fetched from besides the repo's own
+	SubmoduleHosts string `conf:"optional"`
+	// commit signature policy(off/required)
+	Signatures string `conf:"optional"`
+	// validation(off disables) & comma separated external validators
+	Validate   string `conf:"optional"`
+	Validators string `conf:"optional"`
+	// secret scanning(block/warn/off) & comma separated key globs exempted
+	Secrets      string `conf:"optional"`
+	SecretsAllow string `conf:"optional"`
+	// where encrypted files are decrypted(master/slave)
+	Decrypt string `conf:"optional"`
+	// comma separated key globs exported as Kubernetes Secrets rather than ConfigMap data
+	SecretPaths string `conf:"optional"`
+	// comma separated overlays(off by default, on applies ${dc}) & variable substitution(on/off)
+	Overlays  string `conf:"optional"`
+	Variables string `conf:"optional"`
+	// rollout strategy(all/canary/waves), canary nodes("n1,n2" or "10%"), waves("10%,50%"),
+	// wait between stages & ack timeout in second, and what to do when a stage fails(pause/rollback)
+	Rollout          string `conf:"optional"`
+	RolloutNodes     string `conf:"optional"`
+	RolloutWaves     string `conf:"optional"`
+	RolloutWait      string `conf:"optional"`
+	RolloutTimeout   string `conf:"optional"`
+	RolloutOnFailure string `conf:"optional"`
+	// post-apply health check run by slaves(http://, tcp://host:port or cmd:<shell>), timeout in second
+	// and fraction of failing nodes("0.2" or "20%") rolling the app back to its last good commit
+	HealthCheck       string `conf:"optional"`
+	HealthTimeout     string `conf:"optional"`
+	RollbackThreshold string `conf:"optional"`
+	// approval gate(off/required) & number of distinct approvers required
+	Approval  string `conf:"optional"`
+	Approvers string `conf:"optional"`
+	// what to do with keys edited outside of the master(alert/revert/off)
+	Drift string `conf:"optional"`
+	// note left by confctl explaining the last rev change(client.ChangeNote)
+	Change string `conf:"optional"`
 }
 
 func (c *AppConf) String() string {
@@ -60,6 +107,9 @@ func (c *AppConf) isComplete() bool {
 	ret := true
 	elem := reflect.ValueOf(c).Elem()
 	for i := 0; i < elem.NumField(); i++ {
+		if elem.Type().Field(i).Tag.Get("conf") == "optional" {
+			continue
+		}
 		if elem.Field(i).String() == "" {
 			ret = false
 		}
@@ -67,6 +117,15 @@ func (c *AppConf) isComplete() bool {
 	return ret
 }
 
+// snapshotOptions returns snapshot options configured for the app
+func (c *AppConf) snapshotOptions() SnapshotOptions {
+	return SnapshotOptions{
+		submodules:     c.Submodules,
+		submoduleHosts: splitList(c.SubmoduleHosts),
+		symlinks:       c.Symlinks,
+	}
+}
+
 // ConfTracker emits changes in app configuration
 type ConfTracker struct {
 	shutdown     bool
@@ -76,11 +135,14 @@ type ConfTracker struct {
 	appConfigs   map[string]*AppConf
 	events       chan AppConfEvent
 	newConfigApp map[string]bool
+	// global variables, replaced as a whole on changes
+	vars map[string]string
+	log  *logrus.Entry
 }
 
 // NewConfTracker makes a new ConfTracker
 func NewConfTracker(config *ConfTrackerConfig) (*ConfTracker, error) {
-	watcherConfig := &WatcherConfig{watchType: "prefix", key: config.keyPrefix, host: config.consulAddr}
+	watcherConfig := &WatcherConfig{watchType: "prefix", key: config.keyPrefix, host: config.consulAddr, store: config.store}
 	watcher, err := NewWatcher(watcherConfig)
 	if err != nil {
 		return nil, err
@@ -91,6 +153,8 @@ func NewConfTracker(config *ConfTrackerConfig) (*ConfTracker, error) {
 
 		appConfigs:   make(map[string]*AppConf),
 		newConfigApp: make(map[string]bool),
+		vars:         make(map[string]string),
+		log:          configureLogger("tracker"),
 
 		C:      watcher.eventCh,
 		events: make(chan AppConfEvent),
@@ -108,7 +172,7 @@ func (t *ConfTracker) Run() {
 		case <-t.shutdownCh:
 			return
 		case v := <-t.C:
-			pairs, ok := v.(consulapi.KVPairs)
+			pairs, ok := v.(kvstore.Pairs)
 			if !ok {
 				panic("invalid value from watcher")
 			}
@@ -122,26 +186,58 @@ func (t *ConfTracker) Run() {
 	}
 }
 
-// emtiConf process Consul's key value pairs
-func (t *ConfTracker) emitConf(pairs consulapi.KVPairs, confChan chan AppConfEvent) {
-	// use as a set
-	tmp := make(map[string]bool)
+// emitConf rebuilds app configurations from the current pairs, emits one event per app changed
+func (t *ConfTracker) emitConf(pairs kvstore.Pairs, confChan chan AppConfEvent) {
+	varsChanged := t.updateVars(pairs)
+
+	// fields absent from pairs are left to their defaults
+	confs := make(map[string]*AppConf)
 	for _, pair := range pairs {
-		appID, _ := parseKey(pair.Key)
-		tmp[appID] = true
-		t.emitConfPair(pair, confChan)
+		appID, field := parseKey(pair.Key)
+		if appID == varsNamespace {
+			continue
+		}
+		conf, ok := confs[appID]
+		if !ok {
+			conf = &AppConf{ID: appID}
+			confs[appID] = conf
+		}
+		setConfField(conf, field, string(pair.Value))
+	}
+
+	for id, conf := range confs {
+		changed := !reflect.DeepEqual(conf, t.appConfigs[id])
+		t.appConfigs[id] = conf
+		if !conf.isComplete() {
+			continue
+		}
+		// re-render apps already running with new variables
+		if !changed && !(varsChanged && t.newConfigApp[id]) {
+			continue
+		}
+		evt := AppConfEvent{
+			t:       appConfChanged,
+			AppConf: conf,
+			vars:    t.vars,
+		}
+		if !t.newConfigApp[id] {
+			evt.t = appConfNew
+			t.newConfigApp[id] = true
+		}
+		confChan <- evt
 	}
 
 	// removed app configs
 	var appsRemoved []string
 	for k := range t.appConfigs {
-		_, ok := tmp[k]
-		_, ok2 := t.newConfigApp[k]
-
-		if !ok && ok2 {
-			delete(t.newConfigApp, k)
+		if _, ok := confs[k]; ok {
+			continue
+		}
+		delete(t.appConfigs, k)
+		if t.newConfigApp[k] {
 			appsRemoved = append(appsRemoved, k)
 		}
+		delete(t.newConfigApp, k)
 	}
 
 	for _, id := range appsRemoved {
@@ -154,56 +250,54 @@ func (t *ConfTracker) emitConf(pairs consulapi.KVPairs, confChan chan AppConfEve
 	}
 }
 
+// updateVars collects global variables, returns true when they changed
+// the app id of the variables namespace is reserved, an app configured under it is reported
+func (t *ConfTracker) updateVars(pairs kvstore.Pairs) bool {
+	vars := make(map[string]string)
+	reserved := &AppConf{ID: varsNamespace}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair.Key, "/", 4)
+		if len(parts) == 4 && parts[2] == varsNamespace {
+			vars[parts[3]] = string(pair.Value)
+			_, field := parseKey(pair.Key)
+			setConfField(reserved, field, string(pair.Value))
+		}
+	}
+	if reflect.DeepEqual(vars, t.vars) {
+		return false
+	}
+	if reserved.isComplete() {
+		t.log.Errorf("App id(%s) is reserved for global variables, app ignored, its fields are read as variables", varsNamespace)
+	}
+	t.vars = vars
+	return true
+}
+
 // parseKey parses key to appId & field
 func parseKey(key string) (appID string, field string) {
 	// TODO: Fix - parse depends on key format
 	// key = config/global/testapp/branch
 	parts := strings.Split(key, "/")
 	appID = parts[2]
-	field = strings.Title(parts[3])
+	// secrets_allow => SecretsAllow
+	words := strings.FieldsFunc(parts[3], func(c rune) bool {
+		return c == '_' || c == '-'
+	})
+	field = strings.Title(strings.Join(words, " "))
+	field = strings.Replace(field, " ", "", -1)
 	if field == "Id" {
 		field = "ID"
 	}
 	return
 }
 
-// emitConfPair process one KV pair
-func (t *ConfTracker) emitConfPair(pair *consulapi.KVPair, confChan chan AppConfEvent) {
-	appID, field := parseKey(pair.Key)
-	val := string(pair.Value)
-
-	appConf, ok := t.appConfigs[appID]
-
-	if !ok {
-		_, ok2 := t.newConfigApp[appID]
-		if !ok2 {
-			t.newConfigApp[appID] = false
-		}
-		t.appConfigs[appID] = &AppConf{ID: appID}
-	}
-	appConf = t.appConfigs[appID]
-
-	changed := false
-
-	fld := reflect.ValueOf(appConf).Elem().FieldByName(field)
-
-	if fld.String() != val {
-		changed = true
-		fld.SetString(val)
-	}
-
-	if appConf.isComplete() && changed {
-		evt := AppConfEvent{
-			t:       appConfChanged,
-			AppConf: appConf,
-		}
-		if !t.newConfigApp[appID] {
-			evt.t = appConfNew
-			t.newConfigApp[appID] = true
-		}
-		//fmt.Printf("emitting evt(%s)\n", evt)
-		confChan <- evt
+// setConfField sets field of an app configuration, unknown keys under it are ignored
+func setConfField(conf *AppConf, field, val string) {
+	fld := reflect.ValueOf(conf).Elem().FieldByName(field)
+	if !fld.IsValid() || fld.Kind() != reflect.String {
+		return
 	}
+	fld.SetString(val)
 }
 
 // Shutdown shutdown global configuration tracker
@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
 	TT "bitbucket.org/cdnetworks/eos-conf/test"
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/testutil"
@@ -169,3 +170,63 @@ func TestConfTracker(t *testing.T) {
 	// delay server shutdown
 	time.Sleep(100 * time.Millisecond)
 }
+
+func TestConfTrackerEmitConf(t *testing.T) {
+	tracker := &ConfTracker{
+		appConfigs:   make(map[string]*AppConf),
+		newConfigApp: make(map[string]bool),
+		vars:         make(map[string]string),
+		log:          configureLogger("tracker"),
+	}
+	pairs := func(kvs map[string]string) kvstore.Pairs {
+		var ps kvstore.Pairs
+		for k, v := range kvs {
+			ps = append(ps, &kvstore.Pair{Key: "config/global/" + k, Value: []byte(v)})
+		}
+		return ps
+	}
+	emit := func(kvs map[string]string) []AppConfEvent {
+		events := make(chan AppConfEvent, 10)
+		tracker.emitConf(pairs(kvs), events)
+		close(events)
+		var ret []AppConfEvent
+		for evt := range events {
+			ret = append(ret, evt)
+		}
+		return ret
+	}
+
+	web := map[string]string{"web/branch": "master", "web/repo": "repo0", "web/rev": "latest", "web/rollout": "canary", "web/approval": "required"}
+	if evts := emit(web); len(evts) != 1 || evts[0].t != appConfNew || evts[0].Rollout != "canary" {
+		t.Fatalf("expected one new event, got %v", evts)
+	}
+	if evts := emit(web); len(evts) != 0 {
+		t.Fatalf("expected no event without changes, got %v", evts)
+	}
+
+	// several fields changed in one watch emit once, removed ones go back to default
+	web["web/rev"] = "abc"
+	web["web/branch"] = "topic"
+	delete(web, "web/rollout")
+	evts := emit(web)
+	if len(evts) != 1 || evts[0].t != appConfChanged || evts[0].Rev != "abc" || evts[0].Branch != "topic" || evts[0].Rollout != "" || evts[0].Approval != "required" {
+		t.Fatalf("expected one changed event with defaults restored, got %v", evts)
+	}
+
+	web["vars/region"] = "eu"
+	if evts := emit(web); len(evts) != 1 || evts[0].t != appConfChanged || evts[0].vars["region"] != "eu" {
+		t.Fatalf("expected re-render on variables change, got %v", evts)
+	}
+
+	// an app under the reserved id is read as variables, never emitted
+	web["vars/branch"] = "master"
+	web["vars/repo"] = "repo1"
+	web["vars/rev"] = "latest"
+	if evts := emit(web); len(evts) != 1 || evts[0].ID != "web" || evts[0].vars["repo"] != "repo1" {
+		t.Fatalf("expected reserved app ignored, got %v", evts)
+	}
+
+	if evts := emit(nil); len(evts) != 1 || evts[0].t != appConfRemoved || evts[0].ID != "web" {
+		t.Fatalf("expected removed event, got %v", evts)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+)
+
+const (
+	// deploy state of commits parked until approved, see deploy_status.go
+	stateAwaitingApproval = "awaiting_approval"
+
+	actionApproved = "approved"
+
+	// approvalTTL bounds how long an approval is held without the commit being deployed
+	approvalTTL = "24h"
+)
+
+// deployStatus mirrors the deploy status master writes per app
+type deployStatus struct {
+	Commit string `json:"commit"`
+	State  string `json:"state"`
+	Reason string `json:"reason"`
+}
+
+// approveCommand approves the commit of an app awaiting approval
+// the approval key is acquired with a Consul session identifying the node it is made from,
+// master counts it while the session holds it, the key is deleted once the session ends
+func approveCommand(ctx *env, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: approve <app> <commit>")
+	}
+	appID, commit := args[0], args[1]
+
+	pair, _, err := ctx.kv.Get(DefaultDeployKeyPrefix+"/"+appID+"/status", nil)
+	if err != nil {
+		return err
+	}
+	status := &deployStatus{}
+	if pair != nil {
+		if err := json.Unmarshal(pair.Value, status); err != nil {
+			return err
+		}
+	}
+	if status.State != stateAwaitingApproval || !strings.HasPrefix(status.Commit, commit) {
+		return fmt.Errorf("commit(%s) of app(%s) is not awaiting approval", commit, appID)
+	}
+	commit = status.Commit
+
+	approver := actor()
+	session := ctx.client.Session()
+	id, _, err := session.Create(&consulapi.SessionEntry{
+		Name:     "confctl approve " + approver,
+		Behavior: consulapi.SessionBehaviorDelete,
+		TTL:      approvalTTL,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	held := false
+	defer func() {
+		if !held {
+			session.Destroy(id, nil)
+		}
+	}()
+
+	entry, _, err := session.Info(id, nil)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("session(%s) not found", id)
+	}
+
+	data, err := json.Marshal(&client.Approval{
+		Approver: approver,
+		Session:  id,
+		Node:     entry.Node,
+		Time:     time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	ok, _, err := ctx.kv.Acquire(&consulapi.KVPair{
+		Key:     client.ApprovalKey(client.DefaultApprovalKeyPrefix, appID, commit, approver),
+		Value:   data,
+		Session: id,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("approval of commit(%s) by %s in progress elsewhere", commit, approver)
+	}
+	held = true
+
+	recordManual(ctx, appID, commit, actionApproved, status.Reason)
+	fmt.Printf("app(%s) commit(%s) approved by %s\n", appID, commit, approver)
+	return nil
+}
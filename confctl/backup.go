@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+)
+
+const (
+	// DefaultLeaderKey is held by the leading master, see leaderhandler
+	DefaultLeaderKey = "service/confmaster/leader"
+	// DefaultAdminPort is the port of the master admin API
+	DefaultAdminPort = "9080"
+	// AdminTokenEnv holds the admin API token when -token is not given
+	AdminTokenEnv = "CONF_ADMIN_TOKEN"
+)
+
+// backupCommand writes config/global, config/app, overrides & deploy history to an archive
+func backupCommand(ctx *env, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := fs.String("o", "", "archive path, confbackup-<time>.tar.gz when empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("usage: backup [-o file]")
+	}
+
+	now := time.Now().UTC()
+	b := &client.Backup{
+		Created:    now,
+		Actor:      actor(),
+		Namespaces: client.DefaultBackupNamespaces,
+	}
+	if agent, err := ctx.client.Agent().Self(); err == nil {
+		b.Datacenter, _ = agent["Config"]["Datacenter"].(string)
+	}
+	for _, prefix := range b.Namespaces.Prefixes() {
+		pairs, _, err := ctx.kv.List(prefix, nil)
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			if _, ok := b.Namespaces.AppOf(pair.Key); ok {
+				b.Pairs = append(b.Pairs, &client.BackupPair{Key: pair.Key, Value: pair.Value})
+			}
+		}
+	}
+
+	p := *out
+	if p == "" {
+		p = "confbackup-" + now.Format("20060102T150405Z") + ".tar.gz"
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := client.WriteBackup(f, b); err != nil {
+		f.Close()
+		os.Remove(p)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("%d keys backed up to %s, checksum %s\n", b.Keys, p, b.Checksum)
+	return nil
+}
+
+// restoreResult mirrors RestoreResult answered by the master admin API
+type restoreResult struct {
+	Status struct {
+		Node    string `json:"node"`
+		State   string `json:"state"`
+		Set     int    `json:"set"`
+		Deleted int    `json:"deleted"`
+		Error   string `json:"error"`
+	} `json:"status"`
+	Set    []string `json:"set"`
+	Delete []string `json:"delete"`
+	Error  string   `json:"error"`
+}
+
+// restoreCommand restores a backup through the leading master, which fences its writes
+// a dry run only prints what would change
+func restoreCommand(ctx *env, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "print keys set & deleted without restoring")
+	admin := fs.String("admin", "", "admin API address of the leader, resolved from the leader key when empty")
+	token := fs.String("token", os.Getenv(AdminTokenEnv), "admin API token, $"+AdminTokenEnv+" when empty")
+	var apps listFlag
+	fs.Var(&apps, "app", "restore an app only, repeatable")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: restore [-dry-run] [-app id]... [-admin addr] [-token t] <file>")
+	}
+
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := client.ReadBackup(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("backup of %s by %s, datacenter(%s), %d keys\n", b.Created.Format(time.RFC3339), b.Actor, b.Datacenter, b.Keys)
+
+	if *dryRun {
+		current := make(map[string][]byte)
+		for _, prefix := range b.Namespaces.Prefixes() {
+			pairs, _, err := ctx.kv.List(prefix, nil)
+			if err != nil {
+				return err
+			}
+			for _, pair := range pairs {
+				current[pair.Key] = pair.Value
+			}
+		}
+		plan := client.PlanRestore(b, current, apps)
+		for _, pair := range plan.Set {
+			fmt.Printf("set\t%s\n", pair.Key)
+		}
+		for _, key := range plan.Delete {
+			fmt.Printf("delete\t%s\n", key)
+		}
+		fmt.Printf("%d to set, %d to delete\n", len(plan.Set), len(plan.Delete))
+		return nil
+	}
+
+	if *token == "" {
+		return fmt.Errorf("admin API token required, -token or $%s", AdminTokenEnv)
+	}
+	addr := *admin
+	if addr == "" {
+		if addr, err = leaderAdminAddr(ctx); err != nil {
+			return err
+		}
+	}
+	q := url.Values{"app": apps}
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+"/v1/restore?"+q.Encode(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	req.Header.Set("Authorization", "Bearer "+*token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	result := &restoreResult{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("master(%s) answered %s", addr, resp.Status)
+	}
+	if result.Error != "" {
+		return fmt.Errorf("master(%s): %s", addr, result.Error)
+	}
+	fmt.Printf("restore on node(%s) %s, %d set, %d deleted\n",
+		result.Status.Node, result.Status.State, result.Status.Set, result.Status.Deleted)
+	if result.Status.Error != "" {
+		return fmt.Errorf("%s", result.Status.Error)
+	}
+	return nil
+}
+
+// leaderAdminAddr resolves the admin API of the master holding the leader key
+// masters listen on localhost unless started with -adminaddr
+func leaderAdminAddr(ctx *env) (string, error) {
+	pair, _, err := ctx.kv.Get(DefaultLeaderKey, nil)
+	if err != nil {
+		return "", err
+	}
+	if pair == nil || pair.Session == "" {
+		return "", fmt.Errorf("no leading master")
+	}
+	node, _, err := ctx.client.Catalog().Node(string(pair.Value), nil)
+	if err != nil {
+		return "", err
+	}
+	if node == nil || node.Node == nil {
+		return "", fmt.Errorf("leader node(%s) not in catalog", pair.Value)
+	}
+	return net.JoinHostPort(node.Node.Address, DefaultAdminPort), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// blockedCommit mirrors BlockedCommit written by master on automatic rollback
+type blockedCommit struct {
+	Commit string    `json:"commit"`
+	Reason string    `json:"reason"`
+	Node   string    `json:"node"`
+	Time   time.Time `json:"time"`
+}
+
+func blockedKey(appID, commit string) string {
+	return DefaultDeployKeyPrefix + "/" + appID + "/blocked/" + commit
+}
+
+func blockedCommand(ctx *env, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand(list/add/rm)")
+	}
+	switch args[0] {
+	case "list":
+		return blockedList(ctx, args[1:])
+	case "add":
+		return blockedAdd(ctx, args[1:])
+	case "rm":
+		return blockedRemove(ctx, args[1:])
+	}
+	return fmt.Errorf("unknown subcommand(%s)", args[0])
+}
+
+// blockedList prints commits master refuses to deploy for an app
+func blockedList(ctx *env, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: blocked list <app>")
+	}
+	pairs, _, err := ctx.kv.List(blockedKey(args[0], ""), nil)
+	if err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		b := &blockedCommit{}
+		if err := json.Unmarshal(pair.Value, b); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid entry(%s): %v\n", pair.Key, err)
+			continue
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", b.Commit, b.Time.Format(time.RFC3339), b.Node, b.Reason)
+	}
+	return nil
+}
+
+// blockedAdd blocks a commit by hand
+func blockedAdd(ctx *env, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: blocked add <app> <commit> [reason]")
+	}
+	reason := strings.Join(args[2:], " ")
+	data, err := json.Marshal(&blockedCommit{
+		Commit: args[1],
+		Reason: reason,
+		Node:   actor(),
+		Time:   time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := ctx.kv.Put(&consulapi.KVPair{Key: blockedKey(args[0], args[1]), Value: data}, nil); err != nil {
+		return err
+	}
+	recordManual(ctx, args[0], args[1], actionBlocked, reason)
+	return nil
+}
+
+// blockedRemove unblocks a commit, it is deployed again on next change of the app
+func blockedRemove(ctx *env, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: blocked rm <app> <commit>")
+	}
+	if _, err := ctx.kv.Delete(blockedKey(args[0], args[1]), nil); err != nil {
+		return err
+	}
+	recordManual(ctx, args[0], args[1], actionUnblocked, "")
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+)
+
+const (
+	// DefaultBundleDir is where imported bundles are kept for bundle:// repo URLs
+	DefaultBundleDir = "/var/lib/confmaster/bundles"
+
+	// refs bundled for deployed commits, see repo_bundle.go
+	deployedRefs = "refs/deployed/"
+	bundleSuffix = ".bundle"
+)
+
+func bundleCommand(ctx *env, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand(create/import)")
+	}
+	switch args[0] {
+	case "create":
+		return bundleCreate(ctx, args[1:])
+	case "import":
+		return bundleImport(ctx, args[1:])
+	}
+	return fmt.Errorf("unknown subcommand(%s)", args[0])
+}
+
+// git runs git, returning its output
+func git(args ...string) (string, error) {
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return string(out), nil
+}
+
+// bundleCreate writes <app>.bundle files from the master's clones, served over its git HTTP mirror
+func bundleCreate(ctx *env, args []string) error {
+	fs := flag.NewFlagSet("bundle create", flag.ContinueOnError)
+	out := fs.String("o", ".", "directory bundles are written to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: bundle create [-o dir] <app|all>")
+	}
+
+	apps := []string{fs.Arg(0)}
+	if fs.Arg(0) == "all" {
+		keys, _, err := ctx.kv.Keys(client.DefaultKeyPrefix+"/", "/", nil)
+		if err != nil {
+			return err
+		}
+		apps = nil
+		for _, k := range keys {
+			apps = append(apps, strings.TrimSuffix(strings.TrimPrefix(k, client.DefaultKeyPrefix+"/"), "/"))
+		}
+	}
+
+	for _, appID := range apps {
+		p := filepath.Join(*out, appID+bundleSuffix)
+		if err := createBundle(ctx, appID, p); err != nil {
+			return fmt.Errorf("app(%s): %v", appID, err)
+		}
+		fmt.Printf("app(%s) bundled to %s\n", appID, p)
+	}
+	return nil
+}
+
+// createBundle mirrors the master's clone of an app & bundles its branches, tags & deployed commits
+func createBundle(ctx *env, appID, p string) error {
+	snapshot, err := client.New(&client.Config{Client: ctx.client}).Read(appID)
+	if err != nil {
+		return err
+	}
+	repo := string(snapshot.KVs[client.MetaKeyPrefix+"repo"])
+	if repo == "" {
+		return fmt.Errorf("not deployed")
+	}
+
+	dir, err := ioutil.TempDir("", "confctl")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := git("clone", "--mirror", "--quiet", repo, dir); err != nil {
+		return err
+	}
+
+	// the master tracks branches as origin/<branch>, bundled as plain branches
+	refs, err := git("--git-dir", dir, "for-each-ref", "--format=%(refname)", "refs/remotes/")
+	if err != nil {
+		return err
+	}
+	for _, ref := range strings.Fields(refs) {
+		parts := strings.SplitN(strings.TrimPrefix(ref, "refs/remotes/"), "/", 2)
+		if len(parts) != 2 || parts[1] == "HEAD" {
+			continue
+		}
+		if _, err := git("--git-dir", dir, "update-ref", "refs/heads/"+parts[1], ref); err != nil {
+			return err
+		}
+	}
+
+	// deployed commits, from history so they can be rolled back to offline
+	commits := []string{snapshot.Commit}
+	entries, err := loadHistory(ctx, appID, nil)
+	if err != nil {
+		return err
+	}
+	commits = append(commits, deployedCommits(entries)...)
+	for _, commit := range commits {
+		if commit == "" {
+			continue
+		}
+		if _, err := git("--git-dir", dir, "cat-file", "-e", commit+"^{commit}"); err != nil {
+			fmt.Fprintf(os.Stderr, "confctl: app(%s) commit(%s) not in clone, skipped\n", appID, commit)
+			continue
+		}
+		if _, err := git("--git-dir", dir, "update-ref", deployedRefs+commit, commit); err != nil {
+			return err
+		}
+	}
+
+	tmp := p + ".tmp"
+	if _, err := git("--git-dir", dir, "bundle", "create", tmp, "--branches", "--tags", "--glob="+deployedRefs+"*"); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// bundleImport verifies bundles & copies them to the bundle directory of an isolated master
+func bundleImport(ctx *env, args []string) error {
+	fs := flag.NewFlagSet("bundle import", flag.ContinueOnError)
+	dir := fs.String("dir", DefaultBundleDir, "directory bundle:// repo URLs point to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: bundle import [-dir dir] <file>...")
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+	root, err := filepath.Abs(*dir)
+	if err != nil {
+		return err
+	}
+
+	for _, src := range fs.Args() {
+		heads, err := verifyBundle(src)
+		if err != nil {
+			return fmt.Errorf("bundle(%s): %v", src, err)
+		}
+		dst := filepath.Join(root, filepath.Base(src))
+		if err := copyFile(src, dst); err != nil {
+			return err
+		}
+		fmt.Printf("bundle(%s) imported to %s, refs:\n%s", src, dst, heads)
+		fmt.Printf("repo url: bundle://%s\n", dst)
+	}
+	return nil
+}
+
+// verifyBundle checks a bundle is complete & readable, returning its refs
+func verifyBundle(p string) (string, error) {
+	dir, err := ioutil.TempDir("", "confctl")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := git("init", "--bare", "--quiet", dir); err != nil {
+		return "", err
+	}
+	if _, err := git("--git-dir", dir, "bundle", "verify", p); err != nil {
+		return "", err
+	}
+	return git("--git-dir", dir, "bundle", "list-heads", p)
+}
+
+// copyFile copies src over dst atomically, the master may be fetching dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(dst), ".import")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(out.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+	}
+	return err
+}
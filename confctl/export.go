@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+)
+
+func exportCommand(ctx *env, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing format(k8s)")
+	}
+	switch args[0] {
+	case "k8s":
+		return exportK8s(ctx, args[1:])
+	}
+	return fmt.Errorf("unknown format(%s)", args[0])
+}
+
+// exportK8s prints ConfigMap/Secret manifests of the deployed snapshot of an app, or of a commit
+func exportK8s(ctx *env, args []string) error {
+	fs := flag.NewFlagSet("export k8s", flag.ContinueOnError)
+	commit := fs.String("commit", "", "export the tree of a commit from the master's git mirror instead of the deployed snapshot")
+	namespace := fs.String("namespace", "", "namespace of the objects")
+	identity := fs.String("identity", "", "age identity file decrypting encrypted files & values")
+	var secrets listFlag
+	fs.Var(&secrets, "secret", "key glob exported as Secret, repeatable")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: export k8s [-commit c] [-namespace ns] [-secret glob]... [-identity file] <app>")
+	}
+	appID := fs.Arg(0)
+
+	snapshot, err := client.New(&client.Config{Client: ctx.client}).Read(appID)
+	if err != nil {
+		return err
+	}
+	if len(snapshot.KVs) == 0 {
+		return fmt.Errorf("app(%s) not deployed", appID)
+	}
+	kvs := snapshot.KVs
+
+	if *commit != "" && !strings.HasPrefix(snapshot.Commit, *commit) {
+		// overlays & variables are rendered by master on deploy only, the tree is exported as is
+		repo := string(kvs[client.MetaKeyPrefix+"repo"])
+		if kvs, err = commitTree(repo, *commit); err != nil {
+			return err
+		}
+		pair, _, err := ctx.kv.Get(DefaultGlobalConfigKeyPrefix+"/"+appID+"/secret_paths", nil)
+		if err != nil {
+			return err
+		}
+		if pair != nil {
+			secrets = append(secrets, strings.Split(string(pair.Value), ",")...)
+		}
+	}
+
+	if *identity != "" && client.HasEncrypted(kvs) {
+		ids, err := client.LoadIdentities(*identity)
+		if err != nil {
+			return err
+		}
+		for _, k := range client.EncryptedKeys(kvs) {
+			secrets = append(secrets, client.QuoteGlob(k))
+		}
+		if kvs, err = client.DecryptSnapshot(kvs, ids); err != nil {
+			return err
+		}
+	}
+
+	for i := range secrets {
+		secrets[i] = strings.TrimSpace(secrets[i])
+	}
+	out, err := client.ExportK8s(appID, kvs, &client.K8sOptions{Namespace: *namespace, SecretPaths: secrets})
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+// commitTree reads files of a commit with git, from a bare clone of repo
+func commitTree(repo, commit string) (map[string][]byte, error) {
+	if repo == "" {
+		return nil, fmt.Errorf("no repo in deployed snapshot")
+	}
+	dir, err := ioutil.TempDir("", "confctl")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if out, err := exec.Command("git", "clone", "--bare", "--quiet", repo, dir).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("cloning(%s): %v: %s", repo, err, bytes.TrimSpace(out))
+	}
+	full, err := exec.Command("git", "--git-dir", dir, "rev-parse", "--verify", commit+"^{commit}").Output()
+	if err != nil {
+		return nil, fmt.Errorf("commit(%s) not found in(%s)", commit, repo)
+	}
+	archive, err := exec.Command("git", "--git-dir", dir, "archive", "--format=tar", commit).Output()
+	if err != nil {
+		return nil, fmt.Errorf("archiving commit(%s): %v", commit, err)
+	}
+
+	kvs := map[string][]byte{client.MetaCommitKey: bytes.TrimSpace(full)}
+	r := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// symlinks & submodules are resolved by master only
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		kvs[hdr.Name] = data
+	}
+	return kvs, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+)
+
+const (
+	actionFreeze    = "freeze"
+	actionUnfreeze  = "unfreeze"
+	actionEmergency = "emergency_allowed"
+)
+
+func freezeCommand(ctx *env, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand(list/set/rm/emergency)")
+	}
+	switch args[0] {
+	case "list":
+		return freezeList(ctx, args[1:])
+	case "set":
+		return freezeSet(ctx, args[1:])
+	case "rm":
+		return freezeRemove(ctx, args[1:])
+	case "emergency":
+		return freezeEmergency(ctx, args[1:])
+	}
+	return fmt.Errorf("unknown subcommand(%s)", args[0])
+}
+
+// freezeList prints freezes and emergency deploys not used yet
+func freezeList(ctx *env, args []string) error {
+	pairs, _, err := ctx.kv.List(client.DefaultFreezeKeyPrefix+"/", nil)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, pair := range pairs {
+		name := strings.TrimPrefix(pair.Key, client.DefaultFreezeKeyPrefix+"/")
+		if strings.HasPrefix(name, "emergency/") {
+			fmt.Printf("%s\t%s\n", name, pair.Value)
+			continue
+		}
+		f, err := client.ParseFreeze(pair.Value)
+		if err != nil {
+			fmt.Printf("%s\tinvalid: %v\n", name, err)
+			continue
+		}
+		state := "inactive"
+		if f.Active(now) {
+			state = "active"
+		}
+		fmt.Printf("%s\t%s\t%s\n", name, state, pair.Value)
+	}
+	return nil
+}
+
+// freezeSet freezes every app or one app, until removed, for a while or on a recurring schedule
+func freezeSet(ctx *env, args []string) error {
+	fs := flag.NewFlagSet("freeze set", flag.ContinueOnError)
+	app := fs.String("app", "", "freeze one app, every app when empty")
+	forDuration := fs.Duration("for", 0, "freeze for a while, until removed when 0")
+	schedule := fs.String("schedule", "", "recurring freeze start, cron syntax in UTC")
+	duration := fs.String("duration", "", "length of recurring freeze windows, e.g. 62h")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	f := &client.Freeze{
+		Reason:   strings.Join(fs.Args(), " "),
+		Actor:    actor(),
+		Time:     time.Now().UTC(),
+		Schedule: *schedule,
+		Duration: *duration,
+	}
+	if *forDuration > 0 {
+		if *schedule != "" {
+			return fmt.Errorf("-for can't be combined with -schedule")
+		}
+		until := f.Time.Add(*forDuration)
+		f.Until = &until
+	}
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if _, err := client.ParseFreeze(data); err != nil {
+		return err
+	}
+	if _, err := ctx.kv.Put(&consulapi.KVPair{Key: client.FreezeKey(client.DefaultFreezeKeyPrefix, *app), Value: data}, nil); err != nil {
+		return err
+	}
+	if *app != "" {
+		recordManual(ctx, *app, "", actionFreeze, string(data))
+	}
+	return nil
+}
+
+// freezeRemove lifts a freeze, held commits are deployed shortly after
+func freezeRemove(ctx *env, args []string) error {
+	fs := flag.NewFlagSet("freeze rm", flag.ContinueOnError)
+	app := fs.String("app", "", "app freeze to lift, global freeze when empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if _, err := ctx.kv.Delete(client.FreezeKey(client.DefaultFreezeKeyPrefix, *app), nil); err != nil {
+		return err
+	}
+	if *app != "" {
+		recordManual(ctx, *app, "", actionUnfreeze, "")
+	}
+	return nil
+}
+
+// freezeEmergency lets one deploy of an app through active freezes
+func freezeEmergency(ctx *env, args []string) error {
+	fs := flag.NewFlagSet("freeze emergency", flag.ContinueOnError)
+	commit := fs.String("commit", "", "only allow this commit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return fmt.Errorf("usage: freeze emergency [-commit c] <app> <reason>")
+	}
+	appID := fs.Arg(0)
+	reason := strings.Join(fs.Args()[1:], " ")
+
+	data, err := json.Marshal(&client.EmergencyDeploy{
+		Commit: *commit,
+		Reason: reason,
+		Actor:  actor(),
+		Time:   time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := ctx.kv.Put(&consulapi.KVPair{Key: client.EmergencyKey(client.DefaultFreezeKeyPrefix, appID), Value: data}, nil); err != nil {
+		return err
+	}
+	recordManual(ctx, appID, *commit, actionEmergency, reason)
+	return nil
+}
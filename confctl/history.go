@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+)
+
+// manual actions recorded in deploy history
+const (
+	actionOverrideSet    = "override_set"
+	actionOverrideRemove = "override_removed"
+	actionBlocked        = "blocked"
+	actionUnblocked      = "unblocked"
+
+	triggerManual = "manual"
+)
+
+// historyCommand prints deploy history of an app, newest first
+func historyCommand(ctx *env, args []string) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	n := fs.Int("n", 20, "number of entries, all when 0")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: history [-n count] <app>")
+	}
+
+	entries, err := loadHistory(ctx, fs.Arg(0), nil)
+	if err != nil {
+		return err
+	}
+
+	for i, count := len(entries)-1, 0; i >= 0 && (*n <= 0 || count < *n); i, count = i-1, count+1 {
+		e := entries[i]
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Time.Format(time.RFC3339), e.State, e.Trigger, e.Commit, e.Previous, e.Node, e.Reason)
+	}
+	return nil
+}
+
+// loadHistory reads deploy history of an app, oldest entry first
+func loadHistory(ctx *env, appID string, q *consulapi.QueryOptions) ([]*client.HistoryEntry, error) {
+	pair, _, err := ctx.kv.Get(client.HistoryKey(DefaultDeployKeyPrefix, appID), q)
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	return client.ParseHistory(pair.Value)
+}
+
+// actor identifies who ran confctl
+func actor() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return name + "@" + host
+}
+
+// recordManual appends a manual action to deploy history of an app
+// the action already took effect, so failing to record it is only reported
+// trimming is left to the master, its next append keeps the history to its -historylimit
+func recordManual(ctx *env, appID, commit, action, reason string) {
+	err := client.AppendHistory(ctx.kv, client.HistoryKey(DefaultDeployKeyPrefix, appID), &client.HistoryEntry{
+		App:     appID,
+		Commit:  commit,
+		State:   action,
+		Reason:  reason,
+		Trigger: triggerManual,
+		Node:    actor(),
+		Time:    time.Now().UTC(),
+	}, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "confctl: failed to record history of app(%s): %v\n", appID, err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const (
+	// DefaultConsulAddr specifies default consul host to contact
+	DefaultConsulAddr = "localhost:8500"
+	// DefaultGlobalConfigKeyPrefix is key prefix for global configuration
+	DefaultGlobalConfigKeyPrefix = "config/global"
+	// DefaultDeployKeyPrefix is key prefix for deploy status, last good & blocked commits
+	DefaultDeployKeyPrefix = "config/deploy"
+)
+
+// command is a confctl subcommand
+type command struct {
+	usage string
+	run   func(ctx *env, args []string) error
+}
+
+var commands = map[string]*command{
+	"approve": {
+		usage: "approve <app> <commit>",
+		run:   approveCommand,
+	},
+	"backup": {
+		usage: "backup [-o file]",
+		run:   backupCommand,
+	},
+	"blocked": {
+		usage: "blocked list <app> | add <app> <commit> [reason] | rm <app> <commit>",
+		run:   blockedCommand,
+	},
+	"bundle": {
+		usage: "bundle create [-o dir] <app|all> | import [-dir dir] <file>...",
+		run:   bundleCommand,
+	},
+	"export": {
+		usage: "export k8s [-commit c] [-namespace ns] [-secret glob]... [-identity file] <app>",
+		run:   exportCommand,
+	},
+	"freeze": {
+		usage: "freeze list | set [-app id] [-for d | -schedule cron -duration d] [reason] | rm [-app id] | emergency [-commit c] <app> <reason>",
+		run:   freezeCommand,
+	},
+	"history": {
+		usage: "history [-n count] <app>",
+		run:   historyCommand,
+	},
+	"override": {
+		usage: "override list [target] | set [-app id] [-branch b] [-rev r] [-key k=v]... <target> <app> | rm <target> <app>",
+		run:   overrideCommand,
+	},
+	"promote": {
+		usage: "promote <app> --from <env> --to <env>",
+		run:   promoteCommand,
+	},
+	"restore": {
+		usage: "restore [-dry-run] [-app id]... [-admin addr] [-token t] <file>",
+		run:   restoreCommand,
+	},
+	"rollback": {
+		usage: "rollback [-to commit | -steps n] <app>",
+		run:   rollbackCommand,
+	},
+	"status": {
+		usage: "status <app>",
+		run:   statusCommand,
+	},
+}
+
+// env is shared by subcommands
+type env struct {
+	client *consulapi.Client
+	kv     *consulapi.KV
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: confctl [-consul addr] <command> [args]\n\ncommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	flag.PrintDefaults()
+}
+
+func main() {
+	consulAddr := flag.String("consul", DefaultConsulAddr, "consul address")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	conf := consulapi.DefaultConfig()
+	conf.Address = *consulAddr
+	client, err := consulapi.NewClient(conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "confctl: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx := &env{client: client, kv: client.KV()}
+	if err := cmd.run(ctx, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "confctl %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+// listFlag collects repeated flag values
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+)
+
+func overrideCommand(ctx *env, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand(list/set/rm)")
+	}
+	switch args[0] {
+	case "list":
+		return overrideList(ctx, args[1:])
+	case "set":
+		return overrideSet(ctx, args[1:])
+	case "rm":
+		return overrideRemove(ctx, args[1:])
+	}
+	return fmt.Errorf("unknown subcommand(%s)", args[0])
+}
+
+// overrideList prints overrides of all or one node/group
+func overrideList(ctx *env, args []string) error {
+	prefix := client.DefaultOverrideKeyPrefix + "/"
+	if len(args) > 0 {
+		prefix += args[0] + "/"
+	}
+	pairs, _, err := ctx.kv.List(prefix, nil)
+	if err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		parts := strings.SplitN(strings.TrimPrefix(pair.Key, client.DefaultOverrideKeyPrefix+"/"), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fmt.Printf("%s\t%s\t%s\n", parts[0], parts[1], pair.Value)
+	}
+	return nil
+}
+
+// overrideSet redirects a node or group to another app, a pinned branch/rev, and/or overrides keys
+// pinning a branch/rev registers a derived app(<app>@<target>) deployed by the master
+func overrideSet(ctx *env, args []string) error {
+	fs := flag.NewFlagSet("override set", flag.ContinueOnError)
+	app := fs.String("app", "", "redirect to snapshot of another app")
+	branch := fs.String("branch", "", "pin branch")
+	rev := fs.String("rev", "", "pin rev(latest, commit or tag)")
+	var keys listFlag
+	fs.Var(&keys, "key", "override key(k=v), repeatable, refused by slaves verifying signatures")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: override set [flags] <target> <app>")
+	}
+	target, appID := fs.Arg(0), fs.Arg(1)
+
+	o := &client.Override{App: *app}
+	for _, kv := range keys {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid key(%s)", kv)
+		}
+		if o.Keys == nil {
+			o.Keys = make(map[string]string)
+		}
+		o.Keys[parts[0]] = parts[1]
+	}
+
+	ops := consulapi.KVTxnOps{}
+	if *branch != "" || *rev != "" {
+		if o.App != "" {
+			return fmt.Errorf("-app can't be combined with -branch/-rev")
+		}
+		o.App = client.DerivedAppID(appID, target)
+		derived, err := derivedAppOps(ctx, appID, o.App, *branch, *rev)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, derived...)
+	}
+	if o.App == "" && len(o.Keys) == 0 {
+		return fmt.Errorf("nothing to override")
+	}
+
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	if _, err := client.ParseOverride(data); err != nil {
+		return err
+	}
+	ops = append(ops, &consulapi.KVTxnOp{
+		Verb:  string(consulapi.KVSet),
+		Key:   client.OverrideKey(client.DefaultOverrideKeyPrefix, target, appID),
+		Value: data,
+	})
+	if err := txn(ctx, ops, nil); err != nil {
+		return err
+	}
+	recordManual(ctx, appID, "", actionOverrideSet, fmt.Sprintf("target(%s) %s", target, data))
+	return nil
+}
+
+// derivedAppOps copies app configuration to a derived app with branch/rev replaced
+func derivedAppOps(ctx *env, appID, derivedID, branch, rev string) (consulapi.KVTxnOps, error) {
+	prefix := DefaultGlobalConfigKeyPrefix + "/" + appID + "/"
+	pairs, _, err := ctx.kv.List(prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("app(%s) not found", appID)
+	}
+
+	ops := consulapi.KVTxnOps{
+		{Verb: string(consulapi.KVDeleteTree), Key: DefaultGlobalConfigKeyPrefix + "/" + derivedID + "/"},
+	}
+	for _, pair := range pairs {
+		field := strings.TrimPrefix(pair.Key, prefix)
+		value := pair.Value
+		switch strings.ToLower(field) {
+		case "id":
+			value = []byte(derivedID)
+		case "branch":
+			if branch != "" {
+				value = []byte(branch)
+			}
+		case "rev":
+			if rev != "" {
+				value = []byte(rev)
+			}
+		}
+		ops = append(ops, &consulapi.KVTxnOp{
+			Verb:  string(consulapi.KVSet),
+			Key:   DefaultGlobalConfigKeyPrefix + "/" + derivedID + "/" + field,
+			Value: value,
+		})
+	}
+	return ops, nil
+}
+
+// overrideRemove removes an override and the app derived for it
+func overrideRemove(ctx *env, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: override rm <target> <app>")
+	}
+	target, appID := args[0], args[1]
+	derivedID := client.DerivedAppID(appID, target)
+
+	err := txn(ctx, consulapi.KVTxnOps{
+		{Verb: string(consulapi.KVDelete), Key: client.OverrideKey(client.DefaultOverrideKeyPrefix, target, appID)},
+		{Verb: string(consulapi.KVDeleteTree), Key: DefaultGlobalConfigKeyPrefix + "/" + derivedID + "/"},
+	}, nil)
+	if err != nil {
+		return err
+	}
+	recordManual(ctx, appID, "", actionOverrideRemove, fmt.Sprintf("target(%s)", target))
+	return nil
+}
+
+// txn applies ops atomically, in another datacenter when set in q
+func txn(ctx *env, ops consulapi.KVTxnOps, q *consulapi.QueryOptions) error {
+	ok, response, _, err := ctx.kv.Txn(ops, q)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		var errs []string
+		for _, e := range response.Errors {
+			errs = append(errs, e.What)
+		}
+		return fmt.Errorf("transaction failed: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
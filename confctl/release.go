@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+)
+
+const (
+	// deployed state & triggers of the master, see deploy_status.go & history.go
+	stateDeployed   = "deployed"
+	triggerRollback = "rollback"
+	triggerPromote  = "promote"
+
+	latestRev = "latest"
+)
+
+// deployedCommits lists distinct commits deployed according to history, most recent first
+func deployedCommits(entries []*client.HistoryEntry) []string {
+	var commits []string
+	seen := make(map[string]bool)
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.State != stateDeployed || e.Commit == "" || seen[e.Commit] {
+			continue
+		}
+		seen[e.Commit] = true
+		commits = append(commits, e.Commit)
+	}
+	return commits
+}
+
+// rollbackTarget picks the commit to roll back to, to(full or abbreviated commit) wins over steps
+func rollbackTarget(commits []string, to string, steps int) (string, error) {
+	if len(commits) == 0 {
+		return "", fmt.Errorf("no deploy in history")
+	}
+
+	if to != "" {
+		var matches []string
+		for _, commit := range commits {
+			if strings.HasPrefix(commit, to) {
+				matches = append(matches, commit)
+			}
+		}
+		switch {
+		case len(matches) == 0:
+			return "", fmt.Errorf("commit(%s) not deployed in history", to)
+		case len(matches) > 1:
+			return "", fmt.Errorf("commit(%s) is ambiguous", to)
+		case matches[0] == commits[0]:
+			return "", fmt.Errorf("commit(%s) is currently deployed", matches[0])
+		}
+		return matches[0], nil
+	}
+
+	if steps < 1 {
+		return "", fmt.Errorf("invalid steps(%d)", steps)
+	}
+	if steps >= len(commits) {
+		return "", fmt.Errorf("only %d earlier commit(s) in history", len(commits)-1)
+	}
+	return commits[steps], nil
+}
+
+// setRevOps pins rev of an app leaving a change note, so master records the deploy with its trigger
+func setRevOps(appID, rev, trigger, reason string) (consulapi.KVTxnOps, error) {
+	note, err := json.Marshal(&client.ChangeNote{
+		Rev:     rev,
+		Trigger: trigger,
+		Reason:  reason,
+		Actor:   actor(),
+		Time:    time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	prefix := DefaultGlobalConfigKeyPrefix + "/" + appID + "/"
+	return consulapi.KVTxnOps{
+		{Verb: string(consulapi.KVSet), Key: prefix + "change", Value: note},
+		{Verb: string(consulapi.KVSet), Key: prefix + "rev", Value: []byte(rev)},
+	}, nil
+}
+
+// currentRev reads rev configured for an app
+func currentRev(ctx *env, appID string, q *consulapi.QueryOptions) (string, error) {
+	pair, _, err := ctx.kv.Get(DefaultGlobalConfigKeyPrefix+"/"+appID+"/rev", q)
+	if err != nil {
+		return "", err
+	}
+	if pair == nil {
+		return "", fmt.Errorf("app(%s) not found", appID)
+	}
+	return string(pair.Value), nil
+}
+
+// rollbackCommand pins an app to a commit deployed earlier
+func rollbackCommand(ctx *env, args []string) error {
+	fs := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	to := fs.String("to", "", "commit to roll back to")
+	steps := fs.Int("steps", 1, "number of deployed commits to go back")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: rollback [-to commit | -steps n] <app>")
+	}
+	appID := fs.Arg(0)
+
+	rev, err := currentRev(ctx, appID, nil)
+	if err != nil {
+		return err
+	}
+	entries, err := loadHistory(ctx, appID, nil)
+	if err != nil {
+		return err
+	}
+	commits := deployedCommits(entries)
+	target, err := rollbackTarget(commits, *to, *steps)
+	if err != nil {
+		return err
+	}
+
+	pair, _, err := ctx.kv.Get(blockedKey(appID, target), nil)
+	if err != nil {
+		return err
+	}
+	if pair != nil {
+		return fmt.Errorf("commit(%s) is blocked, unblock it first", target)
+	}
+
+	ops, err := setRevOps(appID, target, triggerRollback, fmt.Sprintf("rollback from commit(%s)", commits[0]))
+	if err != nil {
+		return err
+	}
+	if err := txn(ctx, ops, nil); err != nil {
+		return err
+	}
+
+	fmt.Printf("app(%s) rev set to commit(%s), was(%s)\n", appID, target, rev)
+	if rev == latestRev {
+		fmt.Printf("app(%s) no longer follows latest commit, set rev back to %s once fixed\n", appID, latestRev)
+	}
+	return nil
+}
+
+// promoteArgs parses <app> --from <env> --to <env>, both environments(datacenters) are required
+func promoteArgs(args []string) (appID, from, to string, err error) {
+	usage := fmt.Errorf("usage: promote <app> --from <env> --to <env>")
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "", "", "", usage
+	}
+	fs := flag.NewFlagSet("promote", flag.ContinueOnError)
+	fromFlag := fs.String("from", "", "environment(datacenter) to promote from")
+	toFlag := fs.String("to", "", "environment(datacenter) to promote to")
+	if err := fs.Parse(args[1:]); err != nil {
+		return "", "", "", err
+	}
+	if fs.NArg() != 0 || *fromFlag == "" || *toFlag == "" {
+		return "", "", "", usage
+	}
+	if *fromFlag == *toFlag {
+		return "", "", "", fmt.Errorf("promoting app(%s) from and to environment(%s)", args[0], *fromFlag)
+	}
+	return args[0], *fromFlag, *toFlag, nil
+}
+
+// promoteCommand pins an app to the commit deployed in another environment(Consul datacenter)
+func promoteCommand(ctx *env, args []string) error {
+	appID, from, to, err := promoteArgs(args)
+	if err != nil {
+		return err
+	}
+
+	// exact commit deployed, rev in the source environment may be a branch head moving on
+	pair, _, err := ctx.kv.Get(client.DefaultKeyPrefix+"/"+appID+"/"+client.MetaCommitKey, &consulapi.QueryOptions{Datacenter: from})
+	if err != nil {
+		return err
+	}
+	if pair == nil {
+		return fmt.Errorf("app(%s) not deployed in datacenter(%s)", appID, from)
+	}
+	commit := string(pair.Value)
+
+	q := &consulapi.QueryOptions{Datacenter: to}
+	rev, err := currentRev(ctx, appID, q)
+	if err != nil {
+		return err
+	}
+	if rev == commit {
+		return fmt.Errorf("app(%s) already at commit(%s)", appID, commit)
+	}
+
+	ops, err := setRevOps(appID, commit, triggerPromote, fmt.Sprintf("promoted from datacenter(%s)", from))
+	if err != nil {
+		return err
+	}
+	if err := txn(ctx, ops, q); err != nil {
+		return err
+	}
+
+	fmt.Printf("app(%s) rev set to commit(%s), was(%s)\n", appID, commit, rev)
+	return nil
+}
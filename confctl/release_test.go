@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+)
+
+func TestRollbackTarget(t *testing.T) {
+	entries := []*client.HistoryEntry{
+		{Commit: "aaa111", State: stateDeployed},
+		{Commit: "bbb222", State: stateDeployed},
+		{Commit: "ccc333", State: "refused"},
+		{Commit: "aaa111", State: stateDeployed},
+		{Commit: "ddd444", State: stateDeployed},
+	}
+	commits := deployedCommits(entries)
+	if !reflect.DeepEqual(commits, []string{"ddd444", "aaa111", "bbb222"}) {
+		t.Fatalf("unexpected deployed commits(%v)", commits)
+	}
+
+	cases := []struct {
+		to       string
+		steps    int
+		expected string
+	}{
+		{"", 1, "aaa111"},
+		{"", 2, "bbb222"},
+		{"bbb", 1, "bbb222"},
+	}
+	for _, c := range cases {
+		target, err := rollbackTarget(commits, c.to, c.steps)
+		if err != nil || target != c.expected {
+			t.Fatalf("rollbackTarget(%s, %d) = %s, %v", c.to, c.steps, target, err)
+		}
+	}
+
+	for _, c := range []struct {
+		to    string
+		steps int
+	}{
+		{"", 3},
+		{"", 0},
+		{"ccc", 1},
+		{"ddd", 1},
+	} {
+		if _, err := rollbackTarget(commits, c.to, c.steps); err == nil {
+			t.Fatalf("expected error for(%s, %d)", c.to, c.steps)
+		}
+	}
+}
+
+func TestPromoteArgs(t *testing.T) {
+	appID, from, to, err := promoteArgs([]string{"web", "--from", "staging", "--to", "prod"})
+	if err != nil || appID != "web" || from != "staging" || to != "prod" {
+		t.Fatalf("unexpected promote args %s %s %s %v", appID, from, to, err)
+	}
+	for _, args := range [][]string{
+		nil,
+		{"-from", "staging", "-to", "prod", "web"},
+		{"web", "--from", "staging"},
+		{"web", "--to", "prod"},
+		{"web", "--from", "prod", "--to", "prod"},
+		{"web", "--from", "staging", "--to", "prod", "api"},
+	} {
+		if _, _, _, err := promoteArgs(args); err == nil {
+			t.Fatalf("expected promote args %v refused", args)
+		}
+	}
+}
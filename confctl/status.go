@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+)
+
+// DefaultSlaveService is the service slave agents register as
+const DefaultSlaveService = "confslave"
+
+// statusCommand prints how many nodes applied each commit of an app, stragglers & failures
+func statusCommand(ctx *env, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: status <app>")
+	}
+	appID := fs.Arg(0)
+
+	var commit string
+	pair, _, err := ctx.kv.Get(client.DefaultKeyPrefix+"/"+appID+"/"+client.MetaCommitKey, nil)
+	if err != nil {
+		return err
+	}
+	if pair != nil {
+		commit = string(pair.Value)
+	}
+
+	pairs, _, err := ctx.kv.List(client.StatusKey(client.DefaultStatusKeyPrefix, appID, ""), nil)
+	if err != nil {
+		return err
+	}
+	var statuses []*client.AppliedStatus
+	for _, pair := range pairs {
+		s, err := client.ParseAppliedStatus(pair.Value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid status(%s): %v\n", pair.Key, err)
+			continue
+		}
+		statuses = append(statuses, s)
+	}
+
+	services, _, err := ctx.client.Catalog().Service(DefaultSlaveService, "", nil)
+	if err != nil {
+		return err
+	}
+	var nodes []string
+	for _, service := range services {
+		nodes = append(nodes, service.Node)
+	}
+
+	printFleet(client.SummarizeFleet(appID, commit, statuses, nodes))
+	return nil
+}
+
+// printFleet prints commits by number of nodes, then stragglers, failures & nodes not reporting
+func printFleet(f *client.FleetStatus) {
+	fmt.Printf("app(%s) deployed commit(%s) nodes(%d)\n", f.App, f.Commit, f.Nodes)
+
+	var commits []string
+	for c := range f.Commits {
+		commits = append(commits, c)
+	}
+	sort.Slice(commits, func(i, j int) bool {
+		if f.Commits[commits[i]] != f.Commits[commits[j]] {
+			return f.Commits[commits[i]] > f.Commits[commits[j]]
+		}
+		return commits[i] < commits[j]
+	})
+	for _, c := range commits {
+		name, mark := c, ""
+		if c == f.Commit {
+			mark = "\tdeployed"
+		}
+		if c == "" {
+			name = "(none)"
+		}
+		fmt.Printf("%d\t%s%s\n", f.Commits[c], name, mark)
+	}
+
+	if len(f.Stragglers) > 0 {
+		fmt.Printf("stragglers:\n")
+		for _, s := range f.Stragglers {
+			fmt.Printf("%s\t%s\t%s\t%s\n", s.Node, s.Commit, formatTime(s.AppliedAt), s.Version)
+		}
+	}
+	if len(f.Failures) > 0 {
+		fmt.Printf("failures:\n")
+		for _, s := range f.Failures {
+			fmt.Printf("%s\t%s\t%s\t%s\n", s.Node, s.FailedCommit, formatTime(s.Time), s.Error)
+		}
+	}
+	if len(f.Missing) > 0 {
+		fmt.Printf("not reporting:\n")
+		for _, node := range f.Missing {
+			fmt.Printf("%s\n", node)
+		}
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
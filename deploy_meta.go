@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+)
+
+const (
+	// MetaKeyPrefix is a key prefix for deploy metadata in app snapshots
+	MetaKeyPrefix = client.MetaKeyPrefix
+
+	metaBranch      = MetaKeyPrefix + "branch"
+	metaRev         = MetaKeyPrefix + "rev"
+	metaCommit      = client.MetaCommitKey
+	metaRepo        = MetaKeyPrefix + "repo"
+	metaAuthor      = MetaKeyPrefix + "author"
+	metaCommittedAt = MetaKeyPrefix + "committed_at"
+	metaSubject     = MetaKeyPrefix + "subject"
+	metaDeployedAt  = MetaKeyPrefix + "deployed_at"
+	metaDeployedBy  = MetaKeyPrefix + "deployed_by"
+	metaHash        = client.MetaHashKey
+	metaChanges     = MetaKeyPrefix + "changes"
+	metaValidation  = MetaKeyPrefix + "validation"
+	metaEncrypted   = client.MetaEncryptedKey
+	metaSecretPaths = client.MetaSecretPathsKey
+
+	metaHealthCheck   = MetaKeyPrefix + "health_check"
+	metaHealthTimeout = MetaKeyPrefix + "health_timeout"
+)
+
+// isMetaKey checks whether key(relative to app prefix) is a metadata key
+func isMetaKey(key string) bool {
+	return client.IsMetaKey(key)
+}
+
+// KeyChanges lists keys changed relative to the previous deploy
+type KeyChanges struct {
+	Added   []string `json:"added"`
+	Changed []string `json:"changed"`
+	Removed []string `json:"removed"`
+}
+
+// diffSnapshot compares two snapshots (metadata excluded)
+func diffSnapshot(prev, next map[string][]byte) *KeyChanges {
+	changes := &KeyChanges{
+		Added:   []string{},
+		Changed: []string{},
+		Removed: []string{},
+	}
+
+	for k, v := range next {
+		if isMetaKey(k) {
+			continue
+		}
+		old, ok := prev[k]
+		if !ok {
+			changes.Added = append(changes.Added, k)
+		} else if !bytes.Equal(old, v) {
+			changes.Changed = append(changes.Changed, k)
+		}
+	}
+	for k := range prev {
+		if isMetaKey(k) {
+			continue
+		}
+		if _, ok := next[k]; !ok {
+			changes.Removed = append(changes.Removed, k)
+		}
+	}
+
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Changed)
+	sort.Strings(changes.Removed)
+	return changes
+}
+
+// addCommitMeta adds commit attributes & deploy info to snapshot
+func addCommitMeta(kvs map[string][]byte, info *CommitInfo, nodeName string) {
+	kvs[metaAuthor] = []byte(info.Author)
+	kvs[metaCommittedAt] = []byte(info.CommittedAt.UTC().Format(time.RFC3339))
+	kvs[metaSubject] = []byte(info.Subject)
+	kvs[metaDeployedAt] = []byte(time.Now().UTC().Format(time.RFC3339))
+	kvs[metaDeployedBy] = []byte(nodeName)
+}
+
+// encodeChanges serializes KeyChanges for _meta/changes
+func encodeChanges(changes *KeyChanges) []byte {
+	data, err := json.Marshal(changes)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
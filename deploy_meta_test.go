@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffSnapshot(t *testing.T) {
+	prev := map[string][]byte{
+		"a":        []byte("1"),
+		"b":        []byte("2"),
+		"c":        []byte("3"),
+		metaCommit: []byte("old"),
+	}
+	next := map[string][]byte{
+		"a":        []byte("1"),
+		"b":        []byte("20"),
+		"d":        []byte("4"),
+		metaCommit: []byte("new"),
+	}
+
+	changes := diffSnapshot(prev, next)
+	expected := &KeyChanges{
+		Added:   []string{"d"},
+		Changed: []string{"b"},
+		Removed: []string{"c"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expected(%+v) got(%+v)", expected, changes)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DeployDeployed means the commit was pushed to KV
+	DeployDeployed = "deployed"
+	// DeployRefused means the commit was refused and last good snapshot kept
+	DeployRefused = "refused"
+	// DeployRollingOut means the commit is being rolled out in stages
+	DeployRollingOut = "rolling_out"
+	// DeployPaused means a stage failed and staged nodes were left on the commit
+	DeployPaused = "paused"
+	// DeployRolledBack means a stage failed and staged nodes went back to the deployed snapshot
+	DeployRolledBack = "rolled_back"
+	// DeploySkipped means the commit is blocked and was not deployed
+	DeploySkipped = "skipped"
+	// DeployBlocked means the commit failed health checks and is not deployed again until unblocked
+	DeployBlocked = "blocked"
+	// DeployHeld means the commit is queued until a freeze lifts
+	DeployHeld = "held"
+	// DeployAwaitingApproval means the commit is parked until enough approvers approve it
+	DeployAwaitingApproval = "awaiting_approval"
+)
+
+// DeployStatus is the outcome of the latest deploy attempt for an app
+// Trigger is what caused the attempt(config, poll, rollout, rollback or manual)
+type DeployStatus struct {
+	AppID   string    `json:"app"`
+	Commit  string    `json:"commit"`
+	State   string    `json:"state"`
+	Reason  string    `json:"reason,omitempty"`
+	Trigger string    `json:"trigger,omitempty"`
+	Node    string    `json:"node"`
+	Time    time.Time `json:"time"`
+
+	Validation *ValidationReport `json:"validation,omitempty"`
+}
+
+// newDeployStatus creates a DeployStatus stamped with current time
+func newDeployStatus(appID, commit, state, reason, node string) *DeployStatus {
+	return &DeployStatus{
+		AppID:  appID,
+		Commit: commit,
+		State:  state,
+		Reason: reason,
+		Node:   node,
+		Time:   time.Now().UTC(),
+	}
+}
+
+// encode serializes DeployStatus for KV
+func (s *DeployStatus) encode() []byte {
+	data, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// AppState is what master knows about an app, served by the admin API
+type AppState struct {
+	AppID      string            `json:"app"`
+	Status     *DeployStatus     `json:"status,omitempty"`
+	Validation *ValidationReport `json:"validation,omitempty"`
+	// commits held by a freeze, oldest first, the newest is deployed once the freeze lifts
+	Pending []*PendingDeploy `json:"pending,omitempty"`
+	// commit parked until approved
+	Approval *ApprovalRequest `json:"approval,omitempty"`
+	// keys edited outside of the master since its last push
+	Drift *DriftReport `json:"drift,omitempty"`
+}
+
+// PendingDeploy is a commit held by a freeze
+type PendingDeploy struct {
+	Commit  string    `json:"commit"`
+	Trigger string    `json:"trigger"`
+	Reason  string    `json:"reason,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// appStates keeps AppState per app, shared between fetchers & admin API
+type appStates struct {
+	lock   sync.RWMutex
+	states map[string]*AppState
+}
+
+func newAppStates() *appStates {
+	return &appStates{states: make(map[string]*AppState)}
+}
+
+// update applies fn to the state of an app under lock
+func (s *appStates) update(appID string, fn func(*AppState)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, ok := s.states[appID]
+	if !ok {
+		st = &AppState{AppID: appID}
+		s.states[appID] = st
+	}
+	fn(st)
+}
+
+// get returns a copy of the state of an app
+func (s *appStates) get(appID string) (AppState, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	st, ok := s.states[appID]
+	if !ok {
+		return AppState{}, false
+	}
+	return *st, true
+}
+
+// list returns copies of every app state sorted by app id
+func (s *appStates) list() []AppState {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var states []AppState
+	for _, st := range s.states {
+		states = append(states, *st)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].AppID < states[j].AppID
+	})
+	return states
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+const (
+	// DriftAlert reports keys edited outside of the master (default)
+	DriftAlert = "alert"
+	// DriftRevert reports edited keys and pushes the deployed snapshot again
+	DriftRevert = "revert"
+	// DriftOff ignores edits
+	DriftOff = "off"
+)
+
+// DriftReport lists keys of an app edited since the master pushed its snapshot, metadata excluded
+type DriftReport struct {
+	AppID    string      `json:"app"`
+	Commit   string      `json:"commit"`
+	Policy   string      `json:"policy"`
+	Keys     *KeyChanges `json:"keys"`
+	Detected time.Time   `json:"detected"`
+	Reverted bool        `json:"reverted"`
+}
+
+// DriftDetectorConfig is configuration for DriftDetector
+type DriftDetectorConfig struct {
+	store        kvstore.Store
+	appKeyPrefix string
+	states       *appStates
+	// only the leader reverts
+	isLeader func() (bool, error)
+	// pusher changes, reverts are queued along snapshots
+	changes chan *ConfChange
+}
+
+// DriftDetector watches the app prefix and compares it with snapshots pushed by this master
+type DriftDetector struct {
+	shutdown     bool
+	shutdownLock sync.Mutex
+	shutdownCh   chan struct{}
+
+	watcher      *Watcher
+	appKeyPrefix string
+	states       *appStates
+	isLeader     func() (bool, error)
+	changes      chan *ConfChange
+	log          *logrus.Entry
+
+	lock sync.Mutex
+	// snapshots last pushed & drift policy per app
+	expected map[string]map[string][]byte
+	policies map[string]string
+}
+
+// NewDriftDetector creates a new DriftDetector
+func NewDriftDetector(config *DriftDetectorConfig) (*DriftDetector, error) {
+	appKeyPrefix := config.appKeyPrefix
+	if appKeyPrefix == "" {
+		appKeyPrefix = DefaultAppConfigKeyPrefix
+	}
+
+	watcher, err := NewWatcher(&WatcherConfig{watchType: "prefix", key: appKeyPrefix, store: config.store})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DriftDetector{
+		shutdownCh:   make(chan struct{}),
+		watcher:      watcher,
+		appKeyPrefix: appKeyPrefix,
+		states:       config.states,
+		isLeader:     config.isLeader,
+		changes:      config.changes,
+		log:          configureLogger("drift"),
+
+		expected: make(map[string]map[string][]byte),
+		policies: make(map[string]string),
+	}, nil
+}
+
+// Run starts DriftDetector
+func (d *DriftDetector) Run() {
+	go d.Loop()
+}
+
+// Loop is internal loop for DriftDetector
+func (d *DriftDetector) Loop() {
+	for {
+		select {
+		case <-d.shutdownCh:
+			return
+		case v, ok := <-d.watcher.eventCh:
+			if !ok {
+				return
+			}
+			pairs, ok := v.(kvstore.Pairs)
+			if !ok {
+				panic("invalid value from watcher")
+			}
+			d.check(pairs)
+		}
+	}
+}
+
+// setPolicy sets drift policy(alert/revert/off) of an app, alert when empty
+func (d *DriftDetector) setPolicy(appID, policy string) {
+	switch policy {
+	case "":
+		policy = DriftAlert
+	case DriftAlert, DriftRevert, DriftOff:
+	default:
+		d.log.Errorf("Unknown drift policy(%s) of app(%s), alerting only", policy, appID)
+		policy = DriftAlert
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.policies[appID] = policy
+}
+
+// expect records a snapshot about to be pushed, called by the pusher before its transaction
+// derived apps(overrides, rollout candidates) are managed elsewhere and not checked
+func (d *DriftDetector) expect(appID string, kvs map[string][]byte) {
+	if client.IsDerivedApp(appID) {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.expected[appID] = *copySnapshot(kvs)
+}
+
+// forget drops the snapshot expected of an app, e.g. when its push failed
+func (d *DriftDetector) forget(appID string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.expected, appID)
+}
+
+// check compares pairs under the app prefix with expected snapshots
+func (d *DriftDetector) check(pairs kvstore.Pairs) {
+	live := make(map[string]map[string][]byte)
+	for _, pair := range pairs {
+		parts := strings.SplitN(strings.TrimPrefix(pair.Key, d.appKeyPrefix+"/"), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if live[parts[0]] == nil {
+			live[parts[0]] = make(map[string][]byte)
+		}
+		live[parts[0]][parts[1]] = pair.Value
+	}
+
+	d.lock.Lock()
+	// report per app checked, nil when in sync
+	reports := make(map[string]*DriftReport)
+	var reverts []*ConfChange
+	for appID, expected := range d.expected {
+		policy := d.policies[appID]
+		if policy == "" {
+			policy = DriftAlert
+		}
+		var report *DriftReport
+		if policy != DriftOff {
+			report = driftOf(appID, expected, live[appID])
+		}
+		reports[appID] = report
+		if report == nil {
+			continue
+		}
+		report.Policy = policy
+		if policy == DriftRevert {
+			reverts = append(reverts, &ConfChange{appID: appID, kvs: copySnapshot(expected)})
+		}
+	}
+	d.lock.Unlock()
+
+	leader := false
+	if len(reverts) > 0 {
+		var err error
+		if leader, err = d.isLeader(); err != nil {
+			d.log.Errorf("Failed to check leadership: %v", err)
+		}
+	}
+	for appID, report := range reports {
+		if report != nil {
+			report.Reverted = report.Policy == DriftRevert && leader
+			d.log.Warnf("app(%s) commit(%s) drifted, added(%v) changed(%v) removed(%v) reverted(%v)",
+				appID, report.Commit, report.Keys.Added, report.Keys.Changed, report.Keys.Removed, report.Reverted)
+		}
+		if d.states != nil {
+			d.states.update(appID, func(st *AppState) {
+				st.Drift = report
+			})
+		}
+	}
+	if leader {
+		for _, change := range reverts {
+			d.changes <- change
+		}
+	}
+}
+
+// driftOf compares a live snapshot with the expected one, nil when they match
+// or when another commit was deployed meanwhile, which makes the expectation stale
+func driftOf(appID string, expected, live map[string][]byte) *DriftReport {
+	commit := string(expected[metaCommit])
+	if live != nil && string(live[metaCommit]) != commit {
+		return nil
+	}
+	changes := diffSnapshot(expected, live)
+	if len(changes.Added)+len(changes.Changed)+len(changes.Removed) == 0 {
+		return nil
+	}
+	return &DriftReport{
+		AppID:    appID,
+		Commit:   commit,
+		Keys:     changes,
+		Detected: time.Now().UTC(),
+	}
+}
+
+// Shutdown shutdowns DriftDetector
+func (d *DriftDetector) Shutdown() {
+	d.shutdownLock.Lock()
+	defer d.shutdownLock.Unlock()
+
+	if d.shutdown {
+		return
+	}
+	d.shutdown = true
+
+	d.watcher.Shutdown()
+	close(d.shutdownCh)
+}
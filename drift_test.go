@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+func TestDriftDetector(t *testing.T) {
+	d := &DriftDetector{
+		appKeyPrefix: DefaultAppConfigKeyPrefix,
+		states:       newAppStates(),
+		isLeader:     func() (bool, error) { return true, nil },
+		changes:      make(chan *ConfChange, 5),
+		log:          configureLogger("drift"),
+		expected:     make(map[string]map[string][]byte),
+		policies:     make(map[string]string),
+	}
+	snapshot := map[string][]byte{metaCommit: []byte("abc"), "a.conf": []byte("x=1"), "b.conf": []byte("y=1")}
+	d.expect("web", snapshot)
+	d.expect("api", snapshot)
+	d.expect(client.DerivedAppID("web", "canary"), snapshot)
+	d.setPolicy("api", DriftRevert)
+
+	d.check(kvstore.Pairs{
+		{Key: "config/app/web/_meta/commit", Value: []byte("abc")},
+		{Key: "config/app/web/a.conf", Value: []byte("x=2")},
+		{Key: "config/app/web/c.conf", Value: []byte("z=1")},
+		{Key: "config/app/web/_meta/changes", Value: []byte("{}")},
+		{Key: "config/app/api/_meta/commit", Value: []byte("abc")},
+		{Key: "config/app/api/a.conf", Value: []byte("x=1")},
+	})
+
+	st, _ := d.states.get("web")
+	expected := &KeyChanges{Added: []string{"c.conf"}, Changed: []string{"a.conf"}, Removed: []string{"b.conf"}}
+	if st.Drift == nil || st.Drift.Commit != "abc" || st.Drift.Reverted || !reflect.DeepEqual(st.Drift.Keys, expected) {
+		t.Fatalf("unexpected drift of web %+v", st.Drift)
+	}
+	if _, ok := d.states.get(client.DerivedAppID("web", "canary")); ok {
+		t.Fatal("derived apps should not be checked")
+	}
+
+	st, _ = d.states.get("api")
+	if st.Drift == nil || !st.Drift.Reverted || len(d.changes) != 1 {
+		t.Fatalf("expected api to be reverted %+v", st.Drift)
+	}
+	change := <-d.changes
+	if change.appID != "api" || string((*change.kvs)["b.conf"]) != "y=1" {
+		t.Fatalf("unexpected revert %+v", change)
+	}
+
+	// another commit deployed meanwhile, in sync again
+	d.check(kvstore.Pairs{
+		{Key: "config/app/web/_meta/commit", Value: []byte("def")},
+		{Key: "config/app/api/_meta/commit", Value: []byte("abc")},
+		{Key: "config/app/api/a.conf", Value: []byte("x=1")},
+		{Key: "config/app/api/b.conf", Value: []byte("y=1")},
+	})
+	if st, _ := d.states.get("web"); st.Drift != nil {
+		t.Fatalf("expected stale expectation to be ignored %+v", st.Drift)
+	}
+	if st, _ := d.states.get("api"); st.Drift != nil || len(d.changes) != 0 {
+		t.Fatalf("expected api in sync %+v", st.Drift)
+	}
+
+	// not leading, alerting only
+	d.isLeader = func() (bool, error) { return false, nil }
+	d.check(kvstore.Pairs{{Key: "config/app/api/_meta/commit", Value: []byte("abc")}})
+	if st, _ := d.states.get("api"); st.Drift == nil || st.Drift.Reverted || len(d.changes) != 0 {
+		t.Fatalf("expected api drift not reverted %+v", st.Drift)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+// FleetViewConfig is configuration for FleetView
+type FleetViewConfig struct {
+	store           kvstore.Store
+	statusKeyPrefix string
+	appKeyPrefix    string
+}
+
+// FleetView aggregates applied state reported by slaves, read from KV so standby masters serve it too
+type FleetView struct {
+	store           kvstore.Store
+	statusKeyPrefix string
+	appKeyPrefix    string
+	log             *logrus.Entry
+}
+
+// NewFleetView creates a new FleetView
+func NewFleetView(config *FleetViewConfig) *FleetView {
+	statusKeyPrefix := config.statusKeyPrefix
+	if statusKeyPrefix == "" {
+		statusKeyPrefix = client.DefaultStatusKeyPrefix
+	}
+	appKeyPrefix := config.appKeyPrefix
+	if appKeyPrefix == "" {
+		appKeyPrefix = DefaultAppConfigKeyPrefix
+	}
+	return &FleetView{
+		store:           config.store,
+		statusKeyPrefix: statusKeyPrefix,
+		appKeyPrefix:    appKeyPrefix,
+		log:             configureLogger("fleet"),
+	}
+}
+
+// status aggregates statuses of an app against the commit deployed
+func (v *FleetView) status(appID string) (*client.FleetStatus, error) {
+	var commit string
+	pair, err := v.store.Get(v.appKeyPrefix + "/" + appID + "/" + metaCommit)
+	if err != nil {
+		return nil, err
+	}
+	if pair != nil {
+		commit = string(pair.Value)
+	}
+
+	pairs, err := v.store.List(client.StatusKey(v.statusKeyPrefix, appID, ""))
+	if err != nil {
+		return nil, err
+	}
+	var statuses []*client.AppliedStatus
+	for _, pair := range pairs {
+		s, err := client.ParseAppliedStatus(pair.Value)
+		if err != nil {
+			v.log.Errorf("Invalid status(%s): %v", pair.Key, err)
+			continue
+		}
+		statuses = append(statuses, s)
+	}
+
+	nodes, err := listSlaveNodes(v.store)
+	if err != nil {
+		return nil, err
+	}
+	return client.SummarizeFleet(appID, commit, statuses, nodes), nil
+}
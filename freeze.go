@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+// FreezeManagerConfig is configuration for FreezeManager
+type FreezeManagerConfig struct {
+	store     kvstore.Store
+	keyPrefix string
+}
+
+// FreezeManager tracks global & per-app freezes and emergency deploys
+type FreezeManager struct {
+	shutdown     bool
+	shutdownLock sync.Mutex
+	shutdownCh   chan struct{}
+
+	config    *FreezeManagerConfig
+	watcher   *Watcher
+	store     kvstore.Store
+	log       *logrus.Entry
+	keyPrefix string
+
+	lock sync.RWMutex
+	// freezes per app, global freeze under ""
+	freezes     map[string]*client.Freeze
+	emergencies map[string]*client.EmergencyDeploy
+}
+
+// NewFreezeManager creates a new FreezeManager
+func NewFreezeManager(config *FreezeManagerConfig) (*FreezeManager, error) {
+	keyPrefix := config.keyPrefix
+	if keyPrefix == "" {
+		keyPrefix = client.DefaultFreezeKeyPrefix
+	}
+
+	watcher, err := NewWatcher(&WatcherConfig{watchType: "prefix", key: keyPrefix, store: config.store})
+	if err != nil {
+		return nil, err
+	}
+
+	return &FreezeManager{
+		shutdownCh: make(chan struct{}),
+		config:     config,
+		watcher:    watcher,
+		store:      config.store,
+		log:        configureLogger("freeze"),
+		keyPrefix:  keyPrefix,
+
+		freezes:     make(map[string]*client.Freeze),
+		emergencies: make(map[string]*client.EmergencyDeploy),
+	}, nil
+}
+
+// Run starts FreezeManager
+func (m *FreezeManager) Run() {
+	go m.Loop()
+}
+
+// Loop is internal loop for FreezeManager
+func (m *FreezeManager) Loop() {
+	for {
+		select {
+		case <-m.shutdownCh:
+			return
+		case v, ok := <-m.watcher.eventCh:
+			if !ok {
+				return
+			}
+			pairs, ok := v.(kvstore.Pairs)
+			if !ok {
+				panic("invalid value from watcher")
+			}
+			m.update(pairs)
+		}
+	}
+}
+
+// update replaces freezes & emergency deploys as a whole
+func (m *FreezeManager) update(pairs kvstore.Pairs) {
+	freezes := make(map[string]*client.Freeze)
+	emergencies := make(map[string]*client.EmergencyDeploy)
+
+	for _, pair := range pairs {
+		// global, app/<appID> or emergency/<appID>
+		parts := strings.SplitN(strings.TrimPrefix(pair.Key, m.keyPrefix+"/"), "/", 2)
+		switch {
+		case len(parts) == 1 && parts[0] == "global":
+			f, err := client.ParseFreeze(pair.Value)
+			if err != nil {
+				m.log.Errorf("Invalid global freeze, held until fixed: %v", err)
+				f = invalidFreeze(err)
+			}
+			freezes[""] = f
+		case len(parts) == 2 && parts[0] == "app":
+			f, err := client.ParseFreeze(pair.Value)
+			if err != nil {
+				m.log.Errorf("Invalid freeze of app(%s), held until fixed: %v", parts[1], err)
+				f = invalidFreeze(err)
+			}
+			freezes[parts[1]] = f
+		case len(parts) == 2 && parts[0] == "emergency":
+			e, err := client.ParseEmergencyDeploy(pair.Value)
+			if err != nil {
+				m.log.Errorf("Invalid emergency deploy of app(%s): %v", parts[1], err)
+				continue
+			}
+			emergencies[parts[1]] = e
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.freezes = freezes
+	m.emergencies = emergencies
+}
+
+// invalidFreeze holds pushes until a freeze which can't be parsed is fixed or removed,
+// deploying through a freeze meant to hold them is worse than a held deploy
+func invalidFreeze(err error) *client.Freeze {
+	return &client.Freeze{Reason: fmt.Sprintf("invalid freeze(%v)", err)}
+}
+
+// frozen checks whether pushes of an app are held at now, returns the reason
+func (m *FreezeManager) frozen(appID string, now time.Time) (string, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if f, ok := m.freezes[""]; ok && f.Active(now) {
+		return "global freeze: " + f.Reason, true
+	}
+	if f, ok := m.freezes[appID]; ok && f.Active(now) {
+		return "app freeze: " + f.Reason, true
+	}
+	return "", false
+}
+
+// emergency returns the emergency deploy allowing commit of an app through a freeze
+func (m *FreezeManager) emergency(appID, commit string) *client.EmergencyDeploy {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	e, ok := m.emergencies[appID]
+	if !ok || (e.Commit != "" && e.Commit != commit) {
+		return nil
+	}
+	return e
+}
+
+// consume removes an emergency deploy once used, it lets a single deploy through
+func (m *FreezeManager) consume(appID string) {
+	m.lock.Lock()
+	delete(m.emergencies, appID)
+	m.lock.Unlock()
+
+	if err := m.store.Delete(client.EmergencyKey(m.keyPrefix, appID)); err != nil {
+		m.log.Errorf("Failed to remove emergency deploy of app(%s): %v", appID, err)
+	}
+}
+
+// Shutdown shutdowns FreezeManager
+func (m *FreezeManager) Shutdown() {
+	m.shutdownLock.Lock()
+	defer m.shutdownLock.Unlock()
+
+	if m.shutdown {
+		return
+	}
+	m.shutdown = true
+
+	m.watcher.Shutdown()
+	close(m.shutdownCh)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+func TestFreezeManager(t *testing.T) {
+	m := &FreezeManager{keyPrefix: client.DefaultFreezeKeyPrefix, log: configureLogger("freeze")}
+	m.update(kvstore.Pairs{
+		{Key: client.FreezeKey(m.keyPrefix, "web"), Value: []byte(`{"reason": "incident"}`)},
+		{Key: client.FreezeKey(m.keyPrefix, "api"), Value: []byte(`{"schedule": "bad"}`)},
+		{Key: client.EmergencyKey(m.keyPrefix, "web"), Value: []byte(`{"commit": "abc", "reason": "hotfix"}`)},
+	})
+
+	now := time.Now()
+	if why, frozen := m.frozen("web", now); !frozen || why != "app freeze: incident" {
+		t.Fatalf("web should be frozen(%s)", why)
+	}
+	if why, frozen := m.frozen("api", now); !frozen || !strings.HasPrefix(why, "app freeze: invalid freeze") {
+		t.Fatalf("invalid freeze should hold pushes(%s)", why)
+	}
+	if m.emergency("web", "abc") == nil || m.emergency("web", "def") != nil || m.emergency("api", "abc") != nil {
+		t.Fatalf("emergency deploy should only allow its commit")
+	}
+
+	m.update(kvstore.Pairs{
+		{Key: client.FreezeKey(m.keyPrefix, ""), Value: []byte(`{"reason": "holidays"}`)},
+	})
+	if why, frozen := m.frozen("api", now); !frozen || why != "global freeze: holidays" {
+		t.Fatalf("api should be frozen globally(%s)", why)
+	}
+	if m.emergency("web", "abc") != nil {
+		t.Fatalf("removed emergency deploy should be gone")
+	}
+}
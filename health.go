@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+const (
+	// DefaultHealthTimeout is how long a health check is retried after apply in second
+	DefaultHealthTimeout = 30
+
+	// health check kinds, e.g. http://127.0.0.1:8080/health, tcp://127.0.0.1:6379, cmd:pgrep nginx
+	healthCheckHTTP  = "http://"
+	healthCheckHTTPS = "https://"
+	healthCheckTCP   = "tcp://"
+	healthCheckCmd   = "cmd:"
+
+	healthRetryPeriod = time.Second
+)
+
+// parseHealthCheck validates a health check spec
+func parseHealthCheck(spec string) error {
+	for _, prefix := range []string{healthCheckHTTP, healthCheckHTTPS, healthCheckTCP, healthCheckCmd} {
+		if strings.HasPrefix(spec, prefix) && len(spec) > len(prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid health check(%s)", spec)
+}
+
+// checkOnce runs a health check once
+func checkOnce(ctx context.Context, spec string, env []string) error {
+	switch {
+	case strings.HasPrefix(spec, healthCheckHTTP), strings.HasPrefix(spec, healthCheckHTTPS):
+		req, err := http.NewRequest("GET", spec, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("status(%d)", resp.StatusCode)
+		}
+		return nil
+	case strings.HasPrefix(spec, healthCheckTCP):
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", strings.TrimPrefix(spec, healthCheckTCP))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case strings.HasPrefix(spec, healthCheckCmd):
+		cmd := exec.CommandContext(ctx, "sh", "-c", strings.TrimPrefix(spec, healthCheckCmd))
+		cmd.Env = append(os.Environ(), env...)
+		cmd.WaitDelay = time.Second
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			output := strings.TrimSpace(string(out))
+			if len(output) > maxValidatorOutput {
+				output = output[:maxValidatorOutput]
+			}
+			return fmt.Errorf("%v: %s", err, output)
+		}
+		return nil
+	}
+	return parseHealthCheck(spec)
+}
+
+// runHealthCheck retries a health check until it passes or timeout expires
+// services usually need a moment to reload a new snapshot
+func runHealthCheck(spec string, timeout time.Duration, env []string) error {
+	if err := parseHealthCheck(spec); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for {
+		err := checkOnce(ctx, spec, env)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("health check(%s) failed: %v", spec, err)
+		case <-time.After(healthRetryPeriod):
+		}
+	}
+}
+
+// parseFraction parses a fraction of nodes given as "0.2" or "20%"
+func parseFraction(s string) (float64, error) {
+	var f float64
+	var err error
+	if strings.HasSuffix(s, "%") {
+		f, err = strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		f /= 100
+	} else {
+		f, err = strconv.ParseFloat(s, 64)
+	}
+	if err != nil || f <= 0 || f > 1 {
+		return 0, fmt.Errorf("invalid fraction(%s)", s)
+	}
+	return f, nil
+}
+
+// BlockedCommit is a commit not deployed until an operator unblocks it
+// stored at <deploy prefix>/<appID>/blocked/<commit>
+type BlockedCommit struct {
+	Commit string    `json:"commit"`
+	Reason string    `json:"reason"`
+	Node   string    `json:"node"`
+	Time   time.Time `json:"time"`
+}
+
+// rollbackRequest asks the fetcher of an app to redeploy a good commit
+type rollbackRequest struct {
+	appID  string
+	commit string
+	from   string
+	reason string
+}
+
+// monitoredApp is the deployed commit of an app watched for failures
+type monitoredApp struct {
+	commit    string
+	threshold float64
+	lastGood  string
+	// decided once the commit is found good or rolled back
+	decided bool
+}
+
+// HealthMonitorConfig is configuration for HealthMonitor
+type HealthMonitorConfig struct {
+	store           kvstore.Store
+	deployKeyPrefix string
+	ackKeyPrefix    string
+	nodeName        string
+	// only the leader records good commits, blocks & rolls back
+	isLeader func() (bool, error)
+	// blocked commits are recorded to history when set
+	history *DeployHistory
+}
+
+// HealthMonitor watches slave acks and rolls apps back to their last known good commit
+// when a fraction of nodes fails the health check of a new commit
+type HealthMonitor struct {
+	shutdown     bool
+	shutdownLock sync.Mutex
+	shutdownCh   chan struct{}
+
+	config    *HealthMonitorConfig
+	watcher   *Watcher
+	store     kvstore.Store
+	log       *logrus.Entry
+	rollbacks chan *rollbackRequest
+
+	deployKeyPrefix string
+	ackKeyPrefix    string
+	nodeName        string
+	isLeader        func() (bool, error)
+
+	lock sync.Mutex
+	apps map[string]*monitoredApp
+}
+
+// NewHealthMonitor creates a new HealthMonitor
+func NewHealthMonitor(config *HealthMonitorConfig) (*HealthMonitor, error) {
+	deployKeyPrefix := config.deployKeyPrefix
+	if deployKeyPrefix == "" {
+		deployKeyPrefix = DefaultDeployKeyPrefix
+	}
+
+	ackKeyPrefix := config.ackKeyPrefix
+	if ackKeyPrefix == "" {
+		ackKeyPrefix = DefaultAckKeyPrefix
+	}
+
+	watcher, err := NewWatcher(&WatcherConfig{watchType: "prefix", key: ackKeyPrefix, store: config.store})
+	if err != nil {
+		return nil, err
+	}
+
+	return &HealthMonitor{
+		shutdownCh: make(chan struct{}),
+		config:     config,
+		watcher:    watcher,
+		store:      config.store,
+		log:        configureLogger("health"),
+		rollbacks:  make(chan *rollbackRequest, 5),
+
+		deployKeyPrefix: deployKeyPrefix,
+		ackKeyPrefix:    ackKeyPrefix,
+		nodeName:        config.nodeName,
+		isLeader:        config.isLeader,
+
+		apps: make(map[string]*monitoredApp),
+	}, nil
+}
+
+// Run starts HealthMonitor
+func (m *HealthMonitor) Run() {
+	go m.Loop()
+}
+
+// Loop is internal loop for HealthMonitor
+func (m *HealthMonitor) Loop() {
+	for {
+		select {
+		case <-m.shutdownCh:
+			return
+		case v, ok := <-m.watcher.eventCh:
+			if !ok {
+				return
+			}
+			pairs, ok := v.(kvstore.Pairs)
+			if !ok {
+				panic("invalid value from watcher")
+			}
+			m.evaluate(pairs)
+		}
+	}
+}
+
+// lastGoodKey returns the key holding last known good commit of an app
+func (m *HealthMonitor) lastGoodKey(appID string) string {
+	return m.deployKeyPrefix + "/" + appID + "/last_good"
+}
+
+// blockedKey returns the key blocking a commit of an app
+func (m *HealthMonitor) blockedKey(appID, commit string) string {
+	return m.deployKeyPrefix + "/" + appID + "/blocked/" + commit
+}
+
+// track starts watching acks for a commit just pushed, threshold is a fraction of nodes
+// an empty threshold disables automatic rollback for the app
+func (m *HealthMonitor) track(appID, commit, threshold string) {
+	var fraction float64
+	if threshold != "" {
+		var err error
+		if fraction, err = parseFraction(threshold); err != nil {
+			m.log.Errorf("app(%s) rollback threshold: %v", appID, err)
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	app, ok := m.apps[appID]
+	if !ok {
+		app = &monitoredApp{}
+		if pair, err := m.store.Get(m.lastGoodKey(appID)); err == nil && pair != nil {
+			app.lastGood = string(pair.Value)
+		}
+		m.apps[appID] = app
+	}
+	app.commit = commit
+	app.threshold = fraction
+	app.decided = false
+}
+
+// blocked checks whether a commit is blocked, returns the reason
+func (m *HealthMonitor) blocked(appID, commit string) (string, bool) {
+	pair, err := m.store.Get(m.blockedKey(appID, commit))
+	if err != nil || pair == nil {
+		return "", false
+	}
+	b := &BlockedCommit{}
+	if err := json.Unmarshal(pair.Value, b); err != nil {
+		return string(pair.Value), true
+	}
+	return b.Reason, true
+}
+
+// block blocks a commit of an app
+func (m *HealthMonitor) block(appID, commit, reason string) error {
+	data, err := json.Marshal(&BlockedCommit{
+		Commit: commit,
+		Reason: reason,
+		Node:   m.nodeName,
+		Time:   time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return m.store.Put(m.blockedKey(appID, commit), data)
+}
+
+// evaluate decides on tracked commits from acks of the nodes running each app
+func (m *HealthMonitor) evaluate(pairs kvstore.Pairs) {
+	if m.isLeader != nil {
+		leader, err := m.isLeader()
+		if err != nil {
+			m.log.Errorf("Failed to check leadership: %v", err)
+		}
+		if !leader {
+			return
+		}
+	}
+
+	nodes, err := listSlaveNodes(m.store)
+	if err != nil {
+		m.log.Errorf("Failed to list nodes: %v", err)
+		return
+	}
+	live := make(map[string]bool)
+	for _, node := range nodes {
+		live[node] = true
+	}
+
+	// nodes which never acked an app don't run it, nodes gone don't count
+	acks := make(map[string][]*Ack)
+	for _, pair := range pairs {
+		parts := strings.Split(strings.TrimPrefix(pair.Key, m.ackKeyPrefix+"/"), "/")
+		if len(parts) != 2 {
+			continue
+		}
+		if !live[parts[1]] {
+			continue
+		}
+		ack := &Ack{}
+		if err := json.Unmarshal(pair.Value, ack); err != nil {
+			continue
+		}
+		acks[parts[0]] = append(acks[parts[0]], ack)
+	}
+
+	// rollbacks are sent once unlocked, the fetcher may be tracking a commit meanwhile
+	var rollbacks []*rollbackRequest
+	defer func() {
+		for _, req := range rollbacks {
+			m.rollbacks <- req
+		}
+	}()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for appID, app := range m.apps {
+		reporting := len(acks[appID])
+		if app.decided || reporting == 0 {
+			continue
+		}
+
+		var applied, failed int
+		var messages []string
+		for _, ack := range acks[appID] {
+			if ack.Commit != app.commit {
+				continue
+			}
+			if ack.State == AckFailed {
+				failed++
+				messages = append(messages, ack.Message)
+			} else {
+				applied++
+			}
+		}
+
+		if app.threshold > 0 && float64(failed)/float64(reporting) >= app.threshold {
+			app.decided = true
+			if req := m.rollback(appID, app, fmt.Sprintf("%d/%d nodes failed: %s", failed, reporting, strings.Join(messages, "; "))); req != nil {
+				rollbacks = append(rollbacks, req)
+			}
+			continue
+		}
+
+		if applied >= reporting {
+			app.decided = true
+			app.lastGood = app.commit
+			if err := m.store.Put(m.lastGoodKey(appID), []byte(app.commit)); err != nil {
+				m.log.Errorf("Failed to record last good commit of app(%s): %v", appID, err)
+			}
+		}
+	}
+}
+
+// rollback blocks the failing commit, returns the request redeploying the last good one
+func (m *HealthMonitor) rollback(appID string, app *monitoredApp, reason string) *rollbackRequest {
+	m.log.Errorf("app(%s) commit(%s) unhealthy: %s", appID, app.commit, reason)
+
+	// the last good commit failing again is left to operators
+	if app.lastGood == app.commit {
+		return nil
+	}
+
+	if err := m.block(appID, app.commit, reason); err != nil {
+		m.log.Errorf("Failed to block app(%s) commit(%s): %v", appID, app.commit, err)
+	}
+	if m.config.history != nil {
+		m.config.history.append(&client.HistoryEntry{
+			App:      appID,
+			Commit:   app.commit,
+			Previous: app.lastGood,
+			State:    DeployBlocked,
+			Reason:   reason,
+			Trigger:  TriggerRollback,
+			Node:     m.nodeName,
+			Time:     time.Now().UTC(),
+		})
+	}
+
+	if app.lastGood == "" {
+		m.log.Errorf("app(%s) has no last known good commit to roll back to", appID)
+		return nil
+	}
+
+	return &rollbackRequest{
+		appID:  appID,
+		commit: app.lastGood,
+		from:   app.commit,
+		reason: reason,
+	}
+}
+
+// Shutdown shutdowns HealthMonitor
+func (m *HealthMonitor) Shutdown() {
+	m.shutdownLock.Lock()
+	defer m.shutdownLock.Unlock()
+
+	if m.shutdown {
+		return
+	}
+	m.shutdown = true
+
+	m.watcher.Shutdown()
+	close(m.shutdownCh)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+func TestParseFraction(t *testing.T) {
+	cases := map[string]float64{
+		"0.2": 0.2,
+		"20%": 0.2,
+		"1":   1,
+	}
+	for s, expected := range cases {
+		f, err := parseFraction(s)
+		if err != nil || f != expected {
+			t.Fatalf("parseFraction(%s) = %v, %v", s, f, err)
+		}
+	}
+	for _, s := range []string{"", "0", "150%", "half"} {
+		if _, err := parseFraction(s); err == nil {
+			t.Fatalf("expected error for(%s)", s)
+		}
+	}
+}
+
+func TestRunHealthCheck(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthy.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	timeout := 1500 * time.Millisecond
+	for _, spec := range []string{healthy.URL, "tcp://" + l.Addr().String(), "cmd:test \"$CONF_APP_ID\" = app"} {
+		if err := runHealthCheck(spec, timeout, []string{"CONF_APP_ID=app"}); err != nil {
+			t.Fatalf("check(%s) err: %v", spec, err)
+		}
+	}
+	for _, spec := range []string{unhealthy.URL, "cmd:false", "ftp://127.0.0.1", "cmd:"} {
+		if err := runHealthCheck(spec, timeout, nil); err == nil {
+			t.Fatalf("expected check(%s) to fail", spec)
+		}
+	}
+}
+
+func TestHealthMonitorEvaluate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := kvstore.NewFileStore(&kvstore.FileConfig{Root: dir, Node: "master1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range []string{"n1", "n2", "n3"} {
+		store.Register(SlaveServiceName, node)
+	}
+
+	leader := false
+	m, err := NewHealthMonitor(&HealthMonitorConfig{
+		store:    store,
+		nodeName: "master1",
+		isLeader: func() (bool, error) { return leader, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Shutdown()
+
+	// n3 doesn't run web, gone is no longer registered
+	acks := func(commit string) kvstore.Pairs {
+		var pairs kvstore.Pairs
+		for _, node := range []string{"n1", "n2", "gone"} {
+			ack := &Ack{Commit: commit, State: AckApplied}
+			pairs = append(pairs, &kvstore.Pair{Key: ackKey(m.ackKeyPrefix, "web", node), Value: ack.encode()})
+		}
+		return pairs
+	}
+
+	m.track("web", "abc", "")
+	m.evaluate(acks("abc"))
+	if pair, _ := store.Get(m.lastGoodKey("web")); pair != nil {
+		t.Fatal("only the leader should record the last good commit")
+	}
+
+	leader = true
+	pairs := acks("old")
+	pairs[0] = acks("abc")[0]
+	m.evaluate(pairs)
+	if pair, _ := store.Get(m.lastGoodKey("web")); pair != nil {
+		t.Fatal("expected commit undecided until every node running the app applied it")
+	}
+	m.evaluate(acks("abc"))
+	if pair, _ := store.Get(m.lastGoodKey("web")); pair == nil || string(pair.Value) != "abc" {
+		t.Fatalf("expected last good commit recorded, got %v", pair)
+	}
+}
+
+func TestHealthMonitorRollbackUnlocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := kvstore.NewFileStore(&kvstore.FileConfig{Root: dir, Node: "master1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Register(SlaveServiceName, "n1")
+	store.Put(DefaultDeployKeyPrefix+"/web/last_good", []byte("good"))
+
+	m, err := NewHealthMonitor(&HealthMonitorConfig{store: store, nodeName: "master1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Shutdown()
+	// nobody reading rollbacks yet
+	m.rollbacks = make(chan *rollbackRequest)
+
+	m.track("web", "bad", "50%")
+	ack := &Ack{Commit: "bad", State: AckFailed, Message: "down"}
+	go m.evaluate(kvstore.Pairs{{Key: ackKey(m.ackKeyPrefix, "web", "n1"), Value: ack.encode()}})
+
+	tracked := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		m.track("api", "abc", "")
+		close(tracked)
+	}()
+	select {
+	case <-tracked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("track blocked by a pending rollback")
+	}
+	if req := <-m.rollbacks; req.appID != "web" || req.commit != "good" || req.from != "bad" {
+		t.Fatalf("unexpected rollback %+v", req)
+	}
+}
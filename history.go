@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+const (
+	// deploy triggers recorded in history
+	TriggerConfig    = "config"
+	TriggerPoll      = "poll"
+	TriggerRollout   = "rollout"
+	TriggerRollback  = "rollback"
+	TriggerPromote   = "promote"
+	TriggerManual    = "manual"
+	TriggerEmergency = "emergency"
+)
+
+// DeployHistoryConfig is configuration for DeployHistory
+type DeployHistoryConfig struct {
+	store           kvstore.Store
+	deployKeyPrefix string
+	// entries kept per app in KV
+	limit int
+	// local JSONL file every entry is also appended to, disabled when empty
+	logPath string
+}
+
+// DeployHistory records deploy attempts per app in a bounded KV list
+type DeployHistory struct {
+	config *DeployHistoryConfig
+	store  kvstore.Store
+	log    *logrus.Entry
+
+	deployKeyPrefix string
+	limit           int
+
+	lock sync.Mutex
+	sink *os.File
+}
+
+// NewDeployHistory creates a new DeployHistory
+func NewDeployHistory(config *DeployHistoryConfig) (*DeployHistory, error) {
+	deployKeyPrefix := config.deployKeyPrefix
+	if deployKeyPrefix == "" {
+		deployKeyPrefix = DefaultDeployKeyPrefix
+	}
+
+	limit := config.limit
+	if limit <= 0 {
+		limit = client.DefaultHistoryLimit
+	}
+
+	var sink *os.File
+	if config.logPath != "" {
+		var err error
+		sink, err = os.OpenFile(config.logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &DeployHistory{
+		config: config,
+		store:  config.store,
+		log:    configureLogger("history"),
+
+		deployKeyPrefix: deployKeyPrefix,
+		limit:           limit,
+		sink:            sink,
+	}, nil
+}
+
+// record appends an entry for a deploy status, previous is the commit deployed before
+func (h *DeployHistory) record(status *DeployStatus, previous string) {
+	h.append(&client.HistoryEntry{
+		App:      status.AppID,
+		Commit:   status.Commit,
+		Previous: previous,
+		State:    status.State,
+		Reason:   status.Reason,
+		Trigger:  status.Trigger,
+		Node:     status.Node,
+		Time:     status.Time,
+	})
+}
+
+// append appends an entry to KV & the local sink
+func (h *DeployHistory) append(entry *client.HistoryEntry) {
+	key := client.HistoryKey(h.deployKeyPrefix, entry.App)
+	if err := h.appendKV(key, entry); err != nil {
+		h.log.Errorf("Failed to record history of app(%s): %v", entry.App, err)
+	}
+
+	if h.sink == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		panic(err)
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, err := h.sink.Write(append(data, '\n')); err != nil {
+		h.log.Errorf("Failed to write history log(%s): %v", h.config.logPath, err)
+	}
+}
+
+// appendKV appends an entry to the history list at key, check-and-set guards concurrent writers
+func (h *DeployHistory) appendKV(key string, entry *client.HistoryEntry) error {
+	for i := 0; i < client.HistoryRetries; i++ {
+		pair, err := h.store.Get(key)
+		if err != nil {
+			return err
+		}
+
+		var value []byte
+		var index uint64
+		if pair != nil {
+			value, index = pair.Value, pair.ModifyIndex
+		}
+
+		data, err := client.AppendEncoded(value, entry, h.limit)
+		if err != nil {
+			return fmt.Errorf("invalid history(%s): %v", key, err)
+		}
+		ok, err := h.store.CAS(key, data, index)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("history(%s) updated concurrently", key)
+}
+
+// list returns up to limit latest entries of an app, newest first
+func (h *DeployHistory) list(appID string, limit int) ([]*client.HistoryEntry, error) {
+	pair, err := h.store.Get(client.HistoryKey(h.deployKeyPrefix, appID))
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	entries, err := client.ParseHistory(pair.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest []*client.HistoryEntry
+	for i := len(entries) - 1; i >= 0 && (limit <= 0 || len(latest) < limit); i-- {
+		latest = append(latest, entries[i])
+	}
+	return latest, nil
+}
+
+// deployed checks whether a commit of an app is in history as deployed
+func (h *DeployHistory) deployed(appID, commit string) (bool, error) {
+	pair, err := h.store.Get(client.HistoryKey(h.deployKeyPrefix, appID))
+	if err != nil || pair == nil {
+		return false, err
+	}
+	entries, err := client.ParseHistory(pair.Value)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.Commit == commit && e.State == DeployDeployed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+func TestDeployHistoryDeployed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := kvstore.NewFileStore(&kvstore.FileConfig{Root: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewDeployHistory(&DeployHistoryConfig{store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.record(newDeployStatus("web", "abc", DeployDeployed, "", "master1"), "")
+	h.record(newDeployStatus("web", "def", DeployRefused, "validation failed", "master1"), "abc")
+
+	for commit, expected := range map[string]bool{"abc": true, "def": false, "fff": false} {
+		if ok, err := h.deployed("web", commit); err != nil || ok != expected {
+			t.Fatalf("commit(%s) deployed(%v), expected %v: %v", commit, ok, expected, err)
+		}
+	}
+	if ok, _ := h.deployed("api", "abc"); ok {
+		t.Fatal("commit of another app should not count")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+)
+
+// K8sSinkConfig is configuration for K8sSink
+type K8sSinkConfig struct {
+	dir       string
+	namespace string
+}
+
+// K8sSink writes each pushed snapshot as ConfigMap/Secret manifests(<dir>/<app>.yaml),
+// for a kubectl apply or GitOps agent picking them up
+type K8sSink struct {
+	config *K8sSinkConfig
+	log    *logrus.Entry
+}
+
+// NewK8sSink creates a new K8sSink, creating dir if needed
+func NewK8sSink(config *K8sSinkConfig) (*K8sSink, error) {
+	if err := os.MkdirAll(config.dir, 0755); err != nil {
+		return nil, err
+	}
+	return &K8sSink{config: config, log: configureLogger("k8s")}, nil
+}
+
+// Publish writes manifests of a snapshot, replacing the file atomically
+func (s *K8sSink) Publish(appID string, kvs map[string][]byte) {
+	commit := string(kvs[metaCommit])
+	out, err := client.ExportK8s(appID, kvs, &client.K8sOptions{Namespace: s.config.namespace})
+	if err != nil {
+		s.log.Errorf("Failed to export app(%s) commit(%s): %v", appID, commit, err)
+		return
+	}
+
+	// written 0600 through a temp file, manifests may hold Secrets
+	p := filepath.Join(s.config.dir, client.K8sName(appID)+".yaml")
+	tmp, err := ioutil.TempFile(s.config.dir, ".k8s")
+	if err != nil {
+		s.log.Errorf("Failed to write manifests of app(%s): %v", appID, err)
+		return
+	}
+	_, err = tmp.Write(out)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		s.log.Errorf("Failed to write manifests of app(%s): %v", appID, err)
+		return
+	}
+	s.log.Infof("Wrote manifests of app(%s) commit(%s) to %s", appID, commit, p)
+}
+
+// Run is a no-op, manifests are written as snapshots are published
+func (s *K8sSink) Run() {}
+
+// Shutdown is a no-op
+func (s *K8sSink) Shutdown() {}
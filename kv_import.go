@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+// collapse formats of imported directories
+const (
+	CollapseOff  = "off"
+	CollapseYAML = "yaml"
+	CollapseJSON = "json"
+)
+
+// KVImportConfig is configuration for ImportKV
+type KVImportConfig struct {
+	store kvstore.Store
+	// KV prefix read, appKeyPrefix/<appID> the app is published under, & app registered under globalKeyPrefix/<appID>
+	prefix string
+	appID  string
+	// repository the files are committed to, created when the branch doesn't exist
+	repoURL    string
+	branchName string
+	// collapse(off/yaml/json) directories of leaf keys into documents
+	collapse string
+	// local path the repository is cloned to, a temporary directory when empty
+	path string
+
+	globalKeyPrefix string
+	appKeyPrefix    string
+}
+
+// importFiles maps pairs under prefix to files, inverse of the key mapping of Repo.GetSnapshot
+// keys ending with "/" are folders of Consul KV and skipped
+func importFiles(prefix string, pairs kvstore.Pairs) (map[string][]byte, error) {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	files := make(map[string][]byte)
+	for _, pair := range pairs {
+		if !strings.HasPrefix(pair.Key, prefix) || strings.HasSuffix(pair.Key, "/") {
+			continue
+		}
+		p := strings.TrimPrefix(pair.Key, prefix)
+		for _, part := range strings.Split(p, "/") {
+			if part == "" || part == "." || part == ".." || part == ".git" {
+				return nil, fmt.Errorf("key(%s) can't be mapped to a file", pair.Key)
+			}
+		}
+		files[p] = pair.Value
+	}
+
+	// a key can't be both a file and a directory of other keys
+	for p := range files {
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			if _, ok := files[dir]; ok {
+				return nil, fmt.Errorf("key(%s%s) is also a directory of key(%s%s)", prefix, dir, prefix, p)
+			}
+		}
+	}
+	return files, nil
+}
+
+// collapseFiles turns each top-level directory into a yaml or json document(<dir>.yml or <dir>.json)
+// of nested maps, directories holding non UTF-8 values are left as files
+func collapseFiles(files map[string][]byte, format string) (map[string][]byte, error) {
+	var ext string
+	switch format {
+	case "", CollapseOff:
+		return files, nil
+	case CollapseYAML:
+		ext = ".yml"
+	case CollapseJSON:
+		ext = ".json"
+	default:
+		return nil, fmt.Errorf("unknown collapse format(%s)", format)
+	}
+
+	dirs := make(map[string]map[string][]byte)
+	collapsed := make(map[string][]byte)
+	for p, data := range files {
+		parts := strings.SplitN(p, "/", 2)
+		if len(parts) == 1 {
+			collapsed[p] = data
+			continue
+		}
+		if dirs[parts[0]] == nil {
+			dirs[parts[0]] = make(map[string][]byte)
+		}
+		dirs[parts[0]][parts[1]] = data
+	}
+
+	for dir, leaves := range dirs {
+		doc := make(map[string]interface{})
+		for p, data := range leaves {
+			if !utf8.Valid(data) {
+				doc = nil
+				break
+			}
+			m := doc
+			parts := strings.Split(p, "/")
+			for _, part := range parts[:len(parts)-1] {
+				if m[part] == nil {
+					m[part] = make(map[string]interface{})
+				}
+				m = m[part].(map[string]interface{})
+			}
+			m[parts[len(parts)-1]] = string(data)
+		}
+		if doc == nil {
+			for p, data := range leaves {
+				collapsed[dir+"/"+p] = data
+			}
+			continue
+		}
+
+		name := dir + ext
+		if _, ok := files[name]; ok {
+			return nil, fmt.Errorf("directory(%s) collapses onto existing file(%s)", dir, name)
+		}
+		data, err := encodeStructured(name, doc)
+		if err != nil {
+			return nil, err
+		}
+		collapsed[name] = data
+	}
+	return collapsed, nil
+}
+
+// ImportKV commits keys under a KV prefix to a git repository and registers the app to deploy that commit
+// returns the commit created
+func ImportKV(config *KVImportConfig) (string, error) {
+	globalKeyPrefix := config.globalKeyPrefix
+	if globalKeyPrefix == "" {
+		globalKeyPrefix = DefaultGlobalConfigKeyPrefix
+	}
+	appKeyPrefix := config.appKeyPrefix
+	if appKeyPrefix == "" {
+		appKeyPrefix = DefaultAppConfigKeyPrefix
+	}
+	branchName := config.branchName
+	if branchName == "" {
+		branchName = "master"
+	}
+	appID := config.appID
+	if appID == "" {
+		appID = path.Base(strings.TrimSuffix(config.prefix, "/"))
+	}
+	confPrefix := globalKeyPrefix + "/" + appID + "/"
+	log := configureLogger(fmt.Sprintf("import(%s)", appID))
+
+	// deploying the commit replaces the published prefix, keys imported from elsewhere would be left behind
+	if published := appKeyPrefix + "/" + appID; strings.TrimSuffix(config.prefix, "/") != published {
+		return "", fmt.Errorf("app(%s) is published under %s, not prefix(%s)", appID, published, config.prefix)
+	}
+
+	pair, err := config.store.Get(confPrefix + "repo")
+	if err != nil {
+		return "", err
+	}
+	if pair != nil {
+		return "", fmt.Errorf("app(%s) already registered with repo(%s)", appID, pair.Value)
+	}
+
+	pairs, err := config.store.List(strings.TrimSuffix(config.prefix, "/") + "/")
+	if err != nil {
+		return "", err
+	}
+	files, err := importFiles(config.prefix, pairs)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("no keys under prefix(%s)", config.prefix)
+	}
+	if files, err = collapseFiles(files, config.collapse); err != nil {
+		return "", err
+	}
+
+	localPath := config.path
+	if localPath == "" {
+		if localPath, err = ioutil.TempDir("", "confimport"); err != nil {
+			return "", err
+		}
+	}
+	repo, err := CloneRepo(&RepoConfig{
+		path:       localPath,
+		remoteURL:  config.repoURL,
+		remoteName: DefaultRemoteName,
+		branchName: branchName,
+		appID:      appID,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer repo.Close()
+	if err := repo.Fetch(); err != nil {
+		log.Infof("Failed to fetch branch(%s) of repo(%s), starting it: %v", branchName, config.repoURL, err)
+	}
+
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	message := fmt.Sprintf("Import %s from KV prefix(%s)\n", appID, config.prefix)
+	commit, err := repo.CommitFiles(files, name, name+"@"+host, message)
+	if err != nil {
+		return "", err
+	}
+
+	// snapshot of the commit must hold the imported keys as they were
+	snapshot, err := repo.GetSnapshot(commit)
+	if err != nil {
+		return "", err
+	}
+	var extra []string
+	for k, v := range *snapshot {
+		data, ok := files[k]
+		if !ok {
+			extra = append(extra, k)
+		} else if !bytes.Equal(data, v) {
+			return "", fmt.Errorf("file(%s) of commit(%s) differs from its key", k, commit)
+		}
+	}
+	if len(*snapshot) != len(files)+len(extra) {
+		return "", fmt.Errorf("commit(%s) misses imported files", commit)
+	}
+	if len(extra) > 0 {
+		sort.Strings(extra)
+		log.Warnf("Files of repo(%s) not in KV are published too: %v", config.repoURL, extra)
+	}
+
+	if err := repo.Push(); err != nil {
+		return "", err
+	}
+	log.Infof("commit(%s) of %d files pushed to repo(%s) branch(%s)", commit, len(files), config.repoURL, branchName)
+
+	// registering fails when the app was registered meanwhile
+	err = config.store.Txn([]*kvstore.Op{
+		{Verb: kvstore.OpCAS, Key: confPrefix + "repo", Value: []byte(config.repoURL)},
+		{Verb: kvstore.OpSet, Key: confPrefix + "branch", Value: []byte(branchName)},
+		{Verb: kvstore.OpSet, Key: confPrefix + "rev", Value: []byte(commit)},
+	})
+	if err == kvstore.ErrTxnFailed {
+		return "", fmt.Errorf("app(%s) registered meanwhile, commit(%s) pushed but not deployed", appID, commit)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if config.collapse != "" && config.collapse != CollapseOff {
+		log.Warnf("Collapsed documents replace leaf keys of app(%s)", appID)
+	}
+	return commit, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+func TestImportFiles(t *testing.T) {
+	pairs := kvstore.Pairs{
+		{Key: "legacy/web/", Value: nil},
+		{Key: "legacy/web/port", Value: []byte("80")},
+		{Key: "legacy/web/db/", Value: nil},
+		{Key: "legacy/web/db/host", Value: []byte("db1")},
+		{Key: "legacy/web/db/pool/size", Value: []byte("10")},
+		{Key: "legacy/webapp/port", Value: []byte("81")},
+	}
+	files, err := importFiles("legacy/web", pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 || string(files["port"]) != "80" || string(files["db/pool/size"]) != "10" {
+		t.Fatalf("unexpected files %v", files)
+	}
+
+	for _, bad := range []string{"legacy/web/a//b", "legacy/web/../etc", "legacy/web/.git/config"} {
+		if _, err := importFiles("legacy/web/", kvstore.Pairs{{Key: bad}}); err == nil {
+			t.Fatalf("expected key(%s) to be refused", bad)
+		}
+	}
+	conflict := kvstore.Pairs{{Key: "legacy/web/db", Value: []byte("x")}, {Key: "legacy/web/db/host", Value: []byte("db1")}}
+	if _, err := importFiles("legacy/web", conflict); err == nil {
+		t.Fatal("expected key & directory conflict")
+	}
+}
+
+func TestCollapseFiles(t *testing.T) {
+	files := map[string][]byte{
+		"port":         []byte("80"),
+		"db/host":      []byte("db1"),
+		"db/pool/size": []byte("10"),
+		"certs/key":    {0xff, 0xfe},
+	}
+	collapsed, err := collapseFiles(files, CollapseYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(collapsed["db.yml"]) != "host: db1\npool:\n  size: \"10\"\n" {
+		t.Fatalf("unexpected document %q", collapsed["db.yml"])
+	}
+	if len(collapsed) != 3 || collapsed["port"] == nil || collapsed["certs/key"] == nil {
+		t.Fatalf("unexpected files %v", collapsed)
+	}
+
+	collapsed, err = collapseFiles(map[string][]byte{"db/host": []byte("db1")}, CollapseJSON)
+	if err != nil || string(collapsed["db.json"]) != "{\n  \"host\": \"db1\"\n}\n" {
+		t.Fatalf("unexpected json document %q %v", collapsed["db.json"], err)
+	}
+
+	if _, err := collapseFiles(map[string][]byte{"db.yml": nil, "db/host": nil}, CollapseYAML); err == nil {
+		t.Fatal("expected collapse onto existing file to fail")
+	}
+	if same, _ := collapseFiles(files, CollapseOff); len(same) != len(files) {
+		t.Fatal("expected files unchanged")
+	}
+}
+
+func TestImportKVPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := kvstore.NewFileStore(&kvstore.FileConfig{Root: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put("legacy/web/port", []byte("80"))
+
+	// refused before anything is committed or registered
+	if _, err := ImportKV(&KVImportConfig{store: store, prefix: "legacy/web", repoURL: path.Join(dir, "repo")}); err == nil {
+		t.Fatal("expected prefix other than the app prefix to be refused")
+	}
+	if pair, _ := store.Get(DefaultGlobalConfigKeyPrefix + "/web/repo"); pair != nil {
+		t.Fatal("refused import should not register the app")
+	}
+}
@@ -0,0 +1,317 @@
+package kvstore
+
+import (
+	"sync"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/watch"
+)
+
+// ConsulStore is a Store on Consul KV, sessions & the service catalog
+type ConsulStore struct {
+	addr   string
+	client *consulapi.Client
+	kv     *consulapi.KV
+}
+
+// NewConsulStore creates a ConsulStore talking to the agent at addr
+func NewConsulStore(addr string) (*ConsulStore, error) {
+	conf := consulapi.DefaultConfig()
+	if addr != "" {
+		conf.Address = addr
+	}
+	client, err := consulapi.NewClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsulStore{addr: conf.Address, client: client, kv: client.KV()}, nil
+}
+
+// WrapConsulClient creates a ConsulStore on an existing client, watches use the default agent address
+func WrapConsulClient(client *consulapi.Client) *ConsulStore {
+	return &ConsulStore{client: client, kv: client.KV()}
+}
+
+// Client returns the underlying Consul client
+func (s *ConsulStore) Client() *consulapi.Client {
+	return s.client
+}
+
+func fromConsul(pair *consulapi.KVPair) *Pair {
+	return &Pair{Key: pair.Key, Value: pair.Value, ModifyIndex: pair.ModifyIndex, Session: pair.Session}
+}
+
+// Get returns a pair, nil when key doesn't exist
+func (s *ConsulStore) Get(key string) (*Pair, error) {
+	pair, _, err := s.kv.Get(key, nil)
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	return fromConsul(pair), nil
+}
+
+// List returns pairs under prefix
+func (s *ConsulStore) List(prefix string) (Pairs, error) {
+	pairs, _, err := s.kv.List(prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	result := make(Pairs, 0, len(pairs))
+	for _, pair := range pairs {
+		result = append(result, fromConsul(pair))
+	}
+	return result, nil
+}
+
+// Put sets a key
+func (s *ConsulStore) Put(key string, value []byte) error {
+	_, err := s.kv.Put(&consulapi.KVPair{Key: key, Value: value}, nil)
+	return err
+}
+
+// CAS sets value when key is unmodified since index, 0 meaning absent
+func (s *ConsulStore) CAS(key string, value []byte, index uint64) (bool, error) {
+	ok, _, err := s.kv.CAS(&consulapi.KVPair{Key: key, Value: value, ModifyIndex: index}, nil)
+	return ok, err
+}
+
+// Delete removes a key
+func (s *ConsulStore) Delete(key string) error {
+	_, err := s.kv.Delete(key, nil)
+	return err
+}
+
+// DeleteTree removes keys under prefix
+func (s *ConsulStore) DeleteTree(prefix string) error {
+	_, err := s.kv.DeleteTree(prefix, nil)
+	return err
+}
+
+// Txn applies ops in a Consul transaction
+func (s *ConsulStore) Txn(ops []*Op) error {
+	txn := consulapi.KVTxnOps{}
+	for _, op := range ops {
+		o := &consulapi.KVTxnOp{Key: op.Key, Value: op.Value}
+		switch op.Verb {
+		case OpSet:
+			o.Verb = string(consulapi.KVSet)
+		case OpDelete:
+			o.Verb = string(consulapi.KVDelete)
+		case OpDeleteTree:
+			o.Verb = string(consulapi.KVDeleteTree)
+		case OpCAS:
+			o.Verb = string(consulapi.KVCAS)
+			o.Index = op.Index
+		case OpCheckSession:
+			o.Verb = string(consulapi.KVCheckSession)
+			o.Session = op.Session
+		}
+		txn = append(txn, o)
+	}
+
+	ok, _, _, err := s.kv.Txn(txn, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrTxnFailed
+	}
+	return nil
+}
+
+// Watch runs a Consul watch plan, deleted keys are delivered as empty pairs
+func (s *ConsulStore) Watch(key string, prefix bool, stop <-chan struct{}) (<-chan Pairs, error) {
+	params := map[string]interface{}{"type": "key", "key": key}
+	if prefix {
+		params = map[string]interface{}{"type": "keyprefix", "prefix": key}
+	}
+	wp, err := watch.Parse(params)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan Pairs)
+	wp.Handler = func(idx uint64, data interface{}) {
+		var pairs Pairs
+		switch v := data.(type) {
+		case *consulapi.KVPair:
+			if v != nil {
+				pairs = Pairs{fromConsul(v)}
+			}
+		case consulapi.KVPairs:
+			for _, pair := range v {
+				pairs = append(pairs, fromConsul(pair))
+			}
+		}
+		select {
+		case ch <- pairs:
+		case <-stop:
+		}
+	}
+
+	go func() {
+		// wp.Run() is blocking
+		// after wp.Stop() is called, 'connection refused' error
+		// will be silently supressed
+		wp.Run(s.addr)
+		close(ch)
+	}()
+	go func() {
+		<-stop
+		wp.Stop()
+	}()
+	return ch, nil
+}
+
+// consulLock holds a key with a session of this node
+type consulLock struct {
+	store     *ConsulStore
+	key       string
+	value     []byte
+	lock      sync.Mutex
+	sessionID string
+}
+
+// NewLock returns a lock on key, the session is created on first acquire
+func (s *ConsulStore) NewLock(key string, value []byte) (Lock, error) {
+	return &consulLock{store: s, key: key, value: value}, nil
+}
+
+// session reuses the session named after the key on this node, or creates one
+func (l *consulLock) session() (string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.sessionID != "" {
+		return l.sessionID, nil
+	}
+
+	node, _, err := l.store.Self()
+	if err != nil {
+		return "", err
+	}
+	sessions, _, err := l.store.client.Session().List(nil)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range sessions {
+		if s.Name == l.key && s.Node == node {
+			l.sessionID = s.ID
+			return s.ID, nil
+		}
+	}
+
+	id, _, err := l.store.client.Session().Create(&consulapi.SessionEntry{Name: l.key}, nil)
+	if err != nil {
+		return "", err
+	}
+	l.sessionID = id
+	return id, nil
+}
+
+// TryAcquire acquires the key with the session
+func (l *consulLock) TryAcquire() (bool, error) {
+	id, err := l.session()
+	if err != nil {
+		return false, err
+	}
+	ok, _, err := l.store.kv.Acquire(&consulapi.KVPair{Key: l.key, Value: l.value, Session: id}, nil)
+	return ok, err
+}
+
+// Release releases the key if held by the session
+func (l *consulLock) Release() error {
+	id, err := l.session()
+	if err != nil {
+		return err
+	}
+	_, _, err = l.store.kv.Release(&consulapi.KVPair{Key: l.key, Value: l.value, Session: id}, nil)
+	return err
+}
+
+// Destroy destroys the session, releasing the key
+func (l *consulLock) Destroy() error {
+	id, err := l.session()
+	if err != nil {
+		return err
+	}
+	if _, err := l.store.client.Session().Destroy(id, nil); err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	l.sessionID = ""
+	l.lock.Unlock()
+	return nil
+}
+
+// Held checks whether the key is held by the session of this lock
+func (l *consulLock) Held() (bool, error) {
+	l.lock.Lock()
+	id := l.sessionID
+	l.lock.Unlock()
+	if id == "" {
+		return false, nil
+	}
+
+	pair, _, err := l.store.kv.Get(l.key, nil)
+	if err != nil {
+		return false, err
+	}
+	return pair != nil && pair.Session == id, nil
+}
+
+// Session returns the session of this lock
+func (l *consulLock) Session() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.sessionID
+}
+
+// Holder returns value of a key acquired by a session
+func (s *ConsulStore) Holder(key string) (string, error) {
+	pair, _, err := s.kv.Get(key, nil)
+	if err != nil || pair == nil || pair.Session == "" {
+		return "", err
+	}
+	return string(pair.Value), nil
+}
+
+// Register registers service on the local agent, node is the agent's node
+func (s *ConsulStore) Register(service, node string) error {
+	return s.client.Agent().ServiceRegister(&consulapi.AgentServiceRegistration{ID: service, Name: service})
+}
+
+// Deregister removes service from the local agent
+func (s *ConsulStore) Deregister(service, node string) error {
+	return s.client.Agent().ServiceDeregister(service)
+}
+
+// Nodes lists nodes of service in the catalog
+func (s *ConsulStore) Nodes(service string) ([]string, error) {
+	services, _, err := s.client.Catalog().Service(service, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []string
+	for _, svc := range services {
+		nodes = append(nodes, svc.Node)
+	}
+	return nodes, nil
+}
+
+// Self returns node name & datacenter of the local agent
+func (s *ConsulStore) Self() (string, string, error) {
+	agent, err := s.client.Agent().Self()
+	if err != nil {
+		return "", "", err
+	}
+	node, _ := agent["Config"]["NodeName"].(string)
+	dc, _ := agent["Config"]["Datacenter"].(string)
+	return node, dc, nil
+}
+
+// Close is a no-op, Consul clients hold no connection
+func (s *ConsulStore) Close() error {
+	return nil
+}
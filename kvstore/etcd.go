@@ -0,0 +1,506 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+const (
+	// DefaultEtcdEndpoint is the etcd endpoint used when none is configured
+	DefaultEtcdEndpoint = "127.0.0.1:2379"
+	// DefaultEtcdTTL is the lease TTL in seconds of locks & registrations
+	DefaultEtcdTTL = 10
+	// etcdServicePrefix is where nodes register as instances of a service
+	etcdServicePrefix = "service"
+
+	etcdTimeout = 10 * time.Second
+	// retries of transactions whose delete-tree expansion raced with a writer
+	etcdTxnRetries = 5
+)
+
+// EtcdConfig is configuration for EtcdStore
+type EtcdConfig struct {
+	Endpoints []string
+	// node name & datacenter reported by Self, node defaults to hostname
+	Node       string
+	Datacenter string
+	// lease TTL in seconds
+	TTL int
+}
+
+// EtcdStore is a Store on etcd v3, locks & registrations are held by leases
+type EtcdStore struct {
+	client *clientv3.Client
+	node   string
+	dc     string
+	ttl    int
+
+	lock sync.Mutex
+	// session holding registrations
+	session *concurrency.Session
+}
+
+// NewEtcdStore creates an EtcdStore
+func NewEtcdStore(config *EtcdConfig) (*EtcdStore, error) {
+	endpoints := config.Endpoints
+	if len(endpoints) == 0 {
+		endpoints = []string{DefaultEtcdEndpoint}
+	}
+
+	node := config.Node
+	if node == "" {
+		var err error
+		if node, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	ttl := config.TTL
+	if ttl <= 0 {
+		ttl = DefaultEtcdTTL
+	}
+
+	client, err := clientv3.New(clientv3.Config{Endpoints: endpoints, DialTimeout: etcdTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return &EtcdStore{client: client, node: node, dc: config.Datacenter, ttl: ttl}, nil
+}
+
+func fromEtcd(kv *mvccpb.KeyValue) *Pair {
+	pair := &Pair{Key: string(kv.Key), Value: kv.Value, ModifyIndex: uint64(kv.ModRevision)}
+	if kv.Lease != 0 {
+		pair.Session = fmt.Sprintf("%x", kv.Lease)
+	}
+	return pair
+}
+
+func etcdContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), etcdTimeout)
+}
+
+// Get returns a pair, nil when key doesn't exist
+func (s *EtcdStore) Get(key string) (*Pair, error) {
+	ctx, cancel := etcdContext()
+	defer cancel()
+
+	resp, err := s.client.Get(ctx, key)
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, err
+	}
+	return fromEtcd(resp.Kvs[0]), nil
+}
+
+// list returns pairs under prefix & the revision they were read at
+func (s *EtcdStore) list(ctx context.Context, prefix string, opts ...clientv3.OpOption) (Pairs, int64, error) {
+	opts = append(opts, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	resp, err := s.client.Get(ctx, prefix, opts...)
+	if err != nil {
+		return nil, 0, err
+	}
+	pairs := make(Pairs, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		pairs = append(pairs, fromEtcd(kv))
+	}
+	return pairs, resp.Header.Revision, nil
+}
+
+// List returns pairs under prefix
+func (s *EtcdStore) List(prefix string) (Pairs, error) {
+	ctx, cancel := etcdContext()
+	defer cancel()
+
+	pairs, _, err := s.list(ctx, prefix)
+	return pairs, err
+}
+
+// Put sets a key
+func (s *EtcdStore) Put(key string, value []byte) error {
+	ctx, cancel := etcdContext()
+	defer cancel()
+
+	_, err := s.client.Put(ctx, key, string(value))
+	return err
+}
+
+// CAS sets value when the mod revision of key is index, absent keys have revision 0
+func (s *EtcdStore) CAS(key string, value []byte, index uint64) (bool, error) {
+	ctx, cancel := etcdContext()
+	defer cancel()
+
+	resp, err := s.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", int64(index))).
+		Then(clientv3.OpPut(key, string(value))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+// Delete removes a key
+func (s *EtcdStore) Delete(key string) error {
+	ctx, cancel := etcdContext()
+	defer cancel()
+
+	_, err := s.client.Delete(ctx, key)
+	return err
+}
+
+// DeleteTree removes keys under prefix
+func (s *EtcdStore) DeleteTree(prefix string) error {
+	ctx, cancel := etcdContext()
+	defer cancel()
+
+	_, err := s.client.Delete(ctx, prefix, clientv3.WithPrefix())
+	return err
+}
+
+// Txn applies ops in an etcd transaction
+// etcd rejects puts inside a deleted range of the same transaction, so delete-tree is
+// expanded into deletes of the keys read under the prefix, guarded by their revision
+func (s *EtcdStore) Txn(ops []*Op) error {
+	ctx, cancel := etcdContext()
+	defer cancel()
+
+	set := make(map[string]bool)
+	userCheck := false
+	for _, op := range ops {
+		switch op.Verb {
+		case OpSet, OpCAS:
+			set[op.Key] = true
+		}
+		if op.Verb == OpCAS || op.Verb == OpCheckSession {
+			userCheck = true
+		}
+	}
+
+	for i := 0; ; i++ {
+		var cmps []clientv3.Cmp
+		var thens []clientv3.Op
+		deleted := make(map[string]bool)
+
+		for _, op := range ops {
+			switch op.Verb {
+			case OpSet:
+				thens = append(thens, clientv3.OpPut(op.Key, string(op.Value)))
+			case OpCAS:
+				cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(op.Key), "=", int64(op.Index)))
+				thens = append(thens, clientv3.OpPut(op.Key, string(op.Value)))
+			case OpCheckSession:
+				lease, err := strconv.ParseInt(op.Session, 16, 64)
+				if err != nil {
+					return ErrTxnFailed
+				}
+				cmps = append(cmps, clientv3.Compare(clientv3.LeaseValue(op.Key), "=", lease))
+			case OpDelete:
+				if !set[op.Key] && !deleted[op.Key] {
+					deleted[op.Key] = true
+					thens = append(thens, clientv3.OpDelete(op.Key))
+				}
+			case OpDeleteTree:
+				pairs, rev, err := s.list(ctx, op.Key, clientv3.WithKeysOnly())
+				if err != nil {
+					return err
+				}
+				cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(op.Key), "<", rev+1).WithPrefix())
+				for _, pair := range pairs {
+					if !set[pair.Key] && !deleted[pair.Key] {
+						deleted[pair.Key] = true
+						thens = append(thens, clientv3.OpDelete(pair.Key))
+					}
+				}
+			}
+		}
+
+		resp, err := s.client.Txn(ctx).If(cmps...).Then(thens...).Commit()
+		if err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		if userCheck || i >= etcdTxnRetries {
+			return ErrTxnFailed
+		}
+	}
+}
+
+// Watch lists key or prefix on every revision changing it
+func (s *EtcdStore) Watch(key string, prefix bool, stop <-chan struct{}) (<-chan Pairs, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	// read lists key or prefix at rev, the current revision when 0
+	read := func(rev int64) (Pairs, int64, error) {
+		var opts []clientv3.OpOption
+		if rev > 0 {
+			opts = append(opts, clientv3.WithRev(rev))
+		}
+		if prefix {
+			return s.list(ctx, key, opts...)
+		}
+		resp, err := s.client.Get(ctx, key, opts...)
+		if err != nil {
+			return nil, 0, err
+		}
+		var pairs Pairs
+		for _, kv := range resp.Kvs {
+			pairs = append(pairs, fromEtcd(kv))
+		}
+		return pairs, resp.Header.Revision, nil
+	}
+
+	ch := make(chan Pairs)
+	go func() {
+		defer close(ch)
+		for ctx.Err() == nil {
+			pairs, rev, err := read(0)
+			if err != nil {
+				select {
+				case <-time.After(time.Second):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			select {
+			case ch <- pairs:
+			case <-ctx.Done():
+				return
+			}
+
+			opts := []clientv3.OpOption{clientv3.WithRev(rev + 1)}
+			if prefix {
+				opts = append(opts, clientv3.WithPrefix())
+			}
+			// a compacted or broken watch falls back to a fresh read
+			wctx, wcancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+			for resp := range s.client.Watch(wctx, key, opts...) {
+				if resp.Err() != nil {
+					break
+				}
+				pairs, _, err := read(resp.Header.Revision)
+				if err != nil {
+					break
+				}
+				select {
+				case ch <- pairs:
+				case <-ctx.Done():
+				}
+			}
+			wcancel()
+		}
+	}()
+	return ch, nil
+}
+
+// etcdLock holds a key with its own lease, kept alive until destroyed
+type etcdLock struct {
+	store   *EtcdStore
+	key     string
+	value   []byte
+	lock    sync.Mutex
+	session *concurrency.Session
+}
+
+// NewLock returns a lock on key, the lease is granted on first acquire
+func (s *EtcdStore) NewLock(key string, value []byte) (Lock, error) {
+	return &etcdLock{store: s, key: key, value: value}, nil
+}
+
+func (l *etcdLock) lease() (clientv3.LeaseID, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.session != nil {
+		select {
+		case <-l.session.Done():
+			// lease expired, e.g. partitioned longer than TTL
+			l.session = nil
+		default:
+			return l.session.Lease(), nil
+		}
+	}
+	session, err := concurrency.NewSession(l.store.client, concurrency.WithTTL(l.store.ttl))
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+	l.session = session
+	return session.Lease(), nil
+}
+
+// TryAcquire creates the key with the lease unless it exists
+func (l *etcdLock) TryAcquire() (bool, error) {
+	lease, err := l.lease()
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := etcdContext()
+	defer cancel()
+	resp, err := l.store.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(l.key), "=", 0)).
+		Then(clientv3.OpPut(l.key, string(l.value), clientv3.WithLease(lease))).
+		Else(clientv3.OpGet(l.key)).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	if resp.Succeeded {
+		return true, nil
+	}
+	kvs := resp.Responses[0].GetResponseRange().Kvs
+	return len(kvs) > 0 && clientv3.LeaseID(kvs[0].Lease) == lease, nil
+}
+
+// Release deletes the key if held by the lease
+func (l *etcdLock) Release() error {
+	lease, err := l.lease()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := etcdContext()
+	defer cancel()
+	_, err = l.store.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.LeaseValue(l.key), "=", lease)).
+		Then(clientv3.OpDelete(l.key)).
+		Commit()
+	return err
+}
+
+// Destroy revokes the lease, deleting the key if held
+func (l *etcdLock) Destroy() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.session == nil {
+		return nil
+	}
+	err := l.session.Close()
+	l.session = nil
+	return err
+}
+
+// Held checks whether the key is attached to the lease of this lock
+func (l *etcdLock) Held() (bool, error) {
+	l.lock.Lock()
+	session := l.session
+	l.lock.Unlock()
+	if session == nil {
+		return false, nil
+	}
+
+	ctx, cancel := etcdContext()
+	defer cancel()
+	resp, err := l.store.client.Get(ctx, l.key)
+	if err != nil {
+		return false, err
+	}
+	return len(resp.Kvs) > 0 && clientv3.LeaseID(resp.Kvs[0].Lease) == session.Lease(), nil
+}
+
+// Session returns the lease of this lock in hex, as Pair.Session reports it
+func (l *etcdLock) Session() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.session == nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", l.session.Lease())
+}
+
+// Holder returns value of a lock key, keys only live as long as their lease
+func (s *EtcdStore) Holder(key string) (string, error) {
+	pair, err := s.Get(key)
+	if err != nil || pair == nil {
+		return "", err
+	}
+	return string(pair.Value), nil
+}
+
+// serviceKey returns key node registers under for service
+func serviceKey(service, node string) string {
+	return etcdServicePrefix + "/" + service + "/nodes/" + node
+}
+
+// registrations returns the lease registrations are held by
+func (s *EtcdStore) registrations() (clientv3.LeaseID, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.session != nil {
+		select {
+		case <-s.session.Done():
+			s.session = nil
+		default:
+			return s.session.Lease(), nil
+		}
+	}
+	session, err := concurrency.NewSession(s.client, concurrency.WithTTL(s.ttl))
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+	s.session = session
+	return session.Lease(), nil
+}
+
+// Register registers node under service with a lease, it disappears once the node stops
+func (s *EtcdStore) Register(service, node string) error {
+	lease, err := s.registrations()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := etcdContext()
+	defer cancel()
+	_, err = s.client.Put(ctx, serviceKey(service, node), node, clientv3.WithLease(lease))
+	return err
+}
+
+// Deregister removes node from service
+func (s *EtcdStore) Deregister(service, node string) error {
+	return s.Delete(serviceKey(service, node))
+}
+
+// Nodes lists nodes registered for service
+func (s *EtcdStore) Nodes(service string) ([]string, error) {
+	prefix := serviceKey(service, "")
+	pairs, err := s.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []string
+	for _, pair := range pairs {
+		nodes = append(nodes, strings.TrimPrefix(pair.Key, prefix))
+	}
+	return nodes, nil
+}
+
+// Self returns configured node name & datacenter
+func (s *EtcdStore) Self() (string, string, error) {
+	return s.node, s.dc, nil
+}
+
+// Close revokes registrations & closes the client
+func (s *EtcdStore) Close() error {
+	s.lock.Lock()
+	if s.session != nil {
+		s.session.Close()
+		s.session = nil
+	}
+	s.lock.Unlock()
+	return s.client.Close()
+}
@@ -0,0 +1,263 @@
+package kvstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// freePort returns a local port nothing listens on
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startEtcd starts an embedded single member etcd & returns a store connected to it
+func startEtcd(t *testing.T, node string) (*EtcdStore, func()) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	client, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", freePort(t)))
+	peer, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", freePort(t)))
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{*client}, []url.URL{*client}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{*peer}, []url.URL{*peer}
+	cfg.InitialCluster = cfg.Name + "=" + peer.String()
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		os.RemoveAll(dir)
+		t.Fatal("etcd not ready")
+	}
+
+	s, err := NewEtcdStore(&EtcdConfig{Endpoints: []string{client.Host}, Node: node, Datacenter: "dc1", TTL: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.Close()
+		e.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestEtcdKV(t *testing.T) {
+	s, stop := startEtcd(t, "node1")
+	defer stop()
+
+	if pair, err := s.Get("config/app/a/x"); err != nil || pair != nil {
+		t.Fatalf("expected no pair, got %v %v", pair, err)
+	}
+	if err := s.Put("config/app/a/x", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	pair, err := s.Get("config/app/a/x")
+	if err != nil || pair == nil || string(pair.Value) != "1" {
+		t.Fatalf("unexpected pair %v %v", pair, err)
+	}
+
+	// stale index
+	if ok, err := s.CAS("config/app/a/x", []byte("2"), pair.ModifyIndex-1); err != nil || ok {
+		t.Fatalf("expected CAS with stale index to fail, %v %v", ok, err)
+	}
+	if ok, err := s.CAS("config/app/a/x", []byte("2"), pair.ModifyIndex); err != nil || !ok {
+		t.Fatalf("expected CAS to succeed, %v %v", ok, err)
+	}
+	// 0 creates only
+	if ok, _ := s.CAS("config/app/a/x", []byte("3"), 0); ok {
+		t.Fatal("expected CAS of existing key with index 0 to fail")
+	}
+	if ok, _ := s.CAS("config/app/a/y", []byte("3"), 0); !ok {
+		t.Fatal("expected CAS of absent key with index 0 to succeed")
+	}
+
+	pairs, err := s.List("config/app/a/")
+	if err != nil || len(pairs) != 2 || pairs[0].Key != "config/app/a/x" || string(pairs[0].Value) != "2" {
+		t.Fatalf("unexpected pairs %v %v", pairs, err)
+	}
+
+	if err := s.DeleteTree("config/app/a/"); err != nil {
+		t.Fatal(err)
+	}
+	if pairs, _ := s.List("config/app/a/"); len(pairs) != 0 {
+		t.Fatalf("expected empty tree, got %d pairs", len(pairs))
+	}
+}
+
+func TestEtcdTxn(t *testing.T) {
+	s, stop := startEtcd(t, "node1")
+	defer stop()
+
+	s.Put("config/app/a/old", []byte("old"))
+	s.Put("config/app/a/kept", []byte("v1"))
+	s.Put("config/app/ab/other", []byte("other"))
+
+	// replace the tree of app a like the pusher does
+	err := s.Txn([]*Op{
+		{Verb: OpDeleteTree, Key: "config/app/a/"},
+		{Verb: OpSet, Key: "config/app/a/kept", Value: []byte("v2")},
+		{Verb: OpSet, Key: "config/app/a/new", Value: []byte("new")},
+		{Verb: OpSet, Key: "config/deploy/a/status", Value: []byte("deployed")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pairs, _ := s.List("config/app/a/")
+	got := make(map[string]string)
+	for _, pair := range pairs {
+		got[pair.Key] = string(pair.Value)
+	}
+	if len(got) != 2 || got["config/app/a/kept"] != "v2" || got["config/app/a/new"] != "new" {
+		t.Fatalf("unexpected tree %v", got)
+	}
+	if pair, _ := s.Get("config/app/ab/other"); pair == nil {
+		t.Fatal("expected sibling prefix untouched")
+	}
+
+	// a failing check rolls back every op
+	err = s.Txn([]*Op{
+		{Verb: OpSet, Key: "config/app/a/new", Value: []byte("changed")},
+		{Verb: OpCAS, Key: "config/deploy/a/status", Value: []byte("x"), Index: 1},
+	})
+	if err != ErrTxnFailed {
+		t.Fatalf("expected ErrTxnFailed, got %v", err)
+	}
+	if pair, _ := s.Get("config/app/a/new"); string(pair.Value) != "new" {
+		t.Fatalf("expected rolled back value, got %s", pair.Value)
+	}
+}
+
+func TestEtcdWatch(t *testing.T) {
+	s, stop := startEtcd(t, "node1")
+	defer stop()
+
+	s.Put("config/ack/n1/a", []byte("c1"))
+
+	done := make(chan struct{})
+	defer close(done)
+	ch, err := s.Watch("config/ack/", true, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() Pairs {
+		select {
+		case pairs := <-ch:
+			return pairs
+		case <-time.After(5 * time.Second):
+			t.Fatal("no watch event")
+		}
+		return nil
+	}
+
+	if pairs := next(); len(pairs) != 1 {
+		t.Fatalf("expected initial pair, got %v", pairs)
+	}
+	s.Put("config/ack/n2/a", []byte("c1"))
+	if pairs := next(); len(pairs) != 2 || pairs[1].Key != "config/ack/n2/a" {
+		t.Fatalf("expected both pairs, got %v", pairs)
+	}
+	s.DeleteTree("config/ack/n1/")
+	if pairs := next(); len(pairs) != 1 || pairs[0].Key != "config/ack/n2/a" {
+		t.Fatalf("expected remaining pair, got %v", pairs)
+	}
+}
+
+func TestEtcdLock(t *testing.T) {
+	s, stop := startEtcd(t, "node1")
+	defer stop()
+
+	const key = "service/confmaster/leader"
+	l1, _ := s.NewLock(key, []byte("node1"))
+	l2, _ := s.NewLock(key, []byte("node2"))
+
+	if ok, err := l1.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expected first lock to acquire, %v %v", ok, err)
+	}
+	// reacquiring a held lock is a no-op
+	if ok, _ := l1.TryAcquire(); !ok {
+		t.Fatal("expected holder to keep the lock")
+	}
+	if ok, _ := l2.TryAcquire(); ok {
+		t.Fatal("expected second lock to fail")
+	}
+	if holder, _ := s.Holder(key); holder != "node1" {
+		t.Fatalf("expected holder node1, got %s", holder)
+	}
+	// both report the same value, only the lease tells them apart
+	same, _ := s.NewLock(key, []byte("node1"))
+	same.TryAcquire()
+	defer same.Destroy()
+	if held, _ := l1.Held(); !held {
+		t.Fatal("expected first lock held")
+	}
+	if held, _ := same.Held(); held {
+		t.Fatal("expected lock with the same value not held")
+	}
+	if pair, _ := s.Get(key); pair == nil || pair.Session == "" {
+		t.Fatalf("expected key held by a lease, got %v", pair)
+	}
+
+	// releasing a lock not held leaves the holder
+	l2.Release()
+	if holder, _ := s.Holder(key); holder != "node1" {
+		t.Fatalf("expected holder node1, got %s", holder)
+	}
+
+	if err := l1.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if holder, _ := s.Holder(key); holder != "" {
+		t.Fatalf("expected no holder, got %s", holder)
+	}
+	if ok, _ := l2.TryAcquire(); !ok {
+		t.Fatal("expected second lock to acquire after destroy")
+	}
+	l2.Release()
+	if holder, _ := s.Holder(key); holder != "" {
+		t.Fatalf("expected no holder after release, got %s", holder)
+	}
+}
+
+func TestEtcdRegister(t *testing.T) {
+	s, stop := startEtcd(t, "node1")
+	defer stop()
+
+	if node, dc, _ := s.Self(); node != "node1" || dc != "dc1" {
+		t.Fatalf("unexpected self %s %s", node, dc)
+	}
+
+	s.Register("confslave", "node2")
+	s.Register("confslave", "node1")
+	nodes, err := s.Nodes("confslave")
+	if err != nil || len(nodes) != 2 || nodes[0] != "node1" || nodes[1] != "node2" {
+		t.Fatalf("unexpected nodes %v %v", nodes, err)
+	}
+
+	s.Deregister("confslave", "node2")
+	if nodes, _ := s.Nodes("confslave"); len(nodes) != 1 {
+		t.Fatalf("expected one node, got %v", nodes)
+	}
+}
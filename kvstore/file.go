@@ -0,0 +1,836 @@
+package kvstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	// DefaultFileRoot is the directory the file backend keeps keys in
+	DefaultFileRoot = "/var/lib/confmaster"
+	// DefaultFileVersions is number of versions kept per replaced tree
+	DefaultFileVersions = 5
+	// DefaultFilePollInterval is how often watches poll the tree
+	DefaultFilePollInterval = time.Second
+
+	// reserved entries of the root, keys never start with a dot
+	fileVersionsDir = ".versions"
+	fileLocksDir    = ".locks"
+	fileServicesDir = ".services"
+	fileTmpDir      = ".tmp"
+	fileWriteLock   = ".lock"
+	// modify index per key & the revision counter of the store
+	fileIndexesDir = ".indexes"
+	fileRevision   = ".revision"
+
+	// fileExternalIndex is modify index of files written outside the store, revisions start above it
+	fileExternalIndex = 1
+)
+
+// FileConfig is configuration for FileStore
+type FileConfig struct {
+	Root string
+	// TOML file of app definitions served read-only under ManifestPrefix, a table per app
+	// keyed by field(repo, branch, ...) and a vars table of global variables
+	Manifest       string
+	ManifestPrefix string
+	// versions kept per replaced tree
+	Versions     int
+	PollInterval time.Duration
+	// node name & datacenter reported by Self, node defaults to hostname-pid
+	// since processes of a box share the root, locks & leadership are told apart by it
+	Node       string
+	Datacenter string
+}
+
+// FileStore is a Store on a local directory, keys are files under the root
+// a transaction replacing a tree(delete-tree & sets under it) writes a new version directory
+// and switches a symlink at the tree to it, so readers never see a partial snapshot
+// writes of processes sharing the root are serialized by a file lock, each transaction
+// increments a revision counter kept in a file, recorded as modify index of the keys it writes
+type FileStore struct {
+	root           string
+	manifest       string
+	manifestPrefix string
+	versions       int
+	poll           time.Duration
+	node           string
+	dc             string
+
+	lock sync.Mutex
+
+	// tokens of locks this process holds by key, checked by OpCheckSession
+	heldLock sync.Mutex
+	held     map[string]string
+}
+
+// NewFileStore creates a FileStore, creating the root when missing
+func NewFileStore(config *FileConfig) (*FileStore, error) {
+	root := config.Root
+	if root == "" {
+		root = DefaultFileRoot
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{fileVersionsDir, fileLocksDir, fileServicesDir, fileTmpDir, fileIndexesDir} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	versions := config.Versions
+	if versions <= 0 {
+		versions = DefaultFileVersions
+	}
+
+	poll := config.PollInterval
+	if poll <= 0 {
+		poll = DefaultFilePollInterval
+	}
+
+	node := config.Node
+	if node == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		node = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
+	return &FileStore{
+		root:           root,
+		manifest:       config.Manifest,
+		manifestPrefix: strings.TrimSuffix(config.ManifestPrefix, "/"),
+		versions:       versions,
+		poll:           poll,
+		node:           node,
+		dc:             config.Datacenter,
+		held:           make(map[string]string),
+	}, nil
+}
+
+// path returns the file of a key
+func (s *FileStore) path(key string) (string, error) {
+	key = strings.Trim(key, "/")
+	if key == "" || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("invalid key(%s)", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "." || part == ".." {
+			return "", fmt.Errorf("invalid key(%s)", key)
+		}
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// indexPath returns the file holding modify index of a key
+func (s *FileStore) indexPath(key string) string {
+	return filepath.Join(s.root, fileIndexesDir, url.PathEscape(strings.Trim(key, "/")))
+}
+
+// index returns modify index of a key, fileExternalIndex when not written by the store
+func (s *FileStore) index(key string) uint64 {
+	data, err := ioutil.ReadFile(s.indexPath(key))
+	if err != nil {
+		return fileExternalIndex
+	}
+	index, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fileExternalIndex
+	}
+	return index
+}
+
+// nextRevision increments the revision counter, called under the write lock
+func (s *FileStore) nextRevision() (uint64, error) {
+	path := filepath.Join(s.root, fileRevision)
+	rev := uint64(fileExternalIndex)
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if err == nil {
+		if rev, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid revision(%s): %v", path, err)
+		}
+	}
+	rev++
+	if err := s.writeFile(path, []byte(strconv.FormatUint(rev, 10))); err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
+
+// setIndex records modify index of a key, removing it when index is 0
+func (s *FileStore) setIndex(key string, index uint64) error {
+	path := s.indexPath(key)
+	if index == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return s.writeFile(path, []byte(strconv.FormatUint(index, 10)))
+}
+
+// inManifest checks whether a key is served from the manifest
+func (s *FileStore) inManifest(key string) bool {
+	return s.manifest != "" && s.manifestPrefix != "" &&
+		(key == s.manifestPrefix || strings.HasPrefix(key, s.manifestPrefix+"/"))
+}
+
+// manifestPairs converts the manifest into pairs under the manifest prefix
+func (s *FileStore) manifestPairs() (Pairs, error) {
+	var doc map[string]map[string]interface{}
+	if _, err := toml.DecodeFile(s.manifest, &doc); err != nil {
+		return nil, fmt.Errorf("invalid manifest(%s): %v", s.manifest, err)
+	}
+
+	var pairs Pairs
+	for section, fields := range doc {
+		for field, v := range fields {
+			// manifest keys are read-only, never checked-and-set
+			pairs = append(pairs, &Pair{
+				Key:         s.manifestPrefix + "/" + section + "/" + field,
+				Value:       []byte(fmt.Sprint(v)),
+				ModifyIndex: fileExternalIndex,
+			})
+		}
+	}
+	return pairs, nil
+}
+
+// Get returns a pair, nil when key doesn't exist
+func (s *FileStore) Get(key string) (*Pair, error) {
+	if s.inManifest(key) {
+		pairs, err := s.manifestPairs()
+		if err != nil {
+			return nil, err
+		}
+		for _, pair := range pairs {
+			if pair.Key == key {
+				return pair, nil
+			}
+		}
+		return nil, nil
+	}
+
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Pair{Key: key, Value: value, ModifyIndex: s.index(key)}, nil
+}
+
+// walk collects files under dir, following symlinks to version directories
+func (s *FileStore) walk(dir, keyPrefix string, pairs *Pairs) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if dir == s.root && strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		info, err := os.Stat(path)
+		if err != nil {
+			// dangling symlink
+			continue
+		}
+		key := keyPrefix + entry.Name()
+		if info.IsDir() {
+			if err := s.walk(path, key+"/", pairs); err != nil {
+				return err
+			}
+			continue
+		}
+		value, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		*pairs = append(*pairs, &Pair{Key: key, Value: value, ModifyIndex: s.index(key)})
+	}
+	return nil
+}
+
+// List returns pairs under prefix, a prefix not ending with "/" also matches sibling names
+func (s *FileStore) List(prefix string) (Pairs, error) {
+	var pairs Pairs
+	if s.manifest != "" && (s.inManifest(prefix) || strings.HasPrefix(s.manifestPrefix, prefix)) {
+		manifest, err := s.manifestPairs()
+		if err != nil {
+			return nil, err
+		}
+		for _, pair := range manifest {
+			if strings.HasPrefix(pair.Key, prefix) {
+				pairs = append(pairs, pair)
+			}
+		}
+	}
+
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i]
+	}
+	base := s.root
+	keyPrefix := ""
+	if dir != "" {
+		var err error
+		if base, err = s.path(dir); err != nil {
+			return nil, err
+		}
+		keyPrefix = dir + "/"
+	}
+
+	var files Pairs
+	if err := s.walk(base, keyPrefix, &files); err != nil {
+		return nil, err
+	}
+	for _, pair := range files {
+		if strings.HasPrefix(pair.Key, prefix) && !s.inManifest(pair.Key) {
+			pairs = append(pairs, pair)
+		}
+	}
+
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs, nil
+}
+
+// writeLock serializes writers of the root across goroutines & processes
+func (s *FileStore) writeLock() (func(), error) {
+	s.lock.Lock()
+	f, err := os.OpenFile(filepath.Join(s.root, fileWriteLock), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		s.lock.Unlock()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+		s.lock.Unlock()
+	}, nil
+}
+
+// writeFile writes a file atomically by renaming a temporary file over it
+func (s *FileStore) writeFile(path string, value []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Join(s.root, fileTmpDir), "value")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	os.Chmod(tmp.Name(), 0644)
+	return os.Rename(tmp.Name(), path)
+}
+
+// Put sets a key
+func (s *FileStore) Put(key string, value []byte) error {
+	return s.Txn([]*Op{{Verb: OpSet, Key: key, Value: value}})
+}
+
+// CAS sets value when key is unmodified since index, 0 meaning absent
+func (s *FileStore) CAS(key string, value []byte, index uint64) (bool, error) {
+	err := s.Txn([]*Op{{Verb: OpCAS, Key: key, Value: value, Index: index}})
+	if err == ErrTxnFailed {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete removes a key
+func (s *FileStore) Delete(key string) error {
+	return s.Txn([]*Op{{Verb: OpDelete, Key: key}})
+}
+
+// DeleteTree removes keys under prefix, the prefix is a directory
+func (s *FileStore) DeleteTree(prefix string) error {
+	return s.Txn([]*Op{{Verb: OpDeleteTree, Key: prefix}})
+}
+
+// Txn applies ops under the write lock, checks are done before any write
+// a delete-tree followed by sets under the tree becomes a new version of the tree
+func (s *FileStore) Txn(ops []*Op) error {
+	for _, op := range ops {
+		if s.inManifest(op.Key) {
+			return fmt.Errorf("key(%s) is read from manifest(%s)", op.Key, s.manifest)
+		}
+		if _, err := s.path(op.Key); err != nil {
+			return err
+		}
+	}
+
+	unlock, err := s.writeLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, op := range ops {
+		switch op.Verb {
+		case OpCAS:
+			pair, err := s.Get(op.Key)
+			if err != nil {
+				return err
+			}
+			if (pair == nil && op.Index != 0) || (pair != nil && pair.ModifyIndex != op.Index) {
+				return ErrTxnFailed
+			}
+		case OpCheckSession:
+			s.heldLock.Lock()
+			token := s.held[op.Key]
+			s.heldLock.Unlock()
+			if op.Session == "" || token != op.Session {
+				return ErrTxnFailed
+			}
+		}
+	}
+
+	rev, err := s.nextRevision()
+	if err != nil {
+		return err
+	}
+
+	// sets under replaced trees go to their new version
+	trees := make(map[string]map[string][]byte)
+	for _, op := range ops {
+		if op.Verb == OpDeleteTree {
+			trees[strings.Trim(op.Key, "/")] = make(map[string][]byte)
+		}
+	}
+	treeOf := func(key string) (string, bool) {
+		for tree := range trees {
+			if strings.HasPrefix(key, tree+"/") {
+				return tree, true
+			}
+		}
+		return "", false
+	}
+
+	for _, op := range ops {
+		switch op.Verb {
+		case OpDeleteTree:
+			continue
+		case OpSet, OpCAS:
+			if tree, ok := treeOf(op.Key); ok {
+				trees[tree][strings.TrimPrefix(op.Key, tree+"/")] = op.Value
+				continue
+			}
+			path, _ := s.path(op.Key)
+			if err := s.writeFile(path, op.Value); err != nil {
+				return err
+			}
+			if err := s.setIndex(op.Key, rev); err != nil {
+				return err
+			}
+		case OpDelete:
+			if _, ok := treeOf(op.Key); ok {
+				continue
+			}
+			path, _ := s.path(op.Key)
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := s.setIndex(op.Key, 0); err != nil {
+				return err
+			}
+		}
+	}
+
+	for tree, files := range trees {
+		if err := s.replaceTree(tree, files); err != nil {
+			return err
+		}
+		if err := s.setTreeIndexes(tree, files, rev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setTreeIndexes records modify index of the files of a replaced tree, dropping indexes of removed keys
+func (s *FileStore) setTreeIndexes(tree string, files map[string][]byte, rev uint64) error {
+	entries, err := ioutil.ReadDir(filepath.Join(s.root, fileIndexesDir))
+	if err != nil {
+		return err
+	}
+	prefix := url.PathEscape(tree + "/")
+	for _, entry := range entries {
+		key, err := url.PathUnescape(entry.Name())
+		if err != nil || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		if _, ok := files[strings.TrimPrefix(key, tree+"/")]; !ok {
+			if err := s.setIndex(key, 0); err != nil {
+				return err
+			}
+		}
+	}
+	for k := range files {
+		if err := s.setIndex(tree+"/"+k, rev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// versionsDir returns the directory versions of a tree are kept in
+func (s *FileStore) versionsDir(tree string) string {
+	return filepath.Join(s.root, fileVersionsDir, url.PathEscape(tree))
+}
+
+// replaceTree writes files as a new version of tree & switches the tree symlink to it
+// a tree without files is removed
+func (s *FileStore) replaceTree(tree string, files map[string][]byte) error {
+	path, err := s.path(tree)
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		return s.prune(tree, "")
+	}
+
+	name := strconv.FormatInt(time.Now().UnixNano(), 10)
+	version := filepath.Join(s.versionsDir(tree), name)
+	for k, v := range files {
+		file := filepath.Join(version, filepath.FromSlash(k))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(file, v, 0644); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	target, err := filepath.Rel(filepath.Dir(path), version)
+	if err != nil {
+		return err
+	}
+	link := filepath.Join(s.root, fileTmpDir, "link-"+name)
+	if err := os.Symlink(target, link); err != nil {
+		return err
+	}
+	// a plain directory left at the tree can't be renamed over
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(link, path); err != nil {
+		os.Remove(link)
+		return err
+	}
+	return s.prune(tree, name)
+}
+
+// prune removes versions of a tree beyond the number kept, never the current one
+func (s *FileStore) prune(tree, current string) error {
+	entries, err := ioutil.ReadDir(s.versionsDir(tree))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Name() != current {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	keep := s.versions - 1
+	if current == "" {
+		keep = 0
+	}
+	for len(names) > keep {
+		if err := os.RemoveAll(filepath.Join(s.versionsDir(tree), names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// Watch polls key or prefix & delivers it when it changes
+func (s *FileStore) Watch(key string, prefix bool, stop <-chan struct{}) (<-chan Pairs, error) {
+	ch := make(chan Pairs)
+	go func() {
+		defer close(ch)
+
+		ticker := time.NewTicker(s.poll)
+		defer ticker.Stop()
+
+		var last Pairs
+		first := true
+		for {
+			var pairs Pairs
+			var err error
+			if prefix {
+				pairs, err = s.List(key)
+			} else {
+				var pair *Pair
+				if pair, err = s.Get(key); pair != nil {
+					pairs = Pairs{pair}
+				}
+			}
+
+			if err == nil && (first || !samePairs(last, pairs)) {
+				first = false
+				last = pairs
+				select {
+				case ch <- pairs:
+				case <-stop:
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// samePairs compares keys & values
+func samePairs(a, b Pairs) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || !bytes.Equal(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// fileLockTokens numbers locks acquired by this process
+var fileLockTokens uint64
+
+// fileLock holds an exclusive flock on a lock file, released when the process dies
+type fileLock struct {
+	store *FileStore
+	key   string
+	path  string
+	value []byte
+
+	lock  sync.Mutex
+	file  *os.File
+	token string
+}
+
+// lockPath returns the lock file of a key
+func (s *FileStore) lockPath(key string) string {
+	return filepath.Join(s.root, fileLocksDir, url.PathEscape(key))
+}
+
+// NewLock returns a lock on key held by a file lock
+func (s *FileStore) NewLock(key string, value []byte) (Lock, error) {
+	return &fileLock{store: s, key: key, path: s.lockPath(key), value: value}, nil
+}
+
+// TryAcquire locks the lock file without blocking & writes value to it
+func (l *fileLock) TryAcquire() (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file != nil {
+		return true, nil
+	}
+
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return false, err
+	}
+	if _, err := f.WriteAt(l.value, 0); err != nil {
+		f.Close()
+		return false, err
+	}
+	l.file = f
+	l.token = fmt.Sprintf("%d-%d", os.Getpid(), atomic.AddUint64(&fileLockTokens, 1))
+
+	l.store.heldLock.Lock()
+	l.store.held[l.key] = l.token
+	l.store.heldLock.Unlock()
+	return true, nil
+}
+
+// Release clears & unlocks the lock file if held
+func (l *fileLock) Release() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	l.store.heldLock.Lock()
+	delete(l.store.held, l.key)
+	l.store.heldLock.Unlock()
+
+	l.file.Truncate(0)
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Destroy releases the lock, file locks hold no other state
+func (l *fileLock) Destroy() error {
+	return l.Release()
+}
+
+// Held checks whether this lock holds the flock, only one open file of any process can
+func (l *fileLock) Held() (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file != nil, nil
+}
+
+// Session returns the token of the last acquire of this lock
+func (l *fileLock) Session() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.token
+}
+
+// Holder returns value of a locked lock file, a lock file nobody locks has no holder
+func (s *FileStore) Holder(key string) (string, error) {
+	f, err := os.Open(s.lockPath(key))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == nil {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		return "", nil
+	}
+	if err != syscall.EWOULDBLOCK {
+		return "", err
+	}
+	value, err := ioutil.ReadAll(f)
+	return string(value), err
+}
+
+// serviceDir returns the directory nodes of a service register in
+func (s *FileStore) serviceDir(service string) string {
+	return filepath.Join(s.root, fileServicesDir, url.PathEscape(service))
+}
+
+// Register records node as an instance of service until deregistered
+func (s *FileStore) Register(service, node string) error {
+	dir := s.serviceDir(service)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, url.PathEscape(node)), []byte(node), 0644)
+}
+
+// Deregister removes node from service
+func (s *FileStore) Deregister(service, node string) error {
+	err := os.Remove(filepath.Join(s.serviceDir(service), url.PathEscape(node)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Nodes lists nodes registered for service
+func (s *FileStore) Nodes(service string) ([]string, error) {
+	entries, err := ioutil.ReadDir(s.serviceDir(service))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var nodes []string
+	for _, entry := range entries {
+		if node, err := url.PathUnescape(entry.Name()); err == nil {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, nil
+}
+
+// Self returns configured node name & datacenter
+func (s *FileStore) Self() (string, string, error) {
+	return s.node, s.dc, nil
+}
+
+// Close is a no-op, locks are released by Release or Destroy
+func (s *FileStore) Close() error {
+	return nil
+}
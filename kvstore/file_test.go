@@ -0,0 +1,256 @@
+package kvstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func makeFileStore(t *testing.T, config *FileConfig) (*FileStore, func()) {
+	dir, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Root = dir
+	config.Node = "node1"
+	s, err := NewFileStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestFileKV(t *testing.T) {
+	s, cleanup := makeFileStore(t, &FileConfig{})
+	defer cleanup()
+
+	if pair, err := s.Get("config/deploy/web/status"); err != nil || pair != nil {
+		t.Fatalf("expected no pair, got %v %v", pair, err)
+	}
+	if ok, err := s.CAS("config/deploy/web/status", []byte("1"), 0); err != nil || !ok {
+		t.Fatalf("expected CAS of absent key to succeed, %v %v", ok, err)
+	}
+	pair, err := s.Get("config/deploy/web/status")
+	if err != nil || pair == nil || string(pair.Value) != "1" {
+		t.Fatalf("unexpected pair %v %v", pair, err)
+	}
+	if ok, _ := s.CAS("config/deploy/web/status", []byte("2"), pair.ModifyIndex+1); ok {
+		t.Fatal("expected CAS with stale index to fail")
+	}
+	if ok, _ := s.CAS("config/deploy/web/status", []byte("2"), pair.ModifyIndex); !ok {
+		t.Fatal("expected CAS to succeed")
+	}
+
+	s.Put("config/deploy/web2/status", []byte("3"))
+	pairs, err := s.List("config/deploy/web")
+	if err != nil || len(pairs) != 2 || pairs[1].Key != "config/deploy/web2/status" {
+		t.Fatalf("unexpected pairs %v %v", pairs, err)
+	}
+	if pairs, _ := s.List("config/deploy/web/"); len(pairs) != 1 || string(pairs[0].Value) != "2" {
+		t.Fatalf("unexpected pairs %v", pairs)
+	}
+
+	s.Delete("config/deploy/web/status")
+	if pair, _ := s.Get("config/deploy/web/status"); pair != nil {
+		t.Fatal("expected deleted key")
+	}
+
+	if err := s.Put("../escape", []byte("x")); err == nil {
+		t.Fatal("expected invalid key to fail")
+	}
+}
+
+func TestFileIndex(t *testing.T) {
+	s, cleanup := makeFileStore(t, &FileConfig{})
+	defer cleanup()
+
+	// writes within the same clock tick still get distinct indexes
+	s.Put("config/restore", []byte("a"))
+	first, _ := s.Get("config/restore")
+	s.Put("config/restore", []byte("a"))
+	second, _ := s.Get("config/restore")
+	if first.ModifyIndex <= fileExternalIndex || second.ModifyIndex <= first.ModifyIndex {
+		t.Fatalf("expected increasing indexes, got %d %d", first.ModifyIndex, second.ModifyIndex)
+	}
+	if ok, _ := s.CAS("config/restore", []byte("b"), first.ModifyIndex); ok {
+		t.Fatal("expected CAS with the index of an overwritten value to fail")
+	}
+
+	// keys of a replaced tree share the index of the transaction, removed keys drop theirs
+	s.Txn([]*Op{
+		{Verb: OpSet, Key: "config/app/web/a.conf", Value: []byte("1")},
+		{Verb: OpSet, Key: "config/app/web/b.conf", Value: []byte("1")},
+	})
+	s.Txn([]*Op{{Verb: OpDeleteTree, Key: "config/app/web"}, {Verb: OpSet, Key: "config/app/web/a.conf", Value: []byte("2")}})
+	pairs, _ := s.List("config/app/web/")
+	if len(pairs) != 1 || pairs[0].ModifyIndex <= second.ModifyIndex+1 {
+		t.Fatalf("unexpected pairs %v", pairs)
+	}
+	if _, err := os.Stat(s.indexPath("config/app/web/b.conf")); !os.IsNotExist(err) {
+		t.Fatalf("expected index of removed key dropped, %v", err)
+	}
+
+	// files written outside the store
+	ioutil.WriteFile(filepath.Join(s.root, "external"), []byte("x"), 0644)
+	if pair, _ := s.Get("external"); pair == nil || pair.ModifyIndex != fileExternalIndex {
+		t.Fatalf("unexpected external pair %v", pair)
+	}
+
+	// processes sharing a root are told apart
+	dir, _ := ioutil.TempDir("", "filestore")
+	defer os.RemoveAll(dir)
+	other, _ := NewFileStore(&FileConfig{Root: dir})
+	host, _ := os.Hostname()
+	if node, _, _ := other.Self(); node != fmt.Sprintf("%s-%d", host, os.Getpid()) {
+		t.Fatalf("unexpected default node %s", node)
+	}
+}
+
+func TestFileTreeVersions(t *testing.T) {
+	s, cleanup := makeFileStore(t, &FileConfig{Versions: 2})
+	defer cleanup()
+
+	push := func(files map[string]string) {
+		ops := []*Op{{Verb: OpDeleteTree, Key: "config/app/web"}}
+		for k, v := range files {
+			ops = append(ops, &Op{Verb: OpSet, Key: "config/app/web/" + k, Value: []byte(v)})
+		}
+		ops = append(ops, &Op{Verb: OpSet, Key: "config/deploy/web/status", Value: []byte("deployed")})
+		if err := s.Txn(ops); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	push(map[string]string{"etc/a.conf": "a1", "b.yml": "b1"})
+	push(map[string]string{"etc/a.conf": "a2"})
+
+	link := filepath.Join(s.root, "config", "app", "web")
+	info, err := os.Lstat(link)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("expected tree to be a symlink, %v", err)
+	}
+
+	pairs, _ := s.List("config/app/web/")
+	if len(pairs) != 1 || pairs[0].Key != "config/app/web/etc/a.conf" || string(pairs[0].Value) != "a2" {
+		t.Fatalf("unexpected tree %v", pairs)
+	}
+	if pair, _ := s.Get("config/deploy/web/status"); pair == nil {
+		t.Fatal("expected status outside the tree")
+	}
+
+	push(map[string]string{"etc/a.conf": "a3"})
+	versions, _ := ioutil.ReadDir(s.versionsDir("config/app/web"))
+	if len(versions) != 2 {
+		t.Fatalf("expected 2 versions kept, got %d", len(versions))
+	}
+
+	// removing a tree drops its versions
+	if err := s.DeleteTree("config/app/web/"); err != nil {
+		t.Fatal(err)
+	}
+	if pairs, _ := s.List("config/app/web/"); len(pairs) != 0 {
+		t.Fatalf("expected empty tree, got %v", pairs)
+	}
+	if versions, _ := ioutil.ReadDir(s.versionsDir("config/app/web")); len(versions) != 0 {
+		t.Fatalf("expected no versions, got %d", len(versions))
+	}
+}
+
+func TestFileManifest(t *testing.T) {
+	manifest, err := ioutil.TempFile("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(manifest.Name())
+	manifest.WriteString("[vars]\nregion = \"eu\"\n\n[web]\nrepo = \"git.example.com/web\"\nbranch = \"master\"\nrev = \"latest\"\n")
+	manifest.Close()
+
+	s, cleanup := makeFileStore(t, &FileConfig{Manifest: manifest.Name(), ManifestPrefix: "config/global", PollInterval: 10 * time.Millisecond})
+	defer cleanup()
+
+	pairs, err := s.List("config/global/")
+	if err != nil || len(pairs) != 4 {
+		t.Fatalf("unexpected pairs %v %v", pairs, err)
+	}
+	if pairs[0].Key != "config/global/vars/region" || pairs[3].Key != "config/global/web/rev" {
+		t.Fatalf("unexpected keys %s %s", pairs[0].Key, pairs[3].Key)
+	}
+	if pair, _ := s.Get("config/global/web/branch"); pair == nil || string(pair.Value) != "master" {
+		t.Fatalf("unexpected pair %v", pair)
+	}
+	if err := s.Put("config/global/web/rev", []byte("v2")); err == nil {
+		t.Fatal("expected manifest keys to be read-only")
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	ch, _ := s.Watch("config/global", true, done)
+	if pairs := <-ch; len(pairs) != 4 {
+		t.Fatalf("expected initial pairs, got %v", pairs)
+	}
+	ioutil.WriteFile(manifest.Name(), []byte("[web]\nrepo = \"git.example.com/web\"\nbranch = \"master\"\nrev = \"v2\"\n"), 0644)
+	select {
+	case pairs := <-ch:
+		if len(pairs) != 3 || string(pairs[2].Value) != "v2" {
+			t.Fatalf("unexpected pairs %v", pairs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no watch event")
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	s, cleanup := makeFileStore(t, &FileConfig{})
+	defer cleanup()
+
+	const key = "service/confmaster/leader"
+	l1, _ := s.NewLock(key, []byte("proc1"))
+	l2, _ := s.NewLock(key, []byte("proc2"))
+
+	if holder, _ := s.Holder(key); holder != "" {
+		t.Fatalf("expected no holder, got %s", holder)
+	}
+	if ok, err := l1.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expected first lock to acquire, %v %v", ok, err)
+	}
+	if ok, _ := l2.TryAcquire(); ok {
+		t.Fatal("expected second lock to fail")
+	}
+	if holder, _ := s.Holder(key); holder != "proc1" {
+		t.Fatalf("expected holder proc1, got %s", holder)
+	}
+	if held, _ := l1.Held(); !held {
+		t.Fatal("expected first lock held")
+	}
+	if held, _ := l2.Held(); held {
+		t.Fatal("expected second lock not held")
+	}
+	check := func(session string) error {
+		return s.Txn([]*Op{{Verb: OpSet, Key: "k", Value: []byte("v")}, {Verb: OpCheckSession, Key: key, Session: session}})
+	}
+	if err := check(l1.Session()); err != nil {
+		t.Fatalf("expected check of held lock to pass, %v", err)
+	}
+	if err := check(l2.Session()); err != ErrTxnFailed {
+		t.Fatalf("expected check of lock not held to fail, %v", err)
+	}
+	session := l1.Session()
+
+	l1.Destroy()
+	if err := check(session); err != ErrTxnFailed {
+		t.Fatalf("expected check of released lock to fail, %v", err)
+	}
+	if held, _ := l1.Held(); held {
+		t.Fatal("expected destroyed lock not held")
+	}
+	if holder, _ := s.Holder(key); holder != "" {
+		t.Fatalf("expected no holder, got %s", holder)
+	}
+	if ok, _ := l2.TryAcquire(); !ok {
+		t.Fatal("expected second lock to acquire after release")
+	}
+	l2.Release()
+}
@@ -0,0 +1,140 @@
+// Package kvstore abstracts the KV storage masters deliver configuration through,
+// implemented by Consul, etcd v3 and a local directory
+// slave agents & confctl still talk to Consul directly
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// BackendConsul stores configuration in Consul KV (default)
+	BackendConsul = "consul"
+	// BackendEtcd stores configuration in etcd v3
+	BackendEtcd = "etcd"
+	// BackendFile stores configuration in a local directory, for standalone boxes
+	BackendFile = "file"
+)
+
+// ErrTxnFailed is returned when a transaction was rolled back
+var ErrTxnFailed = errors.New("transaction failed")
+
+// Pair is a key & value, ModifyIndex is the Consul modify index or etcd mod revision
+// Session is the Consul session or etcd lease(hex) holding the key, empty when not held
+type Pair struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+	Session     string
+}
+
+// Pairs is a list of pairs sorted by key
+type Pairs []*Pair
+
+// op verbs
+const (
+	OpSet        = "set"
+	OpDelete     = "delete"
+	OpDeleteTree = "delete-tree"
+	// OpCAS sets Value when Key is unmodified since Index, 0 meaning absent
+	OpCAS = "cas"
+	// OpCheckSession fails the transaction unless lock Key is held by Session, see Lock.Session
+	OpCheckSession = "check-session"
+)
+
+// Op is an operation of a transaction
+type Op struct {
+	Verb    string
+	Key     string
+	Value   []byte
+	Index   uint64
+	Session string
+}
+
+// Store is a KV storage with atomic multi-key writes, prefix watches and locks
+type Store interface {
+	// Get returns a pair, nil when key doesn't exist
+	Get(key string) (*Pair, error)
+	// List returns pairs under prefix
+	List(prefix string) (Pairs, error)
+	Put(key string, value []byte) error
+	// CAS sets value when key is unmodified since index, 0 meaning absent
+	CAS(key string, value []byte, index uint64) (bool, error)
+	Delete(key string) error
+	DeleteTree(prefix string) error
+	// Txn applies ops atomically, ErrTxnFailed when a check failed
+	Txn(ops []*Op) error
+
+	// Watch delivers pairs under prefix, or the pair of key, on every change until stop is closed
+	Watch(key string, prefix bool, stop <-chan struct{}) (<-chan Pairs, error)
+
+	// NewLock returns a lock on key held with value by a session(Consul) or lease(etcd)
+	NewLock(key string, value []byte) (Lock, error)
+	// Holder returns value of the holder of a lock key, empty when not held
+	Holder(key string) (string, error)
+
+	// Register registers node as an instance of service until Deregister or the node dies
+	Register(service, node string) error
+	Deregister(service, node string) error
+	// Nodes lists nodes registered for service
+	Nodes(service string) ([]string, error)
+
+	// Self returns node name & datacenter of this member
+	Self() (node string, datacenter string, err error)
+
+	Close() error
+}
+
+// Lock is a key held while its session or lease lives, released when the holder dies
+type Lock interface {
+	// TryAcquire tries once to hold the key, true when held by this lock
+	TryAcquire() (bool, error)
+	// Release releases the key if held
+	Release() error
+	// Destroy releases the key and ends the session or lease
+	Destroy() error
+	// Held checks whether the key is currently held by this lock, not just by an equal value
+	Held() (bool, error)
+	// Session returns the session(Consul), lease(etcd, hex) or lock token(file) the key is acquired with,
+	// empty before the first acquire
+	Session() string
+}
+
+// Config is configuration for New
+type Config struct {
+	Backend string
+	// Consul agent address
+	ConsulAddr string
+	// etcd endpoints, node name(hostname, hostname-pid on file when empty) & datacenter this member reports
+	EtcdEndpoints []string
+	Node          string
+	Datacenter    string
+	// local directory & app manifest served under ManifestPrefix of the file backend
+	FileRoot       string
+	Manifest       string
+	ManifestPrefix string
+}
+
+// New creates a Store for the configured backend
+func New(config *Config) (Store, error) {
+	switch config.Backend {
+	case "", BackendConsul:
+		return NewConsulStore(config.ConsulAddr)
+	case BackendEtcd:
+		return NewEtcdStore(&EtcdConfig{
+			Endpoints:  config.EtcdEndpoints,
+			Node:       config.Node,
+			Datacenter: config.Datacenter,
+		})
+	case BackendFile:
+		return NewFileStore(&FileConfig{
+			Root:           config.FileRoot,
+			Manifest:       config.Manifest,
+			ManifestPrefix: config.ManifestPrefix,
+			Node:           config.Node,
+			Datacenter:     config.Datacenter,
+		})
+	}
+	return nil, fmt.Errorf("unknown backend(%s)", config.Backend)
+}
@@ -7,6 +7,8 @@ import (
 	"math/rand"
 	"sync"
 	"time"
+
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
 )
 
 const (
@@ -43,13 +45,18 @@ type Config struct {
 	WatchPeriod int // in millisecond
 	IsMaster    bool
 	Client      *consulapi.Client
+	// storage leadership is held in, Consul through Client when nil
+	Store kvstore.Store
 }
 
 type LeaderHandler struct {
 	LeaderKey     string
 	Client        *consulapi.Client
+	Store         kvstore.Store
+	lock          kvstore.Lock // leader key held by a session(Consul) or lease(etcd)
 	log           *logrus.Entry
 	NodeName      string // node name
+	Datacenter    string // datacenter of the agent
 	WatchPeriod   time.Duration
 	IsMaster      bool // part of master group, slave otherwise
 	Running       bool
@@ -63,7 +70,17 @@ type LeaderHandler struct {
 // Not thread safe!!!
 func NewLeaderHandler(config *Config) (*LeaderHandler, error) {
 
-	name, err := GetNodeName(config.Client)
+	store := config.Store
+	if store == nil {
+		store = kvstore.WrapConsulClient(config.Client)
+	}
+
+	name, dc, err := store.Self()
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := store.NewLock(config.LeaderKey, []byte(name))
 	if err != nil {
 		return nil, err
 	}
@@ -78,7 +95,10 @@ func NewLeaderHandler(config *Config) (*LeaderHandler, error) {
 
 	handler := &LeaderHandler{
 		Client:       config.Client,
+		Store:        store,
+		lock:         lock,
 		NodeName:     name,
+		Datacenter:   dc,
 		LeaderKey:    config.LeaderKey,
 		log:          logEntry,
 		WatchPeriod:  time.Duration(config.WatchPeriod) * time.Millisecond,
@@ -109,17 +129,15 @@ func (l *LeaderHandler) LeaderCh() chan LeaderEvent {
 }
 
 func (l *LeaderHandler) Cleanup() error {
-	sessionID, err := l.GetSession()
-	if err != nil {
-		return err
+	if !l.IsMaster {
+		return nil
 	}
 
-	_, err = l.Client.Session().Destroy(sessionID, nil)
-	if err != nil {
+	if err := l.lock.Destroy(); err != nil {
 		return err
 	}
 
-	l.log.Infof("node(%s) SessionID(%s) destroyed", l.NodeName, sessionID)
+	l.log.Infof("node(%s) leader lock destroyed", l.NodeName)
 	return nil
 }
 
@@ -130,50 +148,23 @@ What happens to the associated locks depends on the behavior specified at creati
 Consul supports a release and delete behavior.
 
 The release behavior is the default if none is specified.
-*/
-
-func (l *LeaderHandler) GetSession() (string, error) {
-	if !l.IsMaster {
-		panic("Non-master doesn't need a session")
-	}
-
-	c := l.Client
-	sessionName := l.LeaderKey
-
-	// TODO: sessionID cache
-	sessions, _, err := c.Session().List(nil)
-	for _, s := range sessions {
-		if s.Name == sessionName && s.Node == l.NodeName {
-			return s.ID, nil
-		}
-	}
-
-	sessionEntry := &consulapi.SessionEntry{Name: sessionName}
-	sessionID, _, err := c.Session().Create(sessionEntry, nil)
 
-	if err != nil {
-		return "", nil
-	}
-
-	return sessionID, nil
-}
+etcd deletes keys attached to a lease once it is revoked or expires.
+*/
 
+// IsLeader checks whether the leader key is held by the session or lease of this process,
+// the holder value alone is shared by processes reporting the same node name
 func (l *LeaderHandler) IsLeader() (bool, error) {
 	if !l.IsMaster {
 		return false, nil
 	}
 
-	sessionID, err := l.GetSession()
-	if err != nil {
-		return false, err
-	}
-
-	kv, _, err := l.Client.KV().Get(l.LeaderKey, nil)
-	if err != nil {
-		return false, err
-	}
+	return l.lock.Held()
+}
 
-	return kv != nil && l.NodeName == string(kv.Value) && sessionID == kv.Session, nil
+// LeaderCheck returns a transaction op failing unless this process still holds the leader key
+func (l *LeaderHandler) LeaderCheck() *kvstore.Op {
+	return &kvstore.Op{Verb: kvstore.OpCheckSession, Key: l.LeaderKey, Session: l.lock.Session()}
 }
 
 func (l *LeaderHandler) StepDown() error {
@@ -187,18 +178,11 @@ func (l *LeaderHandler) StepDown() error {
 	}
 
 	if b {
-		sessionID, err := l.GetSession()
-		if err != nil {
-			return err
-		}
-
-		key := &consulapi.KVPair{Key: l.LeaderKey, Value: []byte(l.NodeName), Session: sessionID}
-		released, _, err := l.Client.KV().Release(key, nil)
-		if !released || err != nil {
-			l.log.Errorf("Failed to release leadership node(%s) sessionID(%s)", l.NodeName, sessionID)
+		if err := l.lock.Release(); err != nil {
+			l.log.Errorf("Failed to release leadership node(%s)", l.NodeName)
 			return err
 		} else {
-			l.log.Debugf("Released leadership node(%s) sessionID(%s)", l.NodeName, sessionID)
+			l.log.Debugf("Released leadership node(%s)", l.NodeName)
 			time.Sleep(1 * time.Second)
 		}
 	}
@@ -235,8 +219,6 @@ func (l *LeaderHandler) Loop() {
 
 	l.Running = true
 
-	c := l.Client
-
 	// randomize starting
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	time.Sleep(time.Millisecond * time.Duration((r.Int() % 1000)))
@@ -261,20 +243,13 @@ func (l *LeaderHandler) Loop() {
 
 					if !b {
 				*/
-				sessionID, err := l.GetSession()
+				acquired, err := l.lock.TryAcquire()
 				if err != nil {
 					panic(err)
 				}
 
-				pair := &consulapi.KVPair{
-					Key:     l.LeaderKey,
-					Value:   []byte(l.NodeName),
-					Session: sessionID,
-				}
-
-				acquired, _, err := c.KV().Acquire(pair, nil)
 				if acquired {
-					l.log.Debugf("Elected as leader node(%s) sessionID(%s)", l.NodeName, sessionID)
+					l.log.Debugf("Elected as leader node(%s)", l.NodeName)
 				} else {
 					l.log.Debugf("Failed to acquire leadership")
 				}
@@ -282,15 +257,24 @@ func (l *LeaderHandler) Loop() {
 
 			// master followers and client check current leader
 			// TODO: should change to watch
-			kv, _, err := c.KV().Get(l.LeaderKey, nil)
+			newLeader, err := l.Store.Holder(l.LeaderKey)
 			if err != nil {
 				//TODO: error handling
 				panic(err)
 			}
 
-			if kv != nil && kv.Session != "" {
-				newLeader := string(kv.Value)
-				if newLeader != l.currentLeader {
+			// the holder value is shared by processes reporting the same node name,
+			// leading is decided by the lock this process holds
+			leading := false
+			if newLeader == l.NodeName {
+				if leading, err = l.IsLeader(); err != nil {
+					//TODO: error handling
+					panic(err)
+				}
+			}
+
+			if newLeader != "" {
+				if newLeader != l.currentLeader || leading != (l.state == Master) {
 					//var c EventCode
 					if l.currentLeader == "" {
 						l.log.Debugf("New Leadership (%s) found", newLeader)
@@ -299,7 +283,7 @@ func (l *LeaderHandler) Loop() {
 						l.log.Debugf("Leadership Change (%s -> %s) found", l.currentLeader, newLeader)
 					}
 					l.currentLeader = newLeader
-					if newLeader == l.NodeName {
+					if leading {
 						l.state = Master
 						l.leaderCh <- LeaderEvent{newLeader, true}
 					} else {
@@ -307,14 +291,15 @@ func (l *LeaderHandler) Loop() {
 						l.leaderCh <- LeaderEvent{newLeader, false}
 					}
 				} else { // leader == l.currentLeader
-					if newLeader == l.NodeName {
+					if leading {
 						l.log.Debugf("Enjoying leadership....")
 					}
 				}
 			} else { // leadership missing
+				wasLeading := l.state == Master
 				l.state = Slave
 				if l.currentLeader != "" {
-					if l.currentLeader == l.NodeName {
+					if wasLeading {
 						l.leaderCh <- LeaderEvent{"", false}
 					}
 					l.currentLeader = ""
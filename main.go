@@ -1,9 +1,116 @@
 package main
 
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
 func main() {
 	logEntry := configureLogger("main")
 
-	m, err := NewConfMaster(&MasterConfig{})
+	nodeType := flag.String("nodetype", "master", "node type (master, slave or import)")
+	applyRoot := flag.String("applyroot", "/var/lib/confslave", "local directory where slave applies snapshots")
+	signingKey := flag.String("signingkey", "", "ed25519 key file for signing snapshots (master)")
+	commitSigners := flag.String("commitsigners", "", "directory of trusted commit signers (master)")
+	validators := flag.String("validators", "", "external validator commands file (master)")
+	adminAddr := flag.String("adminaddr", DefaultAdminAddr, "admin API listen address, :9080 to reach it from confctl elsewhere (master)")
+	adminTokens := flag.String("admintokens", "", "JSON file of admin API tokens by identity, restore is disabled without it (master)")
+	redactLogs := flag.Bool("redactlogs", false, "dump snapshot keys & sizes only, detected secrets are always masked (master)")
+	ageIdentity := flag.String("ageidentity", "", "age identity file for decrypting snapshots")
+	trustedKeys := flag.String("trustedkeys", "", "trusted ed25519 public keys file (slave)")
+	historyLimit := flag.Int("historylimit", client.DefaultHistoryLimit, "deploy history entries kept per app (master)")
+	historyLog := flag.String("historylog", "", "local JSONL file deploy history is also appended to (master)")
+	backend := flag.String("backend", kvstore.BackendConsul, "KV backend, consul, etcd or file (master)")
+	etcdEndpoints := flag.String("etcd", kvstore.DefaultEtcdEndpoint, "comma separated etcd endpoints (master)")
+	datacenter := flag.String("datacenter", "", "datacenter reported by masters on etcd or file (master)")
+	fileRoot := flag.String("fileroot", kvstore.DefaultFileRoot, "directory snapshots are written to by the file backend (master)")
+	manifest := flag.String("manifest", "", "TOML file of app definitions for the file backend (master)")
+	cacheURL := flag.String("cache", "", "cache snapshots are mirrored to, redis://host:port or memcache://host:port[,host:port] (master)")
+	cacheKeyPrefix := flag.String("cacheprefix", DefaultCacheKeyPrefix, "key prefix of snapshots mirrored to the cache (master)")
+	k8sDir := flag.String("k8sdir", "", "directory Kubernetes ConfigMap/Secret manifests are written to on each push (master)")
+	k8sNamespace := flag.String("k8snamespace", "", "namespace of exported Kubernetes manifests (master)")
+	nodeGroups := flag.String("nodegroups", "", "comma separated node groups overrides are resolved for (slave)")
+	importPrefix := flag.String("importprefix", "", "KV prefix committed to git, the app prefix it is published under (import)")
+	importApp := flag.String("importapp", "", "app registered for the imported prefix, last prefix component when empty (import)")
+	importRepo := flag.String("importrepo", "", "git repository url imported keys are pushed to (import)")
+	importBranch := flag.String("importbranch", "master", "branch imported keys are committed on (import)")
+	collapse := flag.String("collapse", CollapseOff, "collapse directories of leaf keys into documents, off, yaml or json (import)")
+	flag.Parse()
+
+	if *nodeType == "import" {
+		store, err := kvstore.New(&kvstore.Config{
+			Backend:       *backend,
+			ConsulAddr:    DefaultConsulAddr,
+			EtcdEndpoints: splitList(*etcdEndpoints),
+			Datacenter:    *datacenter,
+			FileRoot:      *fileRoot,
+		})
+		if err != nil {
+			logEntry.Errorf("Failed to open KV store err: %v\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+		commit, err := ImportKV(&KVImportConfig{
+			store:      store,
+			prefix:     *importPrefix,
+			appID:      *importApp,
+			repoURL:    *importRepo,
+			branchName: *importBranch,
+			collapse:   *collapse,
+		})
+		if err != nil {
+			logEntry.Errorf("Failed to import prefix(%s) err: %v\n", *importPrefix, err)
+			os.Exit(1)
+		}
+		logEntry.Infof("prefix(%s) imported as commit(%s)", *importPrefix, commit)
+		return
+	}
+
+	if *nodeType == "slave" {
+		s, err := NewConfSlave(&SlaveConfig{
+			applyRoot:       *applyRoot,
+			trustedKeysPath: *trustedKeys,
+			ageIdentityPath: *ageIdentity,
+			nodeGroups:      splitList(*nodeGroups),
+		})
+		if err != nil {
+			logEntry.Errorf("Failed to create ConfSlave err: %v\n", err)
+			return
+		}
+		s.Run()
+
+		sigC := make(chan os.Signal, 2)
+		signal.Notify(sigC, os.Interrupt, syscall.SIGTERM)
+		<-sigC
+		s.Shutdown()
+		return
+	}
+
+	m, err := NewConfMaster(&MasterConfig{
+		signingKeyPath:    *signingKey,
+		commitSignersPath: *commitSigners,
+		validatorsPath:    *validators,
+		adminAddr:         *adminAddr,
+		adminTokensPath:   *adminTokens,
+		redactLogs:        *redactLogs,
+		ageIdentityPath:   *ageIdentity,
+		historyLimit:      *historyLimit,
+		historyLogPath:    *historyLog,
+		backend:           *backend,
+		etcdEndpoints:     splitList(*etcdEndpoints),
+		datacenter:        *datacenter,
+		fileRoot:          *fileRoot,
+		manifestPath:      *manifest,
+		cacheURL:          *cacheURL,
+		cacheKeyPrefix:    *cacheKeyPrefix,
+		k8sDir:            *k8sDir,
+		k8sNamespace:      *k8sNamespace,
+	})
 
 	if err != nil {
 		logEntry.Errorf("Failed to create ConfMaster err: %v\n", err)
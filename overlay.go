@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+)
+
+const (
+	// OverlaysDir holds overlays merged over the base of a repo(overlays/<name>/...)
+	OverlaysDir = "overlays"
+	// DefaultOverlays applies the overlay of the master's datacenter
+	DefaultOverlays = "${dc}"
+	// OverlaysOn enables DefaultOverlays for an app (off by default)
+	OverlaysOn = "on"
+	// OverlaysOff disables overlays for an app
+	OverlaysOff = "off"
+
+	// VariablesFile is a repo file defining variables(flat json object)
+	VariablesFile = ".vars.json"
+	// VariablesOn enables ${var} substitution for an app (off by default)
+	VariablesOn = "on"
+
+	// varsNamespace is the global namespace of variables(config/global/vars/<name>)
+	varsNamespace = "vars"
+)
+
+// variableRef matches ${name}, $${ escapes a literal ${
+var variableRef = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_.\-]*)\}`)
+
+// expandBuiltins expands ${var} of builtin variables only, unknown ones are left as is
+func expandBuiltins(s string, builtins map[string]string) string {
+	return variableRef.ReplaceAllStringFunc(s, func(m string) string {
+		if v, ok := builtins[m[2:len(m)-1]]; ok {
+			return v
+		}
+		return m
+	})
+}
+
+// overlayNames returns overlays in the order they are applied
+// spec is comma separated overlay names, e.g. "${dc},edge", or on for DefaultOverlays
+func overlayNames(spec string, builtins map[string]string) []string {
+	if spec == OverlaysOn {
+		spec = DefaultOverlays
+	}
+	var names []string
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(expandBuiltins(name, builtins))
+		if name == "" || strings.Contains(name, "${") {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// isStructured checks whether a file is deep merged
+func isStructured(key string) bool {
+	switch strings.ToLower(path.Ext(key)) {
+	case ".json", ".yml", ".yaml", ".toml":
+		return true
+	}
+	return false
+}
+
+// decodeStructured decodes json, yaml & toml files into json compatible values
+func decodeStructured(key string, data []byte) (interface{}, error) {
+	var doc interface{}
+	var err error
+	switch strings.ToLower(path.Ext(key)) {
+	case ".json":
+		err = json.Unmarshal(data, &doc)
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		m := make(map[string]interface{})
+		_, err = toml.Decode(string(data), &m)
+		doc = m
+	}
+	if err != nil {
+		return nil, err
+	}
+	return toJSONCompatible(doc), nil
+}
+
+// encodeStructured encodes a merged document in the format of key
+func encodeStructured(key string, doc interface{}) ([]byte, error) {
+	switch strings.ToLower(path.Ext(key)) {
+	case ".json":
+		data, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	case ".yml", ".yaml":
+		return yaml.Marshal(doc)
+	case ".toml":
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(doc); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported format(%s)", key)
+}
+
+// deepMerge merges over into base, maps are merged recursively and anything else is replaced
+func deepMerge(base, over interface{}) interface{} {
+	baseMap, ok := base.(map[string]interface{})
+	overMap, ok2 := over.(map[string]interface{})
+	if !ok || !ok2 {
+		return over
+	}
+	merged := make(map[string]interface{})
+	for k, v := range baseMap {
+		merged[k] = v
+	}
+	for k, v := range overMap {
+		if old, ok := merged[k]; ok {
+			merged[k] = deepMerge(old, v)
+		} else {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// applyOverlays merges overlays over the base of a snapshot
+// the overlays directory itself is not part of the result
+func applyOverlays(kvs map[string][]byte, names []string) (map[string][]byte, error) {
+	prefix := OverlaysDir + "/"
+	out := make(map[string][]byte)
+	for k, v := range kvs {
+		if !strings.HasPrefix(k, prefix) {
+			out[k] = v
+		}
+	}
+
+	for _, name := range names {
+		overlayPrefix := prefix + name + "/"
+		for _, k := range sortedKeys(kvs) {
+			if !strings.HasPrefix(k, overlayPrefix) {
+				continue
+			}
+			rel := strings.TrimPrefix(k, overlayPrefix)
+
+			base, ok := out[rel]
+			if !ok || !isStructured(rel) {
+				out[rel] = kvs[k]
+				continue
+			}
+
+			baseDoc, err := decodeStructured(rel, base)
+			if err != nil {
+				return nil, fmt.Errorf("merging(%s): %v", rel, err)
+			}
+			overDoc, err := decodeStructured(k, kvs[k])
+			if err != nil {
+				return nil, fmt.Errorf("merging(%s): %v", k, err)
+			}
+			data, err := encodeStructured(rel, deepMerge(baseDoc, overDoc))
+			if err != nil {
+				return nil, fmt.Errorf("merging(%s): %v", rel, err)
+			}
+			out[rel] = data
+		}
+	}
+	return out, nil
+}
+
+// loadVariables merges builtins, the repo variables file and global variables in that order
+func loadVariables(kvs map[string][]byte, globals map[string]string, builtins map[string]string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for k, v := range builtins {
+		vars[k] = v
+	}
+
+	if data, ok := kvs[VariablesFile]; ok {
+		repoVars := make(map[string]interface{})
+		if err := json.Unmarshal(data, &repoVars); err != nil {
+			return nil, fmt.Errorf("%s: %v", VariablesFile, err)
+		}
+		for k, v := range repoVars {
+			vars[k] = fmt.Sprintf("%v", v)
+		}
+	}
+
+	for k, v := range globals {
+		vars[k] = v
+	}
+	return vars, nil
+}
+
+// substituteVariables replaces ${var} in text files
+// undefined variables fail the whole snapshot rather than deploying half rendered files
+func substituteVariables(kvs map[string][]byte, vars map[string]string) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	var undefined []string
+	for _, k := range sortedKeys(kvs) {
+		v := kvs[k]
+		if k == VariablesFile || isMetaKey(k) || client.IsEncryptedKey(k) || bytes.IndexByte(v, 0) >= 0 {
+			out[k] = v
+			continue
+		}
+
+		out[k] = variableRef.ReplaceAllFunc(v, func(m []byte) []byte {
+			if string(m) == "$${" {
+				return []byte("${")
+			}
+			name := string(m[2 : len(m)-1])
+			val, ok := vars[name]
+			if !ok {
+				undefined = append(undefined, fmt.Sprintf("%s(%s)", k, name))
+				return m
+			}
+			return []byte(val)
+		})
+	}
+	if len(undefined) > 0 {
+		sort.Strings(undefined)
+		return nil, fmt.Errorf("undefined variables: %s", strings.Join(undefined, ", "))
+	}
+	return out, nil
+}
+
+// overlaysEnabled checks whether an app opted in overlays, the tree is left untouched otherwise
+func overlaysEnabled(spec string) bool {
+	return spec != "" && spec != OverlaysOff
+}
+
+// renderSnapshot applies overlays and substitutes variables as configured for the app
+func renderSnapshot(conf *AppConf, kvs map[string][]byte, globals map[string]string, builtins map[string]string) (map[string][]byte, error) {
+	var err error
+	if overlaysEnabled(conf.Overlays) {
+		kvs, err = applyOverlays(kvs, overlayNames(conf.Overlays, builtins))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.Variables != VariablesOn {
+		return kvs, nil
+	}
+	vars, err := loadVariables(kvs, globals, builtins)
+	if err != nil {
+		return nil, err
+	}
+	return substituteVariables(kvs, vars)
+}
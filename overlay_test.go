@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyOverlays(t *testing.T) {
+	kvs := map[string][]byte{
+		"app.json":                  []byte(`{"db": {"host": "localhost", "port": 5432}, "debug": false}`),
+		"app.yml":                   []byte("cache:\n  size: 10\n  ttl: 60\nhosts: [a, b]\n"),
+		"nginx.conf":                []byte("worker_processes 4;\n"),
+		"overlays/us-east/app.json": []byte(`{"db": {"host": "db.us-east"}}`),
+		"overlays/us-east/app.yml":  []byte("cache:\n  size: 100\nhosts: [c]\n"),
+		"overlays/edge/nginx.conf":  []byte("worker_processes 16;\n"),
+		"overlays/edge/extra.conf":  []byte("extra"),
+		"overlays/eu-west/app.json": []byte(`{"debug": true}`),
+	}
+
+	names := overlayNames("${dc}, edge", map[string]string{"dc": "us-east"})
+	if !reflect.DeepEqual(names, []string{"us-east", "edge"}) {
+		t.Fatalf("unexpected overlays(%v)", names)
+	}
+
+	out, err := applyOverlays(kvs, names)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for k := range out {
+		if strings.HasPrefix(k, OverlaysDir+"/") {
+			t.Fatalf("overlay key(%s) left in snapshot", k)
+		}
+	}
+
+	doc, _ := decodeStructured("app.json", out["app.json"])
+	expected := map[string]interface{}{
+		"db":    map[string]interface{}{"host": "db.us-east", "port": float64(5432)},
+		"debug": false,
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Fatalf("expected(%v) got(%v)", expected, doc)
+	}
+
+	doc, _ = decodeStructured("app.yml", out["app.yml"])
+	expected = map[string]interface{}{
+		"cache": map[string]interface{}{"size": 100, "ttl": 60},
+		"hosts": []interface{}{"c"},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Fatalf("expected(%v) got(%v)", expected, doc)
+	}
+
+	if string(out["nginx.conf"]) != "worker_processes 16;\n" || string(out["extra.conf"]) != "extra" {
+		t.Fatalf("unstructured files should be replaced by overlays")
+	}
+}
+
+func TestRenderSnapshotOverlaysOptIn(t *testing.T) {
+	kvs := map[string][]byte{
+		"app.conf":                  []byte("base"),
+		"overlays/us-east/app.conf": []byte("us-east"),
+	}
+	builtins := map[string]string{"dc": "us-east"}
+
+	for _, spec := range []string{"", OverlaysOff} {
+		out, err := renderSnapshot(&AppConf{Overlays: spec}, kvs, nil, builtins)
+		if err != nil || !reflect.DeepEqual(out, kvs) {
+			t.Fatalf("overlays(%q) should leave the tree untouched, got(%v) %v", spec, out, err)
+		}
+	}
+	out, err := renderSnapshot(&AppConf{Overlays: OverlaysOn}, kvs, nil, builtins)
+	if err != nil || string(out["app.conf"]) != "us-east" || len(out) != 1 {
+		t.Fatalf("expected overlay of dc applied, got(%v) %v", out, err)
+	}
+}
+
+func TestSubstituteVariables(t *testing.T) {
+	kvs := map[string][]byte{
+		VariablesFile: []byte(`{"region": "us", "port": 8080}`),
+		"app.conf":    []byte("region=${region} port=${port} dc=${dc} literal=$${region}"),
+		"secret.age":  []byte("${not_a_var}"),
+	}
+
+	vars, err := loadVariables(kvs, map[string]string{"port": "9090"}, map[string]string{"dc": "us-east"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err := substituteVariables(kvs, vars)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out["app.conf"]) != "region=us port=9090 dc=us-east literal=${region}" {
+		t.Fatalf("unexpected app.conf(%s)", out["app.conf"])
+	}
+	if string(out["secret.age"]) != "${not_a_var}" {
+		t.Fatalf("encrypted files should not be substituted")
+	}
+
+	kvs["b.conf"] = []byte("${missing}")
+	if _, err := substituteVariables(kvs, vars); err == nil || !strings.Contains(err.Error(), "b.conf(missing)") {
+		t.Fatalf("expected undefined variable error, got(%v)", err)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 
@@ -35,6 +37,8 @@ type Repo struct {
 	branchName string
 	remoteName string
 	appID      string
+
+	snapshotOpts SnapshotOptions
 }
 
 func (r *Repo) String() string {
@@ -381,6 +385,39 @@ func (r *Repo) GetLatestCommit() (string, error) {
 	return obj.Id().String(), nil
 }
 
+// CommitInfo contains commit attributes published with snapshots
+type CommitInfo struct {
+	ID          string
+	Author      string
+	CommittedAt time.Time
+	Subject     string
+}
+
+// GetCommitInfo returns author, committer time & subject line of a commit
+func (r *Repo) GetCommitInfo(commit string) (*CommitInfo, error) {
+	oid, err := git.NewOid(commit)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := r.repo.LookupCommit(oid)
+	if err != nil {
+		r.log.Errorf("Failed to find commit(%s)", commit)
+		return nil, err
+	}
+	defer c.Free()
+
+	author := c.Author()
+	subject := strings.TrimSpace(strings.SplitN(c.Message(), "\n", 2)[0])
+
+	return &CommitInfo{
+		ID:          c.Id().String(),
+		Author:      fmt.Sprintf("%s <%s>", author.Name, author.Email),
+		CommittedAt: c.Committer().When,
+		Subject:     subject,
+	}, nil
+}
+
 // BranchName returns current branch name
 func (r *Repo) BranchName() string {
 	return r.branchName
@@ -456,8 +493,12 @@ func (r *Repo) Fetch() error {
 
 	r.log.Infof("fetching remote ref(%s)", refspecs[0])
 
-	options := DefaultFetchOptions(r.log)
-	err = remote.Fetch(refspecs, options, "")
+	if bundle, ok := bundlePath(remote.Url()); ok {
+		err = fetchBundle(r.repo.Path(), bundle, remoteName, branchName)
+	} else {
+		options := DefaultFetchOptions(r.log)
+		err = remote.Fetch(refspecs, options, "")
+	}
 	if err != nil {
 		r.log.Errorf("Failed to fetch remote ref(%s)\n", refspecs[0])
 		return err
@@ -544,6 +585,11 @@ func (r *Repo) SetBranch(branchName string) error {
 	return nil
 }
 
+// SetSnapshotOptions changes handling of submodules & symlinks in snapshots
+func (r *Repo) SetSnapshotOptions(opts SnapshotOptions) {
+	r.snapshotOpts = opts
+}
+
 // LookupTag find tag in the repo
 // http://ben.straub.cc/2013/06/03/refs-tags-and-branching/
 func (r *Repo) LookupTag(tagName string) (string, error) {
@@ -645,19 +691,11 @@ func (r *Repo) GetSnapshot(commit string) (*map[string][]byte, error) {
 	}
 
 	// walk the tree
-	tree.Walk(func(dir string, entry *git.TreeEntry) int {
-		name := path.Join(dir, entry.Name)
-		switch entry.Type {
-		case git.ObjectBlob:
-			blob, err := r.repo.LookupBlob(entry.Id)
-			if err != nil {
-				fmt.Printf("failed to lookup blob")
-				return 1
-			}
-			kv[name] = blob.Contents()
-		}
-		return 0
-	})
+	w := newSnapshotWalker(r, r.repo, tree, r.config.remoteURL, kv, 0)
+	if err := w.walk(""); err != nil {
+		r.log.Errorf("Failed to walk tree of commit(%s): %v", c.Id(), err)
+		return nil, err
+	}
 
 	return &kv, nil
 }
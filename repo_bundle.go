@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// BundleScheme prefixes repo URLs of git bundle files, bundle:///var/lib/confmaster/bundles/web.bundle
+// for datacenters without access to the git server, see confctl bundle
+const BundleScheme = "bundle://"
+
+// bundleDeployedRefs holds commits deployed when a bundle was created
+const bundleDeployedRefs = "refs/deployed/"
+
+// bundlePath returns the bundle file of a bundle:// repo URL
+func bundlePath(url string) (string, bool) {
+	if !strings.HasPrefix(url, BundleScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(url, BundleScheme), true
+}
+
+// fetchBundle fetches branch, tags & deployed commits of a bundle into a repo with git,
+// libgit2 can't read bundles
+func fetchBundle(gitDir, bundle, remoteName, branchName string) error {
+	cmd := exec.Command("git", "--git-dir", gitDir, "fetch", "--quiet", bundle,
+		fmt.Sprintf("+refs/heads/%s:refs/remotes/%s/%s", branchName, remoteName, branchName),
+		"+refs/tags/*:refs/tags/*",
+		"+"+bundleDeployedRefs+"*:"+bundleDeployedRefs+"*",
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("fetching bundle(%s): %v: %s", bundle, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func gitRun(t *testing.T, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestFetchBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if p, ok := bundlePath("bundle://" + dir + "/web.bundle"); !ok || p != dir+"/web.bundle" {
+		t.Fatalf("unexpected bundle path %s", p)
+	}
+	if _, ok := bundlePath("https://git.example.com/web"); ok {
+		t.Fatal("expected no bundle path")
+	}
+
+	src := filepath.Join(dir, "src")
+	gitRun(t, "init", "--quiet", src)
+	ioutil.WriteFile(filepath.Join(src, "a.conf"), []byte("a1"), 0644)
+	gitRun(t, "-C", src, "add", "-A")
+	gitRun(t, "-C", src, "commit", "--quiet", "-m", "first")
+	first := gitRun(t, "-C", src, "rev-parse", "HEAD")
+	gitRun(t, "-C", src, "tag", "-a", "v1", "-m", "v1")
+	gitRun(t, "-C", src, "update-ref", bundleDeployedRefs+first, first)
+	gitRun(t, "-C", src, "branch", "-M", "release")
+	bundle := filepath.Join(dir, "web.bundle")
+	gitRun(t, "-C", src, "bundle", "create", bundle, "--branches", "--tags", "--glob="+bundleDeployedRefs+"*")
+
+	dst := filepath.Join(dir, "dst")
+	gitRun(t, "init", "--bare", "--quiet", dst)
+	if err := fetchBundle(dst, bundle, "origin", "release"); err != nil {
+		t.Fatal(err)
+	}
+	if commit := gitRun(t, "--git-dir", dst, "rev-parse", "refs/remotes/origin/release"); commit != first {
+		t.Fatalf("unexpected branch commit %s", commit)
+	}
+	if commit := gitRun(t, "--git-dir", dst, "rev-parse", "v1^{commit}"); commit != first {
+		t.Fatalf("unexpected tag commit %s", commit)
+	}
+	gitRun(t, "--git-dir", dst, "cat-file", "-e", bundleDeployedRefs+first)
+
+	if err := fetchBundle(dst, bundle, "origin", "missing"); err == nil {
+		t.Fatal("expected missing branch to fail")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// CommitFiles commits files(path => contents) on top of the remote branch, creating the branch when missing
+// files at the same paths are replaced, others are kept; refs/heads/<branch> is moved to the new commit
+func (r *Repo) CommitFiles(files map[string][]byte, name, email, message string) (string, error) {
+	var parents []*git.Commit
+	var base *git.Tree
+	if branch, err := r.getBranch(); err == nil {
+		tip, err := r.repo.LookupCommit(branch.Target())
+		if err != nil {
+			return "", err
+		}
+		defer tip.Free()
+		if base, err = tip.Tree(); err != nil {
+			return "", err
+		}
+		parents = append(parents, tip)
+	} else {
+		r.log.Infof("remote branch(%s) not found, creating root commit", r.BranchName())
+	}
+
+	treeID, err := r.buildTree(base, files)
+	if err != nil {
+		return "", err
+	}
+	tree, err := r.repo.LookupTree(treeID)
+	if err != nil {
+		return "", err
+	}
+	defer tree.Free()
+
+	sig := &git.Signature{Name: name, Email: email, When: time.Now()}
+	oid, err := r.repo.CreateCommit("", sig, sig, message, tree, parents...)
+	if err != nil {
+		return "", err
+	}
+
+	branchRefName := fmt.Sprintf("refs/heads/%s", r.BranchName())
+	ref, err := r.repo.References.Create(branchRefName, oid, true, "commit: "+message)
+	if err != nil {
+		return "", err
+	}
+	defer ref.Free()
+	r.log.Infof("commit(%s) of %d files created on ref(%s)", oid, len(files), branchRefName)
+	return oid.String(), nil
+}
+
+// buildTree writes files into a copy of base, nil for an empty tree
+func (r *Repo) buildTree(base *git.Tree, files map[string][]byte) (*git.Oid, error) {
+	var tb *git.TreeBuilder
+	var err error
+	if base != nil {
+		tb, err = r.repo.TreeBuilderFromTree(base)
+	} else {
+		tb, err = r.repo.TreeBuilder()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer tb.Free()
+
+	dirs := make(map[string]map[string][]byte)
+	for p, data := range files {
+		parts := strings.SplitN(p, "/", 2)
+		if len(parts) == 2 {
+			if dirs[parts[0]] == nil {
+				dirs[parts[0]] = make(map[string][]byte)
+			}
+			dirs[parts[0]][parts[1]] = data
+			continue
+		}
+		oid, err := r.repo.CreateBlobFromBuffer(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := tb.Insert(p, oid, git.FilemodeBlob); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, sub := range dirs {
+		var subBase *git.Tree
+		if base != nil {
+			if entry := base.EntryByName(name); entry != nil && entry.Type == git.ObjectTree {
+				if subBase, err = r.repo.LookupTree(entry.Id); err != nil {
+					return nil, err
+				}
+			}
+		}
+		oid, err := r.buildTree(subBase, sub)
+		if subBase != nil {
+			subBase.Free()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := tb.Insert(name, oid, git.FilemodeTree); err != nil {
+			return nil, err
+		}
+	}
+	return tb.Write()
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+const (
+	// SubmoduleIgnore drops submodule entries from snapshots (default)
+	SubmoduleIgnore = "ignore"
+	// SubmoduleExpand fetches the referenced commit and expands its tree
+	SubmoduleExpand = "expand"
+
+	// SymlinkRaw pushes link target path as a value (default)
+	SymlinkRaw = "raw"
+	// SymlinkResolve pushes contents of the link target within the repo
+	SymlinkResolve = "resolve"
+	// SymlinkSkip drops symlinks from snapshots
+	SymlinkSkip = "skip"
+
+	// maxSymlinkHops bounds symlink resolution (same as linux ELOOP limit)
+	maxSymlinkHops = 40
+	// maxSubmoduleDepth bounds nested submodule expansion
+	maxSubmoduleDepth = 8
+)
+
+// SnapshotOptions controls handling of special tree entries in snapshots
+type SnapshotOptions struct {
+	submodules     string
+	submoduleHosts []string
+	symlinks       string
+}
+
+// submodule is an entry parsed from .gitmodules
+type submodule struct {
+	name string
+	path string
+	url  string
+}
+
+// snapshotWalker walks a git tree collecting blobs into kv
+type snapshotWalker struct {
+	r       *Repo
+	repo    *git.Repository // repository owning root (differs for submodules)
+	root    *git.Tree
+	baseURL string // remote url used for relative submodule urls
+	opts    SnapshotOptions
+	depth   int
+
+	modules map[string]*submodule // by path
+	active  map[string]bool       // real directory paths being walked
+	kv      map[string][]byte
+}
+
+func newSnapshotWalker(r *Repo, repo *git.Repository, root *git.Tree, baseURL string, kv map[string][]byte, depth int) *snapshotWalker {
+	opts := r.snapshotOpts
+	if opts.submodules == "" {
+		opts.submodules = SubmoduleIgnore
+	}
+	if opts.symlinks == "" {
+		opts.symlinks = SymlinkRaw
+	}
+
+	return &snapshotWalker{
+		r:       r,
+		repo:    repo,
+		root:    root,
+		baseURL: baseURL,
+		opts:    opts,
+		depth:   depth,
+		active:  make(map[string]bool),
+		kv:      kv,
+	}
+}
+
+// walk collects the whole tree under keyPrefix
+func (w *snapshotWalker) walk(keyPrefix string) error {
+	return w.walkTree(w.root, "", keyPrefix)
+}
+
+// walkTree walks tree located at realDir in the repository, storing blobs under keyDir
+func (w *snapshotWalker) walkTree(tree *git.Tree, realDir string, keyDir string) error {
+	if w.active[realDir] {
+		return fmt.Errorf("symlink cycle detected at dir(%s)", realDir)
+	}
+	w.active[realDir] = true
+	defer delete(w.active, realDir)
+
+	count := tree.EntryCount()
+	for i := uint64(0); i < count; i++ {
+		entry := tree.EntryByIndex(i)
+		realPath := path.Join(realDir, entry.Name)
+		key := path.Join(keyDir, entry.Name)
+
+		switch entry.Type {
+		case git.ObjectTree:
+			sub, err := w.repo.LookupTree(entry.Id)
+			if err != nil {
+				return err
+			}
+			if err := w.walkTree(sub, realPath, key); err != nil {
+				return err
+			}
+		case git.ObjectBlob:
+			if entry.Filemode == git.FilemodeLink {
+				if err := w.addSymlink(realPath, key, entry); err != nil {
+					return err
+				}
+				continue
+			}
+			blob, err := w.repo.LookupBlob(entry.Id)
+			if err != nil {
+				return err
+			}
+			w.kv[key] = blob.Contents()
+		case git.ObjectCommit:
+			if w.opts.submodules != SubmoduleExpand {
+				w.r.log.Debugf("skipping submodule path(%s) commit(%s)", realPath, entry.Id)
+				continue
+			}
+			if err := w.expandSubmodule(realPath, key, entry.Id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addSymlink stores a symlink entry according to the symlink policy
+func (w *snapshotWalker) addSymlink(realPath string, key string, entry *git.TreeEntry) error {
+	switch w.opts.symlinks {
+	case SymlinkSkip:
+		w.r.log.Debugf("skipping symlink(%s)", realPath)
+		return nil
+	case SymlinkResolve:
+	default:
+		blob, err := w.repo.LookupBlob(entry.Id)
+		if err != nil {
+			return err
+		}
+		w.kv[key] = blob.Contents()
+		return nil
+	}
+
+	target, resolved, err := w.resolvePath(realPath)
+	if err != nil {
+		return err
+	}
+	if target == nil || w.active[resolved] {
+		w.r.log.Warnf("skipping symlink(%s) to parent dir(%s)", realPath, resolved)
+		return nil
+	}
+
+	switch target.Type {
+	case git.ObjectTree:
+		tree, err := w.repo.LookupTree(target.Id)
+		if err != nil {
+			return err
+		}
+		return w.walkTree(tree, resolved, key)
+	case git.ObjectBlob:
+		blob, err := w.repo.LookupBlob(target.Id)
+		if err != nil {
+			return err
+		}
+		w.kv[key] = blob.Contents()
+	case git.ObjectCommit:
+		if w.opts.submodules == SubmoduleExpand {
+			return w.expandSubmodule(resolved, key, target.Id)
+		}
+	}
+	return nil
+}
+
+// linkEscapes checks whether a cleaned relative path points outside of the repo
+func linkEscapes(p string) bool {
+	return path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../")
+}
+
+// resolvePath follows symlinks in every component of p within the root tree
+// a nil entry is returned when p resolves to the root tree itself
+func (w *snapshotWalker) resolvePath(p string) (*git.TreeEntry, string, error) {
+	var entry *git.TreeEntry
+	hops := 0
+	parts := strings.Split(p, "/")
+	resolved := ""
+
+	for i := 0; i < len(parts); i++ {
+		cur := path.Join(resolved, parts[i])
+		e, err := w.root.EntryByPath(cur)
+		if err != nil {
+			return nil, "", fmt.Errorf("symlink(%s) target(%s) not found: %v", p, cur, err)
+		}
+
+		if e.Type == git.ObjectBlob && e.Filemode == git.FilemodeLink {
+			hops++
+			if hops > maxSymlinkHops {
+				return nil, "", fmt.Errorf("symlink(%s) too many levels of links", p)
+			}
+
+			blob, err := w.repo.LookupBlob(e.Id)
+			if err != nil {
+				return nil, "", err
+			}
+			target := strings.TrimSpace(string(blob.Contents()))
+			if path.IsAbs(target) {
+				return nil, "", fmt.Errorf("symlink(%s) escapes repository target(%s)", cur, target)
+			}
+
+			next := path.Join(path.Dir(cur), target)
+			if linkEscapes(next) {
+				return nil, "", fmt.Errorf("symlink(%s) escapes repository target(%s)", cur, target)
+			}
+
+			rest := parts[i+1:]
+			if next == "." {
+				parts = rest
+			} else {
+				parts = append(strings.Split(next, "/"), rest...)
+			}
+			if len(parts) == 0 {
+				// repository root
+				return nil, "", nil
+			}
+			resolved = ""
+			i = -1
+			continue
+		}
+
+		if i < len(parts)-1 && e.Type != git.ObjectTree {
+			return nil, "", fmt.Errorf("symlink(%s) path(%s) is not a directory", p, cur)
+		}
+		resolved = cur
+		entry = e
+	}
+	return entry, resolved, nil
+}
+
+// loadModules reads .gitmodules from the root tree
+func (w *snapshotWalker) loadModules() error {
+	if w.modules != nil {
+		return nil
+	}
+	w.modules = make(map[string]*submodule)
+
+	entry, err := w.root.EntryByPath(".gitmodules")
+	if err != nil {
+		return nil
+	}
+	blob, err := w.repo.LookupBlob(entry.Id)
+	if err != nil {
+		return err
+	}
+	for _, m := range parseGitModules(blob.Contents()) {
+		w.modules[m.path] = m
+	}
+	return nil
+}
+
+// parseGitModules parses .gitmodules(git config format)
+func parseGitModules(data []byte) []*submodule {
+	var modules []*submodule
+	var cur *submodule
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			cur = nil
+			section := strings.TrimSpace(line[1 : len(line)-1])
+			if strings.HasPrefix(section, "submodule") {
+				name := strings.TrimSpace(strings.TrimPrefix(section, "submodule"))
+				cur = &submodule{name: strings.Trim(name, "\"")}
+				modules = append(modules, cur)
+			}
+			continue
+		}
+
+		if cur == nil {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		val := strings.Trim(strings.TrimSpace(kv[1]), "\"")
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "path":
+			cur.path = path.Clean(val)
+		case "url":
+			cur.url = val
+		}
+	}
+	return modules
+}
+
+// resolveSubmoduleURL resolves relative submodule url against the superproject url
+func resolveSubmoduleURL(baseURL string, url string) string {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url
+	}
+	base := strings.TrimSuffix(strings.TrimSuffix(baseURL, "/"), ".git")
+	for {
+		switch {
+		case strings.HasPrefix(url, "./"):
+			url = url[2:]
+		case strings.HasPrefix(url, "../"):
+			url = url[3:]
+			if ix := strings.LastIndex(base, "/"); ix >= 0 {
+				base = base[:ix]
+			}
+		default:
+			return base + "/" + url
+		}
+	}
+}
+
+// splitGitURL returns scheme & host of a git url, scp-like urls are ssh and local paths file
+func splitGitURL(u string) (string, string) {
+	if strings.Contains(u, "://") {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return "", ""
+		}
+		return strings.ToLower(parsed.Scheme), strings.ToLower(parsed.Hostname())
+	}
+	colon := strings.Index(u, ":")
+	if colon > 0 && !strings.Contains(u[:colon], "/") {
+		host := u[:colon]
+		if ix := strings.LastIndex(host, "@"); ix >= 0 {
+			host = host[ix+1:]
+		}
+		return "ssh", strings.ToLower(host)
+	}
+	return "file", ""
+}
+
+// submoduleURLAllowed checks a submodule url is on the superproject's scheme & host
+// or on one of the hosts allowed for the app over the network
+func submoduleURLAllowed(baseURL string, u string, hosts []string) bool {
+	scheme, host := splitGitURL(u)
+	baseScheme, baseHost := splitGitURL(baseURL)
+	if scheme == "" || scheme == "file" {
+		return scheme == baseScheme
+	}
+	if scheme == baseScheme && host == baseHost {
+		return true
+	}
+	switch scheme {
+	case "http", "https", "ssh", "git":
+	default:
+		return false
+	}
+	for _, h := range hosts {
+		if strings.ToLower(h) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// openSubmoduleRepo opens(or initializes) a bare cache repository for url
+func (w *snapshotWalker) openSubmoduleRepo(url string) (*git.Repository, error) {
+	sum := md5.Sum([]byte(url))
+	p := path.Join(w.r.Path(), "modules", hex.EncodeToString(sum[:]))
+
+	if _, err := os.Stat(p); err == nil {
+		return git.OpenRepository(p)
+	}
+	w.r.log.Infof("initializing submodule cache url(%s) path(%s)", url, p)
+	return git.InitRepository(p, true)
+}
+
+// expandSubmodule fetches the submodule commit and walks its tree under key
+func (w *snapshotWalker) expandSubmodule(realPath string, key string, oid *git.Oid) error {
+	if w.depth >= maxSubmoduleDepth {
+		return fmt.Errorf("submodule(%s) nested too deep", realPath)
+	}
+
+	if err := w.loadModules(); err != nil {
+		return err
+	}
+	m, ok := w.modules[realPath]
+	if !ok || m.url == "" {
+		return fmt.Errorf("submodule(%s) not found in .gitmodules", realPath)
+	}
+	url := resolveSubmoduleURL(w.baseURL, m.url)
+	if !submoduleURLAllowed(w.baseURL, url, w.opts.submoduleHosts) {
+		return fmt.Errorf("submodule(%s) url(%s) not allowed, hosts differ from the repo's", realPath, url)
+	}
+
+	subRepo, err := w.openSubmoduleRepo(url)
+	if err != nil {
+		return err
+	}
+	defer subRepo.Free()
+
+	commit, err := subRepo.LookupCommit(oid)
+	if err != nil {
+		w.r.log.Infof("fetching submodule(%s) url(%s) commit(%s)", m.name, url, oid)
+		remote, err := subRepo.Remotes.CreateAnonymous(url)
+		if err != nil {
+			return err
+		}
+		defer remote.Free()
+
+		refspecs := []string{
+			"+refs/heads/*:refs/remotes/origin/*",
+			"+refs/tags/*:refs/tags/*",
+		}
+		if err := remote.Fetch(refspecs, DefaultFetchOptions(w.r.log), ""); err != nil {
+			w.r.log.Errorf("Failed to fetch submodule(%s) url(%s)", m.name, url)
+			return err
+		}
+
+		commit, err = subRepo.LookupCommit(oid)
+		if err != nil {
+			return fmt.Errorf("submodule(%s) commit(%s) not found in url(%s)", m.name, oid, url)
+		}
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	sub := newSnapshotWalker(w.r, subRepo, tree, url, w.kv, w.depth+1)
+	return sub.walk(key)
+}
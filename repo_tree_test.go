@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// commitSymlinks creates symlinks(name => target) in the workdir and commits them
+func commitSymlinks(t *testing.T, repo *git.Repository, links map[string]string) *git.Oid {
+	sig := &git.Signature{
+		Name:  "Rand Om Hacker",
+		Email: "random@hacker.com",
+		When:  time.Now(),
+	}
+
+	idx, err := repo.Index()
+	checkFatal(t, err)
+	for name, target := range links {
+		err = os.Symlink(target, pathInRepo(repo, name))
+		checkFatal(t, err)
+		err = idx.AddByPath(name)
+		checkFatal(t, err)
+	}
+	treeID, err := idx.WriteTree()
+	checkFatal(t, err)
+
+	head, err := repo.Head()
+	checkFatal(t, err)
+	tip, err := repo.LookupCommit(head.Target())
+	checkFatal(t, err)
+
+	tree, err := repo.LookupTree(treeID)
+	checkFatal(t, err)
+	commitID, err := repo.CreateCommit("HEAD", sig, sig, "add symlinks\n", tree, tip)
+	checkFatal(t, err)
+	return commitID
+}
+
+func TestParseGitModules(t *testing.T) {
+	data := []byte(`[submodule "common"]
+	path = lib/common
+	url = ../common.git
+# comment
+[submodule "ext"]
+	path = ext
+	url = https://example.com/ext.git
+`)
+	modules := parseGitModules(data)
+	if len(modules) != 2 {
+		t.Fatalf("expected 2 modules got(%d)", len(modules))
+	}
+	if modules[0].name != "common" || modules[0].path != "lib/common" || modules[0].url != "../common.git" {
+		t.Fatalf("unexpected module(%+v)", modules[0])
+	}
+	if modules[1].path != "ext" || modules[1].url != "https://example.com/ext.git" {
+		t.Fatalf("unexpected module(%+v)", modules[1])
+	}
+}
+
+func TestResolveSubmoduleURL(t *testing.T) {
+	cases := [][3]string{
+		{"http://localhost:9000/app.git", "../common.git", "http://localhost:9000/common.git"},
+		{"http://localhost:9000/group/app", "./sub", "http://localhost:9000/group/app/sub"},
+		{"http://localhost:9000/app", "https://example.com/ext.git", "https://example.com/ext.git"},
+	}
+	for _, c := range cases {
+		if url := resolveSubmoduleURL(c[0], c[1]); url != c[2] {
+			t.Fatalf("base(%s) url(%s) expected(%s) got(%s)", c[0], c[1], c[2], url)
+		}
+	}
+}
+
+func TestSubmoduleURLAllowed(t *testing.T) {
+	base := "https://git.example.com/group/app.git"
+	cases := []struct {
+		url     string
+		hosts   []string
+		allowed bool
+	}{
+		{"https://git.example.com/group/common.git", nil, true},
+		{"https://GIT.example.com:443/common.git", nil, true},
+		{"http://git.example.com/common.git", nil, false},
+		{"https://other.example.com/common.git", nil, false},
+		{"https://other.example.com/common.git", []string{"other.example.com"}, true},
+		{"git@other.example.com:common.git", []string{"other.example.com"}, true},
+		{"file:///etc/secrets", []string{"other.example.com"}, false},
+		{"/srv/git/common.git", nil, false},
+		{"ext::sh -c touch% /tmp/pwned", []string{"sh"}, false},
+	}
+	for _, c := range cases {
+		if allowed := submoduleURLAllowed(base, c.url, c.hosts); allowed != c.allowed {
+			t.Fatalf("url(%s) hosts(%v) expected allowed(%v)", c.url, c.hosts, c.allowed)
+		}
+	}
+	if !submoduleURLAllowed("file:///srv/git/app", "file:///srv/git/common", nil) {
+		t.Fatalf("local submodules of a local repo should be allowed")
+	}
+}
+
+func TestSnapshotSymlinks(t *testing.T) {
+	r := makeTestGit(t)
+	defer cleanupTestRepo(t, r)
+
+	commitSymlinks(t, r, map[string]string{
+		"readme.link": "README",
+		"escape.link": "../../etc/passwd",
+	})
+
+	config := &RepoConfig{
+		path:       makeTempDir(t),
+		remoteURL:  fmt.Sprintf("file://%s", r.Path()),
+		branchName: "master",
+	}
+	repo, err := CloneRepo(config)
+	checkFatal(t, err)
+	defer repo.Close()
+	checkFatal(t, repo.Fetch())
+
+	// raw: link target text is pushed as is
+	snapshot, err := repo.GetSnapshot("")
+	checkFatal(t, err)
+	if string((*snapshot)["readme.link"]) != "README" {
+		t.Fatalf("raw symlink value(%s)", (*snapshot)["readme.link"])
+	}
+
+	// resolve: escaping link must fail the snapshot
+	repo.SetSnapshotOptions(SnapshotOptions{symlinks: SymlinkResolve})
+	if _, err := repo.GetSnapshot(""); err == nil {
+		t.Fatalf("escaping symlink should be refused")
+	}
+
+	// skip: links are dropped
+	repo.SetSnapshotOptions(SnapshotOptions{symlinks: SymlinkSkip})
+	snapshot, err = repo.GetSnapshot("")
+	checkFatal(t, err)
+	if _, ok := (*snapshot)["readme.link"]; ok {
+		t.Fatalf("symlink should be skipped")
+	}
+}
+
+func TestSnapshotSymlinkToParent(t *testing.T) {
+	r := makeTestGit(t)
+	defer cleanupTestRepo(t, r)
+
+	commitSymlinks(t, r, map[string]string{
+		"readme.link": "README",
+		"root.link":   ".",
+	})
+
+	config := &RepoConfig{
+		path:       makeTempDir(t),
+		remoteURL:  fmt.Sprintf("file://%s", r.Path()),
+		branchName: "master",
+	}
+	repo, err := CloneRepo(config)
+	checkFatal(t, err)
+	defer repo.Close()
+	checkFatal(t, repo.Fetch())
+
+	// resolve: links to the root are skipped, others still resolved
+	repo.SetSnapshotOptions(SnapshotOptions{symlinks: SymlinkResolve})
+	snapshot, err := repo.GetSnapshot("")
+	checkFatal(t, err)
+	if len((*snapshot)["readme.link"]) == 0 {
+		t.Fatalf("symlink should be resolved")
+	}
+	for k := range *snapshot {
+		if strings.HasPrefix(k, "root.link") {
+			t.Fatalf("symlink to root should be skipped, got key(%s)", k)
+		}
+	}
+}
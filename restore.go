@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+const (
+	// DefaultRestoreKey fences restores, holding status of the last one
+	DefaultRestoreKey = "config/restore"
+
+	// ops per transaction, the fencing CAS & leader check included
+	restoreTxnOps = 64
+	restoreBatch  = restoreTxnOps - 2
+	// a restore still running after this is taken as dead
+	restoreStaleAge = 10 * time.Minute
+)
+
+// restore states
+const (
+	RestoreRunning = "running"
+	RestoreDone    = "done"
+	RestoreFailed  = "failed"
+	RestoreDryRun  = "dry-run"
+)
+
+// ErrNotLeader is returned when a restore is sent to a master not leading
+var ErrNotLeader = errors.New("not the leader")
+
+// RestoreStatus records progress of a restore under the restore key
+type RestoreStatus struct {
+	Actor    string    `json:"actor"`
+	Node     string    `json:"node"`
+	Apps     []string  `json:"apps,omitempty"`
+	Backup   time.Time `json:"backup"`
+	State    string    `json:"state"`
+	Set      int       `json:"set"`
+	Deleted  int       `json:"deleted"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+// RestoreResult is the plan of a restore & its status
+type RestoreResult struct {
+	Status *RestoreStatus `json:"status"`
+	Set    []string       `json:"set"`
+	Delete []string       `json:"delete"`
+}
+
+// restoreRequest is applied on the pusher goroutine, so no snapshot is pushed meanwhile,
+// pushes of other masters are fenced off by the leader lock checked in their transactions
+type restoreRequest struct {
+	manager *RestoreManager
+	backup  *client.Backup
+	apps    []string
+	actor   string
+	dryRun  bool
+	done    chan *restoreResponse
+}
+
+type restoreResponse struct {
+	result *RestoreResult
+	err    error
+}
+
+// RestoreManagerConfig is configuration for RestoreManager
+type RestoreManagerConfig struct {
+	store      kvstore.Store
+	restoreKey string
+	nodeName   string
+	isLeader   func() (bool, error)
+	// op failing a transaction unless this process holds the leader lock, checked in every batch
+	leaderCheck func() *kvstore.Op
+	// pusher changes, restores are queued along snapshots
+	changes chan *ConfChange
+}
+
+// RestoreManager restores backups of the config namespaces on the leader
+// writes are fenced by the leader lock & a CAS on the restore key within each batch, so a master
+// taking over or a concurrent restore makes the remaining batches fail
+type RestoreManager struct {
+	store       kvstore.Store
+	restoreKey  string
+	nodeName    string
+	isLeader    func() (bool, error)
+	leaderCheck func() *kvstore.Op
+	changes     chan *ConfChange
+	log         *logrus.Entry
+}
+
+// NewRestoreManager creates a new RestoreManager
+func NewRestoreManager(config *RestoreManagerConfig) *RestoreManager {
+	restoreKey := config.restoreKey
+	if restoreKey == "" {
+		restoreKey = DefaultRestoreKey
+	}
+	return &RestoreManager{
+		store:       config.store,
+		restoreKey:  restoreKey,
+		nodeName:    config.nodeName,
+		isLeader:    config.isLeader,
+		leaderCheck: config.leaderCheck,
+		changes:     config.changes,
+		log:         configureLogger("restore"),
+	}
+}
+
+// Restore restores a backup, of apps only when set, and waits for it to finish
+func (m *RestoreManager) Restore(backup *client.Backup, apps []string, actor string, dryRun bool) (*RestoreResult, error) {
+	if err := m.checkLeader(); err != nil {
+		return nil, err
+	}
+	req := &restoreRequest{
+		manager: m,
+		backup:  backup,
+		apps:    apps,
+		actor:   actor,
+		dryRun:  dryRun,
+		done:    make(chan *restoreResponse, 1),
+	}
+	m.changes <- &ConfChange{restore: req}
+	resp := <-req.done
+	return resp.result, resp.err
+}
+
+func (m *RestoreManager) checkLeader() error {
+	leader, err := m.isLeader()
+	if err != nil {
+		return err
+	}
+	if !leader {
+		return ErrNotLeader
+	}
+	return nil
+}
+
+// run applies a restore request, called by the pusher
+func (r *restoreRequest) run() {
+	result, err := r.manager.apply(r)
+	r.done <- &restoreResponse{result: result, err: err}
+}
+
+// current reads pairs of the backed up namespaces
+func (m *RestoreManager) current(ns *client.BackupNamespaces) (map[string][]byte, error) {
+	kvs := make(map[string][]byte)
+	for _, prefix := range ns.Prefixes() {
+		pairs, err := m.store.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, pair := range pairs {
+			kvs[pair.Key] = pair.Value
+		}
+	}
+	return kvs, nil
+}
+
+func (m *RestoreManager) apply(req *restoreRequest) (*RestoreResult, error) {
+	current, err := m.current(req.backup.Namespaces)
+	if err != nil {
+		return nil, err
+	}
+	plan := client.PlanRestore(req.backup, current, req.apps)
+
+	status := &RestoreStatus{
+		Actor:   req.actor,
+		Node:    m.nodeName,
+		Apps:    req.apps,
+		Backup:  req.backup.Created,
+		State:   RestoreDryRun,
+		Started: time.Now().UTC(),
+	}
+	result := &RestoreResult{Status: status, Delete: plan.Delete}
+	for _, pair := range plan.Set {
+		result.Set = append(result.Set, pair.Key)
+	}
+	if req.dryRun {
+		return result, nil
+	}
+
+	// fencing token is the modify index of the restore key
+	fence, err := m.store.Get(m.restoreKey)
+	if err != nil {
+		return nil, err
+	}
+	var index uint64
+	if fence != nil {
+		index = fence.ModifyIndex
+		prev := &RestoreStatus{}
+		if json.Unmarshal(fence.Value, prev) == nil && prev.State == RestoreRunning && time.Since(prev.Started) < restoreStaleAge {
+			return nil, fmt.Errorf("restore by %s on node(%s) running since %s", prev.Actor, prev.Node, prev.Started.Format(time.RFC3339))
+		}
+	}
+
+	var ops []*kvstore.Op
+	for _, pair := range plan.Set {
+		ops = append(ops, &kvstore.Op{Verb: kvstore.OpSet, Key: pair.Key, Value: pair.Value})
+	}
+	for _, key := range plan.Delete {
+		ops = append(ops, &kvstore.Op{Verb: kvstore.OpDelete, Key: key})
+	}
+	m.log.Infof("Restoring backup(%s) by %s apps(%v): %d set, %d deleted",
+		req.backup.Created.Format(time.RFC3339), req.actor, req.apps, len(plan.Set), len(plan.Delete))
+
+	status.State = RestoreRunning
+	for start := 0; ; start += restoreBatch {
+		end := start + restoreBatch
+		if end > len(ops) {
+			end = len(ops)
+		}
+		var next uint64
+		if next, err = m.fencedTxn(ops[start:end], status, index); err != nil {
+			break
+		}
+		index = next
+		for _, op := range ops[start:end] {
+			if op.Verb == kvstore.OpSet {
+				status.Set++
+			} else {
+				status.Deleted++
+			}
+		}
+		if end == len(ops) {
+			break
+		}
+	}
+
+	status.Finished = time.Now().UTC()
+	status.State = RestoreDone
+	if err != nil {
+		status.State = RestoreFailed
+		status.Error = err.Error()
+		m.log.Errorf("Restore failed after %d set, %d deleted: %v", status.Set, status.Deleted, err)
+	} else {
+		m.log.Infof("Restore done, %d set, %d deleted", status.Set, status.Deleted)
+	}
+	if _, ferr := m.fencedTxn(nil, status, index); ferr != nil {
+		m.log.Errorf("Failed to record restore status: %v", ferr)
+	}
+	return result, err
+}
+
+// fencedTxn applies ops along a CAS of the restore status & a check of the leader lock,
+// returning the new fencing token
+func (m *RestoreManager) fencedTxn(ops []*kvstore.Op, status *RestoreStatus, index uint64) (uint64, error) {
+	if err := m.checkLeader(); err != nil {
+		return 0, err
+	}
+	value, err := json.Marshal(status)
+	if err != nil {
+		return 0, err
+	}
+	txn := append(append([]*kvstore.Op{}, ops...), &kvstore.Op{Verb: kvstore.OpCAS, Key: m.restoreKey, Value: value, Index: index})
+	if m.leaderCheck != nil {
+		txn = append(txn, m.leaderCheck())
+	}
+	if err := m.store.Txn(txn); err != nil {
+		if err == kvstore.ErrTxnFailed {
+			return 0, fmt.Errorf("fenced off, restore key(%s) changed or leader lock lost", m.restoreKey)
+		}
+		return 0, err
+	}
+	fence, err := m.store.Get(m.restoreKey)
+	if err != nil {
+		return 0, err
+	}
+	if fence == nil {
+		return 0, fmt.Errorf("restore key(%s) vanished", m.restoreKey)
+	}
+	return fence.ModifyIndex, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+func TestRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := kvstore.NewFileStore(&kvstore.FileConfig{Root: dir, Node: "master1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup := &client.Backup{Namespaces: client.DefaultBackupNamespaces}
+	for i := 0; i < 100; i++ {
+		backup.Pairs = append(backup.Pairs, &client.BackupPair{Key: fmt.Sprintf("config/app/web/k%03d", i), Value: []byte("v")})
+	}
+	backup.Pairs = append(backup.Pairs, &client.BackupPair{Key: "config/global/api/rev", Value: []byte("v1")})
+	store.Put("config/global/web/branch", []byte("stale"))
+	store.Put("config/global/api/rev", []byte("v2"))
+
+	const leaderKey = "service/confmaster/leader"
+	lock, _ := store.NewLock(leaderKey, []byte("master1"))
+	if ok, err := lock.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expected leader lock, %v %v", ok, err)
+	}
+	leader := true
+	m := NewRestoreManager(&RestoreManagerConfig{
+		store:    store,
+		nodeName: "master1",
+		isLeader: func() (bool, error) { return leader, nil },
+		leaderCheck: func() *kvstore.Op {
+			return &kvstore.Op{Verb: kvstore.OpCheckSession, Key: leaderKey, Session: lock.Session()}
+		},
+	})
+
+	result, err := m.apply(&restoreRequest{backup: backup, apps: []string{"web"}, actor: "ops", dryRun: true})
+	if err != nil || len(result.Set) != 100 || len(result.Delete) != 1 {
+		t.Fatalf("unexpected dry run %v %v", result, err)
+	}
+	if pair, _ := store.Get("config/app/web/k000"); pair != nil {
+		t.Fatal("dry run should not write")
+	}
+
+	result, err = m.apply(&restoreRequest{backup: backup, apps: []string{"web"}, actor: "ops"})
+	if err != nil || result.Status.State != RestoreDone || result.Status.Set != 100 || result.Status.Deleted != 1 {
+		t.Fatalf("unexpected restore %+v %v", result.Status, err)
+	}
+	if pair, _ := store.Get("config/app/web/k099"); pair == nil {
+		t.Fatal("expected restored key")
+	}
+	if pair, _ := store.Get("config/global/api/rev"); pair == nil || string(pair.Value) != "v2" {
+		t.Fatal("app not selected should be left alone")
+	}
+	pair, _ := store.Get(DefaultRestoreKey)
+	status := &RestoreStatus{}
+	if pair == nil || json.Unmarshal(pair.Value, status) != nil || status.State != RestoreDone || status.Actor != "ops" {
+		t.Fatalf("unexpected restore status %v", pair)
+	}
+
+	// a restore running elsewhere fences this one off
+	status.State = RestoreRunning
+	status.Node = "master2"
+	data, _ := json.Marshal(status)
+	store.Put(DefaultRestoreKey, data)
+	if _, err := m.apply(&restoreRequest{backup: backup, actor: "ops"}); err == nil {
+		t.Fatal("expected restore to be refused while another runs")
+	}
+
+	// leadership lost while still believing to lead fails the batches
+	store.Delete(DefaultRestoreKey)
+	lock.Release()
+	if _, err := m.apply(&restoreRequest{backup: backup, actor: "ops"}); err == nil {
+		t.Fatal("expected restore to be fenced off without the leader lock")
+	}
+
+	store.Delete(DefaultRestoreKey)
+	leader = false
+	if _, err := m.Restore(backup, nil, "ops", false); err != ErrNotLeader {
+		t.Fatalf("expected not leader, got %v", err)
+	}
+}
+
+func TestRestoreFencesFollowerPush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := kvstore.NewFileStore(&kvstore.FileConfig{Root: dir, Node: "master1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const leaderKey = "service/confmaster/leader"
+	leaderLock, _ := store.NewLock(leaderKey, []byte("master1"))
+	if ok, err := leaderLock.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expected leader lock, %v %v", ok, err)
+	}
+	defer leaderLock.Release()
+	followerLock, _ := store.NewLock(leaderKey, []byte("master2"))
+	check := func(lock kvstore.Lock) func() *kvstore.Op {
+		return func() *kvstore.Op {
+			return &kvstore.Op{Verb: kvstore.OpCheckSession, Key: leaderKey, Session: lock.Session()}
+		}
+	}
+
+	changes := make(chan *ConfChange)
+	leader := NewConfPusher(&ConfPusherConfig{store: store, keyPrefix: DefaultAppConfigKeyPrefix, leaderCheck: check(leaderLock)})
+	leader.changes = changes
+	leader.Run()
+	defer leader.Shutdown()
+	m := NewRestoreManager(&RestoreManagerConfig{
+		store:       store,
+		nodeName:    "master1",
+		isLeader:    func() (bool, error) { return true, nil },
+		leaderCheck: check(leaderLock),
+		changes:     changes,
+	})
+	// a follower still believing to lead
+	follower := NewConfPusher(&ConfPusherConfig{
+		store:       store,
+		keyPrefix:   DefaultAppConfigKeyPrefix,
+		isLeader:    func() (bool, error) { return true, nil },
+		leaderCheck: check(followerLock),
+	})
+
+	backup := &client.Backup{Namespaces: client.DefaultBackupNamespaces, Pairs: []*client.BackupPair{
+		{Key: "config/app/web/a.conf", Value: []byte("restored")},
+	}}
+	pushed := make(chan error, 1)
+	go func() {
+		pushed <- follower.KVUpdate(&ConfChange{appID: "web", kvs: &map[string][]byte{"a.conf": []byte("stale")}})
+	}()
+	if _, err := m.Restore(backup, nil, "ops", false); err != nil {
+		t.Fatalf("unexpected restore error %v", err)
+	}
+	if err := <-pushed; err == nil {
+		t.Fatal("expected push of a follower fenced off")
+	}
+	if pair, _ := store.Get("config/app/web/a.conf"); pair == nil || string(pair.Value) != "restored" {
+		t.Fatalf("expected restored value kept, got %v", pair)
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+const (
+	// RolloutAll pushes a commit to every node at once (default)
+	RolloutAll = "all"
+	// RolloutCanary sends a commit to canary nodes before every node
+	RolloutCanary = "canary"
+	// RolloutWaves sends a commit to growing batches of nodes
+	RolloutWaves = "waves"
+
+	// RolloutPause leaves staged nodes on the failed commit for an operator to decide
+	RolloutPause = "pause"
+	// RolloutRollback returns staged nodes to the deployed snapshot
+	RolloutRollback = "rollback"
+
+	// DefaultRolloutTimeout is how long acks are awaited per stage in second
+	DefaultRolloutTimeout = 300
+
+	// SlaveServiceName is the service slave agents register as
+	SlaveServiceName = "confslave"
+
+	// AckApplied means a slave applied a commit and found it healthy
+	AckApplied = "applied"
+	// AckFailed means a slave failed to apply a commit or its health check failed
+	AckFailed = "failed"
+
+	// rolloutTarget is the override target of candidate snapshots
+	rolloutTarget = "_rollout"
+	// ackPollPeriod is how often acks are checked
+	ackPollPeriod = time.Second
+)
+
+var (
+	// errRolloutCancelled is returned when a newer commit or policy supersedes a rollout
+	errRolloutCancelled = errors.New("rollout cancelled")
+	// errLeadershipLost is returned when a stage write is fenced off by the leader lock
+	errLeadershipLost = errors.New("leader lock lost")
+)
+
+// Ack is written by slave agents to <ack prefix>/<appID>/<node> after applying a snapshot
+type Ack struct {
+	Commit  string    `json:"commit"`
+	State   string    `json:"state"`
+	Message string    `json:"message,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+func (a *Ack) encode() []byte {
+	data, err := json.Marshal(a)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// ackKey returns the key a node acks an app on
+func ackKey(prefix, appID, node string) string {
+	return prefix + "/" + appID + "/" + node
+}
+
+// RolloutPlan is the staged rollout configured for an app
+// stages redirect growing sets of nodes to the candidate snapshot, every node gets it once all stages acked
+type RolloutPlan struct {
+	stages    []string // comma separated nodes or percentage of nodes, cumulative
+	wait      time.Duration
+	timeout   time.Duration
+	onFailure string
+	// handed to the health monitor once every node has the commit
+	rollbackThreshold string
+}
+
+// isStagedRollout checks whether an app is rolled out in stages
+func isStagedRollout(rollout string) bool {
+	return rollout == RolloutCanary || rollout == RolloutWaves
+}
+
+// newRolloutPlan builds the rollout plan of an app
+func newRolloutPlan(conf *AppConf) (*RolloutPlan, error) {
+	plan := &RolloutPlan{
+		timeout:   DefaultRolloutTimeout * time.Second,
+		onFailure: RolloutPause,
+
+		rollbackThreshold: conf.RollbackThreshold,
+	}
+
+	switch conf.Rollout {
+	case RolloutCanary:
+		if conf.RolloutNodes == "" {
+			return nil, fmt.Errorf("canary rollout without rollout_nodes")
+		}
+		plan.stages = []string{conf.RolloutNodes}
+	case RolloutWaves:
+		plan.stages = splitList(conf.RolloutWaves)
+		if len(plan.stages) == 0 {
+			return nil, fmt.Errorf("waves rollout without rollout_waves")
+		}
+	default:
+		return nil, fmt.Errorf("unknown rollout(%s)", conf.Rollout)
+	}
+	for _, stage := range plan.stages {
+		if strings.HasSuffix(stage, "%") {
+			if _, err := strconv.ParseFloat(strings.TrimSuffix(stage, "%"), 64); err != nil {
+				return nil, fmt.Errorf("invalid rollout stage(%s)", stage)
+			}
+		}
+	}
+
+	if conf.RolloutWait != "" {
+		wait, err := strconv.Atoi(conf.RolloutWait)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rollout_wait(%s)", conf.RolloutWait)
+		}
+		plan.wait = time.Duration(wait) * time.Second
+	}
+	if conf.RolloutTimeout != "" {
+		timeout, err := strconv.Atoi(conf.RolloutTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rollout_timeout(%s)", conf.RolloutTimeout)
+		}
+		plan.timeout = time.Duration(timeout) * time.Second
+	}
+	switch conf.RolloutOnFailure {
+	case "", RolloutPause:
+	case RolloutRollback:
+		plan.onFailure = RolloutRollback
+	default:
+		return nil, fmt.Errorf("invalid rollout_on_failure(%s)", conf.RolloutOnFailure)
+	}
+	return plan, nil
+}
+
+// selectNodes resolves a stage to nodes, nodes must be sorted so percentages are cumulative
+func selectNodes(stage string, nodes []string) []string {
+	if strings.HasSuffix(stage, "%") {
+		p, _ := strconv.ParseFloat(strings.TrimSuffix(stage, "%"), 64)
+		n := int(math.Ceil(float64(len(nodes)) * p / 100))
+		if n > len(nodes) {
+			n = len(nodes)
+		}
+		return nodes[:n]
+	}
+
+	known := make(map[string]bool)
+	for _, node := range nodes {
+		known[node] = true
+	}
+	var selected []string
+	for _, node := range splitList(stage) {
+		if known[node] {
+			selected = append(selected, node)
+		}
+	}
+	return selected
+}
+
+// copySnapshot copies a snapshot since the pusher adds metadata in place
+func copySnapshot(kvs map[string][]byte) *map[string][]byte {
+	c := make(map[string][]byte)
+	for k, v := range kvs {
+		c[k] = v
+	}
+	return &c
+}
+
+// RolloutManagerConfig is configuration for RolloutManager
+type RolloutManagerConfig struct {
+	store             kvstore.Store
+	appKeyPrefix      string
+	ackKeyPrefix      string
+	overrideKeyPrefix string
+	changes           chan *ConfChange
+	states            *appStates
+	nodeName          string
+	// commits rolled out to every node are handed to the health monitor when set
+	monitor *HealthMonitor
+	// only the leader rolls out, stage writes fail once it no longer holds the leader lock
+	isLeader    func() (bool, error)
+	leaderCheck func() *kvstore.Op
+}
+
+// rollout is a staged rollout in progress
+type rollout struct {
+	cancelCh chan struct{}
+	doneCh   chan struct{}
+}
+
+// RolloutManager moves commits through staged rollouts, one per app
+// staged nodes are redirected to a candidate snapshot(<appID>@_rollout) with overrides,
+// by the leader only, other masters track the rollout state
+type RolloutManager struct {
+	config  *RolloutManagerConfig
+	store   kvstore.Store
+	changes chan *ConfChange
+	states  *appStates
+	log     *logrus.Entry
+
+	appKeyPrefix      string
+	ackKeyPrefix      string
+	overrideKeyPrefix string
+	nodeName          string
+
+	lock   sync.Mutex
+	active map[string]*rollout
+}
+
+// NewRolloutManager creates a new RolloutManager
+func NewRolloutManager(config *RolloutManagerConfig) *RolloutManager {
+	appKeyPrefix := config.appKeyPrefix
+	if appKeyPrefix == "" {
+		appKeyPrefix = DefaultAppConfigKeyPrefix
+	}
+
+	ackKeyPrefix := config.ackKeyPrefix
+	if ackKeyPrefix == "" {
+		ackKeyPrefix = DefaultAckKeyPrefix
+	}
+
+	overrideKeyPrefix := config.overrideKeyPrefix
+	if overrideKeyPrefix == "" {
+		overrideKeyPrefix = client.DefaultOverrideKeyPrefix
+	}
+
+	return &RolloutManager{
+		config:  config,
+		store:   config.store,
+		changes: config.changes,
+		states:  config.states,
+		log:     configureLogger("rollout"),
+
+		appKeyPrefix:      appKeyPrefix,
+		ackKeyPrefix:      ackKeyPrefix,
+		overrideKeyPrefix: overrideKeyPrefix,
+		nodeName:          config.nodeName,
+
+		active: make(map[string]*rollout),
+	}
+}
+
+// Start starts rolling out a commit, cancelling a rollout in progress for the app
+func (m *RolloutManager) Start(appID, commit string, kvs map[string][]byte, plan *RolloutPlan) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if r, ok := m.active[appID]; ok {
+		m.log.Infof("Cancelling rollout of app(%s)", appID)
+		close(r.cancelCh)
+		<-r.doneCh
+		delete(m.active, appID)
+	}
+
+	if !m.leading() {
+		m.log.Infof("Rollout of app(%s) commit(%s) left to the leader", appID, commit)
+		status := newDeployStatus(appID, commit, DeployRollingOut, "rolled out by the leader", m.nodeName)
+		status.Trigger = TriggerRollout
+		m.states.update(appID, func(st *AppState) {
+			st.Status = status
+		})
+		return
+	}
+
+	r := &rollout{
+		cancelCh: make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	m.active[appID] = r
+
+	go func() {
+		defer close(r.doneCh)
+		m.run(r, appID, commit, kvs, plan)
+	}()
+}
+
+// Cancel stops a rollout in progress or paused, returning staged nodes to the deployed snapshot
+func (m *RolloutManager) Cancel(appID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if r, ok := m.active[appID]; ok {
+		m.log.Infof("Cancelling rollout of app(%s)", appID)
+		close(r.cancelCh)
+		<-r.doneCh
+		delete(m.active, appID)
+		m.cleanup(appID)
+	}
+}
+
+// leading checks whether this master drives rollouts
+func (m *RolloutManager) leading() bool {
+	if m.config.isLeader == nil {
+		return true
+	}
+	leader, err := m.config.isLeader()
+	if err != nil {
+		m.log.Errorf("Failed to check leadership: %v", err)
+	}
+	return leader
+}
+
+// txn applies stage writes along a check of the leader lock
+func (m *RolloutManager) txn(ops []*kvstore.Op) error {
+	if m.config.leaderCheck != nil {
+		ops = append(ops, m.config.leaderCheck())
+	}
+	err := m.store.Txn(ops)
+	if err == kvstore.ErrTxnFailed {
+		return errLeadershipLost
+	}
+	return err
+}
+
+// candidateID returns the app id candidate snapshots are pushed to
+func candidateID(appID string) string {
+	return client.DerivedAppID(appID, rolloutTarget)
+}
+
+// setStatus records rollout progress
+func (m *RolloutManager) setStatus(appID, commit, state, reason string) {
+	status := newDeployStatus(appID, commit, state, reason, m.nodeName)
+	status.Trigger = TriggerRollout
+	m.states.update(appID, func(st *AppState) {
+		st.Status = status
+	})
+	m.changes <- &ConfChange{
+		appID:  appID,
+		status: status,
+	}
+}
+
+// run walks a rollout through its stages
+func (m *RolloutManager) run(r *rollout, appID, commit string, kvs map[string][]byte, plan *RolloutPlan) {
+	candidate := candidateID(appID)
+
+	// staged nodes of a previous rollout go back to the deployed snapshot first
+	if err := m.clearOverrides(appID); err != nil {
+		m.log.Errorf("Failed to clear rollout overrides of app(%s): %v", appID, err)
+	}
+	m.changes <- &ConfChange{appID: candidate, kvs: copySnapshot(kvs)}
+
+	nodes, err := listSlaveNodes(m.store)
+	if err != nil {
+		m.fail(appID, commit, plan, fmt.Sprintf("listing nodes: %v", err))
+		return
+	}
+
+	staged := make(map[string]bool)
+	for i, stage := range plan.stages {
+		if i > 0 && plan.wait > 0 {
+			select {
+			case <-r.cancelCh:
+				return
+			case <-time.After(plan.wait):
+			}
+		}
+
+		var stageNodes []string
+		for _, node := range selectNodes(stage, nodes) {
+			if staged[node] {
+				stageNodes = append(stageNodes, node)
+				continue
+			}
+			pinned, err := m.redirect(appID, node)
+			if err == errLeadershipLost {
+				m.log.Errorf("Rollout of app(%s) commit(%s) stopped: %v", appID, commit, err)
+				return
+			}
+			if err != nil {
+				m.fail(appID, commit, plan, fmt.Sprintf("redirecting node(%s): %v", node, err))
+				return
+			}
+			if !pinned {
+				stageNodes = append(stageNodes, node)
+				staged[node] = true
+			}
+		}
+
+		reason := fmt.Sprintf("stage %d/%d nodes(%s)", i+1, len(plan.stages), strings.Join(stageNodes, ","))
+		m.setStatus(appID, commit, DeployRollingOut, reason)
+
+		var staging []string
+		for node := range staged {
+			staging = append(staging, node)
+		}
+		if err := m.awaitAcks(r, appID, commit, staging, plan.timeout); err != nil {
+			if err == errRolloutCancelled {
+				return
+			}
+			m.fail(appID, commit, plan, fmt.Sprintf("stage %d/%d: %v", i+1, len(plan.stages), err))
+			return
+		}
+	}
+
+	// every stage acked, push to every node
+	status := newDeployStatus(appID, commit, DeployDeployed, "", m.nodeName)
+	status.Trigger = TriggerRollout
+	m.states.update(appID, func(st *AppState) {
+		st.Status = status
+	})
+	m.changes <- &ConfChange{appID: appID, kvs: copySnapshot(kvs), status: status}
+	if m.config.monitor != nil {
+		m.config.monitor.track(appID, commit, plan.rollbackThreshold)
+	}
+
+	// staged nodes leave the candidate once the deployed snapshot has the commit
+	if err := m.awaitDeployed(r, appID, commit); err != nil {
+		return
+	}
+	m.cleanup(appID)
+	m.log.Infof("Rolled out app(%s) commit(%s)", appID, commit)
+}
+
+// fail pauses or rolls back a rollout
+func (m *RolloutManager) fail(appID, commit string, plan *RolloutPlan, reason string) {
+	m.log.Errorf("Rollout of app(%s) commit(%s) failed: %s", appID, commit, reason)
+	if plan.onFailure == RolloutRollback {
+		m.cleanup(appID)
+		m.setStatus(appID, commit, DeployRolledBack, reason)
+		return
+	}
+	m.setStatus(appID, commit, DeployPaused, reason)
+}
+
+// cleanup returns staged nodes to the deployed snapshot and removes the candidate
+func (m *RolloutManager) cleanup(appID string) {
+	if err := m.clearOverrides(appID); err != nil {
+		m.log.Errorf("Failed to clear rollout overrides of app(%s): %v", appID, err)
+	}
+	if err := m.txn([]*kvstore.Op{{Verb: kvstore.OpDeleteTree, Key: m.appKeyPrefix + "/" + candidateID(appID) + "/"}}); err != nil {
+		m.log.Errorf("Failed to remove candidate of app(%s): %v", appID, err)
+	}
+}
+
+// listSlaveNodes lists nodes running slave agents, sorted by name
+func listSlaveNodes(store kvstore.Store) ([]string, error) {
+	nodes, err := store.Nodes(SlaveServiceName)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+// redirect points a node to the candidate snapshot, clearing its ack so a stale one
+// of an earlier attempt at the same commit is not taken for the stage's
+// returns true when the node is pinned by an operator override, which is left untouched
+func (m *RolloutManager) redirect(appID, node string) (bool, error) {
+	key := client.OverrideKey(m.overrideKeyPrefix, node, appID)
+	pair, err := m.store.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if pair != nil {
+		if o, err := client.ParseOverride(pair.Value); err != nil || o.App != candidateID(appID) {
+			return true, nil
+		}
+	}
+
+	data, _ := json.Marshal(&client.Override{App: candidateID(appID)})
+	return false, m.txn([]*kvstore.Op{
+		{Verb: kvstore.OpDelete, Key: ackKey(m.ackKeyPrefix, appID, node)},
+		{Verb: kvstore.OpSet, Key: key, Value: data},
+	})
+}
+
+// clearOverrides removes overrides pointing to the candidate snapshot
+func (m *RolloutManager) clearOverrides(appID string) error {
+	pairs, err := m.store.List(m.overrideKeyPrefix + "/")
+	if err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		if !strings.HasSuffix(pair.Key, "/"+appID) {
+			continue
+		}
+		if o, err := client.ParseOverride(pair.Value); err != nil || o.App != candidateID(appID) {
+			continue
+		}
+		if err := m.txn([]*kvstore.Op{{Verb: kvstore.OpDelete, Key: pair.Key}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// awaitAcks waits until every node acks the commit
+func (m *RolloutManager) awaitAcks(r *rollout, appID, commit string, nodes []string, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(ackPollPeriod)
+	defer ticker.Stop()
+
+	for {
+		pending, err := m.pendingAcks(appID, commit, nodes)
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		select {
+		case <-r.cancelCh:
+			return errRolloutCancelled
+		case <-deadline:
+			return fmt.Errorf("no ack from nodes(%s)", strings.Join(pending, ","))
+		case <-ticker.C:
+		}
+	}
+}
+
+// pendingAcks returns nodes yet to ack the commit, failed acks are errors
+func (m *RolloutManager) pendingAcks(appID, commit string, nodes []string) ([]string, error) {
+	pairs, err := m.store.List(m.ackKeyPrefix + "/" + appID + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	acks := make(map[string]*Ack)
+	for _, pair := range pairs {
+		ack := &Ack{}
+		if err := json.Unmarshal(pair.Value, ack); err != nil {
+			continue
+		}
+		acks[strings.TrimPrefix(pair.Key, m.ackKeyPrefix+"/"+appID+"/")] = ack
+	}
+
+	var pending []string
+	for _, node := range nodes {
+		ack, ok := acks[node]
+		switch {
+		case !ok || ack.Commit != commit:
+			pending = append(pending, node)
+		case ack.State == AckFailed:
+			return nil, fmt.Errorf("node(%s) failed: %s", node, ack.Message)
+		}
+	}
+	sort.Strings(pending)
+	return pending, nil
+}
+
+// awaitDeployed waits until the pusher wrote the commit to the app
+func (m *RolloutManager) awaitDeployed(r *rollout, appID, commit string) error {
+	ticker := time.NewTicker(ackPollPeriod)
+	defer ticker.Stop()
+
+	for {
+		pair, err := m.store.Get(m.appKeyPrefix + "/" + appID + "/" + client.MetaCommitKey)
+		if err == nil && pair != nil && string(pair.Value) == commit {
+			return nil
+		}
+
+		select {
+		case <-r.cancelCh:
+			return errRolloutCancelled
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
+)
+
+func TestRolloutPlan(t *testing.T) {
+	plan, err := newRolloutPlan(&AppConf{
+		Rollout:          RolloutWaves,
+		RolloutWaves:     "10%, 50%",
+		RolloutWait:      "30",
+		RolloutOnFailure: RolloutRollback,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(plan.stages, []string{"10%", "50%"}) || plan.wait != 30*time.Second ||
+		plan.timeout != DefaultRolloutTimeout*time.Second || plan.onFailure != RolloutRollback {
+		t.Fatalf("unexpected plan(%+v)", plan)
+	}
+
+	for _, conf := range []*AppConf{
+		{Rollout: RolloutCanary},
+		{Rollout: RolloutWaves, RolloutWaves: "ten%"},
+		{Rollout: RolloutCanary, RolloutNodes: "edge1", RolloutOnFailure: "retry"},
+	} {
+		if _, err := newRolloutPlan(conf); err == nil {
+			t.Fatalf("expected error for(%+v)", conf)
+		}
+	}
+}
+
+func TestSelectNodes(t *testing.T) {
+	nodes := []string{"edge1", "edge2", "edge3", "edge4", "edge5"}
+
+	cases := []struct {
+		stage    string
+		expected []string
+	}{
+		{"10%", []string{"edge1"}},
+		{"50%", []string{"edge1", "edge2", "edge3"}},
+		{"100%", nodes},
+		{"edge4, edge9", []string{"edge4"}},
+	}
+	for _, c := range cases {
+		if got := selectNodes(c.stage, nodes); !reflect.DeepEqual(got, c.expected) {
+			t.Fatalf("stage(%s) expected(%v) got(%v)", c.stage, c.expected, got)
+		}
+	}
+}
+
+func TestRolloutLeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rollout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := kvstore.NewFileStore(&kvstore.FileConfig{Root: dir, Node: "master1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Register(SlaveServiceName, "edge1")
+
+	const leaderKey = "service/confmaster/leader"
+	lock, _ := store.NewLock(leaderKey, []byte("master1"))
+	leader := false
+	changes := make(chan *ConfChange, 10)
+	m := NewRolloutManager(&RolloutManagerConfig{
+		store:    store,
+		changes:  changes,
+		states:   newAppStates(),
+		nodeName: "master1",
+		isLeader: func() (bool, error) { return leader, nil },
+		leaderCheck: func() *kvstore.Op {
+			return &kvstore.Op{Verb: kvstore.OpCheckSession, Key: leaderKey, Session: lock.Session()}
+		},
+	})
+	plan := &RolloutPlan{stages: []string{"edge1"}, timeout: time.Minute, onFailure: RolloutPause}
+
+	// followers track the rollout, the leader runs it
+	m.Start("web", "abc", map[string][]byte{"a.conf": []byte("a")}, plan)
+	if len(m.active) != 0 || len(changes) != 0 {
+		t.Fatalf("follower should not roll out, active %v changes %d", m.active, len(changes))
+	}
+	if st, ok := m.states.get("web"); !ok || st.Status.State != DeployRollingOut {
+		t.Fatal("follower should track rollout state")
+	}
+
+	// stage writes are fenced by the leader lock
+	if _, err := m.redirect("web", "edge1"); err != errLeadershipLost {
+		t.Fatalf("expected redirect without the leader lock fenced off, got %v", err)
+	}
+	if ok, err := lock.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expected leader lock, %v %v", ok, err)
+	}
+	defer lock.Release()
+	if pinned, err := m.redirect("web", "edge1"); err != nil || pinned {
+		t.Fatalf("expected redirect by the leader, %v %v", pinned, err)
+	}
+	if pair, _ := store.Get(client.OverrideKey(client.DefaultOverrideKeyPrefix, "edge1", "web")); pair == nil {
+		t.Fatal("expected override written by the leader")
+	}
+}
+
+func TestRolloutStaleAck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rollout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := kvstore.NewFileStore(&kvstore.FileConfig{Root: dir, Node: "master1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewRolloutManager(&RolloutManagerConfig{
+		store:    store,
+		changes:  make(chan *ConfChange, 10),
+		states:   newAppStates(),
+		nodeName: "master1",
+	})
+
+	// a failed ack of an earlier attempt at the same commit
+	stale := &Ack{Commit: "abc", State: AckFailed, Message: "disk full", Time: time.Now().UTC()}
+	checkFatal(t, store.Put(ackKey(DefaultAckKeyPrefix, "web", "edge1"), stale.encode()))
+	if _, err := m.pendingAcks("web", "abc", []string{"edge1"}); err == nil {
+		t.Fatal("expected failed ack reported")
+	}
+
+	// a new stage starts from a clean ack
+	if pinned, err := m.redirect("web", "edge1"); err != nil || pinned {
+		t.Fatalf("expected redirect, %v %v", pinned, err)
+	}
+	pending, err := m.pendingAcks("web", "abc", []string{"edge1"})
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("expected node pending, got %v %v", pending, err)
+	}
+}
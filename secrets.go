@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"strings"
+
+	"bitbucket.org/cdnetworks/eos-conf/client"
+)
+
+const (
+	// SecretsBlock refuses snapshots containing secrets (default)
+	SecretsBlock = "block"
+	// SecretsWarn only logs secrets found
+	SecretsWarn = "warn"
+	// SecretsOff disables secret scanning
+	SecretsOff = "off"
+
+	// secretsAllowAnnotation on a line excludes the line from scanning
+	secretsAllowAnnotation = "secrets:allow"
+
+	// entropy thresholds in bits per char (see truffleHog)
+	base64EntropyThreshold = 4.5
+	hexEntropyThreshold    = 3.0
+	minEntropyTokenLen     = 20
+)
+
+// secretRule detects a kind of credential
+type secretRule struct {
+	name string
+	re   *regexp.Regexp
+}
+
+var secretRules = []secretRule{
+	{"private-key", regexp.MustCompile(`-----BEGIN (?:[A-Z0-9]+ )*PRIVATE KEY(?: BLOCK)?-----`)},
+	{"aws-access-key-id", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"aws-secret-access-key", regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?[A-Za-z0-9/+=]{40}`)},
+	{"google-api-key", regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}\b`)},
+	{"github-token", regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{82})\b`)},
+	{"slack-token", regexp.MustCompile(`\bxox[baprs]-[A-Za-z0-9-]{10,}`)},
+	{"stripe-key", regexp.MustCompile(`\b[sr]k_live_[0-9a-zA-Z]{24,}\b`)},
+	{"azure-storage-key", regexp.MustCompile(`AccountKey=[A-Za-z0-9+/=]{88}`)},
+}
+
+var (
+	base64Token = regexp.MustCompile(`[A-Za-z0-9+/=_\-]{20,}`)
+	hexToken    = regexp.MustCompile(`\b[0-9a-fA-F]{20,}\b`)
+	// hex strings are common(checksums, ids) so only flagged next to these words
+	secretWords = regexp.MustCompile(`(?i)(password|passwd|secret|token|api_?key|credential|private)`)
+)
+
+// SecretFinding is a secret detected in a snapshot
+// the secret itself is never serialized
+type SecretFinding struct {
+	Key  string `json:"key"`
+	Line int    `json:"line"`
+	Rule string `json:"rule"`
+
+	match string
+}
+
+func (f *SecretFinding) String() string {
+	return fmt.Sprintf("%s:%d(%s)", f.Key, f.Line, f.Rule)
+}
+
+// shannonEntropy returns entropy of s in bits per char
+func shannonEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	freq := make(map[rune]float64)
+	for _, c := range s {
+		freq[c]++
+	}
+	var entropy float64
+	n := float64(len(s))
+	for _, count := range freq {
+		p := count / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// secretsAllowed checks whether key matches one of allow globs
+func secretsAllowed(key string, allow []string) bool {
+	for _, pattern := range allow {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// scanLine returns findings in a line of a value
+func scanLine(key string, lineNo int, line string) []*SecretFinding {
+	var findings []*SecretFinding
+	found := make(map[string]bool)
+
+	for _, rule := range secretRules {
+		for _, m := range rule.re.FindAllString(line, -1) {
+			findings = append(findings, &SecretFinding{Key: key, Line: lineNo, Rule: rule.name, match: m})
+			found[m] = true
+		}
+	}
+
+	for _, m := range base64Token.FindAllString(line, -1) {
+		if !found[m] && shannonEntropy(m) > base64EntropyThreshold {
+			findings = append(findings, &SecretFinding{Key: key, Line: lineNo, Rule: "high-entropy", match: m})
+			found[m] = true
+		}
+	}
+
+	if secretWords.MatchString(line) {
+		for _, m := range hexToken.FindAllString(line, -1) {
+			if !found[m] && shannonEntropy(m) > hexEntropyThreshold {
+				findings = append(findings, &SecretFinding{Key: key, Line: lineNo, Rule: "high-entropy-hex", match: m})
+			}
+		}
+	}
+	return findings
+}
+
+// scanSecrets scans snapshot values except metadata & allowed keys
+func scanSecrets(kvs map[string][]byte, allow []string) []*SecretFinding {
+	var findings []*SecretFinding
+	for _, k := range sortedKeys(kvs) {
+		v := kvs[k]
+		if isMetaKey(k) || client.IsEncryptedKey(k) || secretsAllowed(k, allow) {
+			continue
+		}
+		// binary files
+		if bytes.IndexByte(v, 0) >= 0 {
+			continue
+		}
+
+		for i, line := range strings.Split(string(v), "\n") {
+			if strings.Contains(line, secretsAllowAnnotation) {
+				continue
+			}
+			// ciphertext is high entropy by design
+			line = client.StripEncryptedValues(line)
+			findings = append(findings, scanLine(k, i+1, line)...)
+		}
+	}
+	return findings
+}
+
+// secretsSummary describes findings without revealing secrets
+func secretsSummary(findings []*SecretFinding) string {
+	var s []string
+	for _, f := range findings {
+		s = append(s, f.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+// redactSecrets masks secrets found in a value
+func redactSecrets(key string, v []byte, findings []*SecretFinding) string {
+	s := string(v)
+	for _, f := range findings {
+		if f.Key == key {
+			s = strings.Replace(s, f.match, "****", -1)
+		}
+	}
+	return s
+}
+
+// parseSecretsAllow splits comma separated allow globs
+func parseSecretsAllow(s string) []string {
+	return splitList(s)
+}
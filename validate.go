@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// ValidationFile is a repo file configuring schemas & size limits
+	ValidationFile = ".validation.json"
+
+	// ValidateOff disables validation for an app
+	ValidateOff = "off"
+
+	// DefaultValidatorTimeout is default timeout of external validators in second
+	DefaultValidatorTimeout = 30
+
+	// maxValidatorOutput bounds output of external validators kept in reports
+	maxValidatorOutput = 4096
+)
+
+// ValidationIssue is a problem found by a validator
+type ValidationIssue struct {
+	Key     string `json:"key,omitempty"`
+	Message string `json:"message"`
+}
+
+// ValidatorResult is outcome of one validator
+type ValidatorResult struct {
+	Name   string            `json:"name"`
+	Passed bool              `json:"passed"`
+	Issues []ValidationIssue `json:"issues,omitempty"`
+}
+
+// ValidationReport is outcome of the validation pipeline for a commit
+type ValidationReport struct {
+	Commit  string            `json:"commit"`
+	Passed  bool              `json:"passed"`
+	Results []ValidatorResult `json:"results"`
+	Time    time.Time         `json:"time"`
+}
+
+// Summary returns one line describing failed validators
+func (r *ValidationReport) Summary() string {
+	var failed []string
+	for _, res := range r.Results {
+		if !res.Passed {
+			failed = append(failed, fmt.Sprintf("%s(%d issues)", res.Name, len(res.Issues)))
+		}
+	}
+	if len(failed) == 0 {
+		return "passed"
+	}
+	return "failed: " + strings.Join(failed, ", ")
+}
+
+func (r *ValidationReport) encode() []byte {
+	data, err := json.Marshal(r)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// Validator checks a snapshot before it is pushed
+type Validator interface {
+	Name() string
+	Validate(kvs map[string][]byte) []ValidationIssue
+}
+
+// ValidationPipeline runs validators in order
+type ValidationPipeline struct {
+	validators []Validator
+}
+
+// Run runs every validator and collects a report
+func (p *ValidationPipeline) Run(commit string, kvs map[string][]byte) *ValidationReport {
+	report := &ValidationReport{
+		Commit: commit,
+		Passed: true,
+		Time:   time.Now().UTC(),
+	}
+	for _, v := range p.validators {
+		issues := v.Validate(kvs)
+		res := ValidatorResult{
+			Name:   v.Name(),
+			Passed: len(issues) == 0,
+			Issues: issues,
+		}
+		if !res.Passed {
+			report.Passed = false
+		}
+		report.Results = append(report.Results, res)
+	}
+	return report
+}
+
+// sortedKeys returns snapshot keys in order so reports are stable
+func sortedKeys(kvs map[string][]byte) []string {
+	var keys []string
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// syntaxValidator parses json, yaml & toml files by extension
+type syntaxValidator struct{}
+
+func (v *syntaxValidator) Name() string {
+	return "syntax"
+}
+
+func (v *syntaxValidator) Validate(kvs map[string][]byte) []ValidationIssue {
+	var issues []ValidationIssue
+	for _, k := range sortedKeys(kvs) {
+		var err error
+		var doc interface{}
+		switch strings.ToLower(path.Ext(k)) {
+		case ".json":
+			err = json.Unmarshal(kvs[k], &doc)
+		case ".yml", ".yaml":
+			err = yaml.Unmarshal(kvs[k], &doc)
+		case ".toml":
+			_, err = toml.Decode(string(kvs[k]), &doc)
+		default:
+			continue
+		}
+		if err != nil {
+			issues = append(issues, ValidationIssue{Key: k, Message: err.Error()})
+		}
+	}
+	return issues
+}
+
+// sizeValidator enforces file & snapshot size limits
+type sizeValidator struct {
+	maxFileSize  int
+	maxTotalSize int
+}
+
+func (v *sizeValidator) Name() string {
+	return "size"
+}
+
+func (v *sizeValidator) Validate(kvs map[string][]byte) []ValidationIssue {
+	var issues []ValidationIssue
+	total := 0
+	for _, k := range sortedKeys(kvs) {
+		size := len(kvs[k])
+		total += size
+		if v.maxFileSize > 0 && size > v.maxFileSize {
+			issues = append(issues, ValidationIssue{
+				Key:     k,
+				Message: fmt.Sprintf("size(%d) exceeds limit(%d)", size, v.maxFileSize),
+			})
+		}
+	}
+	if v.maxTotalSize > 0 && total > v.maxTotalSize {
+		issues = append(issues, ValidationIssue{
+			Message: fmt.Sprintf("snapshot size(%d) exceeds limit(%d)", total, v.maxTotalSize),
+		})
+	}
+	return issues
+}
+
+// SchemaRule applies a JSON schema stored in the repo to matching files
+type SchemaRule struct {
+	Pattern string `json:"pattern"`
+	Schema  string `json:"schema"`
+}
+
+// schemaValidator validates json & yaml files against JSON schemas
+type schemaValidator struct {
+	rules []SchemaRule
+}
+
+func (v *schemaValidator) Name() string {
+	return "schema"
+}
+
+// toJSONCompatible converts yaml maps(map[interface{}]interface{}) for schema validation
+func toJSONCompatible(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, val := range t {
+			m[fmt.Sprintf("%v", k)] = toJSONCompatible(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range t {
+			t[i] = toJSONCompatible(val)
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+func (v *schemaValidator) Validate(kvs map[string][]byte) []ValidationIssue {
+	var issues []ValidationIssue
+	for _, rule := range v.rules {
+		schema, ok := kvs[rule.Schema]
+		if !ok {
+			issues = append(issues, ValidationIssue{Key: rule.Schema, Message: "schema not found"})
+			continue
+		}
+		schemaLoader := gojsonschema.NewBytesLoader(schema)
+
+		for _, k := range sortedKeys(kvs) {
+			if matched, _ := path.Match(rule.Pattern, k); !matched || k == rule.Schema {
+				continue
+			}
+
+			var docLoader gojsonschema.JSONLoader
+			switch strings.ToLower(path.Ext(k)) {
+			case ".yml", ".yaml":
+				var doc interface{}
+				if err := yaml.Unmarshal(kvs[k], &doc); err != nil {
+					// reported by syntax validator
+					continue
+				}
+				docLoader = gojsonschema.NewGoLoader(toJSONCompatible(doc))
+			default:
+				docLoader = gojsonschema.NewBytesLoader(kvs[k])
+			}
+
+			result, err := gojsonschema.Validate(schemaLoader, docLoader)
+			if err != nil {
+				issues = append(issues, ValidationIssue{Key: k, Message: err.Error()})
+				continue
+			}
+			for _, e := range result.Errors() {
+				issues = append(issues, ValidationIssue{Key: k, Message: e.String()})
+			}
+		}
+	}
+	return issues
+}
+
+// ValidatorCommand is an external validator defined on master
+// the command gets the directory the snapshot is written to as last argument
+type ValidatorCommand struct {
+	Command []string `json:"command"`
+	Timeout int      `json:"timeout"` // in second
+}
+
+// commandValidator runs an external command over the snapshot
+type commandValidator struct {
+	name    string
+	appID   string
+	commit  string
+	command *ValidatorCommand
+}
+
+func (v *commandValidator) Name() string {
+	return "command:" + v.name
+}
+
+func (v *commandValidator) Validate(kvs map[string][]byte) []ValidationIssue {
+	if len(v.command.Command) == 0 {
+		return []ValidationIssue{{Message: "empty command"}}
+	}
+
+	tmp, err := ioutil.TempDir("", "confvalidate")
+	if err != nil {
+		return []ValidationIssue{{Message: err.Error()}}
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := path.Join(tmp, v.appID)
+	if err := writeSnapshotDir(dir, kvs, false); err != nil {
+		return []ValidationIssue{{Message: err.Error()}}
+	}
+
+	timeout := v.command.Timeout
+	if timeout == 0 {
+		timeout = DefaultValidatorTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	args := append(append([]string{}, v.command.Command[1:]...), dir)
+	cmd := exec.CommandContext(ctx, v.command.Command[0], args...)
+	cmd.Env = append(os.Environ(), "CONF_APP_ID="+v.appID, "CONF_COMMIT="+v.commit)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// don't wait for grandchildren holding output open after the kill
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return []ValidationIssue{{Message: fmt.Sprintf("timed out after %ds", timeout)}}
+	}
+	if err != nil {
+		output := out.String()
+		if len(output) > maxValidatorOutput {
+			output = output[:maxValidatorOutput]
+		}
+		return []ValidationIssue{{Message: fmt.Sprintf("%v: %s", err, strings.TrimSpace(output))}}
+	}
+	return nil
+}
+
+// repoValidationConfig is the format of ValidationFile
+type repoValidationConfig struct {
+	MaxFileSize  int          `json:"maxFileSize"`
+	MaxTotalSize int          `json:"maxTotalSize"`
+	Schemas      []SchemaRule `json:"schemas"`
+}
+
+// LoadValidatorCommands loads external validators defined on master
+// the file maps validator names to commands
+func LoadValidatorCommands(p string) (map[string]*ValidatorCommand, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	commands := make(map[string]*ValidatorCommand)
+	if err := json.Unmarshal(data, &commands); err != nil {
+		return nil, fmt.Errorf("validators(%s): %v", p, err)
+	}
+	return commands, nil
+}
+
+// newValidationPipeline builds validators for an app from repo & master configuration
+func newValidationPipeline(conf *AppConf, commit string, kvs map[string][]byte, commands map[string]*ValidatorCommand) (*ValidationPipeline, error) {
+	var repoConf repoValidationConfig
+	if data, ok := kvs[ValidationFile]; ok {
+		if err := json.Unmarshal(data, &repoConf); err != nil {
+			return nil, fmt.Errorf("%s: %v", ValidationFile, err)
+		}
+	}
+
+	p := &ValidationPipeline{}
+	p.validators = append(p.validators, &syntaxValidator{})
+	// size limits only apply when the repo sets them
+	if repoConf.MaxFileSize > 0 || repoConf.MaxTotalSize > 0 {
+		p.validators = append(p.validators, &sizeValidator{maxFileSize: repoConf.MaxFileSize, maxTotalSize: repoConf.MaxTotalSize})
+	}
+	if len(repoConf.Schemas) > 0 {
+		p.validators = append(p.validators, &schemaValidator{rules: repoConf.Schemas})
+	}
+
+	for _, name := range strings.Split(conf.Validators, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		command, ok := commands[name]
+		if !ok {
+			return nil, fmt.Errorf("validator(%s) not defined on master", name)
+		}
+		p.validators = append(p.validators, &commandValidator{
+			name:    name,
+			appID:   conf.ID,
+			commit:  commit,
+			command: command,
+		})
+	}
+	return p, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSyntaxValidator(t *testing.T) {
+	kvs := map[string][]byte{
+		"good.json": []byte(`{"a": 1}`),
+		"bad.json":  []byte(`{"a": 1`),
+		"good.yml":  []byte("a:\n  b: 1\n"),
+		"bad.yaml":  []byte("a: [1, 2\n"),
+		"good.toml": []byte("a = 1\n"),
+		"bad.toml":  []byte("a = \n"),
+		"plain.txt": []byte("{not json"),
+	}
+
+	issues := (&syntaxValidator{}).Validate(kvs)
+	if len(issues) != 3 {
+		t.Fatalf("expected 3 issues got(%+v)", issues)
+	}
+	for i, k := range []string{"bad.json", "bad.toml", "bad.yaml"} {
+		if issues[i].Key != k {
+			t.Fatalf("expected issue for(%s) got(%+v)", k, issues[i])
+		}
+	}
+}
+
+func TestSizeValidator(t *testing.T) {
+	kvs := map[string][]byte{
+		"a": make([]byte, 10),
+		"b": make([]byte, 20),
+	}
+	v := &sizeValidator{maxFileSize: 15, maxTotalSize: 25}
+	issues := v.Validate(kvs)
+	if len(issues) != 2 || issues[0].Key != "b" || issues[1].Key != "" {
+		t.Fatalf("unexpected issues(%+v)", issues)
+	}
+}
+
+func TestSchemaValidator(t *testing.T) {
+	kvs := map[string][]byte{
+		"schemas/app.json": []byte(`{
+  "type": "object",
+  "required": ["port"],
+  "properties": {"port": {"type": "integer"}}
+}`),
+		"apps/good.json": []byte(`{"port": 80}`),
+		"apps/bad.json":  []byte(`{"port": "80"}`),
+		"apps/good.yml":  []byte("port: 8080\n"),
+		"apps/bad.yml":   []byte("host: localhost\n"),
+	}
+	v := &schemaValidator{rules: []SchemaRule{
+		{Pattern: "apps/*.json", Schema: "schemas/app.json"},
+		{Pattern: "apps/*.yml", Schema: "schemas/app.json"},
+	}}
+
+	issues := v.Validate(kvs)
+	if len(issues) != 2 || issues[0].Key != "apps/bad.json" || issues[1].Key != "apps/bad.yml" {
+		t.Fatalf("unexpected issues(%+v)", issues)
+	}
+}
+
+func TestValidationPipeline(t *testing.T) {
+	commands := map[string]*ValidatorCommand{
+		"pass":    {Command: []string{"sh", "-c", "test -f $0/a.json"}},
+		"fail":    {Command: []string{"sh", "-c", "echo broken; exit 1"}},
+		"timeout": {Command: []string{"sh", "-c", "sleep 5"}, Timeout: 1},
+	}
+	kvs := map[string][]byte{
+		"a.json":       []byte(`{"a": 1}`),
+		ValidationFile: []byte(`{"maxFileSize": 1024}`),
+	}
+
+	conf := &AppConf{ID: "web2048", Validators: "pass"}
+	p, err := newValidationPipeline(conf, "e491da1", kvs, commands)
+	checkFatal(t, err)
+	if report := p.Run("e491da1", kvs); !report.Passed {
+		t.Fatalf("expected pass got(%+v)", report)
+	}
+
+	conf.Validators = "pass, fail, timeout"
+	p, err = newValidationPipeline(conf, "e491da1", kvs, commands)
+	checkFatal(t, err)
+	report := p.Run("e491da1", kvs)
+	if report.Passed {
+		t.Fatalf("expected failure")
+	}
+	if report.Summary() != "failed: command:fail(1 issues), command:timeout(1 issues)" {
+		t.Fatalf("unexpected summary(%s)", report.Summary())
+	}
+	if msg := report.Results[4].Issues[0].Message; msg != "timed out after 1s" {
+		t.Fatalf("unexpected timeout message(%s)", msg)
+	}
+
+	conf.Validators = "unknown"
+	if _, err := newValidationPipeline(conf, "e491da1", kvs, commands); err == nil {
+		t.Fatalf("undefined validator should fail")
+	}
+
+	// no size limits unless the repo sets them
+	big := map[string][]byte{"a.json": []byte(`"` + strings.Repeat("a", 1024*1024) + `"`)}
+	p, err = newValidationPipeline(&AppConf{ID: "web2048"}, "e491da1", big, commands)
+	checkFatal(t, err)
+	if report := p.Run("e491da1", big); !report.Passed || len(report.Results) != 1 {
+		t.Fatalf("expected syntax check only got(%+v)", report)
+	}
+}
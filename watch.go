@@ -6,8 +6,8 @@ import (
 	"sync"
 
 	log "github.com/Sirupsen/logrus"
-	consulapi "github.com/hashicorp/consul/api"
-	"github.com/hashicorp/consul/watch"
+
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
 )
 
 // WatcherConfig contains configration for Watcher
@@ -15,9 +15,12 @@ type WatcherConfig struct {
 	watchType string
 	key       string
 	host      string
+	// store to watch, a Consul store of host when nil
+	store kvstore.Store
 }
 
 // Watcher watches keyprefix
+// key watches emit *kvstore.Pair, prefix watches emit kvstore.Pairs
 type Watcher struct {
 	config *WatcherConfig
 
@@ -26,7 +29,6 @@ type Watcher struct {
 	shutdownCh   chan struct{}
 
 	eventCh chan interface{}
-	plan    *watch.WatchPlan
 	log     *log.Entry
 }
 
@@ -41,30 +43,21 @@ func (w *Watcher) Shutdown() error {
 	log.Infof("Shutting down")
 	w.shutdown = true
 
-	w.plan.Stop()
 	close(w.shutdownCh)
 	return nil
 }
 
 // NewWatcher creates a new watcher
 func NewWatcher(config *WatcherConfig) (*Watcher, error) {
-
-	params := make(map[string]interface{})
-	watchType := config.watchType
-
 	prefix := fmt.Sprintf("fetcher[%s]", config.key)
 	logEntry := configureLogger(prefix)
 
-	if config.watchType == "prefix" {
-		config.watchType = "keyprefix"
-	}
-
-	params["type"] = config.watchType
-	params[watchType] = config.key
-
-	wp, err := watch.Parse(params)
-	if err != nil {
-		return nil, err
+	store := config.store
+	if store == nil {
+		var err error
+		if store, err = kvstore.NewConsulStore(config.host); err != nil {
+			return nil, err
+		}
 	}
 
 	log.Infof("Watcher starting...")
@@ -73,49 +66,40 @@ func NewWatcher(config *WatcherConfig) (*Watcher, error) {
 		shutdown:   false,
 		shutdownCh: make(chan struct{}),
 		eventCh:    make(chan interface{}),
-		plan:       wp,
 		log:        logEntry,
 	}
 
-	wp.Handler = func(idx uint64, data interface{}) {
-		if data == nil {
-			return
-		}
-		//log.Printf("idx(%d)\n", idx)
-
-		if w.config.watchType == "key" {
-			v, ok := data.(*consulapi.KVPair)
-			// TODO: what happens when key is deleted
-			if !ok || v == nil {
-				return
-			}
-			w.eventCh <- v
-		} else { // keyprefix
-			v, ok := data.(consulapi.KVPairs)
-			//log.Printf("ok(%v) v(%v)\n", ok, v)
-			if !ok {
-				return
-			}
-			w.eventCh <- v
-		}
-
+	isKey := config.watchType == "key"
+	ch, err := store.Watch(config.key, !isKey, w.shutdownCh)
+	if err != nil {
+		return nil, err
 	}
 
 	go func() {
-		// wp.Run() is blocking
-		// after wp.Stop() is called, 'connection refused' error
-		// will be silently supressed
-		if err := wp.Run(w.config.host); err != nil {
-			logEntry.Errorf("Error quering Consul agent: %s", err)
-			return
-		}
-	}()
-
-	go func() {
+		defer close(w.eventCh)
 		for {
+			var v interface{}
+			select {
+			case <-w.shutdownCh:
+				return
+			case pairs, ok := <-ch:
+				if !ok {
+					return
+				}
+				if isKey {
+					// TODO: what happens when key is deleted
+					if len(pairs) == 0 {
+						continue
+					}
+					v = pairs[0]
+				} else {
+					v = pairs
+				}
+			}
+
 			select {
+			case w.eventCh <- v:
 			case <-w.shutdownCh:
-				close(w.eventCh)
 				return
 			}
 		}
@@ -10,6 +10,7 @@ import (
 
 	"io/ioutil"
 
+	"bitbucket.org/cdnetworks/eos-conf/kvstore"
 	testutil "bitbucket.org/cdnetworks/eos-conf/test"
 	"github.com/davecgh/go-spew/spew"
 	consulapi "github.com/hashicorp/consul/api"
@@ -131,7 +132,7 @@ func TestKeyWatch(t *testing.T) {
 
 	var i = 0
 	for evt := range w.eventCh {
-		e := (evt).(*consulapi.KVPair)
+		e := (evt).(*kvstore.Pair)
 		expectedValue := fmt.Sprintf("testValue%d", i)
 		t.Logf("Key(%s) Value(%s) Expected(%s)", e.Key, e.Value, expectedValue)
 		if string(e.Value) != expectedValue {
@@ -199,7 +200,7 @@ func TestKeyPrefixWatch(t *testing.T) {
 	}()
 
 	for evt := range w.eventCh {
-		pairs := (evt).(consulapi.KVPairs)
+		pairs := (evt).(kvstore.Pairs)
 		for _, pair := range pairs {
 			fmt.Printf("\tGot KV(%#v)\n", pair)
 		}